@@ -0,0 +1,97 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/lulf/slim/pkg/archive"
+	"github.com/lulf/slim/pkg/datastore"
+)
+
+func usage() {
+	fmt.Printf("Usage of %s:\n", os.Args[0])
+	fmt.Printf("    [-t file] [-d data] [-z] [-s 0] [-e -1] export <topic> <archive file>\n")
+	fmt.Printf("    [-t file] [-d data] [-k] import <archive file> [topic]\n\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	var dataStoreType string
+	var dataDir string
+	var compress bool
+	var from int64
+	var to int64
+	var keepOffsets bool
+
+	flag.StringVar(&dataStoreType, "t", "file", "Data store type (file or sqlite)")
+	flag.StringVar(&dataDir, "d", "data", "Path to data directory")
+	flag.BoolVar(&compress, "z", false, "Compress the exported archive with gzip")
+	flag.Int64Var(&from, "s", 0, "First offset to export")
+	flag.Int64Var(&to, "e", -1, "Last offset to export (default: -1 (end of topic))")
+	flag.BoolVar(&keepOffsets, "k", false, "Keep the archived offsets when importing instead of appending as new messages")
+
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 1 || dataStoreType == "memory" {
+		usage()
+		os.Exit(1)
+	}
+
+	ds, err := datastore.NewDatastore(dataStoreType, dataDir, -1, -1)
+	if err != nil {
+		log.Fatal("Opening Datastore:", err)
+	}
+	err = ds.Initialize()
+	if err != nil {
+		log.Fatal("Initializing Datastore:", err)
+	}
+	defer ds.Close()
+
+	switch {
+	case args[0] == "export" && len(args) == 3:
+		f, err := os.Create(args[2])
+		if err != nil {
+			log.Fatal("Creating archive:", err)
+		}
+		defer f.Close()
+
+		exported, err := archive.Export(ds, args[1], from, to, f, compress)
+		if err != nil {
+			log.Fatal("Exporting topic:", err)
+		}
+		fmt.Printf("Exported %d messages from topic %s\n", exported, args[1])
+
+	case args[0] == "import" && (len(args) == 2 || len(args) == 3):
+		f, err := os.Open(args[1])
+		if err != nil {
+			log.Fatal("Opening archive:", err)
+		}
+		defer f.Close()
+
+		topic := ""
+		if len(args) == 3 {
+			topic = args[2]
+		}
+		imported, err := archive.Import(ds, topic, f, keepOffsets)
+		if err != nil {
+			log.Fatal("Importing archive:", err)
+		}
+		err = ds.Flush()
+		if err != nil {
+			log.Fatal("Flushing datastore:", err)
+		}
+		fmt.Printf("Imported %d messages\n", imported)
+
+	default:
+		usage()
+		os.Exit(1)
+	}
+}
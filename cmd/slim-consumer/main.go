@@ -7,11 +7,11 @@ package main
 import (
 	"flag"
 	"fmt"
-	"github.com/apache/qpid-proton/go/pkg/amqp"
 	"github.com/apache/qpid-proton/go/pkg/electron"
+	"github.com/lulf/slim/pkg/client"
 	"log"
-	"net"
 	"os"
+	"time"
 )
 
 type Payload struct {
@@ -24,56 +24,60 @@ func main() {
 	var topic string
 	var port int
 	var numMessages int
+	var selector string
+	var group string
+	var since int64
+	var pattern bool
 
-	flag.Int64Var(&offset, "o", 5, "Offset to start consuming from")
+	flag.Int64Var(&offset, "o", 5, "Offset to start consuming from, or -1 to start after the last message")
 	flag.StringVar(&connectHost, "c", "127.0.0.1", "Host to connect to")
 	flag.StringVar(&topic, "t", "mytopic", "Topic to consume from")
 	flag.IntVar(&numMessages, "m", -1, "Number of messages to receive")
 	flag.IntVar(&port, "p", 5672, "Port to connect to")
+	flag.StringVar(&selector, "s", "", "Only receive messages matching selector")
+	flag.StringVar(&group, "g", "", "Consumer group to consume as")
+	flag.BoolVar(&pattern, "P", false, "Treat the topic as a pattern and consume from all matching topics")
+	flag.Int64Var(&since, "T", 0, "Start at the first message stored at or after this time (seconds since the epoch) if offset is -1")
 
 	flag.Usage = func() {
 		fmt.Printf("Usage of %s:\n", os.Args[0])
-		fmt.Printf("    [-o 5] [-c 127.0.0.1] [-p 5672] [-t mytopic] [-m -1]\n")
+		fmt.Printf("    [-o 5] [-c 127.0.0.1] [-p 5672] [-t mytopic] [-m -1] [-s \"color = 'red'\"] [-g mygroup] [-P] [-T 0]\n")
 		flag.PrintDefaults()
 	}
 	flag.Parse()
 
-	tcpConn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", connectHost, port))
-	if err != nil {
-		log.Fatal("Dialing:", err)
+	opts := []client.ConsumerOption{
+		client.ConnectionOptions(electron.ContainerId("slim-consumer")),
+		client.StartOffset(offset),
 	}
-
-	opts := []electron.ConnectionOption{
-		electron.ContainerId("slim-consumer"),
+	if since > 0 {
+		opts = append(opts, client.StartTime(time.Unix(since, 0)))
 	}
-	amqpConn, err := electron.NewConnection(tcpConn, opts...)
-	if err != nil {
-		log.Fatal("NewConnection:", err)
+	if selector != "" {
+		opts = append(opts, client.Selector(selector))
+	}
+	if group != "" {
+		opts = append(opts, client.Group(group))
+	}
+	if pattern {
+		opts = append(opts, client.Pattern())
 	}
 
-	props := map[amqp.Symbol]interface{}{"offset": offset}
-	sopts := []electron.LinkOption{electron.Source(topic), electron.Filter(props)}
-	r, err := amqpConn.Receiver(sopts...)
+	consumer, err := client.NewConsumer(fmt.Sprintf("%s:%d", connectHost, port), topic, opts...)
 	if err != nil {
-		log.Fatal("Receiver:", r)
+		log.Fatal("NewConsumer:", err)
 	}
+	defer consumer.Close()
 
 	numReceived := 0
-	for {
-		if numMessages >= 0 && numReceived >= numMessages {
-			amqpConn.Close(nil)
+	for m := range consumer.Messages() {
+		if numMessages == 0 {
 			break
 		}
-		if rm, err := r.Receive(); err == nil {
-			rm.Accept()
-			m := rm.Message
-			body := m.Body()
-			fmt.Println(body)
-			numReceived += 1
-		} else if err == electron.Closed {
-			return
-		} else {
-			log.Fatalf("receive error %v", err)
+		fmt.Println(m.Body())
+		numReceived += 1
+		if numMessages >= 0 && numReceived >= numMessages {
+			break
 		}
 	}
 }
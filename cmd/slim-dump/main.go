@@ -0,0 +1,203 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/apache/qpid-proton/go/pkg/amqp"
+	"github.com/lulf/slim/pkg/datastore"
+)
+
+func main() {
+	var summary bool
+	var raw bool
+
+	flag.BoolVar(&summary, "s", false, "Only print the headers and inconsistencies, not every record")
+	flag.BoolVar(&raw, "r", false, "Print payloads as raw bytes instead of decoding them as AMQP messages")
+
+	flag.Usage = func() {
+		fmt.Printf("Usage of %s:\n", os.Args[0])
+		fmt.Printf("    [-s] [-r] <data directory> <topic>\n")
+		fmt.Printf("    [-s] [-r] <topic or segment directory, e.g. data/topics/1 or data/topics/1/0>\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var dirs []string
+	var err error
+	switch flag.NArg() {
+	case 1:
+		dirs = []string{flag.Arg(0)}
+		if _, err := os.Stat(filepath.Join(flag.Arg(0), "index.bin")); os.IsNotExist(err) {
+			// A topic directory
+			dirs, err = datastore.SegmentDirs(flag.Arg(0))
+			if err != nil {
+				log.Fatal("Listing segments:", err)
+			}
+		}
+	case 2:
+		dir, err := datastore.FileTopicDir(flag.Arg(0), flag.Arg(1))
+		if err != nil {
+			log.Fatal("Finding topic:", err)
+		}
+		dirs, err = datastore.SegmentDirs(dir)
+		if err != nil {
+			log.Fatal("Listing segments:", err)
+		}
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	d := &dumper{
+		summary:    summary,
+		raw:        raw,
+		lastOffset: -1,
+	}
+	for _, dir := range dirs {
+		err = d.dumpSegment(dir)
+		if err != nil {
+			log.Fatal("Dumping segment:", err)
+		}
+	}
+
+	fmt.Printf("%d segments, %d index entries, %d records, %d offset gaps, %d inconsistencies\n", len(dirs), d.entries, d.records, d.gaps, d.problems)
+	if d.problems > 0 {
+		os.Exit(2)
+	}
+}
+
+type dumper struct {
+	summary bool
+	raw     bool
+
+	entries    int64
+	records    int64
+	gaps       int64
+	problems   int64
+	lastOffset int64
+}
+
+func (d *dumper) report(format string, args ...interface{}) {
+	d.problems++
+	fmt.Printf("INCONSISTENCY: "+format+"\n", args...)
+}
+
+func (d *dumper) dumpSegment(dir string) error {
+	indexFile, err := datastore.OpenMappedReadOnly(filepath.Join(dir, "index.bin"))
+	if err != nil {
+		return err
+	}
+	defer indexFile.Close()
+
+	dataFile, err := datastore.OpenMappedReadOnly(filepath.Join(dir, "data.bin"))
+	if err != nil {
+		return err
+	}
+	defer dataFile.Close()
+
+	fmt.Printf("%s\n", dir)
+	fmt.Printf("index.bin: startOffset=%d fileLocation=%d size=%d\n", indexFile.StartOffset(), indexFile.FileLocation(), indexFile.Size())
+	fmt.Printf("data.bin:  startOffset=%d fileLocation=%d size=%d\n", dataFile.StartOffset(), dataFile.FileLocation(), dataFile.Size())
+
+	report := d.report
+	if indexFile.FileLocation() > indexFile.Size() {
+		report("index fileLocation %d is past the end of the file (%d bytes)", indexFile.FileLocation(), indexFile.Size())
+	}
+	if (indexFile.FileLocation()-datastore.METADATA_SZ)%datastore.INDEX_ENTRY_SZ != 0 {
+		report("index fileLocation %d is not aligned to %d byte entries", indexFile.FileLocation(), datastore.INDEX_ENTRY_SZ)
+	}
+	if dataFile.FileLocation() > dataFile.Size() {
+		report("data fileLocation %d is past the end of the file (%d bytes)", dataFile.FileLocation(), dataFile.Size())
+	}
+
+	// Walk the index, checking that each entry points to a matching record
+	indexed := make(map[int64]bool)
+	for idx := int64(0); ; idx++ {
+		offset, location, err := indexFile.ReadIndexEntry(idx)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			report("reading index entry %d: %v", idx, err)
+			break
+		}
+		d.entries++
+
+		// Gaps are allowed, as in topics imported from other datastores
+		if d.lastOffset >= 0 && offset <= d.lastOffset {
+			report("index entry %d has offset %d, which is not after the previous offset %d", idx, offset, d.lastOffset)
+		} else if d.lastOffset >= 0 && offset != d.lastOffset+1 {
+			d.gaps++
+		}
+		d.lastOffset = offset
+
+		if location < datastore.METADATA_SZ || location >= dataFile.FileLocation() {
+			report("index entry %d (offset %d) points to location %d outside of written data [%d, %d)", idx, offset, location, datastore.METADATA_SZ, dataFile.FileLocation())
+			continue
+		}
+
+		message, err := dataFile.ReadMessageAt(location)
+		if err != nil {
+			report("index entry %d (offset %d): reading record at %d: %v", idx, offset, location, err)
+			continue
+		}
+		indexed[location] = true
+		if message.Offset != offset {
+			report("index entry %d has offset %d but the record at %d has offset %d", idx, offset, location, message.Offset)
+		}
+		if location+datastore.RecordSize(message) > dataFile.FileLocation() {
+			report("record at %d (offset %d) extends past data fileLocation %d", location, offset, dataFile.FileLocation())
+		}
+
+		if !d.summary {
+			printRecord(offset, location, message.Timestamp, message.Payload, d.raw)
+		}
+	}
+
+	// Walk the data file, checking that every record is indexed
+	for location := datastore.METADATA_SZ; location < dataFile.FileLocation(); {
+		message, err := dataFile.ReadMessageAt(location)
+		if err != nil {
+			report("reading record at %d: %v", location, err)
+			break
+		}
+		d.records++
+		if !indexed[location] {
+			report("record at %d (offset %d) is not referenced by the index", location, message.Offset)
+		}
+		location += datastore.RecordSize(message)
+	}
+	return nil
+}
+
+func printRecord(offset int64, location int64, timestamp int64, payload []byte, raw bool) {
+	fmt.Printf("offset=%d location=%d timestamp=%s size=%d\n", offset, location, time.Unix(timestamp, 0).UTC().Format(time.RFC3339), len(payload))
+	if raw {
+		fmt.Printf("  payload: %q\n", payload)
+		return
+	}
+	m, err := amqp.DecodeMessage(payload)
+	if err != nil {
+		fmt.Printf("  payload: not an AMQP message (%v): %q\n", err, payload)
+		return
+	}
+	if m.MessageId() != nil {
+		fmt.Printf("  message-id: %v\n", m.MessageId())
+	}
+	if m.Subject() != "" {
+		fmt.Printf("  subject: %s\n", m.Subject())
+	}
+	if len(m.ApplicationProperties()) > 0 {
+		fmt.Printf("  application-properties: %v\n", m.ApplicationProperties())
+	}
+	fmt.Printf("  body: %v\n", m.Body())
+}
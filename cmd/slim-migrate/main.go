@@ -0,0 +1,166 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/lulf/slim/pkg/api"
+	"github.com/lulf/slim/pkg/datastore"
+)
+
+func main() {
+	var sourceType string
+	var sourceDir string
+	var destType string
+	var destDir string
+
+	flag.StringVar(&sourceType, "s", "sqlite", "Data store type to migrate from (file or sqlite)")
+	flag.StringVar(&sourceDir, "i", "data", "Data directory to migrate from")
+	flag.StringVar(&destType, "t", "file", "Data store type to migrate to (file or sqlite)")
+	flag.StringVar(&destDir, "o", "", "Data directory to migrate to")
+
+	flag.Usage = func() {
+		fmt.Printf("Usage of %s:\n", os.Args[0])
+		fmt.Printf("    [-s sqlite] [-i data] [-t file] -o newdata\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if destDir == "" || sourceType == "memory" || destType == "memory" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if sourceType == destType && sourceDir == destDir {
+		log.Fatal("Source and destination are the same data store")
+	}
+
+	source, err := openDatastore(sourceType, sourceDir)
+	if err != nil {
+		log.Fatal("Opening source datastore:", err)
+	}
+	defer source.Close()
+
+	err = os.MkdirAll(destDir, os.ModePerm)
+	if err != nil {
+		log.Fatal("Error creating datadir:", err)
+	}
+
+	dest, err := openDatastore(destType, destDir)
+	if err != nil {
+		log.Fatal("Opening destination datastore:", err)
+	}
+	defer dest.Close()
+
+	topics, err := source.ListTopics()
+	if err != nil {
+		log.Fatal("Listing topics:", err)
+	}
+
+	existing, err := dest.ListTopics()
+	if err != nil {
+		log.Fatal("Listing destination topics:", err)
+	}
+	for _, topic := range existing {
+		for _, t := range topics {
+			if t == topic {
+				log.Fatal("Topic already exists in destination: ", topic)
+			}
+		}
+	}
+
+	failed := false
+	for _, topic := range topics {
+		copied, err := migrateTopic(source, dest, topic)
+		if err != nil {
+			log.Fatal("Migrating topic ", topic, ":", err)
+		}
+
+		err = verifyTopic(source, dest, topic)
+		if err != nil {
+			log.Print("Verifying topic ", topic, ":", err)
+			failed = true
+			continue
+		}
+		fmt.Printf("Migrated topic %s (%d messages)\n", topic, copied)
+	}
+
+	err = dest.Flush()
+	if err != nil {
+		log.Fatal("Flushing destination datastore:", err)
+	}
+
+	if failed {
+		os.Exit(2)
+	}
+}
+
+func openDatastore(dataStoreType string, dataDir string) (datastore.Datastore, error) {
+	ds, err := datastore.NewDatastore(dataStoreType, dataDir, -1, -1)
+	if err != nil {
+		return nil, err
+	}
+	err = ds.Initialize()
+	if err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+// migrateTopic copies all messages of a topic, keeping their offsets and timestamps
+func migrateTopic(source datastore.Datastore, dest datastore.Datastore, topic string) (int64, error) {
+	err := dest.CreateTopic(topic)
+	if err != nil {
+		return 0, err
+	}
+
+	var copied int64
+	lastOffset := int64(-1)
+	err = datastore.Stream(context.Background(), source, topic, -1, func(message *api.Message) error {
+		if message.Offset <= lastOffset {
+			return fmt.Errorf("Offset %d is not after previous offset %d", message.Offset, lastOffset)
+		}
+		lastOffset = message.Offset
+		copied++
+		return dest.InsertMessage(topic, message)
+	})
+	return copied, err
+}
+
+// verifyTopic checks that the number of messages and the last offset of a topic match
+func verifyTopic(source datastore.Datastore, dest datastore.Datastore, topic string) error {
+	sourceCount, err := source.NumMessages(topic)
+	if err != nil {
+		return err
+	}
+	destCount, err := dest.NumMessages(topic)
+	if err != nil {
+		return err
+	}
+	if sourceCount != destCount {
+		return fmt.Errorf("Source has %d messages, destination has %d", sourceCount, destCount)
+	}
+	if sourceCount == 0 {
+		return nil
+	}
+
+	sourceLast, err := source.LastOffset(topic)
+	if err != nil {
+		return err
+	}
+	destLast, err := dest.LastOffset(topic)
+	if err != nil {
+		return err
+	}
+	if sourceLast != destLast {
+		return fmt.Errorf("Source last offset is %d, destination last offset is %d", sourceLast, destLast)
+	}
+	return nil
+}
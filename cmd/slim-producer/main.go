@@ -9,8 +9,8 @@ import (
 	"fmt"
 	"github.com/apache/qpid-proton/go/pkg/amqp"
 	"github.com/apache/qpid-proton/go/pkg/electron"
+	"github.com/lulf/slim/pkg/client"
 	"log"
-	"net"
 	"os"
 )
 
@@ -23,46 +23,47 @@ func main() {
 	var connectHost string
 	var topic string
 	var port int
+	var batchSize int
 
 	flag.IntVar(&numMessages, "m", 5, "Number of messages to send")
 	flag.StringVar(&connectHost, "c", "127.0.0.1", "Host to connect to")
 	flag.StringVar(&topic, "t", "mytopic", "Topic to send to")
 	flag.IntVar(&port, "p", 5672, "Port to connect to")
+	flag.IntVar(&batchSize, "b", 1, "Number of messages to send before waiting for them to be stored")
 
 	flag.Usage = func() {
 		fmt.Printf("Usage of %s:\n", os.Args[0])
-		fmt.Printf("    [-m 5] [-c 127.0.0.1] [-p 5672] [-t mytopic]\n")
+		fmt.Printf("    [-m 5] [-c 127.0.0.1] [-p 5672] [-t mytopic] [-b 1]\n")
 		flag.PrintDefaults()
 	}
 	flag.Parse()
 
-	tcpConn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", connectHost, port))
-	if err != nil {
-		log.Fatal("Dialing:", err)
+	if batchSize < 1 {
+		batchSize = 1
 	}
 
-	opts := []electron.ConnectionOption{
-		electron.ContainerId("slim-producer"),
-	}
-	amqpConn, err := electron.NewConnection(tcpConn, opts...)
+	producer, err := client.NewProducer(fmt.Sprintf("%s:%d", connectHost, port), topic, electron.ContainerId("slim-producer"))
 	if err != nil {
-		log.Fatal("NewConnection:", err)
+		log.Fatal("NewProducer:", err)
 	}
+	defer producer.Close()
 
-	sopts := []electron.LinkOption{electron.Target(topic)}
-	sender, err := amqpConn.Sender(sopts...)
-	if err != nil {
-		log.Fatal("Sender:", sender)
-	}
-
-	for id := 1; id <= numMessages; id++ {
-		m := amqp.NewMessage()
-		body := fmt.Sprintf("counter: %d", id)
-		m.Marshal(body)
-		outcome := sender.SendSync(m)
-		fmt.Println(body)
-		if outcome.Status == electron.Unsent || outcome.Status == electron.Unacknowledged {
-			log.Print("Error sending:", outcome.Status)
+	for id := 1; id <= numMessages; id += batchSize {
+		bodies := make([]string, 0, batchSize)
+		batch := make([]amqp.Message, 0, batchSize)
+		for i := id; i < id+batchSize && i <= numMessages; i++ {
+			m := amqp.NewMessage()
+			body := fmt.Sprintf("counter: %d", i)
+			m.Marshal(body)
+			bodies = append(bodies, body)
+			batch = append(batch, m)
+		}
+		offsets, err := producer.SendBatch(batch)
+		for i, body := range bodies {
+			fmt.Printf("%s (offset %d)\n", body, offsets[i])
+		}
+		if err != nil {
+			log.Print("Error sending:", err)
 		}
 	}
 }
@@ -5,78 +5,140 @@
 package main
 
 import (
+	"expvar"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
-	"runtime/pprof"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 	"time"
 
+	"github.com/apache/qpid-proton/go/pkg/electron"
+	"github.com/lulf/slim/pkg/cluster"
 	"github.com/lulf/slim/pkg/commitlog"
+	"github.com/lulf/slim/pkg/config"
 	"github.com/lulf/slim/pkg/datastore"
+	"github.com/lulf/slim/pkg/logging"
+	"github.com/lulf/slim/pkg/raft"
 	"github.com/lulf/slim/pkg/server"
 )
 
 func main() {
+	var configFile string
 	var dataDir string
 	var maxlogage int64
 	var maxlogsize int64
 	var listenAddr string
 	var listenPort int
-	var gcInterval int
+	var gcInterval int64
 	var dataStoreType string
-	var flushInterval int
+	var flushInterval int64
+	var lagThreshold int64
+	var debugListener string
+	var leader string
 
+	flag.StringVar(&configFile, "c", "", "Path to configuration file (default: none)")
 	flag.StringVar(&dataDir, "d", "data", "Path to data directory (default: data)")
 	flag.Int64Var(&maxlogsize, "m", -1, "Max number of bytes in log (default: unlimited)")
 	flag.Int64Var(&maxlogage, "a", -1, "Max age in seconds of log entries (default: unlimited)")
-	flag.IntVar(&gcInterval, "g", 0, "Garbage collect interval (default: 0 (never))")
+	flag.Int64Var(&gcInterval, "g", 0, "Garbage collect interval (default: 0 (never))")
 	flag.StringVar(&listenAddr, "l", "127.0.0.1", "Interface address to listen on (default: 127.0.0.1)")
 	flag.IntVar(&listenPort, "p", 5672, "Port to listen on (default: 5672)")
 	flag.StringVar(&dataStoreType, "t", "file", "Data store type to use (memory, file or sqlite. Default: file)")
-	flag.IntVar(&flushInterval, "f", 10, "Flush interval (Only for file data store type. Default: 10 seconds)")
+	flag.Int64Var(&flushInterval, "f", 10, "Flush interval (Only for file data store type. Default: 10 seconds)")
+	flag.Int64Var(&lagThreshold, "w", -1, "Warn when a subscriber lags more than this number of entries behind (default: -1 (never))")
+	flag.StringVar(&debugListener, "D", "", "Address to serve pprof and internal state over HTTP on (default: disabled)")
+	flag.StringVar(&leader, "F", "", "Address of a leader to follow as a read-only replica (default: none)")
 
 	flag.Usage = func() {
 		fmt.Printf("Usage of %s:\n", os.Args[0])
-		fmt.Printf("    [-l 0.0.0.0] [-p 5672] [-c 10] [-m 100] [-g 120] [-d /var/run/slim/data]\n")
+		fmt.Printf("    [-c slim.toml] [-l 0.0.0.0] [-p 5672] [-m 100] [-g 120] [-d /var/run/slim/data]\n")
 		flag.PrintDefaults()
 	}
 	flag.Parse()
 
-	var err error
+	// Settings given on the command line take precedence over the configuration file
+	loadConfig := func() (*config.Config, error) {
+		cfg := config.NewDefaultConfig()
+		if configFile != "" {
+			var err error
+			cfg, err = config.Load(configFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "d":
+				cfg.DataDir = dataDir
+			case "m":
+				cfg.Retention.MaxLogSize = maxlogsize
+			case "a":
+				cfg.Retention.MaxLogAge = maxlogage
+			case "g":
+				cfg.GcInterval = gcInterval
+			case "l", "p":
+				cfg.Listeners = []string{fmt.Sprintf("%s:%d", listenAddr, listenPort)}
+			case "t":
+				cfg.DatastoreType = dataStoreType
+			case "f":
+				cfg.FlushInterval = flushInterval
+			case "w":
+				cfg.LagThreshold = lagThreshold
+			case "D":
+				cfg.DebugListener = debugListener
+			case "F":
+				cfg.Follow.Leader = leader
+			}
+		})
+		return cfg, nil
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal("Loading configuration:", err)
+	}
 
-	err = os.MkdirAll(dataDir, os.ModePerm)
+	err = logging.SetLevel(cfg.LogLevel)
+	if err != nil {
+		log.Fatal("Setting log level:", err)
+	}
+
+	err = os.MkdirAll(cfg.DataDir, os.ModePerm)
 	if err != nil {
 		log.Fatal("Error creating datadir:", err)
 	}
 
 	var ds datastore.Datastore
-	if dataStoreType == "memory" {
-		ds, err = datastore.NewMemoryDatastore()
-	} else if dataStoreType == "sqlite" {
-		ds, err = datastore.NewSqliteDatastore(dataDir, maxlogage, maxlogsize)
-	} else if dataStoreType == "file" {
-		ds, err = datastore.NewFileDatastore(dataDir, maxlogage, maxlogsize)
+	if cfg.DatastoreType == "memory" && (cfg.Memory.SnapshotInterval > 0 || cfg.Memory.Journal) {
+		ds, err = datastore.NewPersistentMemoryDatastore(cfg.DataDir, cfg.Memory.Journal, cfg.Retention.MaxLogAge, cfg.Retention.MaxLogSize)
 	} else {
-		log.Fatal("Invalid data store type specified:", dataStoreType)
+		ds, err = datastore.NewDatastore(cfg.DatastoreType, cfg.DataDir, cfg.Retention.MaxLogAge, cfg.Retention.MaxLogSize)
 	}
 	if err != nil {
 		log.Fatal("Opening Datastore:", err)
 	}
-	defer ds.Close()
+	applyRetention(ds, cfg)
 
 	err = ds.Initialize()
 	if err != nil {
 		log.Fatal("Initializing Datastore:", err)
 	}
 
-	if gcInterval > 0 {
-		go datastore.GarbageCollector(time.Duration(gcInterval), ds)
+	if cfg.GcInterval > 0 {
+		go datastore.GarbageCollector(time.Duration(cfg.GcInterval), ds)
+	} else if cfg.DatastoreType != "memory" && hasRetention(cfg) {
+		log.Print("Retention limits are configured but not applied, as garbage collection is disabled")
 	}
 
-	if dataStoreType == "file" {
-		go datastore.Flusher(time.Duration(flushInterval), ds)
+	if cfg.DatastoreType == "file" {
+		go datastore.Flusher(time.Duration(cfg.FlushInterval), ds)
+	} else if cfg.DatastoreType == "memory" && cfg.Memory.SnapshotInterval > 0 {
+		go datastore.Flusher(time.Duration(cfg.Memory.SnapshotInterval), ds)
 	}
 
 	cl, err := commitlog.NewCommitLog(ds)
@@ -84,24 +146,201 @@ func main() {
 		log.Fatal("Creating commit log:", err)
 	}
 
-	es := server.NewServer("slim-server", cl)
+	expvar.Publish("topics", expvar.Func(func() interface{} {
+		return cl.Stats()
+	}))
 
-	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", listenAddr, listenPort))
-	if err != nil {
-		log.Fatal("Listening:", err)
+	if cfg.LagThreshold >= 0 {
+		go commitlog.LagMonitor(time.Duration(30), cfg.LagThreshold, cl)
+	}
+
+	if cfg.Auth.SaslConfigDir != "" {
+		electron.GlobalSASLConfigDir(cfg.Auth.SaslConfigDir)
+	}
+	if cfg.Auth.SaslConfigName != "" {
+		electron.GlobalSASLConfigName(cfg.Auth.SaslConfigName)
+	}
+	// Options of the connections the server makes to leaders and mirror sources
+	connOpts := []electron.ConnectionOption{electron.SASLAllowInsecure(cfg.Auth.AllowInsecure)}
+	serverOpts := []server.ConnectionOption{
+		server.SASLConfig(cfg.Auth.SaslConfigDir, cfg.Auth.SaslConfigName),
+		server.SASLAllowInsecure(cfg.Auth.AllowInsecure),
+	}
+	if cfg.Auth.Mechanisms != "" {
+		connOpts = append(connOpts, electron.SASLAllowedMechs(cfg.Auth.Mechanisms))
+		serverOpts = append(serverOpts, server.SASLAllowedMechs(cfg.Auth.Mechanisms))
+	}
+
+	es := server.NewServer("slim-server", cl, serverOpts...)
+	es.SetAcl(aclRules(cfg))
+	dedupDir := ""
+	if cfg.DatastoreType != "memory" || cfg.Memory.SnapshotInterval > 0 || cfg.Memory.Journal {
+		dedupDir = filepath.Join(cfg.DataDir, "producers")
+		err = os.MkdirAll(dedupDir, os.ModePerm)
+		if err != nil {
+			log.Fatal("Creating producer state directory:", err)
+		}
+		groupDir := filepath.Join(cfg.DataDir, "groups")
+		err = os.MkdirAll(groupDir, os.ModePerm)
+		if err != nil {
+			log.Fatal("Creating group offset directory:", err)
+		}
+		cl.SetGroupDir(groupDir)
+	}
+	es.SetDedup(int(cfg.Dedup.Window), cfg.Dedup.MessageId, dedupDir)
+	es.SetSnapshotDir(filepath.Join(cfg.DataDir, "snapshots"))
+
+	if cfg.Follow.Leader != "" && cfg.Cluster.Id != "" {
+		log.Fatal("A server cannot both follow a leader and be a cluster member")
+	}
+
+	if cfg.Follow.Leader != "" {
+		es.Follow(server.NewFollower("slim-follower", cl, cfg.Follow.Leader, cfg.Follow.Topics, connOpts...))
+	}
+
+	if len(cfg.Mirrors) > 0 {
+		err = os.MkdirAll(filepath.Join(cfg.DataDir, "mirrors"), os.ModePerm)
+		if err != nil {
+			log.Fatal("Creating mirror state directory:", err)
+		}
+	}
+	for name, mirrorCfg := range cfg.Mirrors {
+		mirror, err := server.NewMirror(name, cl, server.MirrorConfig{
+			Source: mirrorCfg.Source,
+			Topics: mirrorCfg.Topics,
+			Prefix: mirrorCfg.Prefix,
+			Rename: mirrorCfg.Rename,
+			Plain:  mirrorCfg.Plain,
+		}, filepath.Join(cfg.DataDir, "mirrors", name+".json"), connOpts...)
+		if err != nil {
+			log.Fatal("Creating mirror:", err)
+		}
+		es.AddMirror(mirror)
+	}
+
+	var c *cluster.Cluster
+	if cfg.Cluster.Id != "" {
+		c, err = startCluster(cfg, cl)
+		if err != nil {
+			log.Fatal("Starting cluster:", err)
+		}
+		es.SetCluster(c)
+	}
+
+	for _, address := range cfg.Listeners {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			log.Fatal("Listening:", err)
+		}
+		fmt.Printf("Listening on %v\n", listener.Addr())
+		go es.Run(listener)
+	}
+
+	if cfg.DebugListener != "" {
+		go func() {
+			log.Printf("Serving debug endpoint on %s", cfg.DebugListener)
+			err := http.ListenAndServe(cfg.DebugListener, server.NewDebugHandler(cl))
+			if err != nil {
+				log.Print("Serving debug endpoint:", err)
+			}
+		}()
 	}
-	defer listener.Close()
-	fmt.Printf("Listening on %v\n", listener.Addr())
 
-	go func() {
-		time.Sleep(50 * time.Second)
-		out, err := os.Create("slim-server.mprof")
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			log.Print("Received signal ", sig, ", shutting down")
+			break
+		}
+
+		log.Print("Reloading configuration")
+		newCfg, err := loadConfig()
 		if err != nil {
-			log.Fatal("Creating profile:", err)
+			log.Print("Reloading configuration:", err)
+			continue
+		}
+		err = logging.SetLevel(newCfg.LogLevel)
+		if err != nil {
+			log.Print("Reloading configuration:", err)
+			continue
+		}
+		applyRetention(ds, newCfg)
+		es.SetAcl(aclRules(newCfg))
+	}
+
+	es.Shutdown()
+	if c != nil {
+		c.Stop()
+	}
+
+	err = ds.Flush()
+	if err != nil {
+		log.Print("Flushing datastore:", err)
+	}
+	ds.Close()
+	log.Print("Shutdown complete")
+}
+
+func startCluster(cfg *config.Config, cl *commitlog.CommitLog) (*cluster.Cluster, error) {
+	members := make(map[string]cluster.Member, len(cfg.Cluster.Members))
+	for id, member := range cfg.Cluster.Members {
+		members[id] = cluster.Member{
+			RaftAddress: member.Raft,
+			AmqpAddress: member.Amqp,
+		}
+	}
+
+	storage, err := raft.NewFileStorage(filepath.Join(cfg.DataDir, "raft"))
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := cluster.NewCluster(cfg.Cluster.Id, members, cl, storage)
+	if err != nil {
+		return nil, err
+	}
+
+	address := cfg.Cluster.Listener
+	if address == "" {
+		address = members[cfg.Cluster.Id].RaftAddress
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Serving raft for cluster member %s on %v", cfg.Cluster.Id, listener.Addr())
+	c.Start(listener)
+	return c, nil
+}
+
+func applyRetention(ds datastore.Datastore, cfg *config.Config) {
+	topics := make(map[string]datastore.Retention, len(cfg.Topics))
+	for name, retention := range cfg.Topics {
+		topics[name] = datastore.Retention(retention)
+	}
+	ds.RetentionPolicy().Update(datastore.Retention(cfg.Retention), topics)
+}
+
+func hasRetention(cfg *config.Config) bool {
+	limited := func(r config.Retention) bool {
+		return r.MaxLogAge > 0 || r.MaxLogSize > 0 || r.MaxMessages > 0
+	}
+	if limited(cfg.Retention) {
+		return true
+	}
+	for _, retention := range cfg.Topics {
+		if limited(retention) {
+			return true
 		}
+	}
+	return false
+}
 
-		pprof.WriteHeapProfile(out)
-		out.Close()
-	}()
-	es.Run(listener)
+func aclRules(cfg *config.Config) map[string]server.AclRule {
+	rules := make(map[string]server.AclRule, len(cfg.Acl))
+	for user, rule := range cfg.Acl {
+		rules[user] = server.AclRule(rule)
+	}
+	return rules
 }
@@ -0,0 +1,365 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/apache/qpid-proton/go/pkg/amqp"
+	"github.com/apache/qpid-proton/go/pkg/electron"
+	"github.com/lulf/slim/pkg/commitlog"
+	"github.com/lulf/slim/pkg/datastore"
+)
+
+const managementAddress = "$management"
+
+type managementClient struct {
+	conn     electron.Connection
+	sender   electron.Sender
+	receiver electron.Receiver
+	replyTo  string
+	nextId   uint64
+}
+
+func newManagementClient(host string, port int, user string, password string) (*managementClient, error) {
+	opts := []electron.ConnectionOption{electron.ContainerId("slimctl")}
+	if user != "" {
+		// Connections are not encrypted, so plain text passwords must be allowed
+		opts = append(opts, electron.User(user), electron.Password([]byte(password)), electron.SASLAllowInsecure(true))
+	}
+	conn, err := electron.Dial("tcp", fmt.Sprintf("%s:%d", host, port), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	replyTo := fmt.Sprintf("%s/slimctl-%d", managementAddress, os.Getpid())
+	receiver, err := conn.Receiver(electron.Source(replyTo))
+	if err != nil {
+		conn.Close(nil)
+		return nil, err
+	}
+
+	sender, err := conn.Sender(electron.Target(managementAddress))
+	if err != nil {
+		conn.Close(nil)
+		return nil, err
+	}
+
+	return &managementClient{
+		conn:     conn,
+		sender:   sender,
+		receiver: receiver,
+		replyTo:  replyTo,
+	}, nil
+}
+
+func (c *managementClient) Close() {
+	c.conn.Close(nil)
+}
+
+// Request sends a management request and decodes the JSON response body into result.
+func (c *managementClient) Request(operation string, properties map[string]interface{}, result interface{}) error {
+	c.nextId++
+	request := amqp.NewMessage()
+	request.SetMessageId(c.nextId)
+	request.SetReplyTo(c.replyTo)
+	props := map[string]interface{}{"operation": operation}
+	for key, value := range properties {
+		props[key] = value
+	}
+	request.SetApplicationProperties(props)
+
+	outcome := c.sender.SendSync(request)
+	if outcome.Status != electron.Accepted {
+		return fmt.Errorf("Sending request: %v %v", outcome.Status, outcome.Error)
+	}
+
+	for {
+		rm, err := c.receiver.ReceiveTimeout(30 * time.Second)
+		if err != nil {
+			return fmt.Errorf("Receiving response: %v", err)
+		}
+		rm.Accept()
+		response := rm.Message
+		if response.CorrelationId() != c.nextId {
+			continue
+		}
+
+		responseProps := response.ApplicationProperties()
+		statusCode, _ := responseProps["statusCode"].(int32)
+		if statusCode != 200 {
+			return fmt.Errorf("%s failed (%d): %v", operation, statusCode, responseProps["statusDescription"])
+		}
+		body, _ := response.Body().(string)
+		return json.Unmarshal([]byte(body), result)
+	}
+}
+
+func usage() {
+	fmt.Printf("Usage of %s:\n", os.Args[0])
+	fmt.Printf("    [-c 127.0.0.1] [-p 5672] [-u user] [-P password] [-o table] <command> [arguments]\n\n")
+	fmt.Printf("Commands:\n")
+	fmt.Printf("    topics list\n")
+	fmt.Printf("    topics create <topic>\n")
+	fmt.Printf("    topics delete <topic>\n")
+	fmt.Printf("    topics describe <topic>\n")
+	fmt.Printf("    subscribers [topic]\n")
+	fmt.Printf("    groups reset <topic> <group> earliest|latest|<unix timestamp>\n")
+	fmt.Printf("    gc [topic]\n")
+	fmt.Printf("    flush\n")
+	fmt.Printf("    snapshot <directory under the snapshot directory of the server>\n")
+	fmt.Printf("    promote\n")
+	fmt.Printf("    mirrors\n\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	var connectHost string
+	var port int
+	var output string
+	var user string
+	var password string
+
+	flag.StringVar(&connectHost, "c", "127.0.0.1", "Host to connect to")
+	flag.IntVar(&port, "p", 5672, "Port to connect to")
+	flag.StringVar(&user, "u", "", "User to authenticate as (default: anonymous)")
+	flag.StringVar(&password, "P", "", "Password of the user")
+	flag.StringVar(&output, "o", "table", "Output format (table or json)")
+
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 || (output != "table" && output != "json") {
+		usage()
+		os.Exit(1)
+	}
+
+	client, err := newManagementClient(connectHost, port, user, password)
+	if err != nil {
+		log.Fatal("Connecting:", err)
+	}
+	defer client.Close()
+
+	err = run(client, args, output)
+	if err == errUsage {
+		usage()
+		os.Exit(1)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+}
+
+var errUsage = fmt.Errorf("invalid usage")
+
+func run(client *managementClient, args []string, output string) error {
+	command := strings.Join(args[:min(2, len(args))], " ")
+	switch {
+	case command == "topics list":
+		var topics []string
+		if err := client.Request("LIST-TOPICS", nil, &topics); err != nil {
+			return err
+		}
+		return printResult(output, topics, func(w *tabwriter.Writer) {
+			fmt.Fprintln(w, "TOPIC")
+			for _, topic := range topics {
+				fmt.Fprintln(w, topic)
+			}
+		})
+
+	case command == "topics create" && len(args) == 3:
+		var stats commitlog.TopicStats
+		if err := client.Request("CREATE-TOPIC", map[string]interface{}{"name": args[2]}, &stats); err != nil {
+			return err
+		}
+		return printResult(output, stats, func(w *tabwriter.Writer) {
+			fmt.Fprintf(w, "Created topic %s\n", stats.Name)
+		})
+
+	case command == "topics delete" && len(args) == 3:
+		var result map[string]interface{}
+		if err := client.Request("DELETE-TOPIC", map[string]interface{}{"name": args[2]}, &result); err != nil {
+			return err
+		}
+		return printResult(output, result, func(w *tabwriter.Writer) {
+			fmt.Fprintf(w, "Deleted topic %s\n", args[2])
+		})
+
+	case command == "topics describe" && len(args) == 3:
+		var description struct {
+			commitlog.TopicStats
+			NumMessages int64               `json:"numMessages"`
+			Retention   datastore.Retention `json:"retention"`
+		}
+		if err := client.Request("DESCRIBE-TOPIC", map[string]interface{}{"name": args[2]}, &description); err != nil {
+			return err
+		}
+		return printResult(output, description, func(w *tabwriter.Writer) {
+			fmt.Fprintf(w, "Name:\t%s\n", description.Name)
+			fmt.Fprintf(w, "Last committed:\t%d\n", description.LastCommitted)
+			fmt.Fprintf(w, "Messages:\t%d\n", description.NumMessages)
+			fmt.Fprintf(w, "Queue depth:\t%d\n", description.QueueDepth)
+			fmt.Fprintf(w, "Max log age:\t%s\n", limit(description.Retention.MaxLogAge, "s"))
+			fmt.Fprintf(w, "Max log size:\t%s\n", limit(description.Retention.MaxLogSize, " bytes"))
+			fmt.Fprintf(w, "Max messages:\t%s\n", limit(description.Retention.MaxMessages, ""))
+			fmt.Fprintf(w, "Subscribers:\t%d\n", len(description.Subscribers))
+			fmt.Fprintf(w, "Groups:\t%d\n", len(description.Groups))
+		})
+
+	case args[0] == "subscribers" && len(args) <= 2:
+		props := map[string]interface{}{}
+		if len(args) == 2 {
+			props["name"] = args[1]
+		}
+		var stats []commitlog.TopicStats
+		if err := client.Request("GET-STATS", props, &stats); err != nil {
+			return err
+		}
+		return printResult(output, stats, func(w *tabwriter.Writer) {
+			fmt.Fprintln(w, "TOPIC\tSUBSCRIBER\tGROUP\tOFFSET\tLAG")
+			for _, topic := range stats {
+				for _, sub := range topic.Subscribers {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\n", topic.Name, sub.Id, sub.Group, sub.Offset, sub.Lag)
+				}
+				for _, group := range topic.Groups {
+					fmt.Fprintf(w, "%s\t\t%s\t%d\t%d\n", topic.Name, group.Name, group.Offset+1, group.Lag)
+				}
+			}
+		})
+
+	case command == "groups reset" && len(args) == 5:
+		props := map[string]interface{}{
+			"name":     args[2],
+			"group":    args[3],
+			"position": args[4],
+		}
+		if args[4] != "earliest" && args[4] != "latest" {
+			timestamp, err := strconv.ParseInt(args[4], 10, 64)
+			if err != nil {
+				return errUsage
+			}
+			props["position"] = "timestamp"
+			props["timestamp"] = timestamp
+		}
+		var group commitlog.GroupStats
+		if err := client.Request("RESET-OFFSETS", props, &group); err != nil {
+			return err
+		}
+		return printResult(output, group, func(w *tabwriter.Writer) {
+			fmt.Fprintf(w, "Group %s on topic %s continues from offset %d (lag %d)\n", group.Name, args[2], group.Offset+1, group.Lag)
+		})
+
+	case args[0] == "gc" && len(args) <= 2:
+		props := map[string]interface{}{}
+		if len(args) == 2 {
+			props["name"] = args[1]
+		}
+		var topics []string
+		if err := client.Request("GC", props, &topics); err != nil {
+			return err
+		}
+		return printResult(output, topics, func(w *tabwriter.Writer) {
+			fmt.Fprintf(w, "Garbage collected %d topic(s)\n", len(topics))
+		})
+
+	case args[0] == "flush" && len(args) == 1:
+		var result map[string]interface{}
+		if err := client.Request("FLUSH", nil, &result); err != nil {
+			return err
+		}
+		return printResult(output, result, func(w *tabwriter.Writer) {
+			fmt.Fprintln(w, "Flushed datastore")
+		})
+
+	case args[0] == "promote" && len(args) == 1:
+		var result map[string]interface{}
+		if err := client.Request("PROMOTE", nil, &result); err != nil {
+			return err
+		}
+		return printResult(output, result, func(w *tabwriter.Writer) {
+			fmt.Fprintln(w, "Promoted to leader")
+		})
+
+	case args[0] == "mirrors" && len(args) == 1:
+		var result []struct {
+			Name    string           `json:"name"`
+			Source  string           `json:"source"`
+			Offsets map[string]int64 `json:"offsets"`
+		}
+		if err := client.Request("LIST-MIRRORS", nil, &result); err != nil {
+			return err
+		}
+		return printResult(output, result, func(w *tabwriter.Writer) {
+			fmt.Fprintln(w, "MIRROR\tSOURCE\tTOPIC\tMIRRORED OFFSET")
+			for _, mirror := range result {
+				topics := make([]string, 0, len(mirror.Offsets))
+				for topic := range mirror.Offsets {
+					topics = append(topics, topic)
+				}
+				sort.Strings(topics)
+				for _, topic := range topics {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", mirror.Name, mirror.Source, topic, mirror.Offsets[topic])
+				}
+			}
+		})
+
+	case args[0] == "snapshot" && len(args) == 2:
+		var result struct {
+			Path    string           `json:"path"`
+			Offsets map[string]int64 `json:"offsets"`
+		}
+		if err := client.Request("SNAPSHOT", map[string]interface{}{"path": args[1]}, &result); err != nil {
+			return err
+		}
+		return printResult(output, result, func(w *tabwriter.Writer) {
+			fmt.Fprintf(w, "Snapshot written to %s\n\n", result.Path)
+			fmt.Fprintln(w, "TOPIC\tLAST OFFSET")
+			topics := make([]string, 0, len(result.Offsets))
+			for topic := range result.Offsets {
+				topics = append(topics, topic)
+			}
+			sort.Strings(topics)
+			for _, topic := range topics {
+				fmt.Fprintf(w, "%s\t%d\n", topic, result.Offsets[topic])
+			}
+		})
+	}
+	return errUsage
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func limit(value int64, unit string) string {
+	if value <= 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d%s", value, unit)
+}
+
+// printResult writes the result as indented JSON, or as a table using the given function.
+func printResult(output string, result interface{}, table func(w *tabwriter.Writer)) error {
+	if output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	table(w)
+	return w.Flush()
+}
@@ -3,6 +3,7 @@ module github.com/lulf/slim
 go 1.12
 
 require (
+	github.com/BurntSushi/toml v1.2.0
 	github.com/apache/qpid-proton v0.0.0-20191030003658-d693de22cceb
 	github.com/google/pprof v0.0.0-20191218002539-d4f498aebedc // indirect
 	github.com/mattn/go-sqlite3 v1.10.0
@@ -5,8 +5,10 @@
 package api
 
 type Message struct {
-	Offset  int64
-	Payload []byte
+	Offset int64
+	// Time the message was committed to the log, in seconds since the epoch
+	Timestamp int64
+	Payload   []byte
 }
 
 func NewMessage(offset int64, payload []byte) *Message {
@@ -0,0 +1,183 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package archive
+
+// An archive starts with a header:
+//
+//	magic   [8]byte "SLIMARCH"
+//	version uint32
+//	flags   uint32 (FLAG_GZIP if the records are gzip compressed)
+//	length  uint32 length of the topic name
+//	topic   [length]byte
+//
+// followed by records until the end of the stream:
+//
+//	length    uint32 length of the payload
+//	offset    int64
+//	timestamp int64
+//	payload   [length]byte
+//
+// All integers are little endian.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/lulf/slim/pkg/api"
+)
+
+const MAGIC = "SLIMARCH"
+const VERSION uint32 = 1
+
+const FLAG_GZIP uint32 = 1
+
+// Largest payload accepted when reading, to avoid allocating garbage from a corrupt archive
+const MAX_PAYLOAD_SZ uint32 = 256 * 1024 * 1024
+
+type Writer struct {
+	out   io.Writer
+	bufw  *bufio.Writer
+	gzipw *gzip.Writer
+}
+
+type Reader struct {
+	in    io.Reader
+	topic string
+	gzipr *gzip.Reader
+}
+
+func NewWriter(w io.Writer, topic string, compress bool) (*Writer, error) {
+	var flags uint32
+	if compress {
+		flags |= FLAG_GZIP
+	}
+
+	hdr := new(bytes.Buffer)
+	hdr.WriteString(MAGIC)
+	binary.Write(hdr, binary.LittleEndian, VERSION)
+	binary.Write(hdr, binary.LittleEndian, flags)
+	binary.Write(hdr, binary.LittleEndian, uint32(len(topic)))
+	hdr.WriteString(topic)
+
+	bufw := bufio.NewWriter(w)
+	_, err := bufw.Write(hdr.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	writer := &Writer{
+		out:  bufw,
+		bufw: bufw,
+	}
+	if compress {
+		writer.gzipw = gzip.NewWriter(bufw)
+		writer.out = writer.gzipw
+	}
+	return writer, nil
+}
+
+func (w *Writer) Write(message *api.Message) error {
+	hdr := new(bytes.Buffer)
+	binary.Write(hdr, binary.LittleEndian, uint32(len(message.Payload)))
+	binary.Write(hdr, binary.LittleEndian, message.Offset)
+	binary.Write(hdr, binary.LittleEndian, message.Timestamp)
+
+	_, err := w.out.Write(hdr.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = w.out.Write(message.Payload)
+	return err
+}
+
+// Close flushes the archive. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.gzipw != nil {
+		err := w.gzipw.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return w.bufw.Flush()
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	bufr := bufio.NewReader(r)
+
+	hdr := make([]byte, len(MAGIC)+12)
+	_, err := io.ReadFull(bufr, hdr)
+	if err != nil {
+		return nil, fmt.Errorf("Reading archive header: %v", err)
+	}
+	if string(hdr[0:len(MAGIC)]) != MAGIC {
+		return nil, fmt.Errorf("Not a slim archive")
+	}
+	version := binary.LittleEndian.Uint32(hdr[len(MAGIC):])
+	if version != VERSION {
+		return nil, fmt.Errorf("Unsupported archive version %d", version)
+	}
+	flags := binary.LittleEndian.Uint32(hdr[len(MAGIC)+4:])
+	topicLen := binary.LittleEndian.Uint32(hdr[len(MAGIC)+8:])
+
+	topic := make([]byte, topicLen)
+	_, err = io.ReadFull(bufr, topic)
+	if err != nil {
+		return nil, fmt.Errorf("Reading archive header: %v", err)
+	}
+
+	reader := &Reader{
+		in:    bufr,
+		topic: string(topic),
+	}
+	if flags&FLAG_GZIP != 0 {
+		reader.gzipr, err = gzip.NewReader(bufr)
+		if err != nil {
+			return nil, err
+		}
+		reader.in = reader.gzipr
+	}
+	return reader, nil
+}
+
+// Topic returns the name of the topic the archive was exported from
+func (r *Reader) Topic() string {
+	return r.topic
+}
+
+// Next returns the next message in the archive, or io.EOF at the end
+func (r *Reader) Next() (*api.Message, error) {
+	hdr := make([]byte, 20)
+	_, err := io.ReadFull(r.in, hdr)
+	if err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, fmt.Errorf("Reading record: %v", err)
+	}
+
+	sz := binary.LittleEndian.Uint32(hdr[0:4])
+	if sz > MAX_PAYLOAD_SZ {
+		return nil, fmt.Errorf("Record size %d is too large", sz)
+	}
+	payload := make([]byte, sz)
+	_, err = io.ReadFull(r.in, payload)
+	if err != nil {
+		return nil, fmt.Errorf("Reading record: %v", err)
+	}
+
+	message := api.NewMessage(int64(binary.LittleEndian.Uint64(hdr[4:12])), payload)
+	message.Timestamp = int64(binary.LittleEndian.Uint64(hdr[12:20]))
+	return message, nil
+}
+
+func (r *Reader) Close() error {
+	if r.gzipr != nil {
+		return r.gzipr.Close()
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package archive
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/lulf/slim/pkg/api"
+	"github.com/lulf/slim/pkg/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func populate(t *testing.T, topic string, n int64) datastore.Datastore {
+	ds, err := datastore.NewMemoryDatastore()
+	assert.Nil(t, err)
+	assert.Nil(t, ds.CreateTopic(topic))
+	for i := int64(0); i < n; i++ {
+		message := api.NewMessage(i, []byte(fmt.Sprintf("payload%d", i)))
+		message.Timestamp = 1000 + i
+		assert.Nil(t, ds.InsertMessage(topic, message))
+	}
+	return ds
+}
+
+func messages(t *testing.T, ds datastore.Datastore, topic string) []*api.Message {
+	var result []*api.Message
+	err := datastore.Stream(context.Background(), ds, topic, 0, func(message *api.Message) error {
+		result = append(result, message)
+		return nil
+	})
+	assert.Nil(t, err)
+	return result
+}
+
+func TestExportImport(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		source := populate(t, "mytopic", 10)
+
+		var buf bytes.Buffer
+		exported, err := Export(source, "mytopic", 2, 5, &buf, compress)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(4), exported)
+
+		dest, err := datastore.NewMemoryDatastore()
+		assert.Nil(t, err)
+		imported, err := Import(dest, "", bytes.NewReader(buf.Bytes()), true)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(4), imported)
+
+		result := messages(t, dest, "mytopic")
+		assert.Equal(t, 4, len(result))
+		for i, message := range result {
+			offset := int64(i + 2)
+			assert.Equal(t, offset, message.Offset)
+			assert.Equal(t, 1000+offset, message.Timestamp)
+			assert.Equal(t, []byte(fmt.Sprintf("payload%d", offset)), message.Payload)
+		}
+	}
+}
+
+func TestImportAppend(t *testing.T) {
+	source := populate(t, "mytopic", 3)
+	var buf bytes.Buffer
+	_, err := Export(source, "mytopic", 0, -1, &buf, true)
+	assert.Nil(t, err)
+
+	dest := populate(t, "other", 5)
+
+	// Keeping offsets conflicts with the existing messages
+	_, err = Import(dest, "other", bytes.NewReader(buf.Bytes()), true)
+	assert.NotNil(t, err)
+
+	imported, err := Import(dest, "other", bytes.NewReader(buf.Bytes()), false)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), imported)
+
+	result := messages(t, dest, "other")
+	assert.Equal(t, 8, len(result))
+	assert.Equal(t, int64(7), result[7].Offset)
+	assert.Equal(t, []byte("payload2"), result[7].Payload)
+}
+
+func TestInvalidArchive(t *testing.T) {
+	_, err := NewReader(bytes.NewReader([]byte("NOTANARCHIVE0000000000")))
+	assert.NotNil(t, err)
+}
+
+func TestImportGapsIntoFileDatastore(t *testing.T) {
+	// Messages trimmed from a memory topic leave gaps in the archive
+	source := populate(t, "mytopic", 10)
+	assert.Nil(t, source.DeleteTopic("mytopic"))
+	assert.Nil(t, source.CreateTopic("mytopic"))
+	for _, offset := range []int64{2, 3, 7, 9} {
+		assert.Nil(t, source.InsertMessage("mytopic", api.NewMessage(offset, []byte(fmt.Sprintf("payload%d", offset)))))
+	}
+	var buf bytes.Buffer
+	_, err := Export(source, "mytopic", 0, -1, &buf, false)
+	assert.Nil(t, err)
+
+	dir, err := ioutil.TempDir("", "slim-archive")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	dest, err := datastore.NewDatastore("file", dir, -1, -1)
+	assert.Nil(t, err)
+	defer dest.Close()
+	assert.Nil(t, dest.Initialize())
+
+	imported, err := Import(dest, "", bytes.NewReader(buf.Bytes()), true)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), imported)
+
+	var offsets []int64
+	err = datastore.Stream(context.Background(), dest, "mytopic", 4, func(message *api.Message) error {
+		assert.Equal(t, []byte(fmt.Sprintf("payload%d", message.Offset)), message.Payload)
+		offsets = append(offsets, message.Offset)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{7, 9}, offsets)
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/lulf/slim/pkg/api"
+	"github.com/lulf/slim/pkg/datastore"
+)
+
+var errDone = errors.New("done")
+
+// Export writes the messages of a topic with offsets in [from, to] to w. A
+// negative to exports until the end of the topic.
+func Export(ds datastore.Datastore, topic string, from int64, to int64, w io.Writer, compress bool) (int64, error) {
+	writer, err := NewWriter(w, topic, compress)
+	if err != nil {
+		return 0, err
+	}
+
+	var exported int64
+	err = datastore.Stream(context.Background(), ds, topic, from, func(message *api.Message) error {
+		if to >= 0 && message.Offset > to {
+			return errDone
+		}
+		exported++
+		return writer.Write(message)
+	})
+	if err != nil && err != errDone {
+		return exported, err
+	}
+	return exported, writer.Close()
+}
+
+// Import restores the messages of an archive into a topic, creating it if
+// needed. If keepOffsets is set, the archived offsets are kept and must all
+// be after the last offset of the topic. Otherwise the messages are appended
+// with new offsets.
+func Import(ds datastore.Datastore, topic string, r io.Reader, keepOffsets bool) (int64, error) {
+	reader, err := NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	if topic == "" {
+		topic = reader.Topic()
+	}
+
+	topics, err := ds.ListTopics()
+	if err != nil {
+		return 0, err
+	}
+	found := false
+	for _, t := range topics {
+		if t == topic {
+			found = true
+			break
+		}
+	}
+	if !found {
+		err = ds.CreateTopic(topic)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	lastOffset, err := ds.LastOffset(topic)
+	if err != nil {
+		return 0, err
+	}
+	numMessages, err := ds.NumMessages(topic)
+	if err != nil {
+		return 0, err
+	}
+
+	var imported int64
+	for {
+		message, err := reader.Next()
+		if err == io.EOF {
+			return imported, nil
+		} else if err != nil {
+			return imported, err
+		}
+
+		if keepOffsets {
+			if numMessages > 0 && message.Offset <= lastOffset {
+				return imported, fmt.Errorf("Offset %d is not after last offset %d of topic %s", message.Offset, lastOffset, topic)
+			}
+		} else {
+			message.Offset = lastOffset + 1
+		}
+
+		err = ds.InsertMessage(topic, message)
+		if err != nil {
+			return imported, err
+		}
+		lastOffset = message.Offset
+		numMessages++
+		imported++
+	}
+}
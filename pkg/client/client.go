@@ -0,0 +1,28 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+// Package client produces to and consumes from a Slim server over AMQP.
+//
+// A Producer sends messages asynchronously and reports the offset each
+// message was stored at through its Receipt. A Consumer delivers the
+// messages of a topic and reconnects after connection failures, resuming
+// after the last message delivered.
+package client
+
+import (
+	"errors"
+
+	"github.com/apache/qpid-proton/go/pkg/amqp"
+)
+
+var ErrClosed = errors.New("client closed")
+
+// Address prefix of the links the server sends receipts on
+const receiptAddress = "$receipts"
+
+var receiptToAnnotation = amqp.AnnotationKeySymbol("x-opt-receipt-to")
+var offsetAnnotation = amqp.AnnotationKeySymbol("x-opt-offset")
+var timestampAnnotation = amqp.AnnotationKeySymbol("x-opt-timestamp")
+var topicAnnotation = amqp.AnnotationKeySymbol("x-opt-topic")
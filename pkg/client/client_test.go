@@ -0,0 +1,158 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package client
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apache/qpid-proton/go/pkg/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsumerFilter(t *testing.T) {
+	c := newConsumer("127.0.0.1:5672", "topic")
+	assert.Equal(t, map[amqp.Symbol]interface{}{}, c.filter())
+
+	c = newConsumer("127.0.0.1:5672", "topic", StartOffset(5), Selector("color = 'red'"))
+	assert.Equal(t, map[amqp.Symbol]interface{}{
+		"offset":   int64(5),
+		"selector": "color = 'red'",
+	}, c.filter())
+
+	// The start time only applies without a start offset
+	since := time.Unix(1585699200, 0)
+	c = newConsumer("127.0.0.1:5672", "topic", StartTime(since))
+	assert.Equal(t, map[amqp.Symbol]interface{}{"since": int64(1585699200)}, c.filter())
+	c = newConsumer("127.0.0.1:5672", "topic", StartOffset(0), StartTime(since))
+	assert.Equal(t, map[amqp.Symbol]interface{}{"offset": int64(0)}, c.filter())
+
+	c = newConsumer("127.0.0.1:5672", "sensors.*", Pattern(), Group("mygroup"))
+	assert.Equal(t, map[amqp.Symbol]interface{}{
+		"group":   "mygroup",
+		"pattern": true,
+	}, c.filter())
+}
+
+func TestConsumerResume(t *testing.T) {
+	// Reconnecting resumes after the last message delivered
+	c := newConsumer("127.0.0.1:5672", "topic", StartOffset(5))
+	c.lastSeen = 9
+	assert.Equal(t, map[amqp.Symbol]interface{}{"offset": int64(10)}, c.filter())
+
+	c = newConsumer("127.0.0.1:5672", "topic", StartTime(time.Unix(1585699200, 0)))
+	c.lastSeen = 0
+	assert.Equal(t, map[amqp.Symbol]interface{}{"offset": int64(1)}, c.filter())
+
+	// Groups resume from their committed offset
+	c = newConsumer("127.0.0.1:5672", "topic", Group("mygroup"))
+	c.lastSeen = 9
+	assert.Equal(t, map[amqp.Symbol]interface{}{"group": "mygroup"}, c.filter())
+
+	// Offsets of different topics can not be resumed from
+	c = newConsumer("127.0.0.1:5672", "sensors.*", Pattern(), StartOffset(0))
+	c.lastSeen = 9
+	assert.Equal(t, map[amqp.Symbol]interface{}{
+		"offset":  int64(0),
+		"pattern": true,
+	}, c.filter())
+}
+
+func TestNewMessage(t *testing.T) {
+	message := amqp.NewMessage()
+	m := newMessage("topic", message)
+	assert.Equal(t, "topic", m.Topic)
+	assert.Equal(t, int64(-1), m.Offset)
+	assert.Equal(t, int64(0), m.Timestamp)
+
+	message.SetMessageAnnotations(map[amqp.AnnotationKey]interface{}{
+		offsetAnnotation:    int64(3),
+		timestampAnnotation: int64(1585699200),
+		topicAnnotation:     "sensors.a",
+	})
+	m = newMessage("sensors.*", message)
+	assert.Equal(t, "sensors.a", m.Topic)
+	assert.Equal(t, int64(3), m.Offset)
+	assert.Equal(t, int64(1585699200), m.Timestamp)
+}
+
+func TestParseReceipt(t *testing.T) {
+	receipt := amqp.NewMessage()
+	receipt.SetCorrelationId("producer-1")
+	_, _, _, ok := parseReceipt(receipt)
+	assert.False(t, ok)
+
+	receipt.SetApplicationProperties(map[string]interface{}{
+		"topic":     "topic",
+		"offset":    int64(4),
+		"timestamp": int64(1585699200),
+	})
+	key, offset, timestamp, ok := parseReceipt(receipt)
+	assert.True(t, ok)
+	assert.Equal(t, "producer-1", key)
+	assert.Equal(t, int64(4), offset)
+	assert.Equal(t, int64(1585699200), timestamp)
+}
+
+func newTestProducer() *Producer {
+	return &Producer{
+		lock:    &sync.Mutex{},
+		pending: make(map[string]*Receipt),
+	}
+}
+
+func TestReceiptMatching(t *testing.T) {
+	p := newTestProducer()
+
+	// The receipt resolves once both the outcome and the offset arrived, in
+	// either order
+	r1 := p.track("1")
+	r2 := p.track("2")
+	p.get("1", false).accept()
+	p.get("1", false).receipt(7, 1585699200)
+	p.get("2", false).receipt(8, 1585699201)
+	p.get("2", false).accept()
+
+	offset, err := r1.Wait()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), offset)
+	assert.Equal(t, int64(1585699200), r1.Timestamp())
+	offset, err = r2.Wait()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(8), offset)
+	assert.Empty(t, p.pending)
+
+	// Unknown and resolved receipts are ignored
+	assert.Nil(t, p.get("1", false))
+	assert.Nil(t, p.get("3", false))
+
+	// Rejected messages fail without waiting for the offset
+	r3 := p.track("3")
+	p.get("3", true).fail(errors.New("rejected"))
+	_, err = r3.Wait()
+	assert.NotNil(t, err)
+	assert.Empty(t, p.pending)
+}
+
+func TestFailPending(t *testing.T) {
+	p := newTestProducer()
+	r1 := p.track("1")
+	p.get("1", false).accept()
+	r2 := p.track("2")
+
+	p.failPending(nil)
+	_, err := r1.Wait()
+	assert.Equal(t, ErrClosed, err)
+	_, err = r2.Wait()
+	assert.Equal(t, ErrClosed, err)
+
+	// Messages sent after closing fail immediately
+	_, err = p.track("3").Wait()
+	assert.Equal(t, ErrClosed, err)
+	assert.Empty(t, p.pending)
+}
@@ -0,0 +1,330 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package client
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/apache/qpid-proton/go/pkg/amqp"
+	"github.com/apache/qpid-proton/go/pkg/electron"
+)
+
+// Message is a message delivered to a consumer, with the topic and offset
+// it was stored at and the time it was stored in seconds since the epoch.
+type Message struct {
+	amqp.Message
+	Topic     string
+	Offset    int64
+	Timestamp int64
+}
+
+// ConsumerOption configures a consumer
+type ConsumerOption func(c *Consumer)
+
+// StartOffset starts consuming at offset instead of after the last message
+func StartOffset(offset int64) ConsumerOption {
+	return func(c *Consumer) {
+		c.offset = offset
+	}
+}
+
+// StartTime starts consuming at the first message stored at or after t
+func StartTime(t time.Time) ConsumerOption {
+	return func(c *Consumer) {
+		c.since = t.UTC().Unix()
+	}
+}
+
+// Group consumes as a member of a consumer group, starting at the offset
+// last committed by the group.
+func Group(group string) ConsumerOption {
+	return func(c *Consumer) {
+		c.group = group
+	}
+}
+
+// Selector only delivers messages matching a selector expression
+func Selector(selector string) ConsumerOption {
+	return func(c *Consumer) {
+		c.selector = selector
+	}
+}
+
+// Pattern treats the topic as a pattern in path.Match syntax and consumes
+// from all topics matching it
+func Pattern() ConsumerOption {
+	return func(c *Consumer) {
+		c.pattern = true
+	}
+}
+
+// Checkpoint calls fn with the offset of the last message delivered every
+// interval while it changes, and when the consumer is closed.
+func Checkpoint(fn func(offset int64), interval time.Duration) ConsumerOption {
+	return func(c *Consumer) {
+		c.checkpoint = fn
+		c.checkpointInterval = interval
+	}
+}
+
+// ConnectionOptions are used for each connection to the server
+func ConnectionOptions(opts ...electron.ConnectionOption) ConsumerOption {
+	return func(c *Consumer) {
+		c.connOpts = append(c.connOpts, opts...)
+	}
+}
+
+// ReconnectDelay is the time to wait before reconnecting, 1 second by default
+func ReconnectDelay(delay time.Duration) ConsumerOption {
+	return func(c *Consumer) {
+		c.reconnectDelay = delay
+	}
+}
+
+// Consumer delivers the messages of a topic. After a connection failure it
+// reconnects and resumes after the last message delivered. Patterns span
+// several topics with their own offsets, so consumers of patterns resume
+// from the start offset unless they use a group.
+type Consumer struct {
+	address            string
+	topic              string
+	offset             int64
+	since              int64
+	group              string
+	selector           string
+	pattern            bool
+	checkpoint         func(offset int64)
+	checkpointInterval time.Duration
+	connOpts           []electron.ConnectionOption
+	reconnectDelay     time.Duration
+
+	messages chan *Message
+	lock     *sync.Mutex
+	conn     electron.Connection
+	lastSeen int64
+	closed   bool
+	done     chan struct{}
+	wg       *sync.WaitGroup
+}
+
+// NewConsumer connects to the server at address and attaches to topic. An
+// error is returned if the first connection fails.
+func NewConsumer(address string, topic string, opts ...ConsumerOption) (*Consumer, error) {
+	c := newConsumer(address, topic, opts...)
+	rcv, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	c.wg.Add(1)
+	go c.run(rcv)
+	if c.checkpoint != nil && c.checkpointInterval > 0 {
+		c.wg.Add(1)
+		go c.checkpointer()
+	}
+	return c, nil
+}
+
+func newConsumer(address string, topic string, opts ...ConsumerOption) *Consumer {
+	c := &Consumer{
+		address:        address,
+		topic:          topic,
+		offset:         -1,
+		reconnectDelay: time.Second,
+		messages:       make(chan *Message),
+		lock:           &sync.Mutex{},
+		lastSeen:       -1,
+		done:           make(chan struct{}),
+		wg:             &sync.WaitGroup{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// connect attaches to the topic, resuming after the last message delivered
+func (c *Consumer) connect() (electron.Receiver, error) {
+	conn, err := electron.Dial("tcp", c.address, c.connOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		conn.Close(nil)
+		return nil, ErrClosed
+	}
+	c.conn = conn
+	filter := c.filter()
+	c.lock.Unlock()
+
+	rcv, err := conn.Receiver(electron.Source(c.topic), electron.Filter(filter))
+	if err != nil {
+		conn.Close(nil)
+		return nil, err
+	}
+	return rcv, nil
+}
+
+// filter returns the source filter to attach with, resuming after the last
+// message delivered. Called with lock held.
+func (c *Consumer) filter() map[amqp.Symbol]interface{} {
+	filter := map[amqp.Symbol]interface{}{}
+	if c.lastSeen >= 0 && c.group == "" && !c.pattern {
+		filter["offset"] = c.lastSeen + 1
+	} else if c.offset >= 0 {
+		filter["offset"] = c.offset
+	} else if c.since > 0 {
+		filter["since"] = c.since
+	}
+	if c.group != "" {
+		filter["group"] = c.group
+	}
+	if c.selector != "" {
+		filter["selector"] = c.selector
+	}
+	if c.pattern {
+		filter["pattern"] = true
+	}
+	return filter
+}
+
+func (c *Consumer) run(rcv electron.Receiver) {
+	defer c.wg.Done()
+	defer close(c.messages)
+	for {
+		err := c.receive(rcv)
+		if c.isClosed() {
+			return
+		}
+		log.Print("Receiving from ", c.topic, ":", err)
+		rcv.Connection().Close(nil)
+
+		for {
+			select {
+			case <-time.After(c.reconnectDelay):
+			case <-c.done:
+				return
+			}
+			rcv, err = c.connect()
+			if err == nil {
+				break
+			}
+			if c.isClosed() {
+				return
+			}
+			log.Print("Reconnecting to ", c.address, ":", err)
+		}
+	}
+}
+
+func (c *Consumer) receive(rcv electron.Receiver) error {
+	for {
+		rm, err := rcv.Receive()
+		if err != nil {
+			return err
+		}
+		m := newMessage(c.topic, rm.Message)
+
+		select {
+		case c.messages <- m:
+			rm.Accept()
+			c.lock.Lock()
+			if m.Offset >= 0 {
+				c.lastSeen = m.Offset
+			}
+			c.lock.Unlock()
+		case <-c.done:
+			rm.Release()
+			return ErrClosed
+		}
+	}
+}
+
+// newMessage returns a received message with the topic, offset and
+// timestamp the server annotated it with
+func newMessage(topic string, message amqp.Message) *Message {
+	m := &Message{
+		Message: message,
+		Topic:   topic,
+		Offset:  -1,
+	}
+	annotations := message.MessageAnnotations()
+	if offset, ok := annotations[offsetAnnotation].(int64); ok {
+		m.Offset = offset
+	}
+	if timestamp, ok := annotations[timestampAnnotation].(int64); ok {
+		m.Timestamp = timestamp
+	}
+	if topic, ok := annotations[topicAnnotation].(string); ok {
+		m.Topic = topic
+	}
+	return m
+}
+
+func (c *Consumer) checkpointer() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.checkpointInterval)
+	defer ticker.Stop()
+	checkpointed := int64(-1)
+	for {
+		select {
+		case <-ticker.C:
+			if offset := c.LastOffset(); offset != checkpointed {
+				c.checkpoint(offset)
+				checkpointed = offset
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *Consumer) isClosed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closed
+}
+
+// Messages returns the channel messages are delivered on. It is closed when
+// the consumer is closed.
+func (c *Consumer) Messages() <-chan *Message {
+	return c.messages
+}
+
+// LastOffset returns the offset of the last message delivered, or -1 if
+// none has been delivered.
+func (c *Consumer) LastOffset() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lastSeen
+}
+
+// Close disconnects from the server and waits for the messages channel to
+// be closed. Messages delivered but not yet accepted are released.
+func (c *Consumer) Close() {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return
+	}
+	c.closed = true
+	conn := c.conn
+	c.lock.Unlock()
+
+	close(c.done)
+	if conn != nil {
+		conn.Close(nil)
+	}
+	c.wg.Wait()
+	if c.checkpoint != nil {
+		c.checkpoint(c.LastOffset())
+	}
+}
@@ -0,0 +1,296 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package client
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/apache/qpid-proton/go/pkg/amqp"
+	"github.com/apache/qpid-proton/go/pkg/electron"
+)
+
+// Producer sends messages to a topic without waiting for each message to be
+// stored. The offset of each message is reported by its receipt.
+type Producer struct {
+	conn         electron.Connection
+	snd          electron.Sender
+	receipts     electron.Receiver
+	receiptTo    string
+	outcomes     chan electron.Outcome
+	lock         *sync.Mutex
+	pending      map[string]*Receipt
+	closed       bool
+	nextId       uint64
+	handlersDone *sync.WaitGroup
+}
+
+var producerCounter uint64
+
+// NewProducer connects to the server at address and attaches to topic
+func NewProducer(address string, topic string, opts ...electron.ConnectionOption) (*Producer, error) {
+	conn, err := electron.Dial("tcp", address, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// The server sends receipts on a link attached by the producer
+	receiptTo := fmt.Sprintf("%s/%s-%d", receiptAddress, conn.Container().Id(), atomic.AddUint64(&producerCounter, 1))
+	receipts, err := conn.Receiver(electron.Source(receiptTo), electron.Capacity(100), electron.Prefetch(true))
+	if err != nil {
+		conn.Close(nil)
+		return nil, err
+	}
+	snd, err := conn.Sender(electron.Target(topic))
+	if err != nil {
+		conn.Close(nil)
+		return nil, err
+	}
+
+	p := &Producer{
+		conn:         conn,
+		snd:          snd,
+		receipts:     receipts,
+		receiptTo:    receiptTo,
+		outcomes:     make(chan electron.Outcome, 100),
+		lock:         &sync.Mutex{},
+		pending:      make(map[string]*Receipt),
+		handlersDone: &sync.WaitGroup{},
+	}
+	p.handlersDone.Add(2)
+	go p.handleOutcomes()
+	go p.handleReceipts()
+	return p, nil
+}
+
+// Send sends a message and returns its receipt without waiting for it to be
+// stored. Messages without a message-id are given one. Send blocks while the
+// server has not granted credit for more messages.
+func (p *Producer) Send(m amqp.Message) *Receipt {
+	if m.MessageId() == nil {
+		m.SetMessageId(fmt.Sprintf("%s-%d", p.receiptTo, atomic.AddUint64(&p.nextId, 1)))
+	}
+	key := fmt.Sprint(m.MessageId())
+
+	annotations := m.MessageAnnotations()
+	if annotations == nil {
+		annotations = make(map[amqp.AnnotationKey]interface{})
+	}
+	annotations[receiptToAnnotation] = p.receiptTo
+	m.SetMessageAnnotations(annotations)
+
+	r := p.track(key)
+	if r.err == nil {
+		p.snd.SendAsync(m, p.outcomes, key)
+	}
+	return r
+}
+
+// track returns a pending receipt for the message with key, or a failed one
+// if the producer is closed
+func (p *Producer) track(key string) *Receipt {
+	r := newReceipt()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		r.fail(ErrClosed)
+		return r
+	}
+	p.pending[key] = r
+	return r
+}
+
+// SendBatch sends all messages before waiting for them to be stored, and
+// returns their offsets. The first error encountered is returned.
+func (p *Producer) SendBatch(messages []amqp.Message) ([]int64, error) {
+	receipts := make([]*Receipt, 0, len(messages))
+	for _, m := range messages {
+		receipts = append(receipts, p.Send(m))
+	}
+	offsets := make([]int64, 0, len(messages))
+	var firstErr error
+	for _, r := range receipts {
+		offset, err := r.Wait()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		offsets = append(offsets, offset)
+	}
+	return offsets, firstErr
+}
+
+// Close disconnects from the server. Receipts of messages not yet stored
+// fail with ErrClosed.
+func (p *Producer) Close() {
+	p.conn.Close(nil)
+	p.handlersDone.Wait()
+	p.failPending(ErrClosed)
+}
+
+func (p *Producer) handleOutcomes() {
+	defer p.handlersDone.Done()
+	for {
+		select {
+		case outcome := <-p.outcomes:
+			key := outcome.Value.(string)
+			if outcome.Status == electron.Accepted {
+				if r := p.get(key, false); r != nil {
+					r.accept()
+				}
+			} else if r := p.get(key, true); r != nil {
+				r.fail(fmt.Errorf("Message %s: %v %v", key, outcome.Status, outcome.Error))
+			}
+		case <-p.conn.Done():
+			p.failPending(p.conn.Error())
+			return
+		}
+	}
+}
+
+func (p *Producer) handleReceipts() {
+	defer p.handlersDone.Done()
+	for {
+		rm, err := p.receipts.Receive()
+		if err != nil {
+			return
+		}
+		rm.Accept()
+		key, offset, timestamp, ok := parseReceipt(rm.Message)
+		if !ok {
+			continue
+		}
+		if r := p.get(key, false); r != nil {
+			r.receipt(offset, timestamp)
+		}
+	}
+}
+
+// parseReceipt returns the key of the message a receipt is for, and the
+// offset and timestamp the message was stored with
+func parseReceipt(m amqp.Message) (string, int64, int64, bool) {
+	props := m.ApplicationProperties()
+	offset, ok := props["offset"].(int64)
+	if !ok {
+		return "", 0, 0, false
+	}
+	timestamp, _ := props["timestamp"].(int64)
+	return fmt.Sprint(m.CorrelationId()), offset, timestamp, true
+}
+
+// get returns the pending receipt for a message. Receipts are removed once
+// resolved, or immediately if remove is set.
+func (p *Producer) get(key string, remove bool) *Receipt {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	r, ok := p.pending[key]
+	if !ok {
+		return nil
+	}
+	if remove || r.resolving() {
+		delete(p.pending, key)
+	}
+	return r
+}
+
+func (p *Producer) failPending(err error) {
+	if err == nil {
+		err = ErrClosed
+	}
+	p.lock.Lock()
+	p.closed = true
+	pending := p.pending
+	p.pending = make(map[string]*Receipt)
+	p.lock.Unlock()
+	for _, r := range pending {
+		r.fail(err)
+	}
+}
+
+// Receipt reports the outcome of a sent message. It is resolved once the
+// server has both accepted the message and reported its offset.
+type Receipt struct {
+	lock      *sync.Mutex
+	done      chan struct{}
+	accepted  bool
+	receipted bool
+	offset    int64
+	timestamp int64
+	err       error
+}
+
+func newReceipt() *Receipt {
+	return &Receipt{
+		lock:   &sync.Mutex{},
+		done:   make(chan struct{}),
+		offset: -1,
+	}
+}
+
+// Done is closed when the receipt is resolved
+func (r *Receipt) Done() <-chan struct{} {
+	return r.done
+}
+
+// Wait waits for the message to be stored and returns its offset. The
+// offset is -1 if the message was a duplicate of a message already stored.
+func (r *Receipt) Wait() (int64, error) {
+	<-r.done
+	return r.offset, r.err
+}
+
+// Timestamp returns the time the message was stored, in seconds since the
+// epoch, once the receipt is resolved.
+func (r *Receipt) Timestamp() int64 {
+	<-r.done
+	return r.timestamp
+}
+
+// resolving returns true if the receipt is resolved by the next update
+func (r *Receipt) resolving() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.accepted || r.receipted
+}
+
+func (r *Receipt) accept() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.accepted = true
+	r.resolve()
+}
+
+func (r *Receipt) receipt(offset int64, timestamp int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.receipted = true
+	r.offset = offset
+	r.timestamp = timestamp
+	r.resolve()
+}
+
+func (r *Receipt) fail(err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	select {
+	case <-r.done:
+		return
+	default:
+	}
+	r.err = err
+	close(r.done)
+}
+
+// resolve closes done once accepted and receipted. Called with lock held.
+func (r *Receipt) resolve() {
+	if r.accepted && r.receipted {
+		select {
+		case <-r.done:
+		default:
+			close(r.done)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+// Package cluster replicates the commit log across a group of slim-servers
+// using Raft. Entries are only stored, on every member, once a majority of
+// the group has agreed on them.
+package cluster
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lulf/slim/pkg/api"
+	"github.com/lulf/slim/pkg/commitlog"
+	"github.com/lulf/slim/pkg/datastore"
+	"github.com/lulf/slim/pkg/raft"
+)
+
+// Member is a slim-server in the cluster
+type Member struct {
+	// Address the member serves Raft requests on
+	RaftAddress string
+	// Address the member accepts AMQP connections on, used to redirect producers
+	AmqpAddress string
+}
+
+// Cluster is the state machine replicated by Raft. Offsets are assigned to
+// messages as entries are applied, so every member stores a message under
+// the same offset. Snapshots of the state are the last offset of each topic,
+// taken once the datastore has been flushed.
+type Cluster struct {
+	id        string
+	cl        *commitlog.CommitLog
+	members   map[string]Member
+	node      *raft.Node
+	storage   raft.Storage
+	transport *raft.RPCTransport
+	listener  net.Listener
+
+	lock    *sync.Mutex
+	offsets map[string]int64
+}
+
+// ReadArgs requests the messages of a topic from another member
+type ReadArgs struct {
+	Topic  string
+	Offset int64
+	Max    int
+}
+
+type ReadReply struct {
+	Messages []*api.Message
+}
+
+// service serves the messages of the commit log to members restoring a
+// snapshot
+type service struct {
+	cl *commitlog.CommitLog
+}
+
+func (s *service) Read(args *ReadArgs, reply *ReadReply) error {
+	messages, err := s.cl.ReadMessages(args.Topic, args.Offset, args.Max)
+	if err == commitlog.ErrTopicNotFound {
+		return nil
+	}
+	reply.Messages = messages
+	return err
+}
+
+func NewCluster(id string, members map[string]Member, cl *commitlog.CommitLog, storage raft.Storage) (*Cluster, error) {
+	if _, ok := members[id]; !ok {
+		return nil, fmt.Errorf("Cluster member %s not found among members", id)
+	}
+
+	peers := make([]string, 0, len(members)-1)
+	addresses := make(map[string]string, len(members))
+	for memberId, member := range members {
+		addresses[memberId] = member.RaftAddress
+		if memberId != id {
+			peers = append(peers, memberId)
+		}
+	}
+
+	c := &Cluster{
+		id:        id,
+		cl:        cl,
+		members:   members,
+		storage:   storage,
+		transport: raft.NewRPCTransport(addresses, time.Second),
+		lock:      &sync.Mutex{},
+		offsets:   make(map[string]int64),
+	}
+
+	snapshot, err := storage.LoadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	if snapshot == nil {
+		// Messages stored before the cluster was formed keep their offsets
+		for _, name := range cl.Topics() {
+			if topic, err := cl.GetTopic(name); err == nil {
+				c.offsets[name] = topic.LastCommitted()
+			}
+		}
+		data, err := c.Snapshot()
+		if err != nil {
+			return nil, err
+		}
+		err = storage.SaveSnapshot(&raft.Snapshot{Data: data})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	node, err := raft.NewNode(raft.DefaultConfig(id, peers), c.transport, storage, c)
+	if err != nil {
+		return nil, err
+	}
+	c.node = node
+	return c, nil
+}
+
+// Start serves Raft requests on listener and starts replicating entries
+// added to the commit log.
+func (c *Cluster) Start(listener net.Listener) {
+	c.listener = listener
+	c.cl.SetReplicator(c)
+	go func() {
+		err := raft.ServeServices(listener, map[string]interface{}{
+			"Raft":    raft.NewService(c.node),
+			"Cluster": &service{cl: c.cl},
+		})
+		if err != nil {
+			log.Print("Serving raft:", err)
+		}
+	}()
+	c.node.Start()
+}
+
+func (c *Cluster) Stop() {
+	if c.listener != nil {
+		c.listener.Close()
+	}
+	c.node.Stop()
+	c.transport.Close()
+	err := c.storage.Close()
+	if err != nil {
+		log.Print("Closing raft storage:", err)
+	}
+}
+
+func (c *Cluster) IsLeader() bool {
+	return c.node.IsLeader()
+}
+
+// LeaderAddress returns the AMQP address of the leader, or an empty string if
+// no leader is known.
+func (c *Cluster) LeaderAddress() string {
+	return c.members[c.node.Leader()].AmqpAddress
+}
+
+// Replicate waits until a majority of the cluster has agreed on the message
+// and it has been stored under the offset assigned to it when applied. Only
+// the leader replicates messages.
+func (c *Cluster) Replicate(topicName string, message *api.Message) error {
+	value, err := c.node.Propose(encodeCommand(topicName, message))
+	if err != nil {
+		return err
+	}
+	if err, ok := value.(error); ok {
+		return err
+	}
+	message.Offset = value.(int64)
+	return nil
+}
+
+// Apply stores the message of an entry under the next offset of its topic,
+// returning the offset. Messages already stored are skipped. The member
+// exits if the message can not be stored, as it would otherwise store the
+// messages of later entries under other offsets than the other members.
+func (c *Cluster) Apply(index uint64, command []byte) interface{} {
+	topic, message, err := decodeCommand(command)
+	if err != nil {
+		log.Print("Decoding raft entry ", index, ":", err)
+		return err
+	}
+
+	c.lock.Lock()
+	offset, ok := c.offsets[topic]
+	c.lock.Unlock()
+	if !ok {
+		offset = -1
+	}
+	message.Offset = offset + 1
+
+	err = c.cl.Apply(topic, message)
+	if err != nil {
+		log.Fatal("Applying raft entry ", index, ":", err)
+	}
+	c.lock.Lock()
+	c.offsets[topic] = message.Offset
+	c.lock.Unlock()
+	return message.Offset
+}
+
+// Snapshot flushes the datastore so that the messages of the entries applied
+// so far are not lost once the entries are removed from the raft log.
+func (c *Cluster) Snapshot() ([]byte, error) {
+	c.lock.Lock()
+	offsets := make(map[string]int64, len(c.offsets))
+	for topic, offset := range c.offsets {
+		offsets[topic] = offset
+	}
+	c.lock.Unlock()
+
+	err := c.cl.Flush()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(offsets)
+}
+
+// Restore sets the offsets of a snapshot. A snapshot sent by the leader
+// replaces entries this member has not applied, so the messages it is
+// missing are first read from the leader.
+func (c *Cluster) Restore(snapshot []byte, leader string) error {
+	offsets := make(map[string]int64)
+	err := json.Unmarshal(snapshot, &offsets)
+	if err != nil {
+		return err
+	}
+	if leader != "" {
+		for topic, offset := range offsets {
+			err = c.fetch(leader, topic, offset)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	c.lock.Lock()
+	c.offsets = offsets
+	c.lock.Unlock()
+	return nil
+}
+
+// fetch reads the messages of a topic up to last from a member
+func (c *Cluster) fetch(member string, topicName string, last int64) error {
+	topic, err := c.cl.GetOrNewTopic(topicName)
+	if err != nil {
+		return err
+	}
+	for topic.LastCommitted() < last {
+		args := &ReadArgs{Topic: topicName, Offset: topic.LastCommitted() + 1, Max: datastore.ReadBatchSize}
+		reply := &ReadReply{}
+		err = c.transport.Call(member, "Cluster.Read", args, reply)
+		if err != nil {
+			return err
+		}
+		if len(reply.Messages) == 0 {
+			// Removed from the member by retention
+			return nil
+		}
+		for _, message := range reply.Messages {
+			if message.Offset > last {
+				return nil
+			}
+			err = c.cl.Apply(topicName, message)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Commands are encoded as:
+//
+//	length    uint32 length of the topic name
+//	topic     [length]byte
+//	timestamp int64
+//	payload   remaining bytes
+func encodeCommand(topic string, message *api.Message) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(len(topic)))
+	buf.WriteString(topic)
+	binary.Write(buf, binary.LittleEndian, message.Timestamp)
+	buf.Write(message.Payload)
+	return buf.Bytes()
+}
+
+func decodeCommand(command []byte) (string, *api.Message, error) {
+	reader := bytes.NewReader(command)
+	var length uint32
+	err := binary.Read(reader, binary.LittleEndian, &length)
+	if err != nil {
+		return "", nil, err
+	}
+	if int64(length) > int64(reader.Len()) {
+		return "", nil, io.ErrUnexpectedEOF
+	}
+	topic := make([]byte, length)
+	reader.Read(topic)
+
+	var timestamp int64
+	err = binary.Read(reader, binary.LittleEndian, &timestamp)
+	if err != nil {
+		return "", nil, err
+	}
+
+	payload := make([]byte, reader.Len())
+	reader.Read(payload)
+	message := api.NewMessage(0, payload)
+	message.Timestamp = timestamp
+	return string(topic), message, nil
+}
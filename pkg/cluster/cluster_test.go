@@ -0,0 +1,160 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lulf/slim/pkg/api"
+	"github.com/lulf/slim/pkg/commitlog"
+	"github.com/lulf/slim/pkg/datastore"
+	"github.com/lulf/slim/pkg/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+type testMember struct {
+	cluster *Cluster
+	cl      *commitlog.CommitLog
+	ds      datastore.Datastore
+}
+
+func startClusters(t *testing.T, ids []string) []*testMember {
+	listeners := make(map[string]net.Listener)
+	members := make(map[string]Member)
+	for _, id := range ids {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+		listeners[id] = listener
+		members[id] = Member{RaftAddress: listener.Addr().String(), AmqpAddress: "amqp-" + id}
+	}
+
+	result := make([]*testMember, 0, len(ids))
+	for _, id := range ids {
+		ds, err := datastore.NewMemoryDatastore()
+		assert.Nil(t, err)
+		cl, err := commitlog.NewCommitLog(ds)
+		assert.Nil(t, err)
+		c, err := NewCluster(id, members, cl, raft.NewMemoryStorage())
+		assert.Nil(t, err)
+		c.Start(listeners[id])
+		result = append(result, &testMember{cluster: c, cl: cl, ds: ds})
+	}
+	return result
+}
+
+func produce(topic *commitlog.Topic, payload string) bool {
+	done := make(chan bool, 1)
+	topic.AddEntry(commitlog.NewEntry(api.NewMessage(0, []byte(payload)), func(ok bool) {
+		done <- ok
+	}))
+	return <-done
+}
+
+func TestReplicatedCommitLog(t *testing.T) {
+	members := startClusters(t, []string{"a", "b", "c"})
+
+	var leader *testMember
+	deadline := time.Now().Add(5 * time.Second)
+	for leader == nil && time.Now().Before(deadline) {
+		for _, m := range members {
+			if m.cluster.IsLeader() {
+				leader = m
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NotNil(t, leader)
+
+	topic, err := leader.cl.GetOrNewTopic("mytopic")
+	assert.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		assert.True(t, produce(topic, fmt.Sprintf("payload%d", i)))
+	}
+	assert.Equal(t, int64(4), topic.LastCommitted())
+
+	for _, m := range members {
+		// Followers store entries once they learn they are committed
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if t, err := m.cl.GetTopic("mytopic"); err == nil && t.LastCommitted() == 4 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		var offsets []int64
+		err := datastore.Stream(context.Background(), m.ds, "mytopic", 0, func(message *api.Message) error {
+			offsets = append(offsets, message.Offset)
+			return nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, []int64{0, 1, 2, 3, 4}, offsets)
+
+		if m != leader {
+			assert.Equal(t, "amqp-"+leader.cluster.id, m.cluster.LeaderAddress())
+			followerTopic, err := m.cl.GetTopic("mytopic")
+			assert.Nil(t, err)
+			assert.False(t, produce(followerTopic, "rejected"))
+		}
+	}
+
+	for _, m := range members {
+		m.cluster.Stop()
+		m.cl.Close()
+	}
+}
+
+func TestRestoreFromLeader(t *testing.T) {
+	members := startClusters(t, []string{"a", "b"})
+	leader, follower := members[0], members[1]
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, leader.cl.Apply("mytopic", api.NewMessage(int64(i), []byte(fmt.Sprintf("payload%d", i)))))
+	}
+	follower.cluster.Stop()
+
+	// Messages the snapshot includes are read from the leader
+	ds, err := datastore.NewMemoryDatastore()
+	assert.Nil(t, err)
+	cl, err := commitlog.NewCommitLog(ds)
+	assert.Nil(t, err)
+	c, err := NewCluster("b", follower.cluster.members, cl, raft.NewMemoryStorage())
+	assert.Nil(t, err)
+	assert.Nil(t, c.Restore([]byte(`{"mytopic":3}`), "a"))
+
+	var offsets []int64
+	err = datastore.Stream(context.Background(), ds, "mytopic", 0, func(message *api.Message) error {
+		offsets = append(offsets, message.Offset)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{0, 1, 2, 3}, offsets)
+
+	snapshot, err := c.Snapshot()
+	assert.Nil(t, err)
+	assert.Equal(t, `{"mytopic":3}`, string(snapshot))
+
+	c.Stop()
+	cl.Close()
+	leader.cluster.Stop()
+	leader.cl.Close()
+	follower.cl.Close()
+}
+
+func TestCommandEncoding(t *testing.T) {
+	message := api.NewMessage(0, []byte("payload"))
+	message.Timestamp = 1000
+	topic, decoded, err := decodeCommand(encodeCommand("mytopic", message))
+	assert.Nil(t, err)
+	assert.Equal(t, "mytopic", topic)
+	assert.Equal(t, message, decoded)
+
+	_, _, err = decodeCommand([]byte{100, 0, 0, 0, 1})
+	assert.NotNil(t, err)
+}
@@ -6,11 +6,23 @@
 package commitlog
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/lulf/slim/pkg/api"
 	"github.com/lulf/slim/pkg/datastore"
 	"log"
+	"os"
+	"sort"
 	"sync"
 )
 
+var ErrClosed = errors.New("commit log closed")
+
+var ErrTopicNotFound = errors.New("topic not found")
+
+var errFound = errors.New("found")
+
 func max(a, b int) int {
 	if a < b {
 		return b
@@ -49,17 +61,239 @@ func (cl *CommitLog) GetOrNewTopic(topicName string) (*Topic, error) {
 	if ok {
 		return topic, nil
 	}
+	if cl.closed {
+		return nil, ErrClosed
+	}
 	err := cl.ds.CreateTopic(topicName)
 	if err != nil {
 		log.Print("Creating topic:", err)
 		return nil, err
 	}
 	topic = createTopic(topicName, -1, cl.ds)
+	topic.replicator = cl.replicator
+	topic.dedupSize = cl.dedupSize
+	topic.dedupDecoder = cl.decoder
+	topic.dedupDir = cl.dedupDir
+	topic.groupDir = cl.groupDir
 	cl.topicMap[topicName] = topic
 	go topic.run()
 	return topic, nil
 }
 
+// SetReplicator makes entries added to topics go through the replicator
+// before being stored. It must be set before any entries are added.
+func (cl *CommitLog) SetReplicator(replicator Replicator) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	cl.replicator = replicator
+	for _, topic := range cl.topicMap {
+		topic.replicator = replicator
+	}
+}
+
+// SetDedup enables deduplication of idempotent entries, remembering the last
+// sequence number and the keys of the last window messages of each
+// producer. The window of each topic is saved to a file in stateDir when the
+// commit log is flushed or closed, and rebuilt from that file and the
+// entries stored after it using decoder. Without a stateDir, the window is
+// rebuilt from the whole topic. It must be set before any entries are added.
+func (cl *CommitLog) SetDedup(window int, decoder DedupDecoder, stateDir string) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	cl.dedupSize = window
+	cl.decoder = decoder
+	cl.dedupDir = stateDir
+	for _, topic := range cl.topicMap {
+		topic.dedupSize = window
+		topic.dedupDecoder = decoder
+		topic.dedupDir = stateDir
+	}
+}
+
+// Apply stores an entry agreed on by the replicator under its offset,
+// creating the topic if needed. Entries at or before the last offset of the
+// topic are skipped.
+func (cl *CommitLog) Apply(topicName string, message *api.Message) error {
+	topic, err := cl.GetOrNewTopic(topicName)
+	if err != nil {
+		return err
+	}
+	var stored bool
+	topic.store(NewReplicatedEntry(message, func(ok bool) {
+		stored = ok
+	}))
+	if !stored {
+		return fmt.Errorf("Storing entry %d of topic %s failed", message.Offset, topicName)
+	}
+	return nil
+}
+
+func (cl *CommitLog) GetTopic(topicName string) (*Topic, error) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	topic, ok := cl.topicMap[topicName]
+	if !ok {
+		return nil, ErrTopicNotFound
+	}
+	return topic, nil
+}
+
+func (cl *CommitLog) Topics() []string {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	names := make([]string, 0, len(cl.topicMap))
+	for name := range cl.topicMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DeleteTopic closes all subscribers of a topic and removes it and its
+// entries from the datastore.
+func (cl *CommitLog) DeleteTopic(topicName string) error {
+	cl.lock.Lock()
+	topic, ok := cl.topicMap[topicName]
+	if ok {
+		delete(cl.topicMap, topicName)
+	}
+	cl.lock.Unlock()
+	if !ok {
+		return ErrTopicNotFound
+	}
+
+	topic.close()
+	for _, path := range []string{topic.dedupFile(), topic.groupFile()} {
+		if path == "" {
+			continue
+		}
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return cl.ds.DeleteTopic(topicName)
+}
+
+func (cl *CommitLog) NumMessages(topicName string) (int64, error) {
+	if _, err := cl.GetTopic(topicName); err != nil {
+		return 0, err
+	}
+	return cl.ds.NumMessages(topicName)
+}
+
+// OffsetAt returns the offset of the last entry stored before the given
+// timestamp, or -1 if there is no such entry. Entries are stored in
+// timestamp order, so the offset is found by bisection.
+func (cl *CommitLog) OffsetAt(topicName string, timestamp int64) (int64, error) {
+	topic, err := cl.GetTopic(topicName)
+	if err != nil {
+		return -1, err
+	}
+
+	// Entries before low are stored before the timestamp, and entries from
+	// high on at or after it
+	low, high := int64(0), topic.LastCommitted()+1
+	for low < high {
+		mid := low + (high-low)/2
+		message, err := cl.firstMessage(topicName, mid)
+		if err != nil {
+			return -1, err
+		}
+		if message == nil || message.Timestamp >= timestamp {
+			high = mid
+		} else {
+			low = message.Offset + 1
+		}
+	}
+	return low - 1, nil
+}
+
+// firstMessage returns the first message of a topic at or after offset, or
+// nil if there is none
+func (cl *CommitLog) firstMessage(topicName string, offset int64) (*api.Message, error) {
+	var found *api.Message
+	err := datastore.Stream(context.Background(), cl.ds, topicName, offset, func(message *api.Message) error {
+		found = message
+		return errFound
+	})
+	if err != nil && err != errFound {
+		return nil, err
+	}
+	return found, nil
+}
+
+// ReadMessages returns at most max messages of a topic starting at offset
+func (cl *CommitLog) ReadMessages(topicName string, offset int64, max int) ([]*api.Message, error) {
+	if _, err := cl.GetTopic(topicName); err != nil {
+		return nil, err
+	}
+	messages := make([]*api.Message, 0)
+	err := datastore.Stream(context.Background(), cl.ds, topicName, offset, func(message *api.Message) error {
+		messages = append(messages, message)
+		if len(messages) >= max {
+			return errFound
+		}
+		return nil
+	})
+	if err != nil && err != errFound {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func (cl *CommitLog) Retention(topicName string) datastore.Retention {
+	return cl.ds.RetentionPolicy().Get(topicName)
+}
+
+// Flush flushes the datastore and saves the deduplication windows and the
+// offsets of consumer groups
+func (cl *CommitLog) Flush() error {
+	err := cl.ds.Flush()
+	if err != nil {
+		return err
+	}
+	return cl.saveState()
+}
+
+func (cl *CommitLog) saveState() error {
+	cl.lock.Lock()
+	topics := make([]*Topic, 0, len(cl.topicMap))
+	for _, topic := range cl.topicMap {
+		topics = append(topics, topic)
+	}
+	cl.lock.Unlock()
+
+	for _, topic := range topics {
+		err := topic.saveDedup()
+		if err != nil {
+			return err
+		}
+		err = topic.saveGroups()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Snapshot flushes the datastore and writes a consistent copy of it to a new
+// directory, returning the last offset included for each topic.
+func (cl *CommitLog) Snapshot(dir string) (map[string]int64, error) {
+	err := cl.ds.Flush()
+	if err != nil {
+		return nil, err
+	}
+	return cl.ds.Snapshot(dir)
+}
+
+func (cl *CommitLog) GarbageCollect(topicName string) error {
+	if _, err := cl.GetTopic(topicName); err != nil {
+		return err
+	}
+	return cl.ds.GarbageCollect(topicName)
+}
+
 func createTopic(topicName string, lastOffset int64, ds datastore.Datastore) *Topic {
 	subLock := &sync.Mutex{}
 	return &Topic{
@@ -67,8 +301,32 @@ func createTopic(topicName string, lastOffset int64, ds datastore.Datastore) *To
 		lastCommitted: lastOffset,
 		offsetCounter: lastOffset,
 		subs:          make(map[string]*Subscriber),
+		groups:        make(map[string]int64),
 		incoming:      make(chan *Entry, 100),
 		subLock:       subLock,
+		closeLock:     &sync.RWMutex{},
+		stopped:       make(chan struct{}),
+		storeLock:     &sync.Mutex{},
 		ds:            ds,
 	}
 }
+
+// Close stops accepting new entries, waits for the entries already queued on
+// each topic to be stored and wakes up all subscribers.
+func (cl *CommitLog) Close() {
+	cl.lock.Lock()
+	cl.closed = true
+	topics := make([]*Topic, 0, len(cl.topicMap))
+	for _, topic := range cl.topicMap {
+		topics = append(topics, topic)
+	}
+	cl.lock.Unlock()
+
+	for _, topic := range topics {
+		topic.close()
+	}
+	err := cl.Flush()
+	if err != nil {
+		log.Print("Saving deduplication state:", err)
+	}
+}
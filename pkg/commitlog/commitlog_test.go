@@ -0,0 +1,443 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package commitlog
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/lulf/slim/pkg/api"
+	"github.com/lulf/slim/pkg/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloseDrainsQueuedEntries(t *testing.T) {
+	ds, err := datastore.NewMemoryDatastore()
+	assert.Nil(t, err)
+	cl, err := NewCommitLog(ds)
+	assert.Nil(t, err)
+
+	topic, err := cl.GetOrNewTopic("mytopic")
+	assert.Nil(t, err)
+
+	results := make(chan bool, 10)
+	for i := 0; i < 10; i++ {
+		topic.AddEntry(NewEntry(api.NewMessage(0, []byte("payload")), func(ok bool) {
+			results <- ok
+		}))
+	}
+	sub := topic.NewSubscriber("sub1", "", 0, 0)
+
+	cl.Close()
+	assert.Equal(t, 10, len(results))
+	for i := 0; i < 10; i++ {
+		assert.True(t, <-results)
+	}
+
+	num, err := ds.NumMessages("mytopic")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), num)
+
+	// Entries added after closing are rejected
+	topic.AddEntry(NewEntry(api.NewMessage(0, []byte("payload")), func(ok bool) {
+		results <- ok
+	}))
+	assert.False(t, <-results)
+
+	_, err = cl.GetOrNewTopic("othertopic")
+	assert.Equal(t, ErrClosed, err)
+
+	err = sub.Stream(func(message *api.Message) error { return nil })
+	assert.Equal(t, ErrSubscriberClosed, err)
+}
+
+func TestReplicatedEntriesKeepOffsets(t *testing.T) {
+	ds, err := datastore.NewMemoryDatastore()
+	assert.Nil(t, err)
+	cl, err := NewCommitLog(ds)
+	assert.Nil(t, err)
+	defer cl.Close()
+
+	topic, err := cl.GetOrNewTopic("mytopic")
+	assert.Nil(t, err)
+
+	results := make(chan bool, 1)
+	for _, offset := range []int64{0, 1, 1, 2} {
+		message := api.NewMessage(offset, []byte("payload"))
+		message.Timestamp = 1000 + offset
+		topic.AddEntry(NewReplicatedEntry(message, func(ok bool) {
+			results <- ok
+		}))
+		assert.True(t, <-results)
+	}
+	assert.Equal(t, int64(2), topic.LastCommitted())
+
+	// The duplicate of offset 1 was skipped
+	num, err := ds.NumMessages("mytopic")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), num)
+
+	var timestamps []int64
+	err = datastore.Stream(context.Background(), ds, "mytopic", 0, func(message *api.Message) error {
+		timestamps = append(timestamps, message.Timestamp)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1000, 1001, 1002}, timestamps)
+
+	// New entries continue after the replicated offsets
+	insert(t, topic, 1)
+	assert.Equal(t, int64(3), topic.LastCommitted())
+}
+
+// testDecoder uses the payload of a message as its id
+func testDecoder(payload []byte) (DedupKey, bool) {
+	return DedupKey{Producer: "p1", Sequence: -1, Id: string(payload)}, true
+}
+
+func TestOffsetAt(t *testing.T) {
+	ds, err := datastore.NewMemoryDatastore()
+	assert.Nil(t, err)
+	cl, err := NewCommitLog(ds)
+	assert.Nil(t, err)
+	defer cl.Close()
+
+	// Offsets may have gaps
+	for _, offset := range []int64{0, 1, 2, 5, 6, 9} {
+		message := api.NewMessage(offset, []byte("payload"))
+		message.Timestamp = 100 + offset*10
+		assert.Nil(t, cl.Apply("topic", message))
+	}
+
+	for timestamp, expected := range map[int64]int64{
+		0:   -1,
+		100: -1,
+		101: 0,
+		120: 1,
+		150: 2,
+		151: 5,
+		190: 6,
+		191: 9,
+		500: 9,
+	} {
+		offset, err := cl.OffsetAt("topic", timestamp)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, offset, timestamp)
+	}
+	_, err = cl.OffsetAt("unknown", 0)
+	assert.Equal(t, ErrTopicNotFound, err)
+}
+
+func TestIdempotentEntries(t *testing.T) {
+	ds, err := datastore.NewMemoryDatastore()
+	assert.Nil(t, err)
+	cl, err := NewCommitLog(ds)
+	assert.Nil(t, err)
+	cl.SetDedup(2, testDecoder, "")
+
+	topic, err := cl.GetOrNewTopic("mytopic")
+	assert.Nil(t, err)
+	add := func(key DedupKey, payload string) {
+		done := make(chan bool, 1)
+		topic.AddEntry(NewIdempotentEntry(api.NewMessage(0, []byte(payload)), key, func(ok bool) {
+			done <- ok
+		}))
+		assert.True(t, <-done)
+	}
+
+	add(DedupKey{Producer: "p1", Sequence: -1, Id: "a"}, "a")
+	add(DedupKey{Producer: "p1", Sequence: -1, Id: "a"}, "a")
+	add(DedupKey{Producer: "p1", Sequence: -1, Id: "b"}, "b")
+	add(DedupKey{Producer: "p2", Sequence: 0}, "p2-0")
+	add(DedupKey{Producer: "p2", Sequence: 1}, "p2-1")
+	add(DedupKey{Producer: "p2", Sequence: 0}, "p2-0")
+	add(DedupKey{Producer: "p2", Sequence: 1}, "p2-1")
+	assert.Equal(t, int64(3), topic.LastCommitted())
+
+	// Ids fall out of the window of their producer
+	add(DedupKey{Producer: "p1", Sequence: -1, Id: "c"}, "c")
+	add(DedupKey{Producer: "p1", Sequence: -1, Id: "a"}, "a")
+	assert.Equal(t, int64(5), topic.LastCommitted())
+	cl.Close()
+
+	// The window is rebuilt from the end of the log after a restart
+	cl, err = NewCommitLog(ds)
+	assert.Nil(t, err)
+	cl.SetDedup(2, testDecoder, "")
+	topic, err = cl.GetTopic("mytopic")
+	assert.Nil(t, err)
+	add(DedupKey{Producer: "p1", Sequence: -1, Id: "a"}, "a")
+	add(DedupKey{Producer: "p1", Sequence: -1, Id: "c"}, "c")
+	assert.Equal(t, int64(5), topic.LastCommitted())
+	add(DedupKey{Producer: "p1", Sequence: -1, Id: "b"}, "b")
+	assert.Equal(t, int64(6), topic.LastCommitted())
+	cl.Close()
+}
+
+// sequenceDecoder decodes keys from payloads of the form producer/epoch/sequence
+func sequenceDecoder(payload []byte) (DedupKey, bool) {
+	parts := strings.Split(string(payload), "/")
+	epoch, _ := strconv.ParseInt(parts[1], 10, 64)
+	sequence, _ := strconv.ParseInt(parts[2], 10, 64)
+	return DedupKey{Producer: parts[0], Epoch: epoch, Sequence: sequence}, true
+}
+
+func TestProducerEpochs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dedup")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	ds, err := datastore.NewMemoryDatastore()
+	assert.Nil(t, err)
+	cl, err := NewCommitLog(ds)
+	assert.Nil(t, err)
+	cl.SetDedup(2, sequenceDecoder, dir)
+
+	topic, err := cl.GetOrNewTopic("my/topic")
+	assert.Nil(t, err)
+	add := func(payload string) bool {
+		key, _ := sequenceDecoder([]byte(payload))
+		done := make(chan bool, 1)
+		topic.AddEntry(NewIdempotentEntry(api.NewMessage(0, []byte(payload)), key, func(ok bool) {
+			done <- ok
+		}))
+		return <-done
+	}
+
+	assert.True(t, add("p/0/0"))
+	assert.True(t, add("p/0/1"))
+	assert.True(t, add("p/0/0"))
+	assert.Equal(t, int64(1), topic.LastCommitted())
+
+	// Sequence numbers below the window are rejected rather than dropped
+	assert.True(t, add("p/0/2"))
+	assert.True(t, add("p/0/3"))
+	assert.False(t, add("p/0/0"))
+	assert.Equal(t, int64(3), topic.LastCommitted())
+
+	// A new epoch restarts the sequence and fences off the old one
+	assert.True(t, add("p/1/0"))
+	assert.False(t, add("p/0/4"))
+	assert.Equal(t, int64(4), topic.LastCommitted())
+	cl.Close()
+	_, err = os.Stat(filepath.Join(dir, "my%2Ftopic.json"))
+	assert.Nil(t, err)
+
+	// Entries stored after the state was saved are found in the log
+	assert.Nil(t, ds.InsertMessage("my/topic", api.NewMessage(5, []byte("p/1/1"))))
+	cl, err = NewCommitLog(ds)
+	assert.Nil(t, err)
+	cl.SetDedup(2, sequenceDecoder, dir)
+	topic, err = cl.GetTopic("my/topic")
+	assert.Nil(t, err)
+	assert.True(t, add("p/1/1"))
+	assert.False(t, add("p/0/5"))
+	assert.True(t, add("p/1/2"))
+	assert.Equal(t, int64(6), topic.LastCommitted())
+
+	assert.Nil(t, cl.DeleteTopic("my/topic"))
+	_, err = os.Stat(filepath.Join(dir, "my%2Ftopic.json"))
+	assert.True(t, os.IsNotExist(err))
+	cl.Close()
+}
+
+func TestProducerSequenceGaps(t *testing.T) {
+	ds, err := datastore.NewMemoryDatastore()
+	assert.Nil(t, err)
+	cl, err := NewCommitLog(ds)
+	assert.Nil(t, err)
+	defer cl.Close()
+	cl.SetDedup(2, sequenceDecoder, "")
+
+	topic, err := cl.GetOrNewTopic("topic")
+	assert.Nil(t, err)
+	add := func(payload string, sparse bool) bool {
+		key, _ := sequenceDecoder([]byte(payload))
+		key.Sparse = sparse
+		done := make(chan bool, 1)
+		topic.AddEntry(NewIdempotentEntry(api.NewMessage(0, []byte(payload)), key, func(ok bool) {
+			done <- ok
+		}))
+		return <-done
+	}
+
+	assert.True(t, add("p/0/0", false))
+	assert.True(t, add("p/0/1", false))
+
+	// A message after a lost one is rejected until the lost one is retried
+	assert.False(t, add("p/0/3", false))
+	assert.Equal(t, int64(1), topic.LastCommitted())
+	assert.True(t, add("p/0/2", false))
+	assert.True(t, add("p/0/3", false))
+	assert.True(t, add("p/0/3", false))
+	assert.Equal(t, int64(3), topic.LastCommitted())
+
+	// A new epoch may start anywhere
+	assert.True(t, add("p/1/5", false))
+	assert.False(t, add("p/1/7", false))
+	assert.True(t, add("p/1/6", false))
+	assert.Equal(t, int64(5), topic.LastCommitted())
+
+	// Sparse sequences skip values
+	assert.True(t, add("m/0/0", true))
+	assert.True(t, add("m/0/4", true))
+	assert.True(t, add("m/0/4", true))
+	assert.Equal(t, int64(7), topic.LastCommitted())
+}
+
+func TestTransaction(t *testing.T) {
+	ds, err := datastore.NewMemoryDatastore()
+	assert.Nil(t, err)
+	cl, err := NewCommitLog(ds)
+	assert.Nil(t, err)
+	defer cl.Close()
+
+	topic1, err := cl.GetOrNewTopic("topic1")
+	assert.Nil(t, err)
+
+	txn := cl.NewTransaction()
+	assert.Nil(t, txn.Add("topic1", api.NewMessage(0, []byte("a"))))
+	assert.Nil(t, txn.Add("topic2", api.NewMessage(0, []byte("b"))))
+	assert.Nil(t, txn.Add("topic1", api.NewMessage(0, []byte("c"))))
+
+	// Staged messages are not stored
+	assert.Equal(t, int64(-1), topic1.LastCommitted())
+	_, err = cl.GetTopic("topic2")
+	assert.Equal(t, ErrTopicNotFound, err)
+
+	assert.Nil(t, txn.Commit())
+	assert.Equal(t, int64(1), topic1.LastCommitted())
+	topic2, err := cl.GetTopic("topic2")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), topic2.LastCommitted())
+
+	var payloads []string
+	sub := topic1.NewSubscriber("sub1", "", 0, 0)
+	err = sub.Stream(func(message *api.Message) error {
+		payloads = append(payloads, string(message.Payload))
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "c"}, payloads)
+	assert.Equal(t, ErrTransactionDone, txn.Commit())
+
+	txn = cl.NewTransaction()
+	assert.Nil(t, txn.Add("topic1", api.NewMessage(0, []byte("d"))))
+	txn.Rollback()
+	assert.Equal(t, ErrTransactionDone, txn.Add("topic1", api.NewMessage(0, []byte("e"))))
+	assert.Equal(t, ErrTransactionDone, txn.Commit())
+	assert.Equal(t, int64(1), topic1.LastCommitted())
+}
+
+// failingDatastore fails inserts into a topic after a number of inserts
+type failingDatastore struct {
+	*datastore.MemoryDatastore
+	topic string
+	after int
+}
+
+func (ds *failingDatastore) InsertMessage(topic string, message *api.Message) error {
+	if topic == ds.topic {
+		if ds.after == 0 {
+			return errors.New("insert failed")
+		}
+		ds.after--
+	}
+	return ds.MemoryDatastore.InsertMessage(topic, message)
+}
+
+func TestTransactionInsertFailure(t *testing.T) {
+	memory, err := datastore.NewMemoryDatastore()
+	assert.Nil(t, err)
+	ds := &failingDatastore{MemoryDatastore: memory, topic: "topic2", after: 1}
+	cl, err := NewCommitLog(ds)
+	assert.Nil(t, err)
+	defer cl.Close()
+
+	topic1, err := cl.GetOrNewTopic("topic1")
+	assert.Nil(t, err)
+	topic2, err := cl.GetOrNewTopic("topic2")
+	assert.Nil(t, err)
+	txn := cl.NewTransaction()
+	assert.Nil(t, txn.Add("topic1", api.NewMessage(0, []byte("a"))))
+	assert.Nil(t, txn.Commit())
+
+	// The second message of topic2 fails after topic1 and topic2 were written to
+	txn = cl.NewTransaction()
+	assert.Nil(t, txn.Add("topic1", api.NewMessage(0, []byte("b"))))
+	assert.Nil(t, txn.Add("topic2", api.NewMessage(0, []byte("c"))))
+	assert.Nil(t, txn.Add("topic2", api.NewMessage(0, []byte("d"))))
+	assert.NotNil(t, txn.Commit())
+
+	assert.Equal(t, int64(0), topic1.LastCommitted())
+	assert.Equal(t, int64(-1), topic2.LastCommitted())
+	last, err := memory.LastOffset("topic1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), last)
+	count, err := memory.NumMessages("topic2")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), count)
+
+	// Later messages reuse the offsets of the removed ones
+	txn = cl.NewTransaction()
+	assert.Nil(t, txn.Add("topic1", api.NewMessage(0, []byte("e"))))
+	assert.Nil(t, txn.Commit())
+	var payloads []string
+	sub := topic1.NewSubscriber("sub1", "", 0, 0)
+	err = sub.Stream(func(message *api.Message) error {
+		payloads = append(payloads, string(message.Payload))
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "e"}, payloads)
+}
+
+func TestIdempotentTransaction(t *testing.T) {
+	ds, err := datastore.NewMemoryDatastore()
+	assert.Nil(t, err)
+	cl, err := NewCommitLog(ds)
+	assert.Nil(t, err)
+	defer cl.Close()
+	cl.SetDedup(2, sequenceDecoder, "")
+
+	stage := func(txn *Transaction, payload string) {
+		key, _ := sequenceDecoder([]byte(payload))
+		assert.Nil(t, txn.AddIdempotent("topic", api.NewMessage(0, []byte(payload)), key))
+	}
+
+	// Duplicates within the transaction are skipped
+	txn := cl.NewTransaction()
+	stage(txn, "p/0/0")
+	stage(txn, "p/0/1")
+	stage(txn, "p/0/1")
+	assert.Nil(t, txn.Commit())
+	topic, err := cl.GetTopic("topic")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), topic.LastCommitted())
+
+	// Messages already stored are skipped
+	txn = cl.NewTransaction()
+	stage(txn, "p/0/1")
+	stage(txn, "p/0/2")
+	assert.Nil(t, txn.Commit())
+	assert.Equal(t, int64(2), topic.LastCommitted())
+
+	// A regression fails the whole transaction and leaves the window intact
+	txn = cl.NewTransaction()
+	stage(txn, "p/0/3")
+	stage(txn, "p/0/0")
+	assert.NotNil(t, txn.Commit())
+	assert.Equal(t, int64(2), topic.LastCommitted())
+
+	txn = cl.NewTransaction()
+	stage(txn, "p/0/3")
+	assert.Nil(t, txn.Commit())
+	assert.Equal(t, int64(3), topic.LastCommitted())
+}
@@ -0,0 +1,303 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package commitlog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/lulf/slim/pkg/api"
+	"github.com/lulf/slim/pkg/datastore"
+)
+
+// Maximum number of producers tracked per topic. The least recently seen
+// producer is forgotten when a new producer exceeds it.
+const maxDedupProducers = 10000
+
+// DedupKey identifies a message sent by an idempotent producer
+type DedupKey struct {
+	// Id of the producer. Empty for messages only identified by Id.
+	Producer string
+	// Epoch of the producer, increased when it restarts its sequence
+	Epoch int64
+	// Sequence number assigned by the producer, or -1 if the message is
+	// identified by Id. Sequence numbers of a producer must increase by one
+	// within an epoch, unless Sparse is set.
+	Sequence int64
+	Id       string
+	// Sparse allows sequence numbers to skip values, as the offsets of a
+	// mirrored topic do
+	Sparse bool
+}
+
+// DedupDecoder returns the deduplication key of a stored message, if any.
+// It is used to rebuild the deduplication window from the log.
+type DedupDecoder func(payload []byte) (DedupKey, bool)
+
+// dedupWindow remembers the keys of the latest messages of each producer
+type dedupWindow struct {
+	size      int
+	producers map[string]*producerWindow
+	clock     uint64
+}
+
+type producerWindow struct {
+	ids          map[string]bool
+	ring         []string
+	next         int
+	epoch        int64
+	lastSequence int64
+	used         uint64
+}
+
+// dedupState is the deduplication window of a topic up to an offset, saved
+// so that it is not rebuilt from the whole log after a restart
+type dedupState struct {
+	Offset    int64                    `json:"offset"`
+	Producers map[string]producerState `json:"producers"`
+}
+
+type producerState struct {
+	Epoch    int64 `json:"epoch"`
+	Sequence int64 `json:"sequence"`
+	// Message ids of the producer, oldest first
+	Ids []string `json:"ids,omitempty"`
+}
+
+func newDedupWindow(size int) *dedupWindow {
+	return &dedupWindow{
+		size:      size,
+		producers: make(map[string]*producerWindow),
+	}
+}
+
+// check returns true if a message with the key was already stored, or an
+// error if the producer has since moved to a newer epoch, the sequence
+// number is too old to tell whether it was stored, or messages before it are
+// missing.
+func (w *dedupWindow) check(key DedupKey) (bool, error) {
+	p, ok := w.producers[key.Producer]
+	if !ok {
+		return false, nil
+	}
+	if key.Sequence < 0 {
+		return p.ids[key.Id], nil
+	}
+	if key.Epoch < p.epoch {
+		return false, fmt.Errorf("Producer %s epoch %d is older than epoch %d", key.Producer, key.Epoch, p.epoch)
+	}
+	if key.Epoch > p.epoch {
+		return false, nil
+	}
+	if key.Sequence > p.lastSequence {
+		if key.Sparse || p.lastSequence < 0 || key.Sequence == p.lastSequence+1 {
+			return false, nil
+		}
+		return false, fmt.Errorf("Producer %s sequence %d is out of order, expected %d", key.Producer, key.Sequence, p.lastSequence+1)
+	}
+	if key.Sequence > p.lastSequence-int64(w.size) {
+		return true, nil
+	}
+	return false, fmt.Errorf("Producer %s sequence %d regressed from %d", key.Producer, key.Sequence, p.lastSequence)
+}
+
+func (w *dedupWindow) record(key DedupKey) {
+	p, ok := w.producers[key.Producer]
+	if !ok {
+		if len(w.producers) >= maxDedupProducers {
+			w.evict()
+		}
+		p = &producerWindow{
+			ids:          make(map[string]bool),
+			epoch:        key.Epoch,
+			lastSequence: -1,
+		}
+		w.producers[key.Producer] = p
+	}
+	w.clock++
+	p.used = w.clock
+
+	if key.Sequence >= 0 {
+		if key.Epoch > p.epoch {
+			p.epoch = key.Epoch
+			p.lastSequence = key.Sequence
+		} else if key.Epoch == p.epoch && key.Sequence > p.lastSequence {
+			p.lastSequence = key.Sequence
+		}
+		return
+	}
+	if p.ids[key.Id] {
+		return
+	}
+	if len(p.ring) < w.size {
+		p.ring = append(p.ring, key.Id)
+	} else {
+		delete(p.ids, p.ring[p.next])
+		p.ring[p.next] = key.Id
+		p.next = (p.next + 1) % w.size
+	}
+	p.ids[key.Id] = true
+}
+
+// evict forgets the least recently seen producer
+func (w *dedupWindow) evict() {
+	var oldest string
+	var oldestUsed uint64
+	first := true
+	for producer, p := range w.producers {
+		if first || p.used < oldestUsed {
+			oldest = producer
+			oldestUsed = p.used
+			first = false
+		}
+	}
+	delete(w.producers, oldest)
+}
+
+func (w *dedupWindow) state(offset int64) *dedupState {
+	state := &dedupState{
+		Offset:    offset,
+		Producers: make(map[string]producerState, len(w.producers)),
+	}
+	for producer, p := range w.producers {
+		ids := make([]string, 0, len(p.ring))
+		ids = append(ids, p.ring[p.next:]...)
+		ids = append(ids, p.ring[:p.next]...)
+		state.Producers[producer] = producerState{
+			Epoch:    p.epoch,
+			Sequence: p.lastSequence,
+			Ids:      ids,
+		}
+	}
+	return state
+}
+
+func (w *dedupWindow) restore(state *dedupState) {
+	for producer, saved := range state.Producers {
+		w.producers[producer] = &producerWindow{
+			ids:          make(map[string]bool),
+			epoch:        saved.Epoch,
+			lastSequence: saved.Sequence,
+		}
+		for _, id := range saved.Ids {
+			w.record(DedupKey{Producer: producer, Sequence: -1, Id: id})
+		}
+	}
+}
+
+// checkDuplicate returns true if the entry was already stored by its
+// producer, or an error if the entry must be rejected
+func (topic *Topic) checkDuplicate(e *Entry) (bool, error) {
+	if e.key == nil {
+		return false, nil
+	}
+	topic.storeLock.Lock()
+	defer topic.storeLock.Unlock()
+	topic.loadDedup()
+	if topic.dedup == nil {
+		return false, nil
+	}
+	return topic.dedup.check(*e.key)
+}
+
+// recordKey adds the key of a stored entry to the window. Replicated entries
+// carry no key, so it is decoded from the message. Must be called with
+// storeLock held.
+func (topic *Topic) recordKey(e *Entry) {
+	if topic.dedup == nil {
+		// The window is rebuilt from the log when first needed
+		return
+	}
+	if e.key != nil {
+		topic.dedup.record(*e.key)
+	} else if key, ok := topic.dedupDecoder(e.message.Payload); ok {
+		topic.dedup.record(key)
+	}
+}
+
+// dedupFile returns the file the window of the topic is saved to, or an
+// empty string if it is not saved
+func (topic *Topic) dedupFile() string {
+	if topic.dedupDir == "" {
+		return ""
+	}
+	return filepath.Join(topic.dedupDir, url.PathEscape(topic.name)+".json")
+}
+
+// loadDedup rebuilds the window from the saved state and the entries stored
+// after it, or from the whole topic if no state was saved. Must be called
+// with storeLock held.
+func (topic *Topic) loadDedup() {
+	if topic.dedup != nil || topic.dedupSize <= 0 || topic.dedupDecoder == nil {
+		return
+	}
+	window := newDedupWindow(topic.dedupSize)
+	from := int64(0)
+	state, err := readDedupState(topic.dedupFile())
+	if err != nil {
+		log.Print("Reading deduplication state:", err)
+	} else if state != nil && state.Offset <= topic.LastCommitted() {
+		// State saved past the end of the topic refers to entries that were lost
+		window.restore(state)
+		from = state.Offset + 1
+	}
+	err = datastore.Stream(context.Background(), topic.ds, topic.name, from, func(message *api.Message) error {
+		if key, ok := topic.dedupDecoder(message.Payload); ok {
+			window.record(key)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Print("Rebuilding deduplication window:", err)
+	}
+	topic.dedup = window
+}
+
+// saveDedup writes the window of the topic to its state file. The entries
+// must have been flushed to the datastore.
+func (topic *Topic) saveDedup() error {
+	topic.storeLock.Lock()
+	if topic.dedup == nil || topic.dedupFile() == "" {
+		topic.storeLock.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(topic.dedup.state(topic.LastCommitted()))
+	topic.storeLock.Unlock()
+	if err != nil {
+		return err
+	}
+	path := topic.dedupFile()
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readDedupState(path string) (*dedupState, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	state := &dedupState{}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package commitlog
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// SetGroupDir saves the committed offsets of the consumer groups of each
+// topic to a file in dir when the commit log is flushed or closed, and
+// restores them from there. It must be set before any subscribers are
+// created.
+func (cl *CommitLog) SetGroupDir(dir string) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	cl.groupDir = dir
+	for _, topic := range cl.topicMap {
+		topic.groupDir = dir
+		topic.loadGroups()
+	}
+}
+
+// groupFile returns the file the group offsets of the topic are saved to,
+// or an empty string if they are not saved
+func (topic *Topic) groupFile() string {
+	if topic.groupDir == "" {
+		return ""
+	}
+	return filepath.Join(topic.groupDir, url.PathEscape(topic.name)+".json")
+}
+
+// loadGroups restores the saved group offsets of the topic
+func (topic *Topic) loadGroups() {
+	path := topic.groupFile()
+	if path == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Print("Reading group offsets:", err)
+		return
+	}
+	groups := make(map[string]int64)
+	err = json.Unmarshal(data, &groups)
+	if err != nil {
+		log.Print("Reading group offsets:", err)
+		return
+	}
+
+	lastCommitted := topic.LastCommitted()
+	topic.subLock.Lock()
+	defer topic.subLock.Unlock()
+	for group, committed := range groups {
+		// Offsets saved past the end of the topic refer to entries that were lost
+		if committed > lastCommitted {
+			committed = lastCommitted
+		}
+		topic.groups[group] = committed
+	}
+}
+
+// saveGroups writes the group offsets of the topic to its group file
+func (topic *Topic) saveGroups() error {
+	path := topic.groupFile()
+	if path == "" {
+		return nil
+	}
+	topic.subLock.Lock()
+	data, err := json.Marshal(topic.groups)
+	topic.subLock.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package commitlog
+
+import (
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+type SubscriberStats struct {
+	Id     string `json:"id"`
+	Group  string `json:"group,omitempty"`
+	Offset int64  `json:"offset"`
+	Lag    int64  `json:"lag"`
+}
+
+type GroupStats struct {
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+	Lag    int64  `json:"lag"`
+}
+
+type TopicStats struct {
+	Name          string            `json:"name"`
+	LastCommitted int64             `json:"lastCommitted"`
+	QueueDepth    int               `json:"queueDepth"`
+	Subscribers   []SubscriberStats `json:"subscribers"`
+	Groups        []GroupStats      `json:"groups"`
+}
+
+func lag(lastCommitted int64, delivered int64) int64 {
+	if delivered >= lastCommitted {
+		return 0
+	}
+	return lastCommitted - delivered
+}
+
+func (cl *CommitLog) Stats() []TopicStats {
+	cl.lock.Lock()
+	topics := make([]*Topic, 0, len(cl.topicMap))
+	for _, topic := range cl.topicMap {
+		topics = append(topics, topic)
+	}
+	cl.lock.Unlock()
+
+	stats := make([]TopicStats, 0, len(topics))
+	for _, topic := range topics {
+		stats = append(stats, topic.Stats())
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
+
+func (topic *Topic) Stats() TopicStats {
+	lastCommitted := atomic.LoadInt64(&topic.lastCommitted)
+	stats := TopicStats{
+		Name:          topic.name,
+		LastCommitted: lastCommitted,
+		QueueDepth:    len(topic.incoming),
+		Subscribers:   make([]SubscriberStats, 0),
+		Groups:        make([]GroupStats, 0),
+	}
+
+	topic.subLock.Lock()
+	for _, sub := range topic.subs {
+		offset := sub.Offset()
+		stats.Subscribers = append(stats.Subscribers, SubscriberStats{
+			Id:     sub.id,
+			Group:  sub.group,
+			Offset: offset,
+			Lag:    lag(lastCommitted, offset-1),
+		})
+	}
+	for group, committed := range topic.groups {
+		stats.Groups = append(stats.Groups, GroupStats{
+			Name:   group,
+			Offset: committed,
+			Lag:    lag(lastCommitted, committed),
+		})
+	}
+	topic.subLock.Unlock()
+
+	sort.Slice(stats.Subscribers, func(i, j int) bool { return stats.Subscribers[i].Id < stats.Subscribers[j].Id })
+	sort.Slice(stats.Groups, func(i, j int) bool { return stats.Groups[i].Name < stats.Groups[j].Name })
+	return stats
+}
+
+func LagMonitor(checkInterval time.Duration, threshold int64, cl *CommitLog) {
+	for {
+		time.Sleep(checkInterval * time.Second)
+		for _, topic := range cl.Stats() {
+			for _, sub := range topic.Subscribers {
+				if sub.Lag > threshold {
+					log.Printf("Subscriber %s on topic %s is lagging behind by %d entries (offset %d, last committed %d)", sub.Id, topic.Name, sub.Lag, sub.Offset, topic.LastCommitted)
+				}
+			}
+		}
+	}
+}
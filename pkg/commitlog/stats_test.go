@@ -0,0 +1,109 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package commitlog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lulf/slim/pkg/api"
+	"github.com/lulf/slim/pkg/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func insert(t *testing.T, topic *Topic, n int) {
+	done := make(chan bool)
+	for i := 0; i < n; i++ {
+		topic.AddEntry(NewEntry(api.NewMessage(0, []byte("payload")), func(ok bool) {
+			done <- ok
+		}))
+		assert.True(t, <-done)
+	}
+}
+
+func TestSubscriberLag(t *testing.T) {
+	ds, err := datastore.NewMemoryDatastore()
+	assert.Nil(t, err)
+	cl, err := NewCommitLog(ds)
+	assert.Nil(t, err)
+
+	topic, err := cl.GetOrNewTopic("mytopic")
+	assert.Nil(t, err)
+	insert(t, topic, 5)
+
+	sub := topic.NewSubscriber("sub1", "", 0, 0)
+	assert.Equal(t, int64(5), sub.Lag())
+
+	sub.Commit(2)
+	assert.Equal(t, int64(2), sub.Lag())
+
+	stats := cl.Stats()
+	assert.Equal(t, 1, len(stats))
+	assert.Equal(t, int64(4), stats[0].LastCommitted)
+	assert.Equal(t, 1, len(stats[0].Subscribers))
+	assert.Equal(t, int64(2), stats[0].Subscribers[0].Lag)
+}
+
+func TestGroupLag(t *testing.T) {
+	ds, err := datastore.NewMemoryDatastore()
+	assert.Nil(t, err)
+	cl, err := NewCommitLog(ds)
+	assert.Nil(t, err)
+
+	topic, err := cl.GetOrNewTopic("mytopic")
+	assert.Nil(t, err)
+	insert(t, topic, 5)
+
+	sub := topic.NewSubscriber("sub1", "group1", 0, 0)
+	sub.Commit(1)
+	sub.Close()
+
+	stats := topic.Stats()
+	assert.Equal(t, 0, len(stats.Subscribers))
+	assert.Equal(t, 1, len(stats.Groups))
+	assert.Equal(t, int64(3), stats.Groups[0].Lag)
+
+	// New group members resume after the last committed offset
+	sub = topic.NewSubscriber("sub2", "group1", -1, 0)
+	assert.Equal(t, int64(2), sub.Offset())
+}
+
+func TestGroupOffsetsSaved(t *testing.T) {
+	dir, err := ioutil.TempDir("", "groups")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	ds, err := datastore.NewMemoryDatastore()
+	assert.Nil(t, err)
+	cl, err := NewCommitLog(ds)
+	assert.Nil(t, err)
+	cl.SetGroupDir(dir)
+
+	topic, err := cl.GetOrNewTopic("my/topic")
+	assert.Nil(t, err)
+	insert(t, topic, 5)
+	sub := topic.NewSubscriber("sub1", "group1", 0, 0)
+	sub.Commit(2)
+	sub.Close()
+	cl.Close()
+	_, err = os.Stat(filepath.Join(dir, "my%2Ftopic.json"))
+	assert.Nil(t, err)
+
+	// The group resumes after a restart
+	cl, err = NewCommitLog(ds)
+	assert.Nil(t, err)
+	cl.SetGroupDir(dir)
+	topic, err = cl.GetTopic("my/topic")
+	assert.Nil(t, err)
+	sub = topic.NewSubscriber("sub2", "group1", -1, 0)
+	assert.Equal(t, int64(3), sub.Offset())
+	sub.Close()
+
+	assert.Nil(t, cl.DeleteTopic("my/topic"))
+	_, err = os.Stat(filepath.Join(dir, "my%2Ftopic.json"))
+	assert.True(t, os.IsNotExist(err))
+	cl.Close()
+}
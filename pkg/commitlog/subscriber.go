@@ -6,10 +6,18 @@
 package commitlog
 
 import (
+	"errors"
 	"github.com/lulf/slim/pkg/api"
+	"github.com/lulf/slim/pkg/datastore"
 	"sync/atomic"
 )
 
+var ErrSubscriberClosed = errors.New("subscriber closed")
+
+var errRepositioned = errors.New("subscriber repositioned")
+
+var errUncommitted = errors.New("entry not committed")
+
 type StreamFn = func(message *api.Message) error
 
 func (s *Subscriber) Stream(callback StreamFn) error {
@@ -17,23 +25,89 @@ func (s *Subscriber) Stream(callback StreamFn) error {
 	var lastCommitted int64
 	s.lock.Lock()
 	for {
+		if atomic.LoadInt32(&s.closed) != 0 {
+			s.lock.Unlock()
+			return ErrSubscriberClosed
+		}
 		lastCommitted = atomic.LoadInt64(&topic.lastCommitted)
-		if lastCommitted == s.offset-1 {
+		if lastCommitted == s.Offset()-1 {
 			s.cond.Wait()
 		} else {
 			break
 		}
 	}
 	s.lock.Unlock()
-	return topic.ds.StreamMessages(topic.name, s.offset, callback)
+	atomic.StoreInt32(&s.repositioned, 0)
+	err := datastore.Stream(s.ctx, topic.ds, topic.name, s.Offset(), func(message *api.Message) error {
+		if atomic.LoadInt32(&s.closed) != 0 {
+			return ErrSubscriberClosed
+		}
+		if atomic.LoadInt32(&s.repositioned) != 0 {
+			return errRepositioned
+		}
+		// Entries of a transaction being committed are stored before they are visible
+		if message.Offset > atomic.LoadInt64(&topic.lastCommitted) {
+			return errUncommitted
+		}
+		return callback(message)
+	})
+	if err == errRepositioned || err == errUncommitted {
+		return nil
+	} else if err != nil && atomic.LoadInt32(&s.closed) != 0 {
+		return ErrSubscriberClosed
+	}
+	return err
 }
 
 func (s *Subscriber) Commit(offset int64) {
-	s.offset = offset + 1
+	s.lock.Lock()
+	if atomic.LoadInt32(&s.repositioned) != 0 {
+		s.lock.Unlock()
+		return
+	}
+	atomic.StoreInt64(&s.offset, offset+1)
+	s.lock.Unlock()
+	if s.group != "" {
+		s.topic.subLock.Lock()
+		if committed, ok := s.topic.groups[s.group]; !ok || offset > committed {
+			s.topic.groups[s.group] = offset
+		}
+		s.topic.subLock.Unlock()
+	}
+}
+
+// reposition moves the subscriber to the given offset, interrupting an
+// ongoing stream. Called with the topic subscriber lock held.
+func (s *Subscriber) reposition(offset int64) {
+	s.lock.Lock()
+	atomic.StoreInt32(&s.repositioned, 1)
+	atomic.StoreInt64(&s.offset, offset)
+	s.cond.Broadcast()
+	s.lock.Unlock()
+}
+
+// Offset returns the next offset to be delivered to the subscriber
+func (s *Subscriber) Offset() int64 {
+	return atomic.LoadInt64(&s.offset)
+}
+
+// Lag returns the number of committed entries not yet delivered to the subscriber
+func (s *Subscriber) Lag() int64 {
+	return lag(atomic.LoadInt64(&s.topic.lastCommitted), s.Offset()-1)
 }
 
 func (s *Subscriber) Close() {
 	s.topic.subLock.Lock()
 	delete(s.topic.subs, s.id)
 	s.topic.subLock.Unlock()
+	s.stop()
+}
+
+// stop marks the subscriber as closed and wakes it up if it is waiting for entries
+func (s *Subscriber) stop() {
+	atomic.StoreInt32(&s.closed, 1)
+	s.cancel()
+	s.lock.Lock()
+	s.cond.Broadcast()
+	s.lock.Unlock()
 }
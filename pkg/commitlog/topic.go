@@ -6,52 +6,165 @@
 package commitlog
 
 import (
+	"context"
 	"log"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 func (topic *Topic) AddEntry(entry *Entry) {
+	topic.closeLock.RLock()
+	defer topic.closeLock.RUnlock()
+	if topic.closed {
+		entry.listener(false)
+		return
+	}
 	topic.incoming <- entry
 }
 
+func (topic *Topic) close() {
+	topic.closeLock.Lock()
+	if !topic.closed {
+		topic.closed = true
+		close(topic.incoming)
+	}
+	topic.closeLock.Unlock()
+
+	<-topic.stopped
+
+	topic.subLock.Lock()
+	subs := make([]*Subscriber, 0, len(topic.subs))
+	for _, sub := range topic.subs {
+		subs = append(subs, sub)
+	}
+	topic.subLock.Unlock()
+	for _, sub := range subs {
+		sub.stop()
+	}
+}
+
 func (topic *Topic) run() {
-	for {
-		e := <-topic.incoming
-		m := e.message
-		m.Offset = atomic.AddInt64(&topic.offsetCounter, 1)
-		err := topic.ds.InsertMessage(topic.name, m)
+	defer close(topic.stopped)
+	for e := range topic.incoming {
+		duplicate, err := topic.checkDuplicate(e)
 		if err != nil {
-			log.Print("Inserting event:", err)
+			log.Print("Rejecting entry:", err)
 			e.listener(false)
 			continue
 		}
-		atomic.StoreInt64(&topic.lastCommitted, m.Offset)
-		e.listener(true)
-		for _, sub := range topic.subs {
-			sub.cond.Signal()
+		if duplicate {
+			// The offset the message was first stored at is not known
+			e.message.Offset = -1
+			e.listener(true)
+			continue
+		}
+		if topic.replicator != nil && !e.replicated {
+			m := e.message
+			m.Timestamp = time.Now().UTC().Unix()
+			err := topic.replicator.Replicate(topic.name, m)
+			if err != nil {
+				log.Print("Replicating event:", err)
+			}
+			e.listener(err == nil)
+			continue
 		}
+		topic.store(e)
 	}
 }
 
-func (topic *Topic) NewSubscriber(id string, offset int64, since int64) *Subscriber {
+// store assigns the next offset to an entry, unless it is replicated, and
+// inserts it into the datastore.
+func (topic *Topic) store(e *Entry) {
+	topic.storeLock.Lock()
+	defer topic.storeLock.Unlock()
+
+	m := e.message
+	if e.replicated {
+		if m.Offset <= atomic.LoadInt64(&topic.offsetCounter) {
+			e.listener(true)
+			return
+		}
+		atomic.StoreInt64(&topic.offsetCounter, m.Offset)
+	} else {
+		m.Offset = atomic.AddInt64(&topic.offsetCounter, 1)
+		m.Timestamp = time.Now().UTC().Unix()
+	}
+	err := topic.ds.InsertMessage(topic.name, m)
+	if err != nil {
+		log.Print("Inserting event:", err)
+		e.listener(false)
+		return
+	}
+	atomic.StoreInt64(&topic.lastCommitted, m.Offset)
+	topic.recordKey(e)
+	e.listener(true)
+	topic.notify()
+}
+
+// notify wakes up subscribers waiting for new entries
+func (topic *Topic) notify() {
+	topic.subLock.Lock()
+	for _, sub := range topic.subs {
+		sub.lock.Lock()
+		sub.cond.Signal()
+		sub.lock.Unlock()
+	}
+	topic.subLock.Unlock()
+}
+
+func (topic *Topic) NewSubscriber(id string, group string, offset int64, since int64) *Subscriber {
 	lock := &sync.Mutex{}
 	cond := sync.NewCond(lock)
 	lastCommitted := atomic.LoadInt64(&topic.lastCommitted)
-	if offset < 0 || offset > lastCommitted {
+
+	topic.subLock.Lock()
+	defer topic.subLock.Unlock()
+
+	// A group member without an explicit offset resumes where the group left off
+	committed, hasGroupOffset := topic.groups[group]
+	if group != "" && offset < 0 && hasGroupOffset {
+		offset = committed + 1
+	} else if offset < 0 || offset > lastCommitted {
 		offset = lastCommitted
 	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 	sub := &Subscriber{
 		id:     id,
+		group:  group,
 		topic:  topic,
 		lock:   lock,
 		cond:   cond,
 		offset: offset,
 		since:  since,
+		ctx:    ctx,
+		cancel: cancel,
 	}
-
-	topic.subLock.Lock()
 	topic.subs[sub.id] = sub
-	topic.subLock.Unlock()
+	if group != "" && !hasGroupOffset {
+		topic.groups[group] = offset - 1
+	}
 	return sub
 }
+
+// ResetGroup moves the committed offset of a consumer group, repositioning
+// any active members of the group to continue after the new offset.
+func (topic *Topic) ResetGroup(group string, offset int64) {
+	topic.subLock.Lock()
+	defer topic.subLock.Unlock()
+	topic.groups[group] = offset
+	for _, sub := range topic.subs {
+		if sub.group == group {
+			sub.reposition(offset + 1)
+		}
+	}
+}
+
+func (topic *Topic) Name() string {
+	return topic.name
+}
+
+func (topic *Topic) LastCommitted() int64 {
+	return atomic.LoadInt64(&topic.lastCommitted)
+}
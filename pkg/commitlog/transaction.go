@@ -0,0 +1,184 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package commitlog
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lulf/slim/pkg/api"
+)
+
+var ErrTransactionDone = errors.New("transaction already discharged")
+var ErrTransactionsNotSupported = errors.New("transactions are not supported with a replicator")
+
+// Transaction stages messages for one or more topics. The messages are
+// stored and made visible to subscribers together when it is committed.
+type Transaction struct {
+	cl      *CommitLog
+	lock    *sync.Mutex
+	entries map[string][]*Entry
+	done    bool
+}
+
+func (cl *CommitLog) NewTransaction() *Transaction {
+	return &Transaction{
+		cl:      cl,
+		lock:    &sync.Mutex{},
+		entries: make(map[string][]*Entry),
+	}
+}
+
+// Add stages a message for a topic
+func (t *Transaction) Add(topicName string, message *api.Message) error {
+	return t.add(topicName, &Entry{message: message})
+}
+
+// AddIdempotent stages a message of an idempotent producer. It is skipped
+// on commit if the producer already stored it.
+func (t *Transaction) AddIdempotent(topicName string, message *api.Message, key DedupKey) error {
+	return t.add(topicName, &Entry{message: message, key: &key})
+}
+
+func (t *Transaction) add(topicName string, e *Entry) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.done {
+		return ErrTransactionDone
+	}
+	t.entries[topicName] = append(t.entries[topicName], e)
+	return nil
+}
+
+// Rollback discards the staged messages
+func (t *Transaction) Rollback() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.done = true
+	t.entries = nil
+}
+
+// Commit stores the staged messages, creating topics as needed. The last
+// committed offset of each topic only advances once all messages are
+// stored, so subscribers see either all or none of them. If the datastore
+// fails part way, the messages already stored are removed and an error is
+// returned. Messages of idempotent
+// producers that were already stored are skipped, and the whole transaction
+// fails if one of them is rejected.
+func (t *Transaction) Commit() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.done {
+		return ErrTransactionDone
+	}
+	t.done = true
+
+	t.cl.lock.Lock()
+	replicated := t.cl.replicator != nil
+	t.cl.lock.Unlock()
+	if replicated {
+		return ErrTransactionsNotSupported
+	}
+
+	// Locking topics in name order avoids deadlocks between transactions
+	names := make([]string, 0, len(t.entries))
+	for name := range t.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	topics := make([]*Topic, 0, len(names))
+	for _, name := range names {
+		topic, err := t.cl.GetOrNewTopic(name)
+		if err != nil {
+			return err
+		}
+		topics = append(topics, topic)
+	}
+
+	for _, topic := range topics {
+		topic.storeLock.Lock()
+		topic.loadDedup()
+	}
+
+	// Keys are recorded as they are checked to find duplicates within the
+	// transaction. If the commit fails, the windows are rebuilt from the log.
+	var err error
+	staged := make([][]*Entry, len(topics))
+	for i, topic := range topics {
+		for _, e := range t.entries[names[i]] {
+			duplicate := false
+			if e.key != nil && topic.dedup != nil {
+				duplicate, err = topic.dedup.check(*e.key)
+				if err != nil {
+					break
+				}
+				if !duplicate {
+					topic.dedup.record(*e.key)
+				}
+			}
+			if !duplicate {
+				staged[i] = append(staged[i], e)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	committed := make([]int64, len(topics))
+	for i, topic := range topics {
+		committed[i] = atomic.LoadInt64(&topic.offsetCounter)
+	}
+	for i := 0; err == nil && i < len(topics); i++ {
+		topic := topics[i]
+		for _, e := range staged[i] {
+			m := e.message
+			m.Offset = atomic.LoadInt64(&topic.offsetCounter) + 1
+			m.Timestamp = time.Now().UTC().Unix()
+			err = topic.ds.InsertMessage(topic.name, m)
+			if err != nil {
+				log.Print("Inserting event:", err)
+				break
+			}
+			atomic.StoreInt64(&topic.offsetCounter, m.Offset)
+		}
+	}
+	if err != nil {
+		t.rollback(topics, committed)
+	}
+	for _, topic := range topics {
+		atomic.StoreInt64(&topic.lastCommitted, atomic.LoadInt64(&topic.offsetCounter))
+		topic.storeLock.Unlock()
+		topic.notify()
+	}
+	t.entries = nil
+	return err
+}
+
+// rollback removes the messages a failed commit stored after the committed
+// offset of each topic, and rebuilds the deduplication windows from the log.
+// Called with the store locks held. If a topic can not be truncated, its
+// offsets stay reserved so that they are not stored twice, and the messages
+// already stored become visible.
+func (t *Transaction) rollback(topics []*Topic, committed []int64) {
+	for i, topic := range topics {
+		topic.dedup = nil
+		if atomic.LoadInt64(&topic.offsetCounter) == committed[i] {
+			continue
+		}
+		err := topic.ds.Truncate(topic.name, committed[i])
+		if err != nil {
+			log.Print("Truncating topic:", err)
+			continue
+		}
+		atomic.StoreInt64(&topic.offsetCounter, committed[i])
+	}
+}
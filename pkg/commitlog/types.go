@@ -5,6 +5,7 @@
 package commitlog
 
 import (
+	"context"
 	"github.com/lulf/slim/pkg/api"
 	"github.com/lulf/slim/pkg/datastore"
 	"sync"
@@ -12,17 +13,36 @@ import (
 
 type Subscriber struct {
 	id     string
+	group  string
 	lock   *sync.Mutex
 	cond   *sync.Cond
 	offset int64
 	since  int64
-	topic  *Topic
+	closed int32
+	// Set when the offset is moved while streaming
+	repositioned int32
+	topic        *Topic
+	// Cancelled when the subscriber is closed to stop reading the datastore
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Replicator agrees on entries with other nodes before they are stored. It
+// stores agreed entries on every node, including this one, through Apply.
+type Replicator interface {
+	Replicate(topic string, message *api.Message) error
 }
 
 type CommitLog struct {
-	ds       datastore.Datastore
-	topicMap map[string]*Topic
-	lock     *sync.Mutex
+	ds         datastore.Datastore
+	topicMap   map[string]*Topic
+	lock       *sync.Mutex
+	closed     bool
+	replicator Replicator
+	dedupSize  int
+	decoder    DedupDecoder
+	dedupDir   string
+	groupDir   string
 }
 
 type Topic struct {
@@ -32,14 +52,27 @@ type Topic struct {
 	offsetCounter int64
 	incoming      chan *Entry
 	subs          map[string]*Subscriber
+	groups        map[string]int64
 	subLock       *sync.Mutex
+	closeLock     *sync.RWMutex
+	closed        bool
+	stopped       chan struct{}
+	replicator    Replicator
+	storeLock     *sync.Mutex
+	dedupSize     int
+	dedupDecoder  DedupDecoder
+	dedupDir      string
+	dedup         *dedupWindow
+	groupDir      string
 }
 
 type CommitListener func(bool)
 
 type Entry struct {
-	message  *api.Message
-	listener CommitListener
+	message    *api.Message
+	listener   CommitListener
+	replicated bool
+	key        *DedupKey
 }
 
 func NewEntry(message *api.Message, listener CommitListener) *Entry {
@@ -48,3 +81,24 @@ func NewEntry(message *api.Message, listener CommitListener) *Entry {
 		listener: listener,
 	}
 }
+
+// NewReplicatedEntry creates an entry that keeps the offset and timestamp of
+// the message, as received from a leader. Entries at or before the last
+// offset of the topic are skipped.
+func NewReplicatedEntry(message *api.Message, listener CommitListener) *Entry {
+	return &Entry{
+		message:    message,
+		listener:   listener,
+		replicated: true,
+	}
+}
+
+// NewIdempotentEntry creates an entry that is accepted without being stored
+// again if its producer already stored a message with the same key.
+func NewIdempotentEntry(message *api.Message, key DedupKey, listener CommitListener) *Entry {
+	return &Entry{
+		message:  message,
+		listener: listener,
+		key:      &key,
+	}
+}
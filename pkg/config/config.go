@@ -0,0 +1,211 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+)
+
+type Config struct {
+	DataDir       string               `toml:"data_dir"`
+	DatastoreType string               `toml:"datastore"`
+	Listeners     []string             `toml:"listeners"`
+	GcInterval    int64                `toml:"gc_interval"`
+	FlushInterval int64                `toml:"flush_interval"`
+	LagThreshold  int64                `toml:"lag_threshold"`
+	LogLevel      string               `toml:"log_level"`
+	DebugListener string               `toml:"debug_listener"`
+	Retention     Retention            `toml:"retention"`
+	Auth          Auth                 `toml:"auth"`
+	Acl           map[string]AclRule   `toml:"acl"`
+	Topics        map[string]Retention `toml:"-"`
+	Follow        Follow               `toml:"follow"`
+	Cluster       Cluster              `toml:"cluster"`
+	Mirrors       map[string]Mirror    `toml:"mirrors"`
+	Dedup         Dedup                `toml:"dedup"`
+	Memory        Memory               `toml:"memory"`
+}
+
+// Retention limits in seconds, bytes and messages. Negative values mean unlimited.
+type Retention struct {
+	MaxLogAge   int64 `toml:"max_log_age"`
+	MaxLogSize  int64 `toml:"max_log_size"`
+	MaxMessages int64 `toml:"max_messages"`
+}
+
+type Auth struct {
+	// Space separated list of allowed SASL mechanisms. Empty allows the defaults.
+	Mechanisms     string `toml:"mechanisms"`
+	AllowInsecure  bool   `toml:"allow_insecure"`
+	SaslConfigDir  string `toml:"sasl_config_dir"`
+	SaslConfigName string `toml:"sasl_config_name"`
+}
+
+// Follow configures the server as a read-only follower of a leader
+type Follow struct {
+	// Address of the leader. Empty if the server is not a follower.
+	Leader string `toml:"leader"`
+	// Topics to replicate. Empty replicates all topics on the leader.
+	Topics []string `toml:"topics"`
+}
+
+// Cluster configures the server as a member of a Raft replicated cluster
+type Cluster struct {
+	// Id of this server among the members. Empty if clustering is disabled.
+	Id string `toml:"id"`
+	// Address to serve Raft requests on. Defaults to the Raft address of this member.
+	Listener string                   `toml:"listener"`
+	Members  map[string]ClusterMember `toml:"members"`
+}
+
+type ClusterMember struct {
+	Raft string `toml:"raft"`
+	Amqp string `toml:"amqp"`
+}
+
+// Dedup configures deduplication of messages from idempotent producers
+type Dedup struct {
+	// Number of messages remembered per producer. 0 disables deduplication.
+	Window int64 `toml:"window"`
+	// Deduplicate messages without a producer id on their message-id
+	MessageId bool `toml:"message_id"`
+}
+
+// Memory configures persistence of the memory datastore
+type Memory struct {
+	// Seconds between snapshots of the topics. 0 disables snapshots.
+	SnapshotInterval int64 `toml:"snapshot_interval"`
+	// Journal changes between snapshots
+	Journal bool `toml:"journal"`
+}
+
+// Mirror copies topics from a remote source into local topics
+type Mirror struct {
+	// Address of the source
+	Source string `toml:"source"`
+	// Topics to mirror. Empty mirrors all topics on a Slim source.
+	Topics []string `toml:"topics"`
+	// Prefix added to the name of mirrored topics
+	Prefix string `toml:"prefix"`
+	// Local names of mirrored topics, keyed by source topic
+	Rename map[string]string `toml:"rename"`
+	// The source is a plain AMQP broker rather than a Slim server
+	Plain bool `toml:"plain"`
+}
+
+// AclRule lists the address patterns a user may send to and receive from,
+// and the restricted management operations the user may perform.
+type AclRule struct {
+	Send    []string `toml:"send"`
+	Receive []string `toml:"receive"`
+	Manage  []string `toml:"manage"`
+}
+
+func NewDefaultConfig() *Config {
+	return &Config{
+		DataDir:       "data",
+		DatastoreType: "file",
+		Listeners:     []string{"127.0.0.1:5672"},
+		GcInterval:    0,
+		FlushInterval: 10,
+		LagThreshold:  -1,
+		LogLevel:      "info",
+		Retention: Retention{
+			MaxLogAge:   -1,
+			MaxLogSize:  -1,
+			MaxMessages: -1,
+		},
+		Acl:    make(map[string]AclRule),
+		Topics: make(map[string]Retention),
+		Cluster: Cluster{
+			Members: make(map[string]ClusterMember),
+		},
+		Mirrors: make(map[string]Mirror),
+		Dedup: Dedup{
+			Window: 1000,
+		},
+	}
+}
+
+// document is the layout of the configuration file. The settings of topics
+// are decoded once the global retention they inherit from is known.
+type document struct {
+	Config
+	Topics map[string]toml.Primitive `toml:"topics"`
+}
+
+// Load reads the configuration file at path, using defaults for settings
+// not present in the file.
+func Load(path string) (*Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	doc := document{Config: *NewDefaultConfig()}
+	md, err := toml.NewDecoder(file).Decode(&doc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	config := &doc.Config
+	err = config.decodeTopics(md, doc.Topics)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("%s: unknown setting '%s'", path, undecoded[0])
+	}
+	err = config.validate()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return config, nil
+}
+
+func (c *Config) decodeTopics(md toml.MetaData, topics map[string]toml.Primitive) error {
+	for _, name := range sortedKeys(topics) {
+		// Settings not overridden are inherited from the global retention
+		retention := c.Retention
+		err := md.PrimitiveDecode(topics[name], &retention)
+		if err != nil {
+			return err
+		}
+		c.Topics[name] = retention
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	names := make([]string, 0, len(c.Mirrors))
+	for name := range c.Mirrors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		mirror := c.Mirrors[name]
+		if mirror.Source == "" {
+			return fmt.Errorf("'mirrors.%s.source' must be set", name)
+		}
+		if mirror.Plain && len(mirror.Topics) == 0 {
+			return fmt.Errorf("'mirrors.%s.topics' must be set for a plain AMQP source", name)
+		}
+	}
+	return nil
+}
+
+func sortedKeys(topics map[string]toml.Primitive) []string {
+	keys := make([]string, 0, len(topics))
+	for key := range topics {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "slim-config.*.toml")
+	assert.Nil(t, err)
+	_, err = f.WriteString(content)
+	assert.Nil(t, err)
+	f.Close()
+	return f.Name()
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `
+# Slim server configuration
+data_dir = "/var/lib/slim"
+datastore = "sqlite"
+listeners = [
+    "0.0.0.0:5672",
+    "127.0.0.1:5673", # trailing comma
+]
+gc_interval = 60
+log_level = "debug" # inline comment
+debug_listener = "127.0.0.1:6060"
+
+[retention]
+max_log_age = 86_400
+
+[auth]
+mechanisms = "PLAIN ANONYMOUS"
+sasl_config_dir = 'C:\sasl2'
+sasl_config_name = "slim\u0021"
+allow_insecure = true
+
+[acl.alice]
+send = ["sensors.*"]
+receive = ["*"]
+manage = ["SNAPSHOT"]
+
+[topics."events.#1"]
+max_log_size = 1000000
+max_messages = 500
+
+[follow]
+leader = "leader:5672"
+
+[cluster]
+id = "node1"
+
+[cluster.members.node1]
+raft = "host1:7000"
+amqp = "host1:5672"
+
+[cluster.members.node2]
+raft = "host2:7000"
+amqp = "host2:5672"
+
+[dedup]
+message_id = true
+
+[memory]
+snapshot_interval = 30
+journal = true
+
+[mirrors.edge]
+source = "edge:5672"
+topics = ["sensors.temperature", "sensors.humidity"]
+prefix = "edge."
+
+[mirrors.edge.rename]
+"sensors.humidity" = "humidity"
+`)
+	defer os.Remove(path)
+
+	config, err := Load(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "/var/lib/slim", config.DataDir)
+	assert.Equal(t, "sqlite", config.DatastoreType)
+	assert.Equal(t, []string{"0.0.0.0:5672", "127.0.0.1:5673"}, config.Listeners)
+	assert.Equal(t, int64(60), config.GcInterval)
+	assert.Equal(t, int64(10), config.FlushInterval)
+	assert.Equal(t, "debug", config.LogLevel)
+	assert.Equal(t, "127.0.0.1:6060", config.DebugListener)
+	assert.Equal(t, Retention{MaxLogAge: 86400, MaxLogSize: -1, MaxMessages: -1}, config.Retention)
+	assert.Equal(t, "PLAIN ANONYMOUS", config.Auth.Mechanisms)
+	assert.True(t, config.Auth.AllowInsecure)
+	assert.Equal(t, `C:\sasl2`, config.Auth.SaslConfigDir)
+	assert.Equal(t, "slim!", config.Auth.SaslConfigName)
+	assert.Equal(t, AclRule{Send: []string{"sensors.*"}, Receive: []string{"*"}, Manage: []string{"SNAPSHOT"}}, config.Acl["alice"])
+	assert.Equal(t, Retention{MaxLogAge: 86400, MaxLogSize: 1000000, MaxMessages: 500}, config.Topics["events.#1"])
+	assert.Equal(t, "leader:5672", config.Follow.Leader)
+	assert.Equal(t, 0, len(config.Follow.Topics))
+	assert.Equal(t, "node1", config.Cluster.Id)
+	assert.Equal(t, ClusterMember{Raft: "host2:7000", Amqp: "host2:5672"}, config.Cluster.Members["node2"])
+	assert.Equal(t, Dedup{Window: 1000, MessageId: true}, config.Dedup)
+	assert.Equal(t, Memory{SnapshotInterval: 30, Journal: true}, config.Memory)
+	assert.Equal(t, Mirror{
+		Source: "edge:5672",
+		Topics: []string{"sensors.temperature", "sensors.humidity"},
+		Prefix: "edge.",
+		Rename: map[string]string{"sensors.humidity": "humidity"},
+	}, config.Mirrors["edge"])
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, content := range []string{
+		"data_dir = 5",
+		"unknown = true",
+		"[retention]\nmax_log_age = \"forever\"",
+		"listeners = [\"a\", 1]",
+		"[acl.bob\nsend = []",
+		"data_dir = \"unterminated",
+		"data_dir",
+		"[memory]\njournal = 1",
+		"listeners = [\"a\", [\"b\"]]",
+		"[[acl]]\nsend = []",
+		"[topics]\nevents = 1",
+		"[topics.events]\nmax_log_agee = 1",
+		"[cluster.members.node1]\nhttp = \"host1:8080\"",
+		"[mirrors.edge]\nprefix = \"edge.\"",
+		"[mirrors.edge]\nsource = \"edge:5672\"\nplain = true",
+	} {
+		path := writeConfig(t, content)
+		_, err := Load(path)
+		assert.NotNil(t, err, content)
+		os.Remove(path)
+	}
+}
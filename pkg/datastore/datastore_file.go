@@ -5,10 +5,17 @@
 package datastore
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	"database/sql"
@@ -16,50 +23,207 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 
 	"github.com/lulf/slim/pkg/api"
+	"github.com/lulf/slim/pkg/logging"
 )
 
+var errLimitReached = errors.New("limit reached")
+
 type fileDatastore struct {
 	dataDir string
 	topicDb *sql.DB
 
+	lock   *sync.RWMutex
 	topics map[string]*topicData
 
 	maxSegmentSize int64
 	maxBufferSize  int64
-	maxLogSize     int64
-	maxLogAge      int64
+	retention      *RetentionPolicy
 }
 
 type topicData struct {
+	// Directory of the topic relative to the data directory
+	dir string
+
+	// Segments are ordered by offset and only the last one is appended
+	// to. Readers hold the read lock while reading them, and segments are
+	// only added or removed with the write lock held.
+	lock     *sync.RWMutex
+	segments []*segment
+}
+
+// A segment holds the messages of a topic from the offset it is named
+// after up to the first offset of the next segment
+type segment struct {
+	dir       string
 	dataFile  *mappedFile
 	indexFile *mappedFile
 }
 
+func openSegment(dir string) (*segment, error) {
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	indexFile, err := OpenMapped(filepath.Join(dir, "index.bin"))
+	if err != nil {
+		return nil, err
+	}
+
+	dataFile, err := OpenMapped(filepath.Join(dir, "data.bin"))
+	if err != nil {
+		indexFile.Close()
+		return nil, err
+	}
+	return &segment{
+		dir:       dir,
+		indexFile: indexFile,
+		dataFile:  dataFile,
+	}, nil
+}
+
+func (s *segment) sync() {
+	s.dataFile.Sync()
+	s.indexFile.Sync()
+}
+
+func (s *segment) close() {
+	s.dataFile.Close()
+	s.indexFile.Close()
+}
+
+// newestTimestamp returns the timestamp of the last message in the segment
+func (s *segment) newestTimestamp() (int64, error) {
+	_, location, err := s.indexFile.ReadIndexEntry(s.indexFile.NumEntries() - 1)
+	if err != nil {
+		return -1, err
+	}
+	message, err := s.dataFile.ReadMessageAt(location)
+	if err != nil {
+		return -1, err
+	}
+	return message.Timestamp, nil
+}
+
+// activeSegment returns the segment appended to, or nil if the topic is deleted
+func (t *topicData) activeSegment() *segment {
+	if len(t.segments) == 0 {
+		return nil
+	}
+	return t.segments[len(t.segments)-1]
+}
+
+func (t *topicData) lastOffset() (int64, error) {
+	for i := len(t.segments) - 1; i >= 0; i-- {
+		if t.segments[i].indexFile.NumEntries() > 0 {
+			return t.segments[i].indexFile.ReadLastOffset()
+		}
+	}
+	return -1, nil
+}
+
+func (t *topicData) close() {
+	for _, s := range t.segments {
+		s.close()
+	}
+	t.segments = nil
+}
+
 func (ds fileDatastore) Flush() error {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
 	for _, data := range ds.topics {
-		data.dataFile.Sync()
-		data.indexFile.Sync()
+		// Segments are synced when a new one is started
+		data.lock.RLock()
+		if active := data.activeSegment(); active != nil {
+			active.sync()
+		}
+		data.lock.RUnlock()
 	}
 	return nil
 }
 
 func (ds fileDatastore) Close() {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
 	for _, data := range ds.topics {
-		data.dataFile.Close()
-		data.indexFile.Close()
+		data.lock.Lock()
+		data.close()
+		data.lock.Unlock()
 	}
+	ds.topicDb.Close()
 }
 
-func indexFileName(topic string) string {
-	return fmt.Sprintf("%s/index.bin", dataDirName(topic))
+// Each topic is stored in a directory named after its row in the topic
+// database, so that topic names never need to be valid or safe paths
+func topicDirName(id int64) string {
+	return filepath.Join("topics", strconv.FormatInt(id, 10))
 }
 
-func dataFileName(topic string) string {
-	return fmt.Sprintf("%s/data.bin", dataDirName(topic))
+// SegmentDirs returns the segment directories of a topic directory,
+// ordered by offset
+func SegmentDirs(topicDir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(topicDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var offsets []int64
+	for _, entry := range entries {
+		offset, err := strconv.ParseInt(entry.Name(), 10, 64)
+		if err != nil || !entry.IsDir() || strconv.FormatInt(offset, 10) != entry.Name() {
+			continue
+		}
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	dirs := make([]string, 0, len(offsets))
+	for _, offset := range offsets {
+		dirs = append(dirs, filepath.Join(topicDir, strconv.FormatInt(offset, 10)))
+	}
+	return dirs, nil
 }
 
-func dataDirName(topic string) string {
-	return fmt.Sprintf("data/%s/0", topic)
+// openTopic opens the segments of a topic stored in dir, starting with an
+// empty one if there are none
+func (ds *fileDatastore) openTopic(topic string, dir string) error {
+	dirs, err := SegmentDirs(filepath.Join(ds.dataDir, dir))
+	if err != nil {
+		return err
+	}
+	if len(dirs) == 0 {
+		dirs = []string{filepath.Join(ds.dataDir, dir, "0")}
+	}
+
+	store := &topicData{
+		dir:  dir,
+		lock: &sync.RWMutex{},
+	}
+	for _, segmentDir := range dirs {
+		s, err := openSegment(segmentDir)
+		if err != nil {
+			store.close()
+			return err
+		}
+		store.segments = append(store.segments, s)
+	}
+
+	ds.lock.Lock()
+	ds.topics[topic] = store
+	ds.lock.Unlock()
+	return nil
+}
+
+func (ds *fileDatastore) topic(topic string) (*topicData, error) {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+	store, ok := ds.topics[topic]
+	if !ok {
+		return nil, fmt.Errorf("Unknown topic %s", topic)
+	}
+	return store, nil
 }
 
 func NewFileDatastore(dataDir string, maxLogAge int64, maxLogSize int64) (*fileDatastore, error) {
@@ -75,43 +239,103 @@ func NewFileDatastore(dataDir string, maxLogAge int64, maxLogSize int64) (*fileD
 	return &fileDatastore{
 		dataDir:        dataDir,
 		topicDb:        db,
+		lock:           &sync.RWMutex{},
 		maxSegmentSize: 10 * 1024 * 1024,
-		maxLogSize:     maxLogSize,
-		maxLogAge:      maxLogAge,
+		retention:      NewRetentionPolicy(maxLogAge, maxLogSize),
 		topics:         make(map[string]*topicData),
 	}, nil
 }
 
+// fileMigrations upgrades the topic database of a store in dataDir, along
+// with the files of the topics
+func fileMigrations(dataDir string) []migration {
+	return []migration{
+		createFileTopics,
+		dropPartitions,
+		moveTopicDirs(dataDir),
+		convertSegments(dataDir),
+	}
+}
+
+func createFileTopics(tx *sql.Tx) error {
+	_, err := tx.Exec("create table if not exists topics (name text not null primary key, data_dir text, partitions integer);")
+	return err
+}
+
+// Drop the unused partitions column
+func dropPartitions(tx *sql.Tx) error {
+	statements := []string{
+		"create table topics_new (name text not null primary key, data_dir text);",
+		"INSERT INTO topics_new (name, data_dir) SELECT name, data_dir FROM topics;",
+		"DROP TABLE topics;",
+		"ALTER TABLE topics_new RENAME TO topics;",
+	}
+	for _, statement := range statements {
+		_, err := tx.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (ds *fileDatastore) Initialize() error {
-	tableCreate := "create table if not exists topics (name text not null primary key, data_dir text, partitions integer);"
-	_, err := ds.topicDb.Exec(tableCreate)
+	err := migrate(ds.topicDb, fileMigrations(ds.dataDir))
 	if err != nil {
-		log.Print("Creating topics table:", err)
 		return err
 	}
 
-	topics, err := ds.ListTopics()
+	dirs, err := listTopicDirs(ds.topicDb)
 	if err != nil {
 		log.Print("Listing topics:", err)
 		return err
 	}
-	for _, topic := range topics {
-		indexFile, err := OpenMapped(indexFileName(topic))
+	for topic, dir := range dirs {
+		err = ds.openTopic(topic, dir)
 		if err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		dataFile, err := OpenMapped(dataFileName(topic))
-		if err != nil {
-			return err
-		}
+// FileTopicDir returns the directory holding the segments of a topic in a
+// file datastore, which must be in the current format
+func FileTopicDir(dataDir string, topic string) (string, error) {
+	db, err := sql.Open("sqlite3", filepath.Join(dataDir, "store.db"))
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	var dir sql.NullString
+	err = db.QueryRow("SELECT data_dir FROM topics WHERE name = ?", topic).Scan(&dir)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("Unknown topic %s", topic)
+	} else if err != nil {
+		return "", err
+	}
+	return filepath.Join(dataDir, dir.String), nil
+}
 
-		ds.topics[topic] = &topicData{
-			indexFile: indexFile,
-			dataFile:  dataFile,
+// listTopicDirs returns the directory of each topic
+func listTopicDirs(db *sql.DB) (map[string]string, error) {
+	rows, err := db.Query("SELECT name, data_dir FROM topics")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	dirs := make(map[string]string)
+	for rows.Next() {
+		var name string
+		var dir sql.NullString
+		err = rows.Scan(&name, &dir)
+		if err != nil {
+			return nil, err
 		}
+		dirs[name] = dir.String
 	}
-	return nil
+	return dirs, rows.Err()
 }
 
 func (ds *fileDatastore) CreateTopic(topic string) error {
@@ -121,113 +345,525 @@ func (ds *fileDatastore) CreateTopic(topic string) error {
 		return err
 	}
 
-	createTopic, err := tx.Prepare("INSERT INTO topics (name, data_dir, partitions) values(?, ?, 0);")
+	result, err := tx.Exec("INSERT INTO topics (name) values(?);", topic)
 	if err != nil {
-		log.Print("Preparing create topic:", err)
+		log.Print("Create topic:", topic, err)
+		tx.Rollback()
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		tx.Rollback()
 		return err
 	}
-	defer createTopic.Close()
 
-	_, err = createTopic.Exec(topic, topic)
+	dir := topicDirName(id)
+	_, err = tx.Exec("UPDATE topics SET data_dir = ? WHERE name = ?;", dir, topic)
 	if err != nil {
 		log.Print("Create topic:", topic, err)
+		tx.Rollback()
 		return err
 	}
 
-	err = os.MkdirAll(dataDirName(topic), os.ModePerm)
+	// Remove anything left behind by a deleted topic with the same id
+	err = os.RemoveAll(filepath.Join(ds.dataDir, dir))
+	if err == nil {
+		err = ds.openTopic(topic, dir)
+	}
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
+	return tx.Commit()
+}
 
-	indexFile, err := OpenMapped(indexFileName(topic))
+func (ds *fileDatastore) DeleteTopic(topic string) error {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	store, ok := ds.topics[topic]
+	if !ok {
+		return fmt.Errorf("Unknown topic %s", topic)
+	}
+
+	_, err := ds.topicDb.Exec("DELETE FROM topics WHERE name = ?", topic)
 	if err != nil {
+		log.Print("Deleting topic:", topic, err)
 		return err
 	}
 
-	dataFile, err := OpenMapped(dataFileName(topic))
+	store.lock.Lock()
+	store.close()
+	store.lock.Unlock()
+	delete(ds.topics, topic)
+
+	return os.RemoveAll(filepath.Join(ds.dataDir, store.dir))
+}
+
+// Snapshot writes the log of each topic up to its last indexed entry into
+// dir, along with a topic database listing them. Sealed segments are never
+// modified, so they are hard linked. The active segment is still appended
+// to, so it is copied.
+func (ds *fileDatastore) Snapshot(dir string) (map[string]int64, error) {
+	err := ds.Flush()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	ds.topics[topic] = &topicData{
-		indexFile: indexFile,
-		dataFile:  dataFile,
+
+	err = os.Mkdir(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
 	}
 
-	return tx.Commit()
+	ds.lock.RLock()
+	topics := make(map[string]*topicData, len(ds.topics))
+	for name, store := range ds.topics {
+		topics[name] = store
+	}
+	ds.lock.RUnlock()
+
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "store.db"))
+	if err != nil {
+		log.Print("Opening Database:", err)
+		return nil, err
+	}
+	defer db.Close()
+
+	err = migrate(db, fileMigrations(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	offsets := make(map[string]int64, len(topics))
+	for name, store := range topics {
+		offset, err := snapshotTopic(store, filepath.Join(dir, store.dir))
+		if err != nil {
+			log.Print("Snapshot topic:", name, err)
+			return nil, err
+		}
+
+		// Keep the row of the topic, which its directory is named after
+		var id int64
+		err = ds.topicDb.QueryRow("SELECT rowid FROM topics WHERE name = ?", name).Scan(&id)
+		if err == nil {
+			_, err = db.Exec("INSERT INTO topics (rowid, name, data_dir) values(?, ?, ?);", id, name, store.dir)
+		}
+		if err != nil {
+			log.Print("Snapshot topic:", name, err)
+			return nil, err
+		}
+		offsets[name] = offset
+	}
+	return offsets, nil
+}
+
+// snapshotTopic links or copies the segments of a topic, returning the
+// offset of the last entry in the snapshot.
+func snapshotTopic(store *topicData, dir string) (int64, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	lastOffset := int64(-1)
+	for i, s := range store.segments {
+		sealed := i < len(store.segments)-1
+		offset, err := snapshotSegment(s, filepath.Join(dir, filepath.Base(s.dir)), sealed)
+		if err != nil {
+			return -1, err
+		}
+		if offset >= 0 {
+			lastOffset = offset
+		}
+	}
+	return lastOffset, nil
+}
+
+// snapshotSegment links a sealed segment, or copies the index of the active
+// segment and the data it refers to, returning the offset of the last entry
+// in the snapshot.
+func snapshotSegment(store *segment, dir string, sealed bool) (int64, error) {
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return -1, err
+	}
+
+	// The index is written after the data, so everything it refers to is
+	// already in the data file
+	indexLocation := store.indexFile.FileLocation()
+	numEntries := (indexLocation - METADATA_SZ) / INDEX_ENTRY_SZ
+	lastOffset := int64(-1)
+	dataLocation := METADATA_SZ
+	if numEntries > 0 {
+		var location int64
+		lastOffset, location, err = store.indexFile.ReadIndexEntry(numEntries - 1)
+		if err != nil {
+			return -1, err
+		}
+		message, err := store.dataFile.ReadMessageAt(location)
+		if err != nil {
+			return -1, err
+		}
+		dataLocation = location + RecordSize(message)
+	}
+
+	if sealed {
+		for _, name := range []string{"index.bin", "data.bin"} {
+			err = os.Link(filepath.Join(store.dir, name), filepath.Join(dir, name))
+			if err != nil {
+				return -1, err
+			}
+		}
+		return lastOffset, nil
+	}
+	err = store.indexFile.CopyTo(filepath.Join(dir, "index.bin"), indexLocation)
+	if err != nil {
+		return -1, err
+	}
+	err = store.dataFile.CopyTo(filepath.Join(dir, "data.bin"), dataLocation)
+	if err != nil {
+		return -1, err
+	}
+	return lastOffset, nil
 }
 
 // Write algorithm
 // 1. Locate topic
-// 2. Compare flushIdx with writeIdx
-// 3. If room, put message in buffer and increment idx
+// 2. Start a new segment if the active one is full
+// 3. Append message to the data file and its location to the index
 func (ds *fileDatastore) InsertMessage(topic string, message *api.Message) error {
-	store := ds.topics[topic]
+	store, err := ds.topic(topic)
+	if err != nil {
+		return err
+	}
+
+	store.lock.RLock()
+	if active := store.activeSegment(); active != nil && active.dataFile.FileLocation() >= ds.maxSegmentSize {
+		store.lock.RUnlock()
+		err = ds.rollSegment(store, message.Offset)
+		if err != nil {
+			return err
+		}
+		store.lock.RLock()
+	}
+	defer store.lock.RUnlock()
+
+	active := store.activeSegment()
+	if active == nil {
+		return fmt.Errorf("Unknown topic %s", topic)
+	}
+
+	// Entries are searched by offset, which must be increasing
+	last, err := store.lastOffset()
+	if err != nil {
+		return err
+	}
+	if message.Offset <= last {
+		return fmt.Errorf("Offset %d of topic %s is not after the last offset %d", message.Offset, topic, last)
+	}
 
 	// log.Println("Appending message", message, store.nextFileOffset)
-	dataOffset, err := store.dataFile.AppendMessage(message)
+	dataOffset, err := active.dataFile.AppendMessage(message)
 	if err != nil {
 		return err
 	}
 
-	err = store.indexFile.AppendIndex(message.Offset, dataOffset)
+	err = active.indexFile.AppendIndex(message.Offset, dataOffset)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// Truncate removes the messages of a topic after offset. Segments that only
+// hold such messages are removed, except the first segment of the topic.
+func (ds *fileDatastore) Truncate(topic string, offset int64) error {
+	store, err := ds.topic(topic)
+	if err != nil {
+		return err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	sealed := false
+	for len(store.segments) > 1 {
+		active := store.activeSegment()
+		if active.indexFile.NumEntries() > 0 && active.indexFile.StartOffset() <= offset {
+			break
+		}
+		logging.Debug("Removing segment", active.dir)
+		active.close()
+		store.segments = store.segments[:len(store.segments)-1]
+		sealed = true
+		err = os.RemoveAll(active.dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	active := store.activeSegment()
+	if active == nil {
+		return fmt.Errorf("Unknown topic %s", topic)
+	}
+	position, err := active.indexFile.SearchIndex(offset + 1)
+	if err != nil {
+		return err
+	}
+	if position >= active.indexFile.NumEntries() {
+		return nil
+	}
+	_, location, err := active.indexFile.ReadIndexEntry(position)
+	if err != nil {
+		return err
+	}
+	if sealed {
+		// The segment was sealed, and may be linked into snapshots
+		truncated, err := truncatedCopy(active, METADATA_SZ+position*INDEX_ENTRY_SZ, location)
+		if truncated != nil {
+			store.segments[len(store.segments)-1] = truncated
+		}
+		return err
+	}
+	// The index is truncated first, so it never refers past the data
+	err = active.indexFile.Truncate(METADATA_SZ + position*INDEX_ENTRY_SZ)
+	if err != nil {
+		return err
+	}
+	return active.dataFile.Truncate(location)
+}
+
+// truncatedCopy replaces the files of a segment with copies ending at the
+// given index and data locations, and opens the segment again. The files
+// are replaced rather than truncated, as they may be linked elsewhere.
+func truncatedCopy(s *segment, indexLocation int64, dataLocation int64) (*segment, error) {
+	copies := []struct {
+		file     *mappedFile
+		location int64
+	}{
+		// The index is replaced first, so it never refers past the data
+		{s.indexFile, indexLocation},
+		{s.dataFile, dataLocation},
+	}
+	for _, c := range copies {
+		tmp := c.file.path + ".truncated"
+		os.Remove(tmp)
+		err := c.file.CopyTo(tmp, c.location)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.close()
+	var renameErr error
+	for _, c := range copies {
+		err := os.Rename(c.file.path+".truncated", c.file.path)
+		if err != nil && renameErr == nil {
+			renameErr = err
+		}
+	}
+	truncated, err := openSegment(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	return truncated, renameErr
+}
+
+// rollSegment starts a new segment at offset if the active segment is full
+func (ds *fileDatastore) rollSegment(store *topicData, offset int64) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	active := store.activeSegment()
+	if active == nil || active.dataFile.FileLocation() < ds.maxSegmentSize || active.indexFile.NumEntries() == 0 {
+		return nil
+	}
+	last, err := store.lastOffset()
+	if err != nil || offset <= last {
+		// Rejected when inserted
+		return err
+	}
+
+	active.sync()
+	s, err := openSegment(filepath.Join(ds.dataDir, store.dir, strconv.FormatInt(offset, 10)))
+	if err != nil {
+		return err
+	}
+	store.segments = append(store.segments, s)
+	return nil
+}
+
+// GarbageCollect removes the oldest segments of a topic while every message
+// in them is outside of its retention. The active segment is never removed,
+// so retention is applied at the granularity of segments.
 func (ds *fileDatastore) GarbageCollect(topic string) error {
+	store, err := ds.topic(topic)
+	if err != nil {
+		return err
+	}
+
+	retention := ds.retention.Get(topic)
+	if retention.MaxLogAge <= 0 && retention.MaxLogSize <= 0 && retention.MaxMessages <= 0 {
+		return nil
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	segments := store.segments
+	if len(segments) < 2 {
+		return nil
+	}
+
+	// Size and number of messages kept in the segments after each segment
+	newerSize := make([]int64, len(segments))
+	newerMessages := make([]int64, len(segments))
+	for i := len(segments) - 2; i >= 0; i-- {
+		newer := segments[i+1]
+		newerSize[i] = newerSize[i+1] + newer.dataFile.FileLocation() - METADATA_SZ
+		newerMessages[i] = newerMessages[i+1] + newer.indexFile.NumEntries()
+	}
+
+	oldest := time.Now().UTC().Unix() - retention.MaxLogAge
+	expired := 0
+	for i := 0; i < len(segments)-1; i++ {
+		remove := segments[i].indexFile.NumEntries() == 0 ||
+			(retention.MaxLogSize > 0 && newerSize[i] >= retention.MaxLogSize) ||
+			(retention.MaxMessages > 0 && newerMessages[i] >= retention.MaxMessages)
+		if !remove && retention.MaxLogAge > 0 {
+			newest, err := segments[i].newestTimestamp()
+			if err != nil {
+				return err
+			}
+			remove = newest < oldest
+		}
+		if !remove {
+			break
+		}
+		expired++
+	}
+
+	for _, s := range segments[:expired] {
+		logging.Debug("Removing segment", s.dir)
+		s.close()
+		store.segments = store.segments[1:]
+		err = os.RemoveAll(s.dir)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+func (ds *fileDatastore) RetentionPolicy() *RetentionPolicy {
+	return ds.retention
+}
+
+// ListMessages returns at most limit messages after offset that were stored
+// after insertionTime, or all of them if limit is negative
 func (ds *fileDatastore) ListMessages(topic string, limit int64, offset int64, insertionTime int64) ([]*api.Message, error) {
-	return nil, nil
+	var messages []*api.Message
+	if limit == 0 {
+		return messages, nil
+	}
+	err := Stream(context.Background(), ds, topic, offset+1, func(message *api.Message) error {
+		if message.Timestamp <= insertionTime {
+			return nil
+		}
+		messages = append(messages, message)
+		if limit > 0 && int64(len(messages)) >= limit {
+			return errLimitReached
+		}
+		return nil
+	})
+	if err != nil && err != errLimitReached {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func (ds *fileDatastore) ReadMessages(ctx context.Context, topic string, offset int64) (MessageIterator, error) {
+	store, err := ds.topic(topic)
+	if err != nil {
+		return nil, err
+	}
+	return &fileIterator{
+		ctx:    ctx,
+		store:  store,
+		offset: offset,
+	}, nil
+}
+
+type fileIterator struct {
+	ctx    context.Context
+	store  *topicData
+	offset int64
 }
 
 // Read algorithm
 // 1. Locate topic
-// 2. Lookup id in index using binary search
-// 3. If in cache,
-func (ds *fileDatastore) StreamMessages(topic string, offset int64, callback StreamingFunc) error {
-	store := ds.topics[topic]
-
-	if offset < 0 {
-		offset = 0
+// 2. Lookup id in the index of each segment using binary search, as offsets may have gaps
+// 3. Read messages at the file offsets of the following index entries
+func (it *fileIterator) Next() ([]*api.Message, error) {
+	if err := it.ctx.Err(); err != nil {
+		return nil, err
 	}
-	for {
-		// log.Println("Streaming message", offset)
-		fileOffset, err := store.indexFile.ReadFileOffset(offset)
+
+	it.store.lock.RLock()
+	defer it.store.lock.RUnlock()
+
+	batch := make([]*api.Message, 0, ReadBatchSize)
+	for _, s := range it.store.segments {
+		if len(batch) >= ReadBatchSize {
+			break
+		}
+		idx, err := s.indexFile.SearchIndex(it.offset)
 		if err != nil {
-			// log.Println("ERROR", err)
+			return nil, err
+		}
+		for ; len(batch) < ReadBatchSize; idx++ {
+			_, fileOffset, err := s.indexFile.ReadIndexEntry(idx)
 			if err == io.EOF {
-				// log.Println("Stoooping stream")
-				return nil
+				break
+			} else if err != nil {
+				return nil, err
 			}
-			return err
-		}
-		// log.Println("Located file offset", fileOffset)
-		message, err := store.dataFile.ReadMessageAt(fileOffset)
-		if err != nil {
-			return err
+			message, err := s.dataFile.ReadMessageAt(fileOffset)
+			if err != nil {
+				return nil, err
+			}
+			batch = append(batch, message)
+			it.offset = message.Offset + 1
 		}
-		//log.Println("Located message", message)
+	}
 
-		err = callback(message)
-		if err != nil {
-			return err
-		}
-		offset += 1
+	if len(batch) == 0 {
+		return nil, io.EOF
 	}
-	return nil
+	return batch, nil
+}
+
+func (it *fileIterator) Close() {
 }
 
 func (ds *fileDatastore) NumMessages(topic string) (int64, error) {
-	return 0, nil
+	store, err := ds.topic(topic)
+	if err != nil {
+		return 0, err
+	}
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	var entries int64
+	for _, s := range store.segments {
+		entries += s.indexFile.NumEntries()
+	}
+	return entries, nil
 }
 
 func (ds *fileDatastore) LastOffset(topic string) (int64, error) {
-	data := ds.topics[topic]
-	return data.indexFile.ReadLastOffset()
+	store, err := ds.topic(topic)
+	if err != nil {
+		return -1, err
+	}
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return store.lastOffset()
 }
 
 func (ds *fileDatastore) ListTopics() ([]string, error) {
@@ -243,6 +879,7 @@ func (ds *fileDatastore) ListTopics() ([]string, error) {
 		log.Print("Executing query:", err)
 		return nil, err
 	}
+	defer rows.Close()
 
 	var topics []string = make([]string, 0)
 	for rows.Next() {
@@ -262,7 +899,7 @@ func (ds *fileDatastore) ListTopics() ([]string, error) {
 func Flusher(flushInterval time.Duration, ds Datastore) {
 	for {
 		time.Sleep(flushInterval * time.Second)
-		log.Println("Flushing datastore")
+		logging.Debug("Flushing datastore")
 		err := ds.Flush()
 		if err != nil {
 			log.Println("Error flush datastore:", err)
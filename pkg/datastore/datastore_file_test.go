@@ -0,0 +1,575 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lulf/slim/pkg/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStreamFromStartOffset(t *testing.T) {
+	f := tempDbFile(t, "startoffset")
+	ds, err := NewFileDatastore(f, -1, -1)
+	assert.Nil(t, err)
+	assert.Nil(t, ds.Initialize())
+
+	assert.Nil(t, ds.CreateTopic("mytopic"))
+	for offset := int64(5); offset < 10; offset++ {
+		assert.Nil(t, ds.InsertMessage("mytopic", api.NewMessage(offset, []byte("payload"))))
+	}
+
+	var offsets []int64
+	err = Stream(context.Background(), ds, "mytopic", 7, func(message *api.Message) error {
+		offsets = append(offsets, message.Offset)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{7, 8, 9}, offsets)
+
+	offsets = nil
+	err = Stream(context.Background(), ds, "mytopic", 0, func(message *api.Message) error {
+		offsets = append(offsets, message.Offset)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{5, 6, 7, 8, 9}, offsets)
+	ds.Close()
+
+	// Reopening must keep the start offset
+	ds, err = NewFileDatastore(f, -1, -1)
+	assert.Nil(t, err)
+	defer ds.Close()
+	assert.Nil(t, ds.Initialize())
+
+	offsets = nil
+	err = Stream(context.Background(), ds, "mytopic", 9, func(message *api.Message) error {
+		offsets = append(offsets, message.Offset)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{9}, offsets)
+}
+
+func TestFileListMessages(t *testing.T) {
+	f := tempDbFile(t, "listmessages")
+	ds, err := NewFileDatastore(f, -1, -1)
+	assert.Nil(t, err)
+	defer ds.Close()
+	assert.Nil(t, ds.Initialize())
+
+	assert.Nil(t, ds.CreateTopic("mytopic"))
+	for offset := int64(1); offset <= 4; offset++ {
+		message := api.NewMessage(offset, []byte("payload"))
+		message.Timestamp = 100 + offset
+		assert.Nil(t, ds.InsertMessage("mytopic", message))
+	}
+
+	lst, err := ds.ListMessages("mytopic", -1, 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(lst))
+
+	lst, err = ds.ListMessages("mytopic", -1, 2, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(lst))
+	assert.Equal(t, int64(3), lst[0].Offset)
+
+	lst, err = ds.ListMessages("mytopic", 1, 2, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(lst))
+
+	lst, err = ds.ListMessages("mytopic", -1, 0, 102)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(lst))
+	assert.Equal(t, int64(3), lst[0].Offset)
+
+	lst, err = ds.ListMessages("mytopic", 0, 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(lst))
+
+	_, err = ds.ListMessages("unknown", -1, 0, 0)
+	assert.NotNil(t, err)
+}
+
+func TestFileSnapshot(t *testing.T) {
+	f := tempDbFile(t, "snapshot")
+	ds, err := NewFileDatastore(f, -1, -1)
+	assert.Nil(t, err)
+	defer ds.Close()
+	assert.Nil(t, ds.Initialize())
+
+	assert.Nil(t, ds.CreateTopic("mytopic"))
+	for offset := int64(0); offset < 5; offset++ {
+		assert.Nil(t, ds.InsertMessage("mytopic", api.NewMessage(offset, []byte("payload"))))
+	}
+
+	dir := filepath.Join(f, "snapshot")
+	offsets, err := ds.Snapshot(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int64{"mytopic": 4}, offsets)
+
+	// Entries written after the snapshot are not part of it
+	assert.Nil(t, ds.InsertMessage("mytopic", api.NewMessage(5, []byte("payload"))))
+
+	snapshot, err := NewFileDatastore(dir, -1, -1)
+	assert.Nil(t, err)
+	defer snapshot.Close()
+	assert.Nil(t, snapshot.Initialize())
+
+	count, err := snapshot.NumMessages("mytopic")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), count)
+
+	last, err := snapshot.LastOffset("mytopic")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), last)
+
+	// The snapshot can be written to
+	assert.Nil(t, snapshot.InsertMessage("mytopic", api.NewMessage(5, []byte("payload"))))
+	count, err = snapshot.NumMessages("mytopic")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), count)
+
+	_, err = ds.Snapshot(dir)
+	assert.NotNil(t, err)
+}
+
+func TestFileSchemaMigrations(t *testing.T) {
+	f := tempDbFile(t, "migrations")
+	ds, err := NewFileDatastore(f, -1, -1)
+	assert.Nil(t, err)
+
+	// Store written before schema versions
+	_, err = ds.topicDb.Exec("create table topics (name text not null primary key, data_dir text, partitions integer);")
+	assert.Nil(t, err)
+	assert.Nil(t, ds.CreateTopic("mytopic"))
+	ds.Close()
+
+	ds, err = NewFileDatastore(f, -1, -1)
+	assert.Nil(t, err)
+	assert.Nil(t, ds.Initialize())
+	topics, err := ds.ListTopics()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"mytopic"}, topics)
+	assert.Nil(t, ds.CreateTopic("other"))
+
+	// Stores written by newer versions are refused
+	_, err = ds.topicDb.Exec("UPDATE schema_version SET version = ?", len(fileMigrations(f))+1)
+	assert.Nil(t, err)
+	ds.Close()
+
+	ds, err = NewFileDatastore(f, -1, -1)
+	assert.Nil(t, err)
+	defer ds.Close()
+	assert.NotNil(t, ds.Initialize())
+}
+
+// writeLegacySegment writes a segment as written before headers were
+// versioned, with records of the given header size
+func writeLegacySegment(t *testing.T, dir string, headerSize int64, offsets ...int64) {
+	assert.Nil(t, os.MkdirAll(dir, os.ModePerm))
+	index := new(bytes.Buffer)
+	data := new(bytes.Buffer)
+	location := int64(16)
+	for _, offset := range offsets {
+		payload := []byte(fmt.Sprintf("payload %d", offset))
+		binary.Write(index, binary.LittleEndian, offset)
+		binary.Write(index, binary.LittleEndian, location)
+		binary.Write(data, binary.LittleEndian, offset)
+		if headerSize == 24 {
+			binary.Write(data, binary.LittleEndian, int64(1000+offset))
+		}
+		binary.Write(data, binary.LittleEndian, int64(len(payload)))
+		data.Write(payload)
+		location += headerSize + int64(len(payload))
+	}
+	for name, content := range map[string]*bytes.Buffer{"index.bin": index, "data.bin": data} {
+		hdr := new(bytes.Buffer)
+		if name == "index.bin" && len(offsets) > 0 {
+			binary.Write(hdr, binary.LittleEndian, offsets[0])
+		} else {
+			binary.Write(hdr, binary.LittleEndian, int64(0))
+		}
+		binary.Write(hdr, binary.LittleEndian, int64(16+content.Len()))
+		// Files were preallocated beyond the data written
+		padding := make([]byte, 100)
+		err := ioutil.WriteFile(filepath.Join(dir, name), append(append(hdr.Bytes(), content.Bytes()...), padding...), 0644)
+		assert.Nil(t, err)
+	}
+}
+
+func TestFileLegacyLayout(t *testing.T) {
+	f := tempDbFile(t, "legacy")
+	ds, err := NewFileDatastore(f, -1, -1)
+	assert.Nil(t, err)
+
+	// Topics were stored in directories named after them, with records
+	// without a timestamp in the oldest versions
+	_, err = ds.topicDb.Exec("create table topics (name text not null primary key, data_dir text, partitions integer);")
+	assert.Nil(t, err)
+	for _, name := range []string{"a", "a/b", "empty"} {
+		_, err = ds.topicDb.Exec("INSERT INTO topics (name, data_dir) values(?, ?)", name, name)
+		assert.Nil(t, err)
+	}
+	writeLegacySegment(t, filepath.Join(f, "a", "0"), 16, 3, 4, 5)
+	writeLegacySegment(t, filepath.Join(f, "a", "b", "0"), 24, 0, 1)
+	writeLegacySegment(t, filepath.Join(f, "empty", "0"), 16)
+	ds.Close()
+
+	ds, err = NewFileDatastore(f, -1, -1)
+	assert.Nil(t, err)
+	defer ds.Close()
+	assert.Nil(t, ds.Initialize())
+
+	var messages []*api.Message
+	err = Stream(context.Background(), ds, "a", 0, func(message *api.Message) error {
+		messages = append(messages, message)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(messages))
+	for i, message := range messages {
+		assert.Equal(t, int64(3+i), message.Offset)
+		assert.Equal(t, fmt.Sprintf("payload %d", 3+i), string(message.Payload))
+		assert.True(t, message.Timestamp > 1000)
+	}
+
+	messages = nil
+	err = Stream(context.Background(), ds, "a/b", 0, func(message *api.Message) error {
+		messages = append(messages, message)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(messages))
+	assert.Equal(t, int64(1001), messages[1].Timestamp)
+	assert.Equal(t, "payload 1", string(messages[1].Payload))
+
+	count, err := ds.NumMessages("empty")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), count)
+	assert.Nil(t, ds.InsertMessage("empty", api.NewMessage(0, []byte("payload"))))
+
+	// The directories named after topics are gone
+	_, err = os.Stat(filepath.Join(f, "a"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFileLegacyWorkingDirectory(t *testing.T) {
+	wd, err := os.Getwd()
+	assert.Nil(t, err)
+	dir := tempDbFile(t, "legacywd")
+	assert.Nil(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	// The first versions wrote logs under data in the working directory,
+	// whatever the data directory
+	f := filepath.Join(dir, "store")
+	assert.Nil(t, os.Mkdir(f, os.ModePerm))
+	ds, err := NewFileDatastore(f, -1, -1)
+	assert.Nil(t, err)
+	_, err = ds.topicDb.Exec("create table topics (name text not null primary key, data_dir text, partitions integer);")
+	assert.Nil(t, err)
+	_, err = ds.topicDb.Exec("INSERT INTO topics (name, data_dir) values(?, ?)", "a", "a")
+	assert.Nil(t, err)
+	writeLegacySegment(t, filepath.Join(dir, "data", "a", "0"), 24, 0, 1)
+	ds.Close()
+
+	ds, err = NewFileDatastore(f, -1, -1)
+	assert.Nil(t, err)
+	defer ds.Close()
+	assert.Nil(t, ds.Initialize())
+	count, err := ds.NumMessages("a")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), count)
+	_, err = os.Stat(filepath.Join(dir, "data", "a"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFileLegacyMissingLog(t *testing.T) {
+	f := tempDbFile(t, "legacymissing")
+	ds, err := NewFileDatastore(f, -1, -1)
+	assert.Nil(t, err)
+	_, err = ds.topicDb.Exec("create table topics (name text not null primary key, data_dir text, partitions integer);")
+	assert.Nil(t, err)
+	_, err = ds.topicDb.Exec("INSERT INTO topics (name, data_dir) values(?, ?)", "a", "a")
+	assert.Nil(t, err)
+	ds.Close()
+
+	// A topic whose log is not found is not started empty
+	ds, err = NewFileDatastore(f, -1, -1)
+	assert.Nil(t, err)
+	defer ds.Close()
+	assert.NotNil(t, ds.Initialize())
+	_, err = os.Stat(filepath.Join(f, "topics"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFileDeleteTopic(t *testing.T) {
+	f := tempDbFile(t, "delete")
+	ds, err := NewFileDatastore(f, -1, -1)
+	assert.Nil(t, err)
+	defer ds.Close()
+	assert.Nil(t, ds.Initialize())
+
+	names := []string{"a", "a/b", ".", "..", "/", "../../x", ""}
+	for _, name := range names {
+		assert.Nil(t, ds.CreateTopic(name))
+		assert.Nil(t, ds.InsertMessage(name, api.NewMessage(0, []byte(name))))
+	}
+
+	// Deleting a topic leaves every other topic intact
+	for i, name := range names {
+		assert.Nil(t, ds.DeleteTopic(name))
+		for _, other := range names[i+1:] {
+			var payloads []string
+			err = Stream(context.Background(), ds, other, 0, func(message *api.Message) error {
+				payloads = append(payloads, string(message.Payload))
+				return nil
+			})
+			assert.Nil(t, err)
+			assert.Equal(t, []string{other}, payloads)
+		}
+	}
+	_, err = os.Stat(filepath.Join(f, "store.db"))
+	assert.Nil(t, err)
+}
+
+func TestFileSparseOffsets(t *testing.T) {
+	f := tempDbFile(t, "sparse")
+	ds, err := NewFileDatastore(f, -1, -1)
+	assert.Nil(t, err)
+	defer ds.Close()
+	assert.Nil(t, ds.Initialize())
+	assert.Nil(t, ds.CreateTopic("mytopic"))
+
+	// Topics migrated or imported from other datastores may have gaps
+	for _, offset := range []int64{3, 4, 8, 20, 21} {
+		assert.Nil(t, ds.InsertMessage("mytopic", api.NewMessage(offset, []byte("payload"))))
+	}
+	assert.NotNil(t, ds.InsertMessage("mytopic", api.NewMessage(21, []byte("payload"))))
+
+	for start, expected := range map[int64][]int64{
+		0:  {3, 4, 8, 20, 21},
+		5:  {8, 20, 21},
+		8:  {8, 20, 21},
+		21: {21},
+		22: nil,
+	} {
+		var offsets []int64
+		err = Stream(context.Background(), ds, "mytopic", start, func(message *api.Message) error {
+			offsets = append(offsets, message.Offset)
+			return nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, expected, offsets, start)
+	}
+
+	count, err := ds.NumMessages("mytopic")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), count)
+	last, err := ds.LastOffset("mytopic")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(21), last)
+}
+
+func TestFileSegmentRetention(t *testing.T) {
+	f := tempDbFile(t, "segments")
+	ds, err := NewFileDatastore(f, -1, -1)
+	assert.Nil(t, err)
+	assert.Nil(t, ds.Initialize())
+	assert.Nil(t, ds.CreateTopic("mytopic"))
+
+	// Three messages per segment
+	ds.maxSegmentSize = METADATA_SZ + 3*(RECORD_HEADER_SZ+int64(len("payload")))
+	for offset := int64(0); offset < 10; offset++ {
+		message := api.NewMessage(offset, []byte("payload"))
+		message.Timestamp = time.Now().UTC().Unix()
+		if offset < 9 {
+			message.Timestamp -= 3600
+		}
+		assert.Nil(t, ds.InsertMessage("mytopic", message))
+	}
+	assert.NotNil(t, ds.InsertMessage("mytopic", api.NewMessage(9, []byte("payload"))))
+
+	dir, err := FileTopicDir(f, "mytopic")
+	assert.Nil(t, err)
+	segments, err := SegmentDirs(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "0"),
+		filepath.Join(dir, "3"),
+		filepath.Join(dir, "6"),
+		filepath.Join(dir, "9"),
+	}, segments)
+	ds.Close()
+
+	ds, err = NewFileDatastore(f, -1, -1)
+	assert.Nil(t, err)
+	defer ds.Close()
+	assert.Nil(t, ds.Initialize())
+	ds.maxSegmentSize = METADATA_SZ + 3*(RECORD_HEADER_SZ+int64(len("payload")))
+
+	offsets := func() []int64 {
+		var offsets []int64
+		err := Stream(context.Background(), ds, "mytopic", 0, func(message *api.Message) error {
+			offsets = append(offsets, message.Offset)
+			return nil
+		})
+		assert.Nil(t, err)
+		return offsets
+	}
+	assert.Equal(t, []int64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, offsets())
+
+	// Segments are only removed once every message in them is outside the limits
+	ds.RetentionPolicy().Update(Retention{MaxMessages: 5}, nil)
+	assert.Nil(t, ds.GarbageCollect("mytopic"))
+	assert.Equal(t, []int64{3, 4, 5, 6, 7, 8, 9}, offsets())
+
+	ds.RetentionPolicy().Update(Retention{MaxLogSize: 4 * (RECORD_HEADER_SZ + int64(len("payload")))}, nil)
+	assert.Nil(t, ds.GarbageCollect("mytopic"))
+	assert.Equal(t, []int64{6, 7, 8, 9}, offsets())
+
+	// The active segment is kept even when it is expired
+	ds.RetentionPolicy().Update(Retention{MaxLogAge: 60}, nil)
+	assert.Nil(t, ds.GarbageCollect("mytopic"))
+	assert.Equal(t, []int64{9}, offsets())
+	ds.RetentionPolicy().Update(Retention{MaxLogAge: 1, MaxMessages: 1}, nil)
+	assert.Nil(t, ds.GarbageCollect("mytopic"))
+	assert.Equal(t, []int64{9}, offsets())
+
+	count, err := ds.NumMessages("mytopic")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), count)
+
+	for offset := int64(10); offset < 14; offset++ {
+		assert.Nil(t, ds.InsertMessage("mytopic", api.NewMessage(offset, []byte("payload"))))
+	}
+	assert.Equal(t, []int64{9, 10, 11, 12, 13}, offsets())
+	last, err := ds.LastOffset("mytopic")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(13), last)
+
+	snapshot := filepath.Join(f, "snapshot")
+	snapshotOffsets, err := ds.Snapshot(snapshot)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(13), snapshotOffsets["mytopic"])
+	copied, err := NewFileDatastore(snapshot, -1, -1)
+	assert.Nil(t, err)
+	defer copied.Close()
+	assert.Nil(t, copied.Initialize())
+	count, err = copied.NumMessages("mytopic")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), count)
+}
+
+func TestFileSnapshotLinksSealedSegments(t *testing.T) {
+	f := tempDbFile(t, "snapshotlinks")
+	ds, err := NewFileDatastore(f, -1, -1)
+	assert.Nil(t, err)
+	defer ds.Close()
+	assert.Nil(t, ds.Initialize())
+	assert.Nil(t, ds.CreateTopic("mytopic"))
+
+	// Three messages per segment
+	ds.maxSegmentSize = METADATA_SZ + 3*(RECORD_HEADER_SZ+int64(len("payload")))
+	for offset := int64(0); offset < 8; offset++ {
+		assert.Nil(t, ds.InsertMessage("mytopic", api.NewMessage(offset, []byte("payload"))))
+	}
+
+	snapshot := filepath.Join(f, "snapshot")
+	offsets, err := ds.Snapshot(snapshot)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), offsets["mytopic"])
+
+	dir, err := FileTopicDir(f, "mytopic")
+	assert.Nil(t, err)
+	snapshotDir, err := FileTopicDir(snapshot, "mytopic")
+	assert.Nil(t, err)
+	sameFile := func(segment string, name string) bool {
+		source, err := os.Stat(filepath.Join(dir, segment, name))
+		assert.Nil(t, err)
+		copied, err := os.Stat(filepath.Join(snapshotDir, segment, name))
+		assert.Nil(t, err)
+		return os.SameFile(source, copied)
+	}
+	for _, name := range []string{"index.bin", "data.bin"} {
+		assert.True(t, sameFile("0", name))
+		assert.True(t, sameFile("3", name))
+		assert.False(t, sameFile("6", name))
+	}
+
+	// Truncating into a sealed segment leaves the linked files intact
+	assert.Nil(t, ds.Truncate("mytopic", 4))
+	assert.Nil(t, ds.InsertMessage("mytopic", api.NewMessage(5, []byte("again"))))
+	assert.False(t, sameFile("3", "index.bin"))
+	assert.False(t, sameFile("3", "data.bin"))
+
+	copied, err := NewFileDatastore(snapshot, -1, -1)
+	assert.Nil(t, err)
+	defer copied.Close()
+	assert.Nil(t, copied.Initialize())
+	var payloads []string
+	err = Stream(context.Background(), copied, "mytopic", 0, func(message *api.Message) error {
+		payloads = append(payloads, string(message.Payload))
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 8, len(payloads))
+	assert.Equal(t, "payload", payloads[5])
+}
+
+func TestFileTruncate(t *testing.T) {
+	f := tempDbFile(t, "truncate")
+	ds, err := NewFileDatastore(f, -1, -1)
+	assert.Nil(t, err)
+	assert.Nil(t, ds.Initialize())
+	assert.Nil(t, ds.CreateTopic("mytopic"))
+
+	// Three messages per segment
+	ds.maxSegmentSize = METADATA_SZ + 3*(RECORD_HEADER_SZ+int64(len("payload")))
+	for offset := int64(0); offset < 8; offset++ {
+		assert.Nil(t, ds.InsertMessage("mytopic", api.NewMessage(offset, []byte("payload"))))
+	}
+
+	// Segments only holding removed messages are removed
+	assert.Nil(t, ds.Truncate("mytopic", 4))
+	dir, err := FileTopicDir(f, "mytopic")
+	assert.Nil(t, err)
+	segments, err := SegmentDirs(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "0"), filepath.Join(dir, "3")}, segments)
+	assert.Equal(t, []int64{0, 1, 2, 3, 4}, memoryOffsets(t, ds, "mytopic", 0))
+
+	// Removed offsets can be stored again
+	assert.Nil(t, ds.InsertMessage("mytopic", api.NewMessage(5, []byte("again"))))
+	ds.Close()
+
+	ds, err = NewFileDatastore(f, -1, -1)
+	assert.Nil(t, err)
+	defer ds.Close()
+	assert.Nil(t, ds.Initialize())
+	var payloads []string
+	err = Stream(context.Background(), ds, "mytopic", 4, func(message *api.Message) error {
+		payloads = append(payloads, string(message.Payload))
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"payload", "again"}, payloads)
+
+	assert.Nil(t, ds.Truncate("mytopic", -1))
+	assert.Empty(t, memoryOffsets(t, ds, "mytopic", 0))
+	count, err := ds.NumMessages("mytopic")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), count)
+}
@@ -5,22 +5,38 @@
 package datastore
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/lulf/slim/pkg/api"
 )
 
+// MemoryDatastore keeps the messages of each topic in a ring buffer bounded
+// by the retention of the topic
 type MemoryDatastore struct {
 	mapLock   *sync.Mutex
-	topicLock map[string]*sync.Mutex
-	topicMap  map[string][]*api.Message
+	topicMap  map[string]*memoryTopic
+	retention *RetentionPolicy
+	// Set if the topics are persisted to disk
+	persistence *memoryPersistence
+}
+
+type memoryTopic struct {
+	lock     *sync.Mutex
+	messages *ring
 }
 
 func NewMemoryDatastore() (*MemoryDatastore, error) {
 	return &MemoryDatastore{
 		mapLock:   &sync.Mutex{},
-		topicMap:  make(map[string][]*api.Message, 0),
-		topicLock: make(map[string]*sync.Mutex, 0),
+		topicMap:  make(map[string]*memoryTopic, 0),
+		retention: NewRetentionPolicy(-1, -1),
 	}, nil
 }
 
@@ -32,68 +48,241 @@ func min(a int64, b int64) int64 {
 }
 
 func (m *MemoryDatastore) Initialize() error {
+	if m.persistence != nil {
+		return m.initialize()
+	}
 	return nil
 }
 
+func (m *MemoryDatastore) topic(topic string) (*memoryTopic, error) {
+	m.mapLock.Lock()
+	defer m.mapLock.Unlock()
+	t, ok := m.topicMap[topic]
+	if !ok {
+		return nil, fmt.Errorf("Unknown topic %s", topic)
+	}
+	return t, nil
+}
+
 func (m *MemoryDatastore) CreateTopic(topic string) error {
+	if m.persistence == nil {
+		m.createTopic(topic)
+		return nil
+	}
+	m.persistence.lock.RLock()
+	defer m.persistence.lock.RUnlock()
+	if m.createTopic(topic) {
+		return m.persistence.appendJournal(JOURNAL_CREATE, topic, nil)
+	}
+	return nil
+}
+
+// createTopic returns true if the topic did not exist
+func (m *MemoryDatastore) createTopic(topic string) bool {
 	m.mapLock.Lock()
 	defer m.mapLock.Unlock()
 
-	if _, ok := m.topicMap[topic]; !ok {
-		m.topicMap[topic] = make([]*api.Message, 0)
-		m.topicLock[topic] = &sync.Mutex{}
+	if _, ok := m.topicMap[topic]; ok {
+		return false
+	}
+	m.topicMap[topic] = &memoryTopic{
+		lock:     &sync.Mutex{},
+		messages: &ring{},
+	}
+	return true
+}
+
+func (m *MemoryDatastore) DeleteTopic(topic string) error {
+	if m.persistence == nil {
+		m.deleteTopic(topic)
+		return nil
+	}
+	m.persistence.lock.RLock()
+	defer m.persistence.lock.RUnlock()
+	if m.deleteTopic(topic) {
+		return m.persistence.appendJournal(JOURNAL_DELETE, topic, nil)
 	}
 	return nil
 }
 
+// deleteTopic returns true if the topic existed
+func (m *MemoryDatastore) deleteTopic(topic string) bool {
+	m.mapLock.Lock()
+	defer m.mapLock.Unlock()
+
+	_, ok := m.topicMap[topic]
+	delete(m.topicMap, topic)
+	return ok
+}
+
+// Snapshot writes the topics in the snapshot format of the memory
+// datastore to the memory directory of dir. The copy has no journal, so
+// its snapshots include no journal generation.
+func (m *MemoryDatastore) Snapshot(dir string) (map[string]int64, error) {
+	err := os.Mkdir(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	snapshotDir := filepath.Join(dir, "memory")
+	err = os.Mkdir(snapshotDir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	topics := m.copyTopics()
+	err = writeSnapshot(snapshotDir, topics, -1)
+	if err != nil {
+		log.Print("Writing snapshot:", err)
+		return nil, err
+	}
+	offsets := make(map[string]int64, len(topics))
+	for topic, messages := range topics {
+		offsets[topic] = -1
+		if len(messages) > 0 {
+			offsets[topic] = messages[len(messages)-1].Offset
+		}
+	}
+	return offsets, nil
+}
+
+// Flush writes a snapshot of the topics if they are persisted
 func (m *MemoryDatastore) Flush() error {
+	if m.persistence != nil {
+		return m.persist()
+	}
 	return nil
 }
 
+// InsertMessage appends a message, removing the oldest messages of the
+// topic if it exceeds its maximum number of messages or size
 func (m *MemoryDatastore) InsertMessage(topic string, message *api.Message) error {
-	m.topicLock[topic].Lock()
-	m.topicMap[topic] = append(m.topicMap[topic], message)
-	m.topicLock[topic].Unlock()
+	t, err := m.topic(topic)
+	if err != nil {
+		return err
+	}
+	if m.persistence != nil {
+		m.persistence.lock.RLock()
+		defer m.persistence.lock.RUnlock()
+		err = m.persistence.appendJournal(JOURNAL_INSERT, topic, message)
+		if err != nil {
+			return err
+		}
+	}
+	retention := m.retention.Get(topic)
+	t.lock.Lock()
+	t.messages.push(message)
+	t.messages.trim(retention, 0)
+	t.lock.Unlock()
 	return nil
 }
 
-func (m *MemoryDatastore) StreamMessages(topic string, offset int64, callback StreamingFunc) error {
-	m.topicLock[topic].Lock()
-	messages := m.topicMap[topic]
-	if offset > 0 {
-		offset = min(offset, int64(len(messages)))
-		messages = messages[offset:]
+// Truncate removes the messages of a topic after offset
+func (m *MemoryDatastore) Truncate(topic string, offset int64) error {
+	t, err := m.topic(topic)
+	if err != nil {
+		return err
 	}
-	for _, message := range messages {
-		err := callback(message)
+	if m.persistence != nil {
+		m.persistence.lock.RLock()
+		defer m.persistence.lock.RUnlock()
+		err = m.persistence.appendJournal(JOURNAL_TRUNCATE, topic, api.NewMessage(offset, nil))
 		if err != nil {
 			return err
 		}
 	}
-
-	defer m.topicLock[topic].Unlock()
+	t.lock.Lock()
+	t.messages.truncate(offset)
+	t.lock.Unlock()
 	return nil
 }
 
+func (m *MemoryDatastore) ReadMessages(ctx context.Context, topic string, offset int64) (MessageIterator, error) {
+	t, err := m.topic(topic)
+	if err != nil {
+		return nil, err
+	}
+	return &memoryIterator{
+		ctx:    ctx,
+		topic:  t,
+		offset: offset,
+	}, nil
+}
+
+type memoryIterator struct {
+	ctx    context.Context
+	topic  *memoryTopic
+	offset int64
+}
+
+// Next copies a batch of messages so that the topic is not locked while
+// they are processed. Reading continues from the oldest message retained if
+// the next offset has been removed.
+func (it *memoryIterator) Next() ([]*api.Message, error) {
+	if err := it.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	it.topic.lock.Lock()
+	messages := it.topic.messages
+	start := messages.search(it.offset)
+	end := int(min(int64(start+ReadBatchSize), int64(messages.len())))
+	batch := messages.slice(start, end)
+	it.topic.lock.Unlock()
+
+	if len(batch) == 0 {
+		return nil, io.EOF
+	}
+	it.offset = batch[len(batch)-1].Offset + 1
+	return batch, nil
+}
+
+func (it *memoryIterator) Close() {
+}
+
 func (m *MemoryDatastore) NumMessages(topic string) (int64, error) {
-	m.topicLock[topic].Lock()
-	defer m.topicLock[topic].Unlock()
-	return int64(len(m.topicMap[topic])), nil
+	t, err := m.topic(topic)
+	if err != nil {
+		return 0, err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return int64(t.messages.len()), nil
 }
 
 func (m *MemoryDatastore) LastOffset(topic string) (int64, error) {
-	m.topicLock[topic].Lock()
-	defer m.topicLock[topic].Unlock()
-	if len(m.topicMap[topic]) > 0 {
-		return m.topicMap[topic][len(m.topicMap[topic])-1].Offset, nil
+	t, err := m.topic(topic)
+	if err != nil {
+		return 0, err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.messages.len() > 0 {
+		return t.messages.at(t.messages.len() - 1).Offset, nil
 	}
 	return 0, nil
 }
 
+// GarbageCollect removes messages older than the maximum age of the topic,
+// and the oldest messages if its limits were lowered
 func (m *MemoryDatastore) GarbageCollect(topic string) error {
+	t, err := m.topic(topic)
+	if err != nil {
+		return err
+	}
+	retention := m.retention.Get(topic)
+	var oldest int64
+	if retention.MaxLogAge > 0 {
+		oldest = time.Now().UTC().Unix() - retention.MaxLogAge
+	}
+	t.lock.Lock()
+	t.messages.trim(retention, oldest)
+	t.lock.Unlock()
 	return nil
 }
 
+func (m *MemoryDatastore) RetentionPolicy() *RetentionPolicy {
+	return m.retention
+}
+
 func (m *MemoryDatastore) ListTopics() ([]string, error) {
 	m.mapLock.Lock()
 	defer m.mapLock.Unlock()
@@ -104,4 +293,8 @@ func (m *MemoryDatastore) ListTopics() ([]string, error) {
 	return keys, nil
 }
 
-func (m *MemoryDatastore) Close() {}
+func (m *MemoryDatastore) Close() {
+	if m.persistence != nil {
+		m.persistence.close()
+	}
+}
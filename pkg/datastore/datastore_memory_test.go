@@ -0,0 +1,294 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package datastore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lulf/slim/pkg/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func memoryOffsets(t *testing.T, ds Datastore, topic string, offset int64) []int64 {
+	var offsets []int64
+	err := Stream(context.Background(), ds, topic, offset, func(message *api.Message) error {
+		offsets = append(offsets, message.Offset)
+		return nil
+	})
+	assert.Nil(t, err)
+	return offsets
+}
+
+// currentJournal returns the path of the newest journal of dir
+func currentJournal(t *testing.T, dir string) string {
+	journals, err := listJournals(filepath.Join(dir, "memory"))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, journals)
+	return journalFileName(filepath.Join(dir, "memory"), journals[len(journals)-1])
+}
+
+func TestMemoryRingBuffer(t *testing.T) {
+	ds, err := NewMemoryDatastore()
+	assert.Nil(t, err)
+	ds.RetentionPolicy().Update(Retention{}, map[string]Retention{
+		"bycount": {MaxMessages: 5},
+		"bysize":  {MaxLogSize: 30},
+	})
+	assert.Nil(t, ds.CreateTopic("bycount"))
+	assert.Nil(t, ds.CreateTopic("bysize"))
+
+	// Offsets do not start at 0 and wrap around the buffer several times
+	for offset := int64(100); offset < 150; offset++ {
+		assert.Nil(t, ds.InsertMessage("bycount", api.NewMessage(offset, []byte("payload"))))
+		assert.Nil(t, ds.InsertMessage("bysize", api.NewMessage(offset, []byte("0123456789"))))
+	}
+
+	count, err := ds.NumMessages("bycount")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), count)
+	last, err := ds.LastOffset("bycount")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(149), last)
+	assert.Equal(t, []int64{147, 148, 149}, memoryOffsets(t, ds, "bycount", 147))
+
+	// Offsets no longer retained start at the oldest message retained
+	assert.Equal(t, []int64{145, 146, 147, 148, 149}, memoryOffsets(t, ds, "bycount", 0))
+
+	count, err = ds.NumMessages("bysize")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), count)
+	assert.Equal(t, []int64{147, 148, 149}, memoryOffsets(t, ds, "bysize", -1))
+
+	// Lowered limits apply when garbage collecting
+	ds.RetentionPolicy().Update(Retention{}, map[string]Retention{
+		"bycount": {MaxMessages: 2},
+	})
+	assert.Nil(t, ds.GarbageCollect("bycount"))
+	assert.Equal(t, []int64{148, 149}, memoryOffsets(t, ds, "bycount", 0))
+}
+
+func TestMemoryPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slim-memory")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ds, err := NewPersistentMemoryDatastore(dir, true, -1, -1)
+	assert.Nil(t, err)
+	assert.Nil(t, ds.Initialize())
+	assert.Nil(t, ds.CreateTopic("a/b"))
+	assert.Nil(t, ds.CreateTopic("deleted"))
+	for offset := int64(0); offset < 10; offset++ {
+		assert.Nil(t, ds.InsertMessage("a/b", api.NewMessage(offset, []byte("payload"))))
+		assert.Nil(t, ds.InsertMessage("deleted", api.NewMessage(offset, []byte("payload"))))
+	}
+	assert.Nil(t, ds.Flush())
+
+	// Changes after the snapshot are only in the journal
+	for offset := int64(10); offset < 15; offset++ {
+		assert.Nil(t, ds.InsertMessage("a/b", api.NewMessage(offset, []byte("payload"))))
+	}
+	assert.Nil(t, ds.DeleteTopic("deleted"))
+	assert.Nil(t, ds.CreateTopic("empty"))
+	ds.Close()
+
+	// A crash while writing leaves an incomplete entry at the end
+	journal, err := os.OpenFile(currentJournal(t, dir), os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, err = journal.Write([]byte{JOURNAL_INSERT, 3, 0})
+	assert.Nil(t, err)
+	journal.Close()
+
+	ds, err = NewPersistentMemoryDatastore(dir, true, -1, -1)
+	assert.Nil(t, err)
+	assert.Nil(t, ds.Initialize())
+	topics, err := ds.ListTopics()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"a/b", "empty"}, topics)
+	assert.Equal(t, []int64{13, 14}, memoryOffsets(t, ds, "a/b", 13))
+	count, err := ds.NumMessages("a/b")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(15), count)
+	ds.Close()
+
+	// Without a journal only the snapshot written when initializing remains
+	ds, err = NewPersistentMemoryDatastore(dir, false, -1, -1)
+	assert.Nil(t, err)
+	assert.Nil(t, ds.Initialize())
+	assert.Nil(t, ds.InsertMessage("a/b", api.NewMessage(15, []byte("payload"))))
+	ds.Close()
+
+	ds, err = NewPersistentMemoryDatastore(dir, false, -1, -1)
+	assert.Nil(t, err)
+	assert.Nil(t, ds.Initialize())
+	last, err := ds.LastOffset("a/b")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(14), last)
+
+	// Management snapshots are restored the same way
+	offsets, err := ds.Snapshot(filepath.Join(dir, "copy"))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int64{"a/b": 14, "empty": -1}, offsets)
+	ds.Close()
+
+	ds, err = NewPersistentMemoryDatastore(filepath.Join(dir, "copy"), false, -1, -1)
+	assert.Nil(t, err)
+	assert.Nil(t, ds.Initialize())
+	assert.Equal(t, []int64{13, 14}, memoryOffsets(t, ds, "a/b", 13))
+	ds.Close()
+}
+
+func TestMemoryPersistenceFailedSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slim-memory")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ds, err := NewPersistentMemoryDatastore(dir, true, -1, -1)
+	assert.Nil(t, err)
+	assert.Nil(t, ds.Initialize())
+	assert.Nil(t, ds.CreateTopic("topic"))
+	for offset := int64(0); offset < 5; offset++ {
+		assert.Nil(t, ds.InsertMessage("topic", api.NewMessage(offset, []byte("payload"))))
+	}
+	assert.Nil(t, ds.Flush())
+
+	// Snapshots fail while the temporary snapshot file can not be created
+	tmp := snapshotFileName(filepath.Join(dir, "memory"), "topic") + ".tmp"
+	assert.Nil(t, os.Mkdir(tmp, os.ModePerm))
+	for offset := int64(5); offset < 15; offset++ {
+		assert.Nil(t, ds.InsertMessage("topic", api.NewMessage(offset, []byte("payload"))))
+		if offset%5 == 4 {
+			assert.NotNil(t, ds.Flush())
+		}
+	}
+	ds.Close()
+	assert.Nil(t, os.Remove(tmp))
+
+	// The changes journaled before each failed snapshot are kept
+	ds, err = NewPersistentMemoryDatastore(dir, true, -1, -1)
+	assert.Nil(t, err)
+	assert.Nil(t, ds.Initialize())
+	count, err := ds.NumMessages("topic")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(15), count)
+	journals, err := listJournals(filepath.Join(dir, "memory"))
+	assert.Nil(t, err)
+	assert.Len(t, journals, 1)
+	ds.Close()
+}
+
+func TestMemoryPersistenceJournalGenerations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slim-memory")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ds, err := NewPersistentMemoryDatastore(dir, true, -1, -1)
+	assert.Nil(t, err)
+	assert.Nil(t, ds.Initialize())
+	assert.Nil(t, ds.CreateTopic("topic"))
+	for offset := int64(0); offset < 5; offset++ {
+		assert.Nil(t, ds.InsertMessage("topic", api.NewMessage(offset, []byte("old"))))
+	}
+	assert.Nil(t, ds.Flush())
+
+	// The topic is recreated in the journal included in the next snapshot
+	assert.Nil(t, ds.DeleteTopic("topic"))
+	assert.Nil(t, ds.CreateTopic("topic"))
+	for offset := int64(0); offset < 10; offset++ {
+		assert.Nil(t, ds.InsertMessage("topic", api.NewMessage(offset, []byte("new"))))
+	}
+	included := currentJournal(t, dir)
+	data, err := ioutil.ReadFile(included)
+	assert.Nil(t, err)
+	assert.Nil(t, ds.Flush())
+	assert.Nil(t, ds.InsertMessage("topic", api.NewMessage(10, []byte("new"))))
+	ds.Close()
+
+	// A crash before the included journal is removed leaves it behind, with
+	// the changes not yet written to disk missing
+	assert.Nil(t, ioutil.WriteFile(included, data[:len(data)/2], 0644))
+
+	ds, err = NewPersistentMemoryDatastore(dir, true, -1, -1)
+	assert.Nil(t, err)
+	assert.Nil(t, ds.Initialize())
+	assert.Equal(t, []int64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, memoryOffsets(t, ds, "topic", 0))
+	err = Stream(context.Background(), ds, "topic", 0, func(message *api.Message) error {
+		assert.Equal(t, "new", string(message.Payload))
+		return nil
+	})
+	assert.Nil(t, err)
+	ds.Close()
+}
+
+func TestMemoryTruncate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slim-memory")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ds, err := NewPersistentMemoryDatastore(dir, true, -1, -1)
+	assert.Nil(t, err)
+	assert.Nil(t, ds.Initialize())
+	assert.Nil(t, ds.CreateTopic("topic"))
+	for offset := int64(0); offset < 5; offset++ {
+		assert.Nil(t, ds.InsertMessage("topic", api.NewMessage(offset, []byte("payload"))))
+	}
+	assert.Nil(t, ds.Truncate("topic", 2))
+	assert.Equal(t, []int64{0, 1, 2}, memoryOffsets(t, ds, "topic", 0))
+	assert.Nil(t, ds.InsertMessage("topic", api.NewMessage(3, []byte("payload"))))
+	ds.Close()
+
+	// Truncation is replayed from the journal
+	ds, err = NewPersistentMemoryDatastore(dir, true, -1, -1)
+	assert.Nil(t, err)
+	assert.Nil(t, ds.Initialize())
+	assert.Equal(t, []int64{0, 1, 2, 3}, memoryOffsets(t, ds, "topic", 0))
+	ds.Close()
+}
+
+func TestMemoryStreamWithoutLock(t *testing.T) {
+	ds, err := NewMemoryDatastore()
+	assert.Nil(t, err)
+	assert.Nil(t, ds.CreateTopic("mytopic"))
+	assert.Nil(t, ds.InsertMessage("mytopic", api.NewMessage(0, []byte("payload"))))
+
+	// A consumer blocked while processing a message
+	delivered := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		done <- Stream(ctx, ds, "mytopic", 0, func(message *api.Message) error {
+			if message.Offset == 0 {
+				close(delivered)
+				<-release
+			}
+			return nil
+		})
+	}()
+	<-delivered
+
+	// Producers and other consumers of the topic proceed meanwhile
+	inserted := make(chan struct{})
+	go func() {
+		for offset := int64(1); offset < 10; offset++ {
+			assert.Nil(t, ds.InsertMessage("mytopic", api.NewMessage(offset, []byte("payload"))))
+		}
+		close(inserted)
+	}()
+	select {
+	case <-inserted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("InsertMessage blocked by a consumer")
+	}
+	assert.Equal(t, []int64{8, 9}, memoryOffsets(t, ds, "mytopic", 8))
+
+	close(release)
+	cancel()
+	<-done
+}
@@ -5,29 +5,53 @@
 package datastore
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"database/sql"
 
 	"github.com/lulf/slim/pkg/api"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 type SqlDatastore struct {
 	handle     *sql.DB
-	maxLogSize int64
-	maxLogAge  int64
+	retention  *RetentionPolicy
+	statements *statementCache
+}
+
+// Statements prepared once for each topic
+type topicStatements struct {
+	insert *sql.Stmt
+	read   *sql.Stmt
+}
+
+type statementCache struct {
+	lock   *sync.Mutex
+	topics map[string]*topicStatements
 }
 
 func (ds SqlDatastore) Close() {
+	ds.statements.lock.Lock()
+	for topic, stmts := range ds.statements.topics {
+		stmts.close()
+		delete(ds.statements.topics, topic)
+	}
+	ds.statements.lock.Unlock()
 	ds.handle.Close()
 }
 
 func NewSqliteDatastore(dataDir string, maxLogAge int64, maxLogSize int64) (*SqlDatastore, error) {
-	fileName := fmt.Sprintf("%s/store.sqlite", dataDir)
+	// Readers do not block the writer in WAL mode
+	fileName := fmt.Sprintf("%s/store.sqlite?_journal_mode=WAL&_busy_timeout=5000", dataDir)
 	db, err := sql.Open("sqlite3", fileName)
 	if err != nil {
 		log.Print("Opening Database:", err)
@@ -35,130 +59,301 @@ func NewSqliteDatastore(dataDir string, maxLogAge int64, maxLogSize int64) (*Sql
 	}
 
 	return &SqlDatastore{
-		handle:     db,
-		maxLogSize: maxLogSize,
-		maxLogAge:  maxLogAge,
+		handle:    db,
+		retention: NewRetentionPolicy(maxLogAge, maxLogSize),
+		statements: &statementCache{
+			lock:   &sync.Mutex{},
+			topics: make(map[string]*topicStatements),
+		},
 	}, nil
 }
 
-func (ds SqlDatastore) Initialize() error {
-	tableCreate := "create table if not exists topics (name text not null primary key, table_name text);"
-	_, err := ds.handle.Exec(tableCreate)
+// topicStatements returns the statements of a topic, preparing them the
+// first time they are used
+func (ds SqlDatastore) topicStatements(topic string) (*topicStatements, error) {
+	ds.statements.lock.Lock()
+	defer ds.statements.lock.Unlock()
+	if stmts, ok := ds.statements.topics[topic]; ok {
+		return stmts, nil
+	}
+
+	tableName, err := ds.tableName(topic)
 	if err != nil {
-		log.Print("Creating topics table:", err)
-		return err
+		return nil, err
 	}
-	return nil
+	insert, err := ds.handle.Prepare(fmt.Sprintf("INSERT INTO %s (id, insertion_time, payload) values(?, ?, ?)", tableName))
+	if err != nil {
+		log.Print("Preparing insert statement:", err)
+		return nil, err
+	}
+	read, err := ds.handle.Prepare(fmt.Sprintf("SELECT id, insertion_time, payload FROM %s WHERE id >= ? ORDER BY id ASC LIMIT ?", tableName))
+	if err != nil {
+		log.Print("Preparing query:", err)
+		insert.Close()
+		return nil, err
+	}
+	stmts := &topicStatements{
+		insert: insert,
+		read:   read,
+	}
+	ds.statements.topics[topic] = stmts
+	return stmts, nil
+}
+
+func (ds SqlDatastore) evictStatements(topic string) {
+	ds.statements.lock.Lock()
+	defer ds.statements.lock.Unlock()
+	if stmts, ok := ds.statements.topics[topic]; ok {
+		stmts.close()
+		delete(ds.statements.topics, topic)
+	}
+}
+
+func (stmts *topicStatements) close() {
+	stmts.insert.Close()
+	stmts.read.Close()
+}
+
+func (ds SqlDatastore) RetentionPolicy() *RetentionPolicy {
+	return ds.retention
+}
+
+var sqlMigrations = []migration{
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec("create table if not exists topics (name text not null primary key, table_name text);")
+		return err
+	},
+	// Rename tables named after their topic to generated names
+	func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT rowid, name, table_name FROM topics")
+		if err != nil {
+			return err
+		}
+		renames := make(map[int64]string)
+		for rows.Next() {
+			var id int64
+			var name string
+			var tableName sql.NullString
+			err = rows.Scan(&id, &name, &tableName)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			if !tableName.Valid {
+				tableName.String = "topic_" + name
+			}
+			if tableName.String != fmt.Sprintf("messages_%d", id) {
+				renames[id] = tableName.String
+			}
+		}
+		rows.Close()
+
+		for id, tableName := range renames {
+			generated := fmt.Sprintf("messages_%d", id)
+			_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s RENAME TO %s", quoteIdentifier(tableName), quoteIdentifier(generated)))
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec("UPDATE topics SET table_name = ? WHERE rowid = ?", generated, id)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	},
 }
 
+func (ds SqlDatastore) Initialize() error {
+	return migrate(ds.handle, sqlMigrations)
+}
+
+// CreateTopic stores the messages of the topic in a table named after the
+// row of the topic, so that topic names never appear in SQL statements
 func (ds SqlDatastore) CreateTopic(topic string) error {
-	// Create initial database table
 	tx, err := ds.handle.Begin()
 	if err != nil {
 		log.Print("Starting transaction:", err)
 		return err
 	}
 
-	createTopic, err := tx.Prepare("INSERT INTO topics (name, table_name) values(?, ?);")
+	result, err := tx.Exec("INSERT INTO topics (name) values(?);", topic)
 	if err != nil {
-		log.Print("Preparing create topic:", err)
+		log.Print("Create topic:", topic, err)
+		tx.Rollback()
 		return err
 	}
-	defer createTopic.Close()
-
-	topicTableName := getTopicTableName(topic)
-	createTable, err := tx.Prepare(fmt.Sprintf("create table if not exists %s (id integer not null primary key, insertion_time integer, payload text);", topicTableName))
+	id, err := result.LastInsertId()
 	if err != nil {
-		log.Print("Preparing create table:", err)
+		tx.Rollback()
 		return err
 	}
-	defer createTable.Close()
 
-	_, err = createTopic.Exec(topic, topicTableName)
+	tableName := fmt.Sprintf("messages_%d", id)
+	_, err = tx.Exec("UPDATE topics SET table_name = ? WHERE name = ?;", tableName, topic)
 	if err != nil {
 		log.Print("Create topic:", topic, err)
+		tx.Rollback()
 		return err
 	}
 
-	_, err = createTable.Exec()
+	_, err = tx.Exec(fmt.Sprintf("create table if not exists %s (id integer not null primary key, insertion_time integer, payload text);", quoteIdentifier(tableName)))
 	if err != nil {
-		log.Print("Creating topic table:", topicTableName, err)
+		log.Print("Creating topic table:", tableName, err)
+		tx.Rollback()
 		return err
 	}
 	return tx.Commit()
 }
 
-func (ds SqlDatastore) InsertMessage(topic string, message *api.Message) error {
+func (ds SqlDatastore) DeleteTopic(topic string) error {
+	ds.evictStatements(topic)
+	tableName, err := ds.tableName(topic)
+	if err != nil {
+		return err
+	}
+
 	tx, err := ds.handle.Begin()
 	if err != nil {
 		log.Print("Starting transaction:", err)
 		return err
 	}
 
-	insertionTime := time.Now().UTC().Unix()
+	_, err = tx.Exec("DELETE FROM topics WHERE name = ?", topic)
+	if err != nil {
+		log.Print("Deleting topic:", topic, err)
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", tableName))
+	if err != nil {
+		log.Print("Dropping topic table:", topic, err)
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
 
-	insertStmt, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s (id, insertion_time, payload) values(?, ?, ?)", getTopicTableName(topic)))
+func (ds SqlDatastore) InsertMessage(topic string, message *api.Message) error {
+	stmts, err := ds.topicStatements(topic)
 	if err != nil {
-		log.Print("Preparing insert statement:", err)
 		return err
 	}
-	defer insertStmt.Close()
 
-	_, err = insertStmt.Exec(message.Offset, insertionTime, message.Payload)
+	insertionTime := message.Timestamp
+	if insertionTime == 0 {
+		insertionTime = time.Now().UTC().Unix()
+	}
+
+	_, err = stmts.insert.Exec(message.Offset, insertionTime, message.Payload)
 	if err != nil {
 		log.Print("Inserting entry:", err)
 		return err
 	}
+	return nil
+}
 
-	return tx.Commit()
+func (ds SqlDatastore) Truncate(topic string, offset int64) error {
+	tableName, err := ds.tableName(topic)
+	if err != nil {
+		return err
+	}
+	_, err = ds.handle.Exec(fmt.Sprintf("DELETE FROM %s WHERE id > ?", tableName), offset)
+	if err != nil {
+		log.Print("Truncating topic:", topic, err)
+		return err
+	}
+	return nil
 }
 
 func (ds SqlDatastore) GarbageCollect(topic string) error {
+	tableName, err := ds.tableName(topic)
+	if err != nil {
+		return err
+	}
+
 	tx, err := ds.handle.Begin()
 	if err != nil {
 		log.Print("Starting transaction:", err)
 		return err
 	}
 
-	if ds.maxLogSize > 0 {
-		/*
-			removeStmt, err := tx.Prepare(fmt.Sprintf("DELETE FROM %s WHERE id NOT IN (SELECT id FROM %s ORDER BY id DESC LIMIT ?)")
-			if err != nil {
-				log.Print("Preparing remove statement:", err)
-				return err
-			}
-			defer removeStmt.Close()*/
+	retention := ds.retention.Get(topic)
+	if retention.MaxMessages > 0 {
+		_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE id <= (SELECT id FROM %s ORDER BY id DESC LIMIT 1 OFFSET ?)", tableName, tableName), retention.MaxMessages)
+		if err != nil {
+			log.Print("Removing oldest entries:", err)
+			tx.Rollback()
+			return err
+		}
+	}
 
-		/*
-			_, err = removeStmt.Exec()
-			if err != nil {
-				log.Print("Removing oldest entry:", err)
-				return err
-			}
-		*/
+	if retention.MaxLogSize > 0 {
+		cutoff, err := sizeCutoff(tx, tableName, retention.MaxLogSize)
+		if err == nil && cutoff >= 0 {
+			_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE id <= ?", tableName), cutoff)
+		}
+		if err != nil {
+			log.Print("Removing oldest entries:", err)
+			tx.Rollback()
+			return err
+		}
 	}
 
 	var removeByAge *sql.Stmt
-	if ds.maxLogAge > 0 {
+	if retention.MaxLogAge > 0 {
 		now := time.Now().UTC().Unix()
-		oldest := now - ds.maxLogAge
-		removeByAge, err = tx.Prepare(fmt.Sprintf("DELETE FROM %s WHERE insertion_time < ?", getTopicTableName(topic)))
+		oldest := now - retention.MaxLogAge
+		removeByAge, err = tx.Prepare(fmt.Sprintf("DELETE FROM %s WHERE insertion_time < ?", tableName))
 		if err != nil {
 			log.Print("Preparing remove statement:", err)
+			tx.Rollback()
 			return err
 		}
 		defer removeByAge.Close()
 		_, err = removeByAge.Exec(oldest)
 		if err != nil {
 			log.Print("Removing oldest entry:", err)
+			tx.Rollback()
 			return err
 		}
 	}
 	return tx.Commit()
 }
 
+// sizeCutoff returns the newest id of the messages that do not fit within
+// maxLogSize bytes of payload together with the messages after them, or -1
+// if all of them fit. The newest message is always kept.
+func sizeCutoff(tx *sql.Tx, tableName string, maxLogSize int64) (int64, error) {
+	rows, err := tx.Query(fmt.Sprintf("SELECT id, length(CAST(payload AS BLOB)) FROM %s ORDER BY id DESC", tableName))
+	if err != nil {
+		return -1, err
+	}
+	defer rows.Close()
+
+	var size int64
+	for kept := 0; rows.Next(); kept++ {
+		var id int64
+		var length sql.NullInt64
+		err = rows.Scan(&id, &length)
+		if err != nil {
+			return -1, err
+		}
+		size += length.Int64
+		if size > maxLogSize && kept > 0 {
+			return id, nil
+		}
+	}
+	return -1, rows.Err()
+}
+
 func (ds SqlDatastore) ListMessages(topic string, limit int64, offset int64, insertionTime int64) ([]*api.Message, error) {
-	stmt, err := ds.handle.Prepare(fmt.Sprintf("SELECT id, payload FROM %s WHERE id > ? AND insertion_time > ? ORDER BY id ASC LIMIT ?", getTopicTableName(topic)))
+	tableName, err := ds.tableName(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt, err := ds.handle.Prepare(fmt.Sprintf("SELECT id, insertion_time, payload FROM %s WHERE id > ? AND insertion_time > ? ORDER BY id ASC LIMIT ?", tableName))
 	if err != nil {
 		log.Print("Preparing query:", err)
 		return nil, err
@@ -170,53 +365,125 @@ func (ds SqlDatastore) ListMessages(topic string, limit int64, offset int64, ins
 		log.Print("Executing query:", err)
 		return nil, err
 	}
+	defer rows.Close()
 
 	var messages []*api.Message
 	for rows.Next() {
 		var id int64
+		var timestamp int64
 		var payload []byte
 
-		err = rows.Scan(&id, &payload)
+		err = rows.Scan(&id, &timestamp, &payload)
 		if err != nil {
 			log.Print("Scan row:", err)
 			return nil, err
 		}
 
-		messages = append(messages, api.NewMessage(id, payload))
+		message := api.NewMessage(id, payload)
+		message.Timestamp = timestamp
+		messages = append(messages, message)
 	}
 
 	return messages, nil
 }
 
-func (ds SqlDatastore) StreamMessages(topic string, offset int64, callback StreamingFunc) error {
-	messages, err := ds.ListMessages(topic, -1, offset, 0)
+func (ds SqlDatastore) ReadMessages(ctx context.Context, topic string, offset int64) (MessageIterator, error) {
+	stmts, err := ds.topicStatements(topic)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return &sqlIterator{
+		ctx:    ctx,
+		stmt:   stmts.read,
+		offset: offset,
+	}, nil
+}
+
+// sqlIterator reads pages of messages ordered by offset, starting each page
+// after the last offset read, so that no query is kept open between pages
+type sqlIterator struct {
+	ctx    context.Context
+	stmt   *sql.Stmt
+	offset int64
+}
+
+func (it *sqlIterator) Next() ([]*api.Message, error) {
+	if err := it.ctx.Err(); err != nil {
+		return nil, err
+	}
+	rows, err := it.stmt.QueryContext(it.ctx, it.offset, ReadBatchSize)
+	if err != nil {
+		log.Print("Executing query:", err)
+		return nil, err
 	}
-	for _, message := range messages {
-		err = callback(message)
+	defer rows.Close()
+
+	batch := make([]*api.Message, 0, ReadBatchSize)
+	for rows.Next() {
+		var id int64
+		var timestamp int64
+		var payload []byte
+
+		err = rows.Scan(&id, &timestamp, &payload)
 		if err != nil {
-			return err
+			log.Print("Scan row:", err)
+			return nil, err
 		}
+
+		message := api.NewMessage(id, payload)
+		message.Timestamp = timestamp
+		batch = append(batch, message)
 	}
-	return nil
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(batch) == 0 {
+		return nil, io.EOF
+	}
+	it.offset = batch[len(batch)-1].Offset + 1
+	return batch, nil
+}
+
+func (it *sqlIterator) Close() {
 }
 
 func (ds SqlDatastore) NumMessages(topic string) (int64, error) {
+	tableName, err := ds.tableName(topic)
+	if err != nil {
+		return 0, err
+	}
 	var count int64
-	row := ds.handle.QueryRow(fmt.Sprintf("SELECT COUNT(id) FROM %s", getTopicTableName(topic)))
-	err := row.Scan(&count)
+	row := ds.handle.QueryRow(fmt.Sprintf("SELECT COUNT(id) FROM %s", tableName))
+	err = row.Scan(&count)
 	return count, err
 }
 
-func getTopicTableName(topic string) string {
-	return fmt.Sprintf("topic_%s", topic)
+// tableName returns the quoted name of the table storing the messages of a
+// topic
+func (ds SqlDatastore) tableName(topic string) (string, error) {
+	var tableName sql.NullString
+	err := ds.handle.QueryRow("SELECT table_name FROM topics WHERE name = ?", topic).Scan(&tableName)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("Unknown topic %s", topic)
+	} else if err != nil {
+		return "", err
+	}
+	return quoteIdentifier(tableName.String), nil
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
 }
 
 func (ds SqlDatastore) LastOffset(topic string) (int64, error) {
+	tableName, err := ds.tableName(topic)
+	if err != nil {
+		return 0, err
+	}
 	var count sql.NullInt64
-	row := ds.handle.QueryRow(fmt.Sprintf("SELECT MAX(id) FROM %s", getTopicTableName(topic)))
-	err := row.Scan(&count)
+	row := ds.handle.QueryRow(fmt.Sprintf("SELECT MAX(id) FROM %s", tableName))
+	err = row.Scan(&count)
 	return count.Int64, err
 }
 
@@ -233,6 +500,7 @@ func (ds SqlDatastore) ListTopics() ([]string, error) {
 		log.Print("Executing query:", err)
 		return nil, err
 	}
+	defer rows.Close()
 
 	var topics []string = make([]string, 0)
 	for rows.Next() {
@@ -249,6 +517,79 @@ func (ds SqlDatastore) ListTopics() ([]string, error) {
 	return topics, nil
 }
 
+// Snapshot copies the database into dir using the sqlite online backup API
+func (ds SqlDatastore) Snapshot(dir string) (map[string]int64, error) {
+	err := os.Mkdir(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	dest, err := sql.Open("sqlite3", filepath.Join(dir, "store.sqlite"))
+	if err != nil {
+		log.Print("Opening Database:", err)
+		return nil, err
+	}
+	defer dest.Close()
+
+	ctx := context.Background()
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer destConn.Close()
+
+	srcConn, err := ds.handle.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer srcConn.Close()
+
+	err = destConn.Raw(func(destDriverConn interface{}) error {
+		return srcConn.Raw(func(srcDriverConn interface{}) error {
+			backup, err := destDriverConn.(*sqlite3.SQLiteConn).Backup("main", srcDriverConn.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			_, err = backup.Step(-1)
+			if err != nil {
+				backup.Finish()
+				return err
+			}
+			return backup.Finish()
+		})
+	})
+	if err != nil {
+		log.Print("Backing up database:", err)
+		return nil, err
+	}
+
+	snapshot := SqlDatastore{handle: dest}
+	topics, err := snapshot.ListTopics()
+	if err != nil {
+		return nil, err
+	}
+	offsets := make(map[string]int64, len(topics))
+	for _, topic := range topics {
+		count, err := snapshot.NumMessages(topic)
+		if err != nil {
+			return nil, err
+		}
+		offsets[topic] = -1
+		if count > 0 {
+			offsets[topic], err = snapshot.LastOffset(topic)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return offsets, nil
+}
+
+// Flush copies committed transactions from the write-ahead log into the database
 func (ds SqlDatastore) Flush() error {
-	return nil
+	_, err := ds.handle.Exec("PRAGMA wal_checkpoint(PASSIVE)")
+	if err != nil {
+		log.Print("Checkpointing write-ahead log:", err)
+	}
+	return err
 }
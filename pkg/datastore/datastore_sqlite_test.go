@@ -5,9 +5,11 @@
 package datastore
 
 import (
+	"context"
 	"fmt"
 	"github.com/lulf/slim/pkg/api"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"io/ioutil"
 	"testing"
 )
@@ -101,6 +103,152 @@ func TestListMessages(t *testing.T) {
 	assert.Equal(t, 1, len(lst))
 }
 
+func TestReadMessages(t *testing.T) {
+	f := tempDbFile(t, "readmessages")
+	ds, err := NewSqliteDatastore(f, 0, 0)
+	defer ds.Close()
+	assert.Nil(t, err)
+	ds.Initialize()
+
+	ds.CreateTopic("mytopic")
+	num := int64(ReadBatchSize + 10)
+	for offset := int64(0); offset < num; offset++ {
+		assert.Nil(t, ds.InsertMessage("mytopic", api.NewMessage(offset, []byte("payload"))))
+	}
+
+	// The message at the offset is included and batches are bounded
+	it, err := ds.ReadMessages(context.Background(), "mytopic", 5)
+	assert.Nil(t, err)
+	batch, err := it.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, ReadBatchSize, len(batch))
+	assert.Equal(t, int64(5), batch[0].Offset)
+	batch, err = it.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, int(num-5-ReadBatchSize), len(batch))
+	_, err = it.Next()
+	assert.Equal(t, io.EOF, err)
+
+	// Messages stored later are returned after io.EOF
+	assert.Nil(t, ds.InsertMessage("mytopic", api.NewMessage(num, []byte("payload"))))
+	batch, err = it.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(batch))
+	assert.Equal(t, num, batch[0].Offset)
+	it.Close()
+
+	// Streaming stops once the context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	var count int
+	err = Stream(ctx, ds, "mytopic", 0, func(message *api.Message) error {
+		count++
+		if count == 3 {
+			cancel()
+		}
+		return nil
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 3, count)
+}
+
+func TestStatementCache(t *testing.T) {
+	f := tempDbFile(t, "statements")
+	ds, err := NewSqliteDatastore(f, 0, 0)
+	defer ds.Close()
+	assert.Nil(t, err)
+	ds.Initialize()
+
+	var mode string
+	assert.Nil(t, ds.handle.QueryRow("PRAGMA journal_mode").Scan(&mode))
+	assert.Equal(t, "wal", mode)
+
+	assert.NotNil(t, ds.InsertMessage("mytopic", api.NewMessage(0, []byte("payload"))))
+
+	assert.Nil(t, ds.CreateTopic("mytopic"))
+	assert.Nil(t, ds.InsertMessage("mytopic", api.NewMessage(0, []byte("payload"))))
+	assert.Nil(t, ds.InsertMessage("mytopic", api.NewMessage(1, []byte("payload"))))
+
+	// Statements of a deleted topic are not reused for a new topic of the same name
+	assert.Nil(t, ds.DeleteTopic("mytopic"))
+	assert.Nil(t, ds.CreateTopic("mytopic"))
+	assert.Nil(t, ds.InsertMessage("mytopic", api.NewMessage(0, []byte("payload"))))
+	count, err := ds.NumMessages("mytopic")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), count)
+	assert.Nil(t, ds.Flush())
+}
+
+func TestTopicNames(t *testing.T) {
+	f := tempDbFile(t, "topicnames")
+	ds, err := NewSqliteDatastore(f, 0, 0)
+	defer ds.Close()
+	assert.Nil(t, err)
+	ds.Initialize()
+
+	names := []string{"my-topic", "my.topic", "my topic", "it's", `"quoted"`, "topic; DROP TABLE topics", "töpic/ü"}
+	for _, name := range names {
+		assert.Nil(t, ds.CreateTopic(name))
+		assert.Nil(t, ds.InsertMessage(name, api.NewMessage(0, []byte(name))))
+	}
+
+	topics, err := ds.ListTopics()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, names, topics)
+	for _, name := range names {
+		messages, err := ds.ListMessages(name, -1, -1, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(messages))
+		assert.Equal(t, name, string(messages[0].Payload))
+		assert.Nil(t, ds.GarbageCollect(name))
+	}
+
+	assert.Nil(t, ds.DeleteTopic("my-topic"))
+	_, err = ds.NumMessages("my-topic")
+	assert.NotNil(t, err)
+}
+
+func TestSchemaMigrations(t *testing.T) {
+	f := tempDbFile(t, "migrations")
+	ds, err := NewSqliteDatastore(f, 0, 0)
+	assert.Nil(t, err)
+
+	// Store written before schema versions, with tables named after topics
+	_, err = ds.handle.Exec("create table topics (name text not null primary key, table_name text);")
+	assert.Nil(t, err)
+	_, err = ds.handle.Exec("INSERT INTO topics (name, table_name) values('mytopic', 'topic_mytopic');")
+	assert.Nil(t, err)
+	_, err = ds.handle.Exec("create table topic_mytopic (id integer not null primary key, insertion_time integer, payload text);")
+	assert.Nil(t, err)
+	_, err = ds.handle.Exec("INSERT INTO topic_mytopic (id, insertion_time, payload) values(0, 1000, 'payload');")
+	assert.Nil(t, err)
+
+	assert.Nil(t, ds.Initialize())
+	count, err := ds.NumMessages("mytopic")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), count)
+	assert.Nil(t, ds.InsertMessage("mytopic", api.NewMessage(1, []byte("payload"))))
+
+	var version int
+	assert.Nil(t, ds.handle.QueryRow("SELECT version FROM schema_version").Scan(&version))
+	assert.Equal(t, len(sqlMigrations), version)
+
+	// Migrations are only run once
+	assert.Nil(t, ds.Initialize())
+	count, err = ds.NumMessages("mytopic")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), count)
+
+	// Stores written by newer versions are refused
+	_, err = ds.handle.Exec("UPDATE schema_version SET version = ?", len(sqlMigrations)+1)
+	assert.Nil(t, err)
+	ds.Close()
+
+	ds, err = NewSqliteDatastore(f, 0, 0)
+	assert.Nil(t, err)
+	defer ds.Close()
+	assert.NotNil(t, ds.Initialize())
+}
+
 func TestNumMessages(t *testing.T) {
 	f := tempDbFile(t, "numevents")
 	ds, err := NewSqliteDatastore(f, 6, 0)
@@ -126,10 +274,93 @@ func TestNumMessages(t *testing.T) {
 	assert.Equal(t, 0, int(count))
 }
 
+func TestTruncate(t *testing.T) {
+	f := tempDbFile(t, "truncate")
+	ds, err := NewSqliteDatastore(f, 0, 0)
+	defer ds.Close()
+	assert.Nil(t, err)
+	assert.Nil(t, ds.Initialize())
+
+	assert.Nil(t, ds.CreateTopic("mytopic"))
+	for offset := int64(0); offset < 5; offset++ {
+		assert.Nil(t, ds.InsertMessage("mytopic", api.NewMessage(offset, []byte("payload"))))
+	}
+	assert.Nil(t, ds.Truncate("mytopic", 2))
+	last, err := ds.LastOffset("mytopic")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), last)
+
+	// Removed offsets can be stored again
+	assert.Nil(t, ds.InsertMessage("mytopic", api.NewMessage(3, []byte("payload"))))
+	count, err := ds.NumMessages("mytopic")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), count)
+}
+
+func TestSnapshot(t *testing.T) {
+	f := tempDbFile(t, "snapshot")
+	ds, err := NewSqliteDatastore(f, 0, 0)
+	defer ds.Close()
+	assert.Nil(t, err)
+	ds.Initialize()
+
+	ds.CreateTopic("mytopic")
+	ds.CreateTopic("empty")
+	ds.InsertMessage("mytopic", api.NewMessage(1, []byte("payload1")))
+	ds.InsertMessage("mytopic", api.NewMessage(2, []byte("payload2")))
+
+	offsets, err := ds.Snapshot(f + "/snapshot")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int64{"mytopic": 2, "empty": -1}, offsets)
+
+	snapshot, err := NewSqliteDatastore(f+"/snapshot", 0, 0)
+	defer snapshot.Close()
+	assert.Nil(t, err)
+	count, err := snapshot.NumMessages("mytopic")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, int(count))
+}
+
 func countEntries(t *testing.T, ds *SqlDatastore) (int, error) {
 	var count int
-	row := ds.handle.QueryRow("SELECT COUNT(id) FROM topic_mytopic")
+	tableName, err := ds.tableName("mytopic")
+	assert.Nil(t, err)
+	row := ds.handle.QueryRow(fmt.Sprintf("SELECT COUNT(id) FROM %s", tableName))
 	assert.NotNil(t, row)
-	err := row.Scan(&count)
+	err = row.Scan(&count)
 	return count, err
 }
+
+func TestGarbageCollect(t *testing.T) {
+	f := tempDbFile(t, "gc")
+	ds, err := NewSqliteDatastore(f, -1, -1)
+	assert.Nil(t, err)
+	defer ds.Close()
+	assert.Nil(t, ds.Initialize())
+	assert.Nil(t, ds.CreateTopic("mytopic"))
+	for offset := int64(0); offset < 10; offset++ {
+		assert.Nil(t, ds.InsertMessage("mytopic", api.NewMessage(offset, []byte("payload"))))
+	}
+
+	ds.RetentionPolicy().Update(Retention{MaxMessages: 6}, nil)
+	assert.Nil(t, ds.GarbageCollect("mytopic"))
+	messages, err := ds.ListMessages("mytopic", 100, -1, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 6, len(messages))
+	assert.Equal(t, int64(4), messages[0].Offset)
+
+	ds.RetentionPolicy().Update(Retention{MaxLogSize: int64(3 * len("payload"))}, nil)
+	assert.Nil(t, ds.GarbageCollect("mytopic"))
+	messages, err = ds.ListMessages("mytopic", 100, -1, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(messages))
+	assert.Equal(t, int64(7), messages[0].Offset)
+
+	// The newest message is kept even if it is larger than the limit
+	ds.RetentionPolicy().Update(Retention{MaxLogSize: 1}, nil)
+	assert.Nil(t, ds.GarbageCollect("mytopic"))
+	messages, err = ds.ListMessages("mytopic", 100, -1, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(messages))
+	assert.Equal(t, int64(9), messages[0].Offset)
+}
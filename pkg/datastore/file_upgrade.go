@@ -0,0 +1,356 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package datastore
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Upgrades of the files of a file datastore written by older versions. The
+// file operations are not part of the transaction of the migration, so each
+// step can be repeated if the migration is interrupted.
+
+type legacyIndexEntry struct {
+	offset   int64
+	location int64
+}
+
+// moveTopicDirs moves the log of each topic from a directory named after
+// the topic to a directory named after its row
+func moveTopicDirs(dataDir string) migration {
+	return func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT rowid, name, data_dir FROM topics")
+		if err != nil {
+			return err
+		}
+		// Names of the topics still in directories named after them
+		legacyDirs := make(map[int64]string)
+		for rows.Next() {
+			var id int64
+			var name string
+			var dir sql.NullString
+			err = rows.Scan(&id, &name, &dir)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			if dir.String != topicDirName(id) {
+				legacyDirs[id] = name
+			}
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		for id, name := range legacyDirs {
+			dst := filepath.Join(dataDir, topicDirName(id), "0")
+			err = moveTopicDir(dataDir, name, dst)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec("UPDATE topics SET data_dir = ? WHERE rowid = ?", topicDirName(id), id)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Roots of the directories named after topics. The first versions wrote
+// them relative to the working directory, whatever the data directory.
+func legacyRoots(dataDir string) []string {
+	if filepath.Clean(dataDir) == "data" {
+		return []string{dataDir}
+	}
+	return []string{dataDir, "data"}
+}
+
+// moveTopicDir moves the log of a topic from the directory named after it
+// to dst, unless it was already moved. A log that is not found fails the
+// migration rather than leaving the topic empty.
+func moveTopicDir(dataDir string, topic string, dst string) error {
+	var sources []string
+	for _, root := range legacyRoots(dataDir) {
+		src := filepath.Join(root, topic, "0")
+		if src == dst {
+			return nil
+		}
+		if _, err := os.Stat(src); err == nil {
+			sources = append(sources, src)
+		}
+	}
+	if _, err := os.Stat(dst); err == nil {
+		if len(sources) > 0 {
+			return fmt.Errorf("Cannot move %s to %s, which already exists", sources[0], dst)
+		}
+		return nil
+	}
+	if len(sources) == 0 {
+		return fmt.Errorf("Log of topic '%s' not found in %s", topic, strings.Join(legacyRoots(dataDir), " or "))
+	}
+	if len(sources) > 1 {
+		return fmt.Errorf("Log of topic '%s' found in both %s and %s", topic, sources[0], sources[1])
+	}
+
+	err := os.MkdirAll(filepath.Dir(dst), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(sources[0], dst)
+	if err != nil {
+		return err
+	}
+	for _, root := range legacyRoots(dataDir) {
+		if strings.HasPrefix(sources[0], root+string(os.PathSeparator)) {
+			removeEmptyDirs(filepath.Dir(sources[0]), root)
+			break
+		}
+	}
+	return nil
+}
+
+// removeEmptyDirs removes dir and its parents up to root while they are empty
+func removeEmptyDirs(dir string, root string) {
+	for strings.HasPrefix(dir, root+string(os.PathSeparator)) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// convertSegments converts the segments of every topic written before the
+// segment files had a versioned header
+func convertSegments(dataDir string) migration {
+	return func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT data_dir FROM topics")
+		if err != nil {
+			return err
+		}
+		var dirs []string
+		for rows.Next() {
+			var dir sql.NullString
+			err = rows.Scan(&dir)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			dirs = append(dirs, dir.String)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		for _, dir := range dirs {
+			err = convertSegment(filepath.Join(dataDir, dir, "0"))
+			if err != nil {
+				log.Print("Converting segment of ", dir, ":", err)
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// convertSegment writes a converted copy of a segment next to it and
+// replaces the segment with it, keeping the original until it is replaced
+func convertSegment(dir string) error {
+	converted := dir + ".new"
+	original := dir + ".old"
+	if _, err := os.Stat(original); err == nil {
+		// Interrupted while replacing the segment
+		if _, err := os.Stat(dir); err == nil {
+			return os.RemoveAll(original)
+		}
+		err = os.Rename(original, dir)
+		if err != nil {
+			return err
+		}
+	}
+	err := os.RemoveAll(converted)
+	if err != nil {
+		return err
+	}
+
+	indexPath := filepath.Join(dir, "index.bin")
+	dataPath := filepath.Join(dir, "data.bin")
+	if !fileExists(indexPath) || !fileExists(dataPath) {
+		return nil
+	}
+	versioned, err := isVersioned(indexPath)
+	if err != nil || versioned {
+		return err
+	}
+
+	err = os.Mkdir(converted, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	err = writeConvertedSegment(indexPath, dataPath, converted)
+	if err != nil {
+		os.RemoveAll(converted)
+		return err
+	}
+	err = os.Rename(dir, original)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(converted, dir)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(original)
+}
+
+// writeConvertedSegment writes the indexed records of a legacy segment to
+// dir in the current format. Records written before records had a
+// timestamp get the time of the conversion.
+func writeConvertedSegment(indexPath string, dataPath string, dir string) error {
+	index, err := ioutil.ReadFile(indexPath)
+	if err != nil {
+		return err
+	}
+	data, err := os.Open(dataPath)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+
+	startOffset, indexEnd := legacyMetadata(index)
+	var entries []legacyIndexEntry
+	for loc := int64(16); loc+INDEX_ENTRY_SZ <= indexEnd && loc+INDEX_ENTRY_SZ <= int64(len(index)); loc += INDEX_ENTRY_SZ {
+		entries = append(entries, legacyIndexEntry{
+			offset:   int64(binary.LittleEndian.Uint64(index[loc : loc+8])),
+			location: int64(binary.LittleEndian.Uint64(index[loc+8 : loc+16])),
+		})
+	}
+
+	dataHdr := make([]byte, 16)
+	_, err = io.ReadFull(data, dataHdr)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	_, dataEnd := legacyMetadata(dataHdr)
+
+	headerSize, err := legacyRecordHeaderSize(data, entries, dataEnd)
+	if err != nil {
+		return fmt.Errorf("%s: %v", dataPath, err)
+	}
+
+	dataOut, err := os.Create(filepath.Join(dir, "data.bin"))
+	if err != nil {
+		return err
+	}
+	defer dataOut.Close()
+	indexOut, err := os.Create(filepath.Join(dir, "index.bin"))
+	if err != nil {
+		return err
+	}
+	defer indexOut.Close()
+
+	now := time.Now().UTC().Unix()
+	dataWriter := bufio.NewWriter(dataOut)
+	indexWriter := bufio.NewWriter(indexOut)
+	dataLocation := METADATA_SZ
+	// The data file ends with the last record, which is updated once written
+	dataWriter.Write(metadata(0, METADATA_SZ))
+	indexWriter.Write(metadata(startOffset, METADATA_SZ+int64(len(entries))*INDEX_ENTRY_SZ))
+	for _, entry := range entries {
+		hdr := make([]byte, headerSize)
+		_, err = data.ReadAt(hdr, entry.location)
+		if err != nil {
+			return err
+		}
+		timestamp := now
+		if headerSize == RECORD_HEADER_SZ {
+			timestamp = int64(binary.LittleEndian.Uint64(hdr[8:16]))
+		}
+		size := int64(binary.LittleEndian.Uint64(hdr[headerSize-8 : headerSize]))
+		if size < 0 || entry.location+headerSize+size > dataEnd {
+			return fmt.Errorf("%s: record at %d with size %d extends past the end of the data", dataPath, entry.location, size)
+		}
+		payload := make([]byte, size)
+		_, err = data.ReadAt(payload, entry.location+headerSize)
+		if err != nil {
+			return err
+		}
+
+		binary.Write(indexWriter, binary.LittleEndian, entry.offset)
+		binary.Write(indexWriter, binary.LittleEndian, dataLocation)
+		binary.Write(dataWriter, binary.LittleEndian, entry.offset)
+		binary.Write(dataWriter, binary.LittleEndian, timestamp)
+		binary.Write(dataWriter, binary.LittleEndian, size)
+		dataWriter.Write(payload)
+		dataLocation += RECORD_HEADER_SZ + size
+	}
+
+	for _, w := range []*bufio.Writer{dataWriter, indexWriter} {
+		err = w.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	_, err = dataOut.WriteAt(metadata(0, dataLocation), 0)
+	if err != nil {
+		return err
+	}
+	for _, f := range []*os.File{dataOut, indexOut} {
+		err = f.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// legacyMetadata returns the start offset and file location of a file
+// written before headers were versioned
+func legacyMetadata(hdr []byte) (int64, int64) {
+	if len(hdr) < 16 {
+		return 0, 16
+	}
+	return int64(binary.LittleEndian.Uint64(hdr[0:8])), int64(binary.LittleEndian.Uint64(hdr[8:16]))
+}
+
+// legacyRecordHeaderSize finds the size of the record headers of a legacy
+// data file, which had no timestamp in the oldest versions. The first
+// indexed record must have the offset of its index entry and end where the
+// next one starts.
+func legacyRecordHeaderSize(data *os.File, entries []legacyIndexEntry, dataEnd int64) (int64, error) {
+	if len(entries) == 0 {
+		return 16, nil
+	}
+	first := entries[0]
+	for _, headerSize := range []int64{16, RECORD_HEADER_SZ} {
+		hdr := make([]byte, headerSize)
+		_, err := data.ReadAt(hdr, first.location)
+		if err != nil {
+			continue
+		}
+		offset := int64(binary.LittleEndian.Uint64(hdr[0:8]))
+		size := int64(binary.LittleEndian.Uint64(hdr[headerSize-8 : headerSize]))
+		end := first.location + headerSize + size
+		if offset != first.offset || size < 0 {
+			continue
+		}
+		if (len(entries) > 1 && end == entries[1].location) || (len(entries) == 1 && end <= dataEnd) {
+			return headerSize, nil
+		}
+	}
+	return 0, fmt.Errorf("unrecognized record layout")
+}
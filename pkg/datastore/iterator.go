@@ -0,0 +1,50 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package datastore
+
+import (
+	"context"
+	"io"
+
+	"github.com/lulf/slim/pkg/api"
+)
+
+// Maximum number of messages returned by a call to MessageIterator.Next
+const ReadBatchSize = 128
+
+// MessageIterator reads the messages of a topic in order. Next returns the
+// next batch of at most ReadBatchSize messages, or io.EOF if no more
+// messages are stored. Messages stored later are returned by later calls.
+// Next returns the error of the context once it is done.
+type MessageIterator interface {
+	Next() ([]*api.Message, error)
+	Close()
+}
+
+// Stream calls callback for the messages of a topic starting at offset until
+// the last message stored, ctx is done or callback returns an error.
+func Stream(ctx context.Context, ds Datastore, topic string, offset int64, callback StreamingFunc) error {
+	it, err := ds.ReadMessages(ctx, topic, offset)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	for {
+		batch, err := it.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for _, message := range batch {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := callback(message); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -7,6 +7,7 @@ package datastore
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"golang.org/x/exp/mmap"
 	"io"
 	// "log"
@@ -36,7 +37,27 @@ func fileExists(filename string) bool {
 	return !info.IsDir()
 }
 
-const METADATA_SZ int64 = int64(16)
+// Index and data files start with a metadata header:
+//
+//	magic        [4]byte "SLIM"
+//	version      uint32  format of the file
+//	startOffset  int64   offset of the first entry of an index file
+//	fileLocation int64   location where the next entry will be written
+//
+// Files written before the header was versioned start directly with the
+// start offset and file location, and are converted by a migration of the
+// file datastore.
+const METADATA_SZ int64 = int64(24)
+
+const SEGMENT_MAGIC = "SLIM"
+
+const SEGMENT_FORMAT_VERSION uint32 = 1
+
+// Each record in the data file is prefixed with its offset, timestamp and payload size
+const RECORD_HEADER_SZ int64 = int64(24)
+
+// Each entry in the index file holds the offset and location of the record in the data file
+const INDEX_ENTRY_SZ int64 = int64(16)
 
 func OpenMapped(path string) (*mappedFile, error) {
 	exists := true
@@ -55,7 +76,7 @@ func OpenMapped(path string) (*mappedFile, error) {
 	}
 
 	startOffset := int64(0)
-	fileLocation := int64(16)
+	fileLocation := METADATA_SZ
 
 	if !exists {
 		finfo, err = os.Stat(path)
@@ -63,14 +84,14 @@ func OpenMapped(path string) (*mappedFile, error) {
 			return nil, err
 		}
 	}
-	if finfo.Size() > 0 {
-		hdr := make([]byte, 16)
-		_, err := reader.ReadAt(hdr, 0)
+	fresh := finfo.Size() == 0
+	if !fresh {
+		startOffset, fileLocation, err = readMetadata(path, reader)
 		if err != nil {
+			reader.Close()
+			handle.Close()
 			return nil, err
 		}
-		startOffset = int64(binary.LittleEndian.Uint64(hdr[0:8]))
-		fileLocation = int64(binary.LittleEndian.Uint64(hdr[8:16]))
 	}
 
 	file := &mappedFile{
@@ -82,12 +103,12 @@ func OpenMapped(path string) (*mappedFile, error) {
 		fileLocation: fileLocation,
 		size:         finfo.Size(),
 	}
-	err = file.ensureAvailable(16)
+	err = file.ensureAvailable(METADATA_SZ)
 	if err != nil {
 		return nil, err
 	}
-	if !exists {
-		err = file.updateMetadata(startOffset, fileLocation)
+	if fresh {
+		err = file.writeHeader()
 		if err != nil {
 			return nil, err
 		}
@@ -95,12 +116,115 @@ func OpenMapped(path string) (*mappedFile, error) {
 	return file, nil
 }
 
+// readMetadata returns the start offset and file location of a file,
+// refusing files not in the current format
+func readMetadata(path string, reader *mmap.ReaderAt) (int64, int64, error) {
+	if int64(reader.Len()) < METADATA_SZ {
+		return 0, 0, fmt.Errorf("%s: file is smaller than the %d byte metadata header", path, METADATA_SZ)
+	}
+	hdr := make([]byte, METADATA_SZ)
+	_, err := reader.ReadAt(hdr, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	if string(hdr[0:4]) != SEGMENT_MAGIC {
+		return 0, 0, fmt.Errorf("%s: file is in a format written by an older version, which must be migrated first", path)
+	}
+	if version := binary.LittleEndian.Uint32(hdr[4:8]); version != SEGMENT_FORMAT_VERSION {
+		return 0, 0, fmt.Errorf("%s: file format version %d is not the supported version %d", path, version, SEGMENT_FORMAT_VERSION)
+	}
+	return int64(binary.LittleEndian.Uint64(hdr[8:16])), int64(binary.LittleEndian.Uint64(hdr[16:24])), nil
+}
+
+// isVersioned returns true if the file at path starts with the magic of
+// versioned files
+func isVersioned(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	magic := make([]byte, len(SEGMENT_MAGIC))
+	_, err = io.ReadFull(f, magic)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return string(magic) == SEGMENT_MAGIC, nil
+}
+
+// OpenMappedReadOnly maps an existing file for reading without creating,
+// growing or otherwise modifying it.
+func OpenMappedReadOnly(path string) (*mappedFile, error) {
+	reader, err := mmap.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	startOffset, fileLocation, err := readMetadata(path, reader)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+
+	return &mappedFile{
+		path:         path,
+		lock:         &sync.RWMutex{},
+		reader:       reader,
+		startOffset:  startOffset,
+		fileLocation: fileLocation,
+		size:         int64(reader.Len()),
+	}, nil
+}
+
 func (f *mappedFile) Close() error {
 	f.reader.Close()
-	f.handle.Close()
+	if f.handle != nil {
+		f.handle.Close()
+	}
 	return nil
 }
 
+// StartOffset returns the offset of the first entry in an index file
+func (f *mappedFile) StartOffset() int64 {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.startOffset
+}
+
+// FileLocation returns the location where the next entry will be written
+func (f *mappedFile) FileLocation() int64 {
+	return atomic.LoadInt64(&f.fileLocation)
+}
+
+func (f *mappedFile) Size() int64 {
+	return f.size
+}
+
+// ReadIndexEntry reads the offset and data file location of the entry at
+// position idx in an index file.
+func (f *mappedFile) ReadIndexEntry(idx int64) (int64, int64, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	loc := METADATA_SZ + idx*INDEX_ENTRY_SZ
+	if idx < 0 || loc+INDEX_ENTRY_SZ > atomic.LoadInt64(&f.fileLocation) {
+		return -1, -1, io.EOF
+	}
+	entry := make([]byte, INDEX_ENTRY_SZ)
+	_, err := f.reader.ReadAt(entry, loc)
+	if err != nil {
+		return -1, -1, err
+	}
+	return int64(binary.LittleEndian.Uint64(entry[0:8])), int64(binary.LittleEndian.Uint64(entry[8:16])), nil
+}
+
+// RecordSize returns the size including header of a record read from a data file
+func RecordSize(message *api.Message) int64 {
+	return RECORD_HEADER_SZ + int64(len(message.Payload))
+}
+
 func (f *mappedFile) ensureAvailable(sz int64) error {
 	//log.Println("ensureAvailable", sz, f.available, f.size)
 	if f.size-f.fileLocation < sz {
@@ -129,13 +253,14 @@ func (f *mappedFile) ensureAvailable(sz int64) error {
 }
 
 func (f *mappedFile) AppendMessage(message *api.Message) (int64, error) {
-	nbytes := int64(len(message.Payload) + 16)
+	nbytes := int64(len(message.Payload)) + RECORD_HEADER_SZ
 	err := f.ensureAvailable(nbytes)
 	if err != nil {
 		return -1, err
 	}
 	szbuf := new(bytes.Buffer)
 	binary.Write(szbuf, binary.LittleEndian, message.Offset)
+	binary.Write(szbuf, binary.LittleEndian, message.Timestamp)
 	binary.Write(szbuf, binary.LittleEndian, int64(len(message.Payload)))
 	// log.Println("Writing", f.path, message.Offset, len(message.Payload), message.Payload, f.fileLocation)
 
@@ -144,7 +269,7 @@ func (f *mappedFile) AppendMessage(message *api.Message) (int64, error) {
 	if err != nil {
 		return -1, err
 	}
-	_, err = f.handle.WriteAt(message.Payload, f.fileLocation+16)
+	_, err = f.handle.WriteAt(message.Payload, f.fileLocation+RECORD_HEADER_SZ)
 	if err != nil {
 		return -1, err
 	}
@@ -155,21 +280,38 @@ func (f *mappedFile) Sync() error {
 	return f.handle.Sync()
 }
 
+func (f *mappedFile) writeHeader() error {
+	_, err := f.handle.WriteAt(metadata(f.startOffset, f.fileLocation), 0)
+	return err
+}
+
 func (f *mappedFile) updateMetadata(startOffset int64, fileLocation int64) error {
+	// log.Println("Update metadata", f.path, startOffset, fileLocation)
+	_, err := f.handle.WriteAt(metadata(startOffset, fileLocation)[8:], 8)
+	return err
+}
+
+func metadata(startOffset int64, fileLocation int64) []byte {
 	buf := new(bytes.Buffer)
+	buf.WriteString(SEGMENT_MAGIC)
+	binary.Write(buf, binary.LittleEndian, SEGMENT_FORMAT_VERSION)
 	binary.Write(buf, binary.LittleEndian, startOffset)
 	binary.Write(buf, binary.LittleEndian, fileLocation)
-	// log.Println("Update metadata", f.path, startOffset, fileLocation)
-	_, err := f.handle.WriteAt(buf.Bytes(), 0)
-	return err
+	return buf.Bytes()
 }
 
 func (f *mappedFile) AppendIndex(offset int64, fileOffset int64) error {
-	nbytes := int64(16)
+	nbytes := INDEX_ENTRY_SZ
 	err := f.ensureAvailable(nbytes)
 	if err != nil {
 		return err
 	}
+	// The first entry written determines the offset the index starts at
+	if f.fileLocation == METADATA_SZ {
+		f.lock.Lock()
+		f.startOffset = offset
+		f.lock.Unlock()
+	}
 	indexBuf := new(bytes.Buffer)
 	binary.Write(indexBuf, binary.LittleEndian, offset)
 	binary.Write(indexBuf, binary.LittleEndian, fileOffset)
@@ -185,49 +327,105 @@ func (f *mappedFile) ReadMessageAt(fileLocation int64) (*api.Message, error) {
 	f.lock.RLock()
 	defer f.lock.RUnlock()
 
-	hdr := make([]byte, 16)
+	hdr := make([]byte, RECORD_HEADER_SZ)
 	_, err := f.reader.ReadAt(hdr, fileLocation)
 	if err != nil {
 		return nil, err
 	}
 	offset := int64(binary.LittleEndian.Uint64(hdr[0:8]))
-	sz := int64(binary.LittleEndian.Uint64(hdr[8:16]))
+	timestamp := int64(binary.LittleEndian.Uint64(hdr[8:16]))
+	sz := int64(binary.LittleEndian.Uint64(hdr[16:24]))
 	// log.Println("ReadMessageAt", f.path, offset, sz, fileLocation)
+	if sz < 0 || fileLocation+RECORD_HEADER_SZ+sz > f.size {
+		return nil, fmt.Errorf("%s: record at %d with size %d extends past end of file", f.path, fileLocation, sz)
+	}
 
 	d := make([]byte, sz)
-	_, err = f.reader.ReadAt(d, fileLocation+16)
+	_, err = f.reader.ReadAt(d, fileLocation+RECORD_HEADER_SZ)
 	if err != nil {
 		return nil, err
 	}
 	data := api.NewMessage(offset, d)
+	data.Timestamp = timestamp
 	return data, nil
 }
 
-func (f *mappedFile) ReadFileOffset(offset int64) (int64, error) {
+// SearchIndex returns the position in an index file of the first entry with
+// an offset at or after the given offset, or NumEntries() if there is none.
+// Offsets are increasing but need not be contiguous.
+func (f *mappedFile) SearchIndex(offset int64) (int64, error) {
 	f.lock.RLock()
 	defer f.lock.RUnlock()
 
-	loc := METADATA_SZ + f.startOffset + (offset * 16)
-	// log.Println("Read File Offset", f.path, loc, f.fileLocation)
-	if loc > atomic.LoadInt64(&f.fileLocation)-16 {
-		return -1, io.EOF
+	entry := make([]byte, 8)
+	lo, hi := int64(0), f.NumEntries()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		_, err := f.reader.ReadAt(entry, METADATA_SZ+mid*INDEX_ENTRY_SZ)
+		if err != nil {
+			return -1, err
+		}
+		if int64(binary.LittleEndian.Uint64(entry)) < offset {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
 	}
-	hdr := make([]byte, 16)
-	_, err := f.reader.ReadAt(hdr, loc)
+	return lo, nil
+}
+
+// CopyTo writes a copy of the file up to the given file location to path,
+// with the metadata updated to end at that location.
+func (f *mappedFile) CopyTo(path string, fileLocation int64) error {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	if fileLocation < METADATA_SZ || fileLocation > f.size {
+		return fmt.Errorf("%s: invalid file location %d", f.path, fileLocation)
+	}
+
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
 	if err != nil {
-		return -1, err
+		return err
 	}
-	// log.Println("Record", int64(binary.LittleEndian.Uint64(hdr[0:8])), int64(binary.LittleEndian.Uint64(hdr[8:16])))
-	return int64(binary.LittleEndian.Uint64(hdr[8:16])), nil
+	defer out.Close()
+
+	_, err = out.Write(metadata(f.startOffset, fileLocation))
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, io.NewSectionReader(f.reader, METADATA_SZ, fileLocation-METADATA_SZ))
+	if err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// Truncate discards the entries from fileLocation on, which are overwritten
+// by the entries appended next
+func (f *mappedFile) Truncate(fileLocation int64) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if fileLocation < METADATA_SZ || fileLocation > atomic.LoadInt64(&f.fileLocation) {
+		return fmt.Errorf("%s: invalid file location %d", f.path, fileLocation)
+	}
+	atomic.StoreInt64(&f.fileLocation, fileLocation)
+	return f.updateMetadata(f.startOffset, fileLocation)
+}
+
+// NumEntries returns the number of entries in an index file
+func (f *mappedFile) NumEntries() int64 {
+	return (atomic.LoadInt64(&f.fileLocation) - METADATA_SZ) / INDEX_ENTRY_SZ
 }
 
 func (f *mappedFile) ReadLastOffset() (int64, error) {
 	f.lock.RLock()
 	defer f.lock.RUnlock()
 
-	loc := f.fileLocation - 16
+	loc := f.fileLocation - INDEX_ENTRY_SZ
 	// log.Println("Read File Offset", f.path, loc, f.fileLocation)
-	if loc < 16 {
+	if loc < METADATA_SZ {
 		return -1, nil
 	}
 	hdr := make([]byte, 16)
@@ -0,0 +1,506 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package datastore
+
+// The memory datastore may persist each topic to a snapshot file in the
+// memory directory of the data directory:
+//
+//	magic      [8]byte "SLIMSNAP"
+//	generation int64 of the last journal included in the snapshot
+//
+// followed by a record for each message:
+//
+//	offset    int64
+//	timestamp int64
+//	length    int64 length of the payload
+//	payload   [length]byte
+//
+// Changes since the last snapshot are optionally appended to a journal of
+// entries. Each snapshot starts a new journal, named journal.<generation>
+// with the generation increased by one, and removes the journals it
+// includes once written:
+//
+//	kind    uint8 (JOURNAL_CREATE, JOURNAL_DELETE, JOURNAL_INSERT or JOURNAL_TRUNCATE)
+//	length  uint32 length of the topic name
+//	topic   [length]byte
+//	record  of the message for JOURNAL_INSERT, or of an empty message with
+//	        the offset to truncate after for JOURNAL_TRUNCATE
+//
+// All integers are little endian.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lulf/slim/pkg/api"
+)
+
+const SNAPSHOT_MAGIC = "SLIMSNAP"
+
+const (
+	JOURNAL_CREATE   uint8 = 1
+	JOURNAL_DELETE   uint8 = 2
+	JOURNAL_INSERT   uint8 = 3
+	JOURNAL_TRUNCATE uint8 = 4
+)
+
+// Largest payload accepted when reading, to avoid allocating garbage from a corrupt file
+const MAX_RECORD_SZ int64 = 256 * 1024 * 1024
+
+const snapshotSuffix = ".snapshot"
+
+const journalPrefix = "journal."
+
+type memoryPersistence struct {
+	dir string
+	// Held exclusively while copying the topics for a snapshot, so that
+	// changes are either part of the snapshot or of the new journal
+	lock *sync.RWMutex
+	// Serializes snapshots
+	snapshotLock *sync.Mutex
+	useJournal   bool
+	journalLock  *sync.Mutex
+	journal      *os.File
+	// Generation of the current journal, changed with the persistence lock
+	// held exclusively
+	generation int64
+}
+
+// NewPersistentMemoryDatastore creates a memory datastore that restores its
+// topics from the memory directory of dataDir when initialized, and writes
+// snapshots of them there when flushed. With journal set, changes between
+// snapshots are also appended to a journal.
+func NewPersistentMemoryDatastore(dataDir string, journal bool, maxLogAge int64, maxLogSize int64) (*MemoryDatastore, error) {
+	ds, err := NewMemoryDatastore()
+	if err != nil {
+		return nil, err
+	}
+	ds.retention = NewRetentionPolicy(maxLogAge, maxLogSize)
+	ds.persistence = &memoryPersistence{
+		dir:          filepath.Join(dataDir, "memory"),
+		lock:         &sync.RWMutex{},
+		snapshotLock: &sync.Mutex{},
+		useJournal:   journal,
+		journalLock:  &sync.Mutex{},
+	}
+	return ds, nil
+}
+
+func journalFileName(dir string, generation int64) string {
+	return filepath.Join(dir, journalPrefix+strconv.FormatInt(generation, 10))
+}
+
+// listJournals returns the generations of the journals in dir, oldest first
+func listJournals(dir string) ([]int64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	generations := make([]int64, 0)
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), journalPrefix) {
+			continue
+		}
+		generation, err := strconv.ParseInt(strings.TrimPrefix(file.Name(), journalPrefix), 10, 64)
+		if err != nil {
+			log.Print("Skipping journal ", file.Name(), ":", err)
+			continue
+		}
+		generations = append(generations, generation)
+	}
+	sort.Slice(generations, func(i, j int) bool { return generations[i] < generations[j] })
+	return generations, nil
+}
+
+func snapshotFileName(dir string, topic string) string {
+	return filepath.Join(dir, url.PathEscape(topic)+snapshotSuffix)
+}
+
+// initialize restores the datastore and writes a snapshot of it, after
+// which the journals replayed are no longer needed
+func (m *MemoryDatastore) initialize() error {
+	err := m.restore()
+	if err != nil {
+		return err
+	}
+	return m.persist()
+}
+
+// restore loads the snapshots and replays the journals into an empty
+// datastore. A crash while writing a snapshot may leave snapshots of some
+// topics newer than the journals kept, so the changes to a topic in the
+// journals its snapshot includes are skipped.
+func (m *MemoryDatastore) restore() error {
+	p := m.persistence
+	err := os.MkdirAll(p.dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(p.dir)
+	if err != nil {
+		return err
+	}
+	snapshots := make(map[string]int64)
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), snapshotSuffix) {
+			continue
+		}
+		topic, err := url.PathUnescape(strings.TrimSuffix(file.Name(), snapshotSuffix))
+		if err != nil {
+			log.Print("Skipping snapshot ", file.Name(), ":", err)
+			continue
+		}
+		messages, generation, err := readTopicSnapshot(filepath.Join(p.dir, file.Name()))
+		if err != nil {
+			return err
+		}
+		m.createTopic(topic)
+		for _, message := range messages {
+			m.restoreMessage(topic, message)
+		}
+		snapshots[topic] = generation
+		if generation > p.generation {
+			p.generation = generation
+		}
+	}
+
+	journals, err := listJournals(p.dir)
+	if err != nil {
+		return err
+	}
+	for _, generation := range journals {
+		if generation > p.generation {
+			p.generation = generation
+		}
+		err = replayJournal(journalFileName(p.dir, generation), func(kind uint8, topic string, message *api.Message) {
+			if snapshot, ok := snapshots[topic]; ok && generation <= snapshot {
+				return
+			}
+			switch kind {
+			case JOURNAL_CREATE:
+				m.createTopic(topic)
+			case JOURNAL_DELETE:
+				m.deleteTopic(topic)
+			case JOURNAL_INSERT:
+				m.restoreMessage(topic, message)
+			case JOURNAL_TRUNCATE:
+				if t, err := m.topic(topic); err == nil {
+					t.lock.Lock()
+					t.messages.truncate(message.Offset)
+					t.lock.Unlock()
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDatastore) restoreMessage(topic string, message *api.Message) {
+	t, err := m.topic(topic)
+	if err != nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.messages.push(message)
+	t.messages.trim(m.retention.Get(topic), 0)
+}
+
+// copyTopics returns the messages of every topic
+func (m *MemoryDatastore) copyTopics() map[string][]*api.Message {
+	m.mapLock.Lock()
+	topics := make(map[string]*memoryTopic, len(m.topicMap))
+	for name, t := range m.topicMap {
+		topics[name] = t
+	}
+	m.mapLock.Unlock()
+
+	copies := make(map[string][]*api.Message, len(topics))
+	for name, t := range topics {
+		t.lock.Lock()
+		copies[name] = t.messages.slice(0, t.messages.len())
+		t.lock.Unlock()
+	}
+	return copies
+}
+
+// persist writes a snapshot of every topic and starts a new journal. If
+// writing the snapshot fails, the journals it includes are kept until a
+// later snapshot succeeds.
+func (m *MemoryDatastore) persist() error {
+	p := m.persistence
+	p.snapshotLock.Lock()
+	defer p.snapshotLock.Unlock()
+
+	p.lock.Lock()
+	topics := m.copyTopics()
+	generation := p.generation
+	p.generation++
+	var err error
+	if p.useJournal {
+		err = p.openJournal()
+	}
+	p.lock.Unlock()
+	if err != nil {
+		log.Print("Opening journal:", err)
+		return err
+	}
+
+	err = writeSnapshot(p.dir, topics, generation)
+	if err != nil {
+		log.Print("Writing snapshot:", err)
+		return err
+	}
+
+	// Remove snapshots of deleted topics
+	files, err := ioutil.ReadDir(p.dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), snapshotSuffix) {
+			continue
+		}
+		topic, err := url.PathUnescape(strings.TrimSuffix(file.Name(), snapshotSuffix))
+		if _, ok := topics[topic]; err == nil && !ok {
+			os.Remove(filepath.Join(p.dir, file.Name()))
+		}
+	}
+
+	// Remove the journals included in the snapshot
+	journals, err := listJournals(p.dir)
+	if err != nil {
+		return err
+	}
+	for _, journal := range journals {
+		if journal > generation {
+			break
+		}
+		err = os.Remove(journalFileName(p.dir, journal))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// openJournal closes the journal and starts an empty one of the current
+// generation. Called with the persistence lock held exclusively.
+func (p *memoryPersistence) openJournal() error {
+	p.journalLock.Lock()
+	defer p.journalLock.Unlock()
+	if p.journal != nil {
+		p.journal.Close()
+		p.journal = nil
+	}
+	journal, err := os.OpenFile(journalFileName(p.dir, p.generation), os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	p.journal = journal
+	return nil
+}
+
+func (p *memoryPersistence) appendJournal(kind uint8, topic string, message *api.Message) error {
+	if !p.useJournal {
+		return nil
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteByte(kind)
+	binary.Write(buf, binary.LittleEndian, uint32(len(topic)))
+	buf.WriteString(topic)
+	if kind == JOURNAL_INSERT || kind == JOURNAL_TRUNCATE {
+		writeRecord(buf, message)
+	}
+
+	p.journalLock.Lock()
+	defer p.journalLock.Unlock()
+	if p.journal == nil {
+		return fmt.Errorf("Journal not open")
+	}
+	_, err := p.journal.Write(buf.Bytes())
+	if err != nil {
+		log.Print("Writing journal:", err)
+	}
+	return err
+}
+
+func (p *memoryPersistence) close() {
+	p.journalLock.Lock()
+	defer p.journalLock.Unlock()
+	if p.journal != nil {
+		p.journal.Close()
+		p.journal = nil
+	}
+}
+
+// writeSnapshot writes a snapshot file for each topic in dir, including the
+// journals up to generation
+func writeSnapshot(dir string, topics map[string][]*api.Message, generation int64) error {
+	for topic, messages := range topics {
+		err := writeTopicSnapshot(snapshotFileName(dir, topic), messages, generation)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTopicSnapshot writes to a temporary file which replaces the previous
+// snapshot once complete
+func writeTopicSnapshot(path string, messages []*api.Message, generation int64) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	w.WriteString(SNAPSHOT_MAGIC)
+	binary.Write(w, binary.LittleEndian, generation)
+	for _, message := range messages {
+		writeRecord(w, message)
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readTopicSnapshot returns the messages of a snapshot file and the
+// generation of the last journal it includes
+func readTopicSnapshot(path string) ([]*api.Message, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	magic := make([]byte, len(SNAPSHOT_MAGIC))
+	_, err = io.ReadFull(r, magic)
+	if err != nil || string(magic) != SNAPSHOT_MAGIC {
+		return nil, 0, fmt.Errorf("%s: not a snapshot", path)
+	}
+	var generation int64
+	err = binary.Read(r, binary.LittleEndian, &generation)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: not a snapshot", path)
+	}
+
+	messages := make([]*api.Message, 0)
+	for {
+		message, err := readRecord(r)
+		if err == io.EOF {
+			return messages, generation, nil
+		} else if err != nil {
+			return nil, 0, fmt.Errorf("%s: %v", path, err)
+		}
+		messages = append(messages, message)
+	}
+}
+
+// replayJournal calls apply for each complete entry of a journal. Entries
+// after an incomplete or corrupt entry, as left by a crash while writing,
+// are ignored.
+func replayJournal(path string, apply func(kind uint8, topic string, message *api.Message)) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	for {
+		kind, err := r.ReadByte()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var length uint32
+		err = binary.Read(r, binary.LittleEndian, &length)
+		if err != nil || int64(length) > MAX_RECORD_SZ {
+			log.Print("Ignoring incomplete journal entry in ", path)
+			return nil
+		}
+		topic := make([]byte, length)
+		_, err = io.ReadFull(r, topic)
+		if err != nil {
+			log.Print("Ignoring incomplete journal entry in ", path)
+			return nil
+		}
+
+		var message *api.Message
+		switch kind {
+		case JOURNAL_INSERT, JOURNAL_TRUNCATE:
+			message, err = readRecord(r)
+			if err != nil {
+				log.Print("Ignoring incomplete journal entry in ", path)
+				return nil
+			}
+		case JOURNAL_CREATE, JOURNAL_DELETE:
+		default:
+			log.Print("Ignoring corrupt journal entry in ", path)
+			return nil
+		}
+		apply(kind, string(topic), message)
+	}
+}
+
+func writeRecord(w io.Writer, message *api.Message) {
+	binary.Write(w, binary.LittleEndian, message.Offset)
+	binary.Write(w, binary.LittleEndian, message.Timestamp)
+	binary.Write(w, binary.LittleEndian, int64(len(message.Payload)))
+	w.Write(message.Payload)
+}
+
+// readRecord returns io.EOF if there are no more records
+func readRecord(r io.Reader) (*api.Message, error) {
+	hdr := make([]byte, 24)
+	n, err := io.ReadFull(r, hdr)
+	if n == 0 && err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	offset := int64(binary.LittleEndian.Uint64(hdr[0:8]))
+	timestamp := int64(binary.LittleEndian.Uint64(hdr[8:16]))
+	sz := int64(binary.LittleEndian.Uint64(hdr[16:24]))
+	if sz < 0 || sz > MAX_RECORD_SZ {
+		return nil, fmt.Errorf("record at offset %d has invalid size %d", offset, sz)
+	}
+	payload := make([]byte, sz)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	message := api.NewMessage(offset, payload)
+	message.Timestamp = timestamp
+	return message, nil
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package datastore
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// A migration upgrades a schema from the previous version. Migration i of a
+// list upgrades to version i+1, and version 0 is a store without a version.
+type migration func(tx *sql.Tx) error
+
+// migrate runs the migrations needed to bring db to the latest version,
+// each in its own transaction
+func migrate(db *sql.DB, migrations []migration) error {
+	_, err := db.Exec("create table if not exists schema_version (version integer not null);")
+	if err != nil {
+		log.Print("Creating schema version table:", err)
+		return err
+	}
+
+	var version sql.NullInt64
+	err = db.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version)
+	if err != nil {
+		log.Print("Reading schema version:", err)
+		return err
+	}
+	current := int(version.Int64)
+	if current > len(migrations) {
+		// The store was written by a newer version
+		return fmt.Errorf("Schema version %d is newer than the supported version %d", current, len(migrations))
+	}
+
+	for v := current; v < len(migrations); v++ {
+		tx, err := db.Begin()
+		if err != nil {
+			log.Print("Starting transaction:", err)
+			return err
+		}
+		err = migrations[v](tx)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM schema_version")
+		}
+		if err == nil {
+			_, err = tx.Exec("INSERT INTO schema_version (version) values(?)", v+1)
+		}
+		if err != nil {
+			log.Print("Migrating schema to version ", v+1, ":", err)
+			tx.Rollback()
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package datastore
+
+import (
+	"sync"
+)
+
+// Retention limits the age in seconds and size in bytes of a topic log, and
+// its number of messages in the memory datastore. Values <= 0 mean unlimited.
+type Retention struct {
+	MaxLogAge   int64 `json:"maxLogAge"`
+	MaxLogSize  int64 `json:"maxLogSize"`
+	MaxMessages int64 `json:"maxMessages"`
+}
+
+// RetentionPolicy holds the retention applied by the garbage collector, with
+// optional per topic overrides. It may be updated while the datastore is in use.
+type RetentionPolicy struct {
+	lock     *sync.RWMutex
+	defaults Retention
+	topics   map[string]Retention
+}
+
+func NewRetentionPolicy(maxLogAge int64, maxLogSize int64) *RetentionPolicy {
+	return &RetentionPolicy{
+		lock: &sync.RWMutex{},
+		defaults: Retention{
+			MaxLogAge:  maxLogAge,
+			MaxLogSize: maxLogSize,
+		},
+		topics: make(map[string]Retention),
+	}
+}
+
+func (p *RetentionPolicy) Update(defaults Retention, topics map[string]Retention) {
+	overrides := make(map[string]Retention, len(topics))
+	for topic, retention := range topics {
+		overrides[topic] = retention
+	}
+	p.lock.Lock()
+	p.defaults = defaults
+	p.topics = overrides
+	p.lock.Unlock()
+}
+
+func (p *RetentionPolicy) Get(topic string) Retention {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if retention, ok := p.topics[topic]; ok {
+		return retention
+	}
+	return p.defaults
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+package datastore
+
+import (
+	"sort"
+
+	"github.com/lulf/slim/pkg/api"
+)
+
+// ring holds the messages of a topic in a circular buffer, which grows when
+// full and reuses the space of messages removed from the front.
+type ring struct {
+	buf   []*api.Message
+	head  int
+	size  int
+	bytes int64
+}
+
+func (r *ring) len() int {
+	return r.size
+}
+
+// at returns the i-th oldest message
+func (r *ring) at(i int) *api.Message {
+	return r.buf[(r.head+i)%len(r.buf)]
+}
+
+func (r *ring) push(message *api.Message) {
+	if r.size == len(r.buf) {
+		r.grow()
+	}
+	r.buf[(r.head+r.size)%len(r.buf)] = message
+	r.size++
+	r.bytes += int64(len(message.Payload))
+}
+
+// pop removes the oldest message
+func (r *ring) pop() {
+	message := r.buf[r.head]
+	r.buf[r.head] = nil
+	r.head = (r.head + 1) % len(r.buf)
+	r.size--
+	r.bytes -= int64(len(message.Payload))
+}
+
+// truncate removes the newest messages with an offset after the given offset
+func (r *ring) truncate(offset int64) {
+	for r.size > 0 && r.at(r.size-1).Offset > offset {
+		i := (r.head + r.size - 1) % len(r.buf)
+		r.bytes -= int64(len(r.buf[i].Payload))
+		r.buf[i] = nil
+		r.size--
+	}
+}
+
+func (r *ring) grow() {
+	capacity := 2 * len(r.buf)
+	if capacity == 0 {
+		capacity = 16
+	}
+	buf := make([]*api.Message, capacity)
+	for i := 0; i < r.size; i++ {
+		buf[i] = r.at(i)
+	}
+	r.buf = buf
+	r.head = 0
+}
+
+// search returns the index of the first message with an offset at or after
+// the given offset, or len() if there is none. Offsets are increasing but
+// need not start at 0 or be contiguous.
+func (r *ring) search(offset int64) int {
+	return sort.Search(r.size, func(i int) bool {
+		return r.at(i).Offset >= offset
+	})
+}
+
+// slice copies the messages from index start up to end
+func (r *ring) slice(start int, end int) []*api.Message {
+	messages := make([]*api.Message, 0, end-start)
+	for i := start; i < end; i++ {
+		messages = append(messages, r.at(i))
+	}
+	return messages
+}
+
+// trim removes the oldest messages until the retention limits are met. The
+// newest message is always kept. Messages older than oldest are removed if
+// oldest is positive.
+func (r *ring) trim(retention Retention, oldest int64) {
+	for r.size > 1 {
+		if (retention.MaxMessages > 0 && int64(r.size) > retention.MaxMessages) ||
+			(retention.MaxLogSize > 0 && r.bytes > retention.MaxLogSize) ||
+			(oldest > 0 && r.at(0).Timestamp < oldest) {
+			r.pop()
+		} else {
+			return
+		}
+	}
+}
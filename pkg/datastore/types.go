@@ -5,6 +5,9 @@
 package datastore
 
 import (
+	"context"
+	"fmt"
+
 	"github.com/lulf/slim/pkg/api"
 )
 
@@ -13,13 +16,38 @@ type StreamingFunc func(*api.Message) error
 type Datastore interface {
 	Initialize() error
 	CreateTopic(topic string) error
+	DeleteTopic(topic string) error
 	InsertMessage(topic string, message *api.Message) error
-	StreamMessages(topic string, offset int64, callback StreamingFunc) error
+	// Remove the messages of a topic after offset, undoing inserts that are not committed
+	Truncate(topic string, offset int64) error
+	// Read the messages of a topic starting at offset, or at the first message if offset is before it
+	ReadMessages(ctx context.Context, topic string, offset int64) (MessageIterator, error)
 	// Read the number of events stored
 	NumMessages(topic string) (int64, error)
 	LastOffset(topic string) (int64, error)
 	Flush() error
+	// Write a consistent copy of the datastore to a new directory, returning the last offset copied for each topic
+	Snapshot(dir string) (map[string]int64, error)
 	GarbageCollect(topic string) error
+	RetentionPolicy() *RetentionPolicy
 	ListTopics() ([]string, error)
 	Close()
 }
+
+// NewDatastore creates a datastore of the given type (memory, file or sqlite)
+func NewDatastore(dataStoreType string, dataDir string, maxLogAge int64, maxLogSize int64) (Datastore, error) {
+	switch dataStoreType {
+	case "memory":
+		ds, err := NewMemoryDatastore()
+		if err != nil {
+			return nil, err
+		}
+		ds.retention = NewRetentionPolicy(maxLogAge, maxLogSize)
+		return ds, nil
+	case "sqlite":
+		return NewSqliteDatastore(dataDir, maxLogAge, maxLogSize)
+	case "file":
+		return NewFileDatastore(dataDir, maxLogAge, maxLogSize)
+	}
+	return nil, fmt.Errorf("Invalid data store type %s", dataStoreType)
+}
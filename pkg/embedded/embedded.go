@@ -0,0 +1,191 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+// Package embedded runs the Slim commit log in-process without AMQP.
+//
+// Payloads are stored as given. Messages produced by AMQP clients are stored
+// as encoded AMQP messages, and AMQP consumers can only decode messages
+// produced through this package if their payload is an encoded AMQP message.
+package embedded
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/lulf/slim/pkg/api"
+	"github.com/lulf/slim/pkg/commitlog"
+	"github.com/lulf/slim/pkg/datastore"
+)
+
+var ErrNotStored = errors.New("message not stored")
+
+// Log produces to and subscribes to topics of a commit log
+type Log struct {
+	cl *commitlog.CommitLog
+	// Set if the datastore was opened by the log and is closed with it
+	ds datastore.Datastore
+}
+
+// Open opens a datastore of the given type (memory, file or sqlite) in
+// dataDir without retention limits, and a commit log on it.
+func Open(dataStoreType string, dataDir string) (*Log, error) {
+	ds, err := datastore.NewDatastore(dataStoreType, dataDir, -1, -1)
+	if err != nil {
+		return nil, err
+	}
+	err = ds.Initialize()
+	if err != nil {
+		ds.Close()
+		return nil, err
+	}
+	cl, err := commitlog.NewCommitLog(ds)
+	if err != nil {
+		ds.Close()
+		return nil, err
+	}
+	return &Log{
+		cl: cl,
+		ds: ds,
+	}, nil
+}
+
+// New uses an existing commit log, which may also be served by a
+// server.Server. Closing the log does not close the commit log.
+func New(cl *commitlog.CommitLog) *Log {
+	return &Log{
+		cl: cl,
+	}
+}
+
+// Close closes the commit log and datastore if they were opened by Open,
+// waiting for produced messages to be stored.
+func (l *Log) Close() error {
+	if l.ds == nil {
+		return nil
+	}
+	l.cl.Close()
+	err := l.ds.Flush()
+	l.ds.Close()
+	return err
+}
+
+// Flush writes stored messages to disk
+func (l *Log) Flush() error {
+	return l.cl.Flush()
+}
+
+// Produce stores a message in a topic, creating the topic if needed, and
+// returns its offset. If ctx is done before the message is stored, the
+// context error is returned, but the message may still be stored.
+func (l *Log) Produce(ctx context.Context, topicName string, payload []byte) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	topic, err := l.cl.GetOrNewTopic(topicName)
+	if err != nil {
+		return 0, err
+	}
+
+	message := api.NewMessage(0, payload)
+	result := make(chan bool, 1)
+	// Adding entries blocks while the queue of the topic is full
+	go topic.AddEntry(commitlog.NewEntry(message, func(ok bool) {
+		result <- ok
+	}))
+	select {
+	case ok := <-result:
+		if !ok {
+			return 0, ErrNotStored
+		}
+		return message.Offset, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+var subscriberCounter uint64
+
+func newSubscriberId() string {
+	return fmt.Sprintf("embedded-%d", atomic.AddUint64(&subscriberCounter, 1))
+}
+
+// Subscription delivers the messages of a topic in order
+type Subscription struct {
+	messages chan *api.Message
+	sub      *commitlog.Subscriber
+	cancel   context.CancelFunc
+	err      error
+}
+
+// Subscribe delivers the messages of a topic starting from offset, or from
+// the last message if offset is negative, creating the topic if needed. The
+// subscription ends when ctx is done or it is closed.
+func (l *Log) Subscribe(ctx context.Context, topicName string, offset int64) (*Subscription, error) {
+	topic, err := l.cl.GetOrNewTopic(topicName)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Subscription{
+		messages: make(chan *api.Message),
+		sub:      topic.NewSubscriber(newSubscriberId(), "", offset, 0),
+		cancel:   cancel,
+	}
+	go func() {
+		// Wakes up the subscriber if it is waiting for messages
+		<-ctx.Done()
+		s.sub.Close()
+	}()
+	go s.run(ctx)
+	return s, nil
+}
+
+func (s *Subscription) run(ctx context.Context) {
+	defer close(s.messages)
+	for {
+		err := s.sub.Stream(func(message *api.Message) error {
+			// The datastore may share stored messages with other subscribers
+			payload := make([]byte, len(message.Payload))
+			copy(payload, message.Payload)
+			m := api.NewMessage(message.Offset, payload)
+			m.Timestamp = message.Timestamp
+			select {
+			case s.messages <- m:
+				s.sub.Commit(m.Offset)
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			s.err = err
+			s.cancel()
+			return
+		}
+	}
+}
+
+// Messages returns the channel messages are delivered on. It is closed when
+// the subscription ends.
+func (s *Subscription) Messages() <-chan *api.Message {
+	return s.messages
+}
+
+// Err returns the reason the subscription ended once the messages channel
+// is closed, which is context.Canceled if it was closed.
+func (s *Subscription) Err() error {
+	return s.err
+}
+
+// Close ends the subscription
+func (s *Subscription) Close() {
+	s.cancel()
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package embedded
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProduceSubscribe(t *testing.T) {
+	l, err := Open("memory", "")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		offset, err := l.Produce(ctx, "mytopic", []byte(fmt.Sprintf("payload%d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(i), offset)
+	}
+
+	sub, err := l.Subscribe(ctx, "mytopic", 2)
+	assert.Nil(t, err)
+	for i := 2; i < 5; i++ {
+		message := <-sub.Messages()
+		assert.Equal(t, int64(i), message.Offset)
+		assert.Equal(t, fmt.Sprintf("payload%d", i), string(message.Payload))
+	}
+
+	// Messages produced while subscribed are delivered
+	go l.Produce(ctx, "mytopic", []byte("payload5"))
+	message := <-sub.Messages()
+	assert.Equal(t, int64(5), message.Offset)
+
+	sub.Close()
+	_, ok := <-sub.Messages()
+	assert.False(t, ok)
+	assert.Equal(t, context.Canceled, sub.Err())
+}
+
+func TestSubscribeCancel(t *testing.T) {
+	l, err := Open("memory", "")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	sub, err := l.Subscribe(ctx, "empty", 0)
+	assert.Nil(t, err)
+
+	// The subscription ends while waiting for messages
+	_, ok := <-sub.Messages()
+	assert.False(t, ok)
+	assert.Equal(t, context.DeadlineExceeded, sub.Err())
+
+	_, err = l.Produce(ctx, "empty", []byte("payload"))
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
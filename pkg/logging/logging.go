@@ -0,0 +1,40 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package logging
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+var debugEnabled int32
+
+// SetLevel sets the log level to either "info" or "debug". Debug messages
+// are only logged at the "debug" level.
+func SetLevel(level string) error {
+	switch level {
+	case "debug":
+		atomic.StoreInt32(&debugEnabled, 1)
+	case "info":
+		atomic.StoreInt32(&debugEnabled, 0)
+	default:
+		return fmt.Errorf("Invalid log level '%s'", level)
+	}
+	return nil
+}
+
+func Debug(v ...interface{}) {
+	if atomic.LoadInt32(&debugEnabled) != 0 {
+		log.Print(v...)
+	}
+}
+
+func Debugf(format string, v ...interface{}) {
+	if atomic.LoadInt32(&debugEnabled) != 0 {
+		log.Printf(format, v...)
+	}
+}
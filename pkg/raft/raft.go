@@ -0,0 +1,736 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+// Package raft implements the Raft consensus algorithm for agreeing on the
+// order of entries in a log replicated across a small group of nodes.
+package raft
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/lulf/slim/pkg/logging"
+)
+
+// Maximum number of entries sent in one AppendEntries request
+const maxAppendEntries = 256
+
+func NewNode(config Config, transport Transport, storage Storage, fsm StateMachine) (*Node, error) {
+	term, votedFor, entries, err := storage.Load()
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := storage.LoadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	lock := &sync.Mutex{}
+	n := &Node{
+		config:     config,
+		transport:  transport,
+		storage:    storage,
+		fsm:        fsm,
+		random:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		applyLock:  &sync.Mutex{},
+		lock:       lock,
+		applyCond:  sync.NewCond(lock),
+		role:       follower,
+		term:       term,
+		votedFor:   votedFor,
+		log:        entries,
+		nextIndex:  make(map[string]uint64),
+		matchIndex: make(map[string]uint64),
+		inflight:   make(map[string]bool),
+		waiters:    make(map[uint64]*waiter),
+		stop:       make(chan struct{}),
+		done:       &sync.WaitGroup{},
+		notifyCh:   make(chan struct{}, 1),
+	}
+	if snapshot != nil {
+		err = fsm.Restore(snapshot.Data, "")
+		if err != nil {
+			return nil, err
+		}
+		n.snapshot = snapshot
+		n.commitIndex = snapshot.Index
+		n.lastApplied = snapshot.Index
+	}
+	n.resetElectionTimer()
+	return n, nil
+}
+
+func (n *Node) Start() {
+	n.done.Add(2)
+	go n.run()
+	go n.applier()
+}
+
+// Stop stops the node. Pending proposals fail with ErrStopped.
+func (n *Node) Stop() {
+	n.lock.Lock()
+	if n.stopped {
+		n.lock.Unlock()
+		return
+	}
+	n.stopped = true
+	n.role = follower
+	close(n.stop)
+	for index, w := range n.waiters {
+		w.result <- ErrStopped
+		delete(n.waiters, index)
+	}
+	n.applyCond.Broadcast()
+	n.lock.Unlock()
+	n.done.Wait()
+}
+
+func (n *Node) Id() string {
+	return n.config.Id
+}
+
+// Leader returns the id of the current leader, or an empty string if unknown
+func (n *Node) Leader() string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.leaderId
+}
+
+func (n *Node) IsLeader() bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.role == leader
+}
+
+func (n *Node) Term() uint64 {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.term
+}
+
+// Propose appends a command to the log and waits until it has been
+// committed and applied on this node, returning the result of applying it.
+// Only the leader accepts proposals. If leadership is lost or the proposal
+// times out, the command may or may not be committed later.
+func (n *Node) Propose(command []byte) (interface{}, error) {
+	n.lock.Lock()
+	if n.stopped {
+		n.lock.Unlock()
+		return nil, ErrStopped
+	}
+	if n.role != leader {
+		n.lock.Unlock()
+		return nil, ErrNotLeader
+	}
+	entry := LogEntry{
+		Term:    n.term,
+		Index:   n.lastIndex() + 1,
+		Command: command,
+	}
+	err := n.appendLocal([]LogEntry{entry})
+	if err != nil {
+		n.lock.Unlock()
+		return nil, err
+	}
+	w := &waiter{term: entry.Term, result: make(chan error, 1)}
+	n.waiters[entry.Index] = w
+	if len(n.config.Peers) == 0 {
+		n.advanceCommit()
+	}
+	n.lock.Unlock()
+	n.notify()
+
+	select {
+	case err = <-w.result:
+		return w.value, err
+	case <-time.After(n.config.ProposeTimeout):
+		n.lock.Lock()
+		if n.waiters[entry.Index] == w {
+			delete(n.waiters, entry.Index)
+		}
+		n.lock.Unlock()
+		// The result may have been delivered while timing out
+		select {
+		case err = <-w.result:
+			return w.value, err
+		default:
+			return nil, ErrTimeout
+		}
+	}
+}
+
+// Barrier waits until all entries committed by earlier leaders have been
+// applied on this node, which must be the leader.
+func (n *Node) Barrier() error {
+	n.lock.Lock()
+	if n.role == leader && n.lastApplied >= n.termStart {
+		n.lock.Unlock()
+		return nil
+	}
+	n.lock.Unlock()
+	_, err := n.Propose(nil)
+	return err
+}
+
+func (n *Node) notify() {
+	select {
+	case n.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// snapshotIndex returns the index of the last entry replaced by the snapshot
+func (n *Node) snapshotIndex() uint64 {
+	if n.snapshot == nil {
+		return 0
+	}
+	return n.snapshot.Index
+}
+
+func (n *Node) lastIndex() uint64 {
+	return n.snapshotIndex() + uint64(len(n.log))
+}
+
+func (n *Node) termAt(index uint64) uint64 {
+	if n.snapshot != nil && index == n.snapshot.Index {
+		return n.snapshot.Term
+	}
+	if index <= n.snapshotIndex() || index > n.lastIndex() {
+		return 0
+	}
+	return n.log[index-n.snapshotIndex()-1].Term
+}
+
+func (n *Node) resetElectionTimer() {
+	n.electionReset = time.Now()
+	n.timeout = n.config.ElectionTimeout + time.Duration(n.random.Int63n(int64(n.config.ElectionTimeout)))
+}
+
+func (n *Node) persistState() {
+	err := n.storage.SaveState(n.term, n.votedFor)
+	if err != nil {
+		log.Print("Saving raft state:", err)
+	}
+}
+
+func (n *Node) appendLocal(entries []LogEntry) error {
+	err := n.storage.Append(entries)
+	if err != nil {
+		log.Print("Appending to raft log:", err)
+		return err
+	}
+	n.log = append(n.log, entries...)
+	return nil
+}
+
+// truncate removes the entry at index and all entries after it. Proposals
+// waiting for them fail.
+func (n *Node) truncate(index uint64) error {
+	err := n.storage.Truncate(index)
+	if err != nil {
+		log.Print("Truncating raft log:", err)
+		return err
+	}
+	n.log = n.log[:index-n.snapshotIndex()-1]
+	for i, w := range n.waiters {
+		if i >= index {
+			w.result <- ErrLeadershipLost
+			delete(n.waiters, i)
+		}
+	}
+	return nil
+}
+
+func (n *Node) run() {
+	defer n.done.Done()
+	ticker := time.NewTicker(n.config.HeartbeatInterval / 5)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.notifyCh:
+			n.lock.Lock()
+			if n.role == leader {
+				n.broadcast()
+			}
+			n.lock.Unlock()
+		case <-ticker.C:
+			n.lock.Lock()
+			if n.role == leader {
+				if time.Since(n.heartbeat) >= n.config.HeartbeatInterval {
+					n.broadcast()
+				}
+			} else if time.Since(n.electionReset) >= n.timeout {
+				n.startElection()
+			}
+			n.lock.Unlock()
+		}
+	}
+}
+
+func (n *Node) becomeFollower(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.persistState()
+	}
+	if n.role == leader {
+		log.Printf("Raft node %s stepping down in term %d", n.config.Id, n.term)
+	}
+	n.role = follower
+}
+
+func (n *Node) startElection() {
+	n.role = candidate
+	n.term++
+	n.votedFor = n.config.Id
+	n.leaderId = ""
+	n.persistState()
+	n.resetElectionTimer()
+	logging.Debugf("Raft node %s starting election for term %d", n.config.Id, n.term)
+
+	votes := 1
+	if votes*2 > len(n.config.Peers)+1 {
+		n.becomeLeader()
+		return
+	}
+
+	args := &RequestVoteArgs{
+		Term:         n.term,
+		CandidateId:  n.config.Id,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.termAt(n.lastIndex()),
+	}
+	for _, peer := range n.config.Peers {
+		go func(peer string) {
+			reply := &RequestVoteReply{}
+			err := n.transport.RequestVote(peer, args, reply)
+			if err != nil {
+				return
+			}
+			n.lock.Lock()
+			defer n.lock.Unlock()
+			if n.stopped {
+				return
+			}
+			if reply.Term > n.term {
+				n.becomeFollower(reply.Term)
+				return
+			}
+			if n.role != candidate || n.term != args.Term || !reply.VoteGranted {
+				return
+			}
+			votes++
+			if votes*2 > len(n.config.Peers)+1 {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+func (n *Node) becomeLeader() {
+	n.role = leader
+	n.leaderId = n.config.Id
+	for _, peer := range n.config.Peers {
+		n.nextIndex[peer] = n.lastIndex() + 1
+		n.matchIndex[peer] = 0
+	}
+
+	// Committing an entry from the new term also commits all entries before it
+	entry := LogEntry{Term: n.term, Index: n.lastIndex() + 1}
+	err := n.appendLocal([]LogEntry{entry})
+	if err != nil {
+		n.becomeFollower(n.term)
+		return
+	}
+	n.termStart = entry.Index
+	log.Printf("Raft node %s is leader for term %d", n.config.Id, n.term)
+
+	if len(n.config.Peers) == 0 {
+		n.advanceCommit()
+	}
+	n.broadcast()
+}
+
+func (n *Node) broadcast() {
+	n.heartbeat = time.Now()
+	for _, peer := range n.config.Peers {
+		if !n.inflight[peer] {
+			n.inflight[peer] = true
+			go n.replicateTo(peer)
+		}
+	}
+}
+
+func (n *Node) replicateTo(peer string) {
+	n.lock.Lock()
+	if n.role != leader || n.stopped {
+		n.inflight[peer] = false
+		n.lock.Unlock()
+		return
+	}
+	next := n.nextIndex[peer]
+	if next <= n.snapshotIndex() {
+		// The entries needed by the peer have been compacted
+		args := &InstallSnapshotArgs{
+			Term:     n.term,
+			LeaderId: n.config.Id,
+			Snapshot: *n.snapshot,
+		}
+		n.lock.Unlock()
+		n.installSnapshotOn(peer, args)
+		return
+	}
+	end := n.lastIndex()
+	if end-next+1 > maxAppendEntries {
+		end = next + maxAppendEntries - 1
+	}
+	entries := make([]LogEntry, 0, end-next+1)
+	if next <= end {
+		entries = append(entries, n.log[next-n.snapshotIndex()-1:end-n.snapshotIndex()]...)
+	}
+	args := &AppendEntriesArgs{
+		Term:         n.term,
+		LeaderId:     n.config.Id,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  n.termAt(next - 1),
+		Entries:      entries,
+		LeaderCommit: n.commitIndex,
+	}
+	n.lock.Unlock()
+
+	reply := &AppendEntriesReply{}
+	err := n.transport.AppendEntries(peer, args, reply)
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.inflight[peer] = false
+	if err != nil || n.stopped {
+		return
+	}
+	if reply.Term > n.term {
+		n.becomeFollower(reply.Term)
+		return
+	}
+	if n.role != leader || n.term != args.Term {
+		return
+	}
+
+	if reply.Success {
+		match := args.PrevLogIndex + uint64(len(args.Entries))
+		if match > n.matchIndex[peer] {
+			n.matchIndex[peer] = match
+		}
+		n.nextIndex[peer] = match + 1
+		n.advanceCommit()
+	} else {
+		next := reply.ConflictIndex
+		if next < 1 {
+			next = 1
+		}
+		if next > n.lastIndex()+1 {
+			next = n.lastIndex() + 1
+		}
+		n.nextIndex[peer] = next
+	}
+
+	// Continue until the peer has caught up
+	if n.nextIndex[peer] <= n.lastIndex() {
+		n.inflight[peer] = true
+		go n.replicateTo(peer)
+	}
+}
+
+func (n *Node) installSnapshotOn(peer string, args *InstallSnapshotArgs) {
+	reply := &InstallSnapshotReply{}
+	err := n.transport.InstallSnapshot(peer, args, reply)
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.inflight[peer] = false
+	if err != nil || n.stopped {
+		return
+	}
+	if reply.Term > n.term {
+		n.becomeFollower(reply.Term)
+		return
+	}
+	if n.role != leader || n.term != args.Term {
+		return
+	}
+
+	if args.Snapshot.Index > n.matchIndex[peer] {
+		n.matchIndex[peer] = args.Snapshot.Index
+	}
+	n.nextIndex[peer] = args.Snapshot.Index + 1
+	n.advanceCommit()
+	if n.nextIndex[peer] <= n.lastIndex() {
+		n.inflight[peer] = true
+		go n.replicateTo(peer)
+	}
+}
+
+// advanceCommit commits the highest entry from the current term stored on a
+// majority of the group.
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		if n.termAt(index) != n.term {
+			break
+		}
+		count := 1
+		for _, peer := range n.config.Peers {
+			if n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if count*2 > len(n.config.Peers)+1 {
+			n.commitIndex = index
+			n.applyCond.Broadcast()
+			return
+		}
+	}
+}
+
+func (n *Node) handleRequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.stopped {
+		return ErrStopped
+	}
+
+	if args.Term > n.term {
+		n.becomeFollower(args.Term)
+		n.leaderId = ""
+	}
+	reply.Term = n.term
+	if args.Term < n.term || (n.votedFor != "" && n.votedFor != args.CandidateId) {
+		return nil
+	}
+
+	// Only vote for candidates with a log at least as up to date as ours
+	lastTerm := n.termAt(n.lastIndex())
+	if args.LastLogTerm < lastTerm || (args.LastLogTerm == lastTerm && args.LastLogIndex < n.lastIndex()) {
+		return nil
+	}
+
+	n.votedFor = args.CandidateId
+	n.persistState()
+	n.resetElectionTimer()
+	reply.VoteGranted = true
+	return nil
+}
+
+func (n *Node) handleAppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.stopped {
+		return ErrStopped
+	}
+
+	reply.Term = n.term
+	if args.Term < n.term {
+		return nil
+	}
+	if args.Term > n.term || n.role != follower {
+		n.becomeFollower(args.Term)
+	}
+	n.leaderId = args.LeaderId
+	n.resetElectionTimer()
+	reply.Term = n.term
+
+	entries := args.Entries
+	if args.PrevLogIndex > n.lastIndex() {
+		reply.ConflictIndex = n.lastIndex() + 1
+		return nil
+	}
+	if args.PrevLogIndex < n.snapshotIndex() {
+		// Entries replaced by the snapshot are committed and match the leader
+		skip := n.snapshotIndex() - args.PrevLogIndex
+		if skip > uint64(len(entries)) {
+			skip = uint64(len(entries))
+		}
+		entries = entries[skip:]
+	} else if args.PrevLogIndex > 0 && n.termAt(args.PrevLogIndex) != args.PrevLogTerm {
+		// Skip back past all entries of the conflicting term
+		conflictTerm := n.termAt(args.PrevLogIndex)
+		index := args.PrevLogIndex
+		for index > n.snapshotIndex()+1 && n.termAt(index-1) == conflictTerm {
+			index--
+		}
+		reply.ConflictIndex = index
+		return nil
+	}
+
+	for i, entry := range entries {
+		if entry.Index <= n.lastIndex() {
+			if n.termAt(entry.Index) == entry.Term {
+				continue
+			}
+			err := n.truncate(entry.Index)
+			if err != nil {
+				return err
+			}
+		}
+		err := n.appendLocal(entries[i:])
+		if err != nil {
+			return err
+		}
+		break
+	}
+
+	if args.LeaderCommit > n.commitIndex {
+		lastNew := args.PrevLogIndex + uint64(len(args.Entries))
+		if args.LeaderCommit < lastNew {
+			n.commitIndex = args.LeaderCommit
+		} else {
+			n.commitIndex = lastNew
+		}
+		n.applyCond.Broadcast()
+	}
+	reply.Success = true
+	return nil
+}
+
+// handleInstallSnapshot replaces the state and the log up to the snapshot
+// when the leader no longer has the entries this node needs.
+func (n *Node) handleInstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	n.lock.Lock()
+	if n.stopped {
+		n.lock.Unlock()
+		return ErrStopped
+	}
+	reply.Term = n.term
+	if args.Term < n.term {
+		n.lock.Unlock()
+		return nil
+	}
+	if args.Term > n.term || n.role != follower {
+		n.becomeFollower(args.Term)
+	}
+	n.leaderId = args.LeaderId
+	n.resetElectionTimer()
+	reply.Term = n.term
+	n.lock.Unlock()
+
+	n.applyLock.Lock()
+	defer n.applyLock.Unlock()
+	n.lock.Lock()
+	applied := n.lastApplied
+	n.lock.Unlock()
+	if args.Snapshot.Index <= applied {
+		return nil
+	}
+	err := n.fsm.Restore(args.Snapshot.Data, args.LeaderId)
+	if err != nil {
+		log.Print("Restoring raft snapshot:", err)
+		return err
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	snapshot := args.Snapshot
+	if snapshot.Index < n.lastIndex() && n.termAt(snapshot.Index) == snapshot.Term {
+		// Keep the entries following the snapshot
+		n.log = append([]LogEntry(nil), n.log[snapshot.Index-n.snapshotIndex():]...)
+	} else {
+		err = n.truncate(n.snapshotIndex() + 1)
+		if err != nil {
+			return err
+		}
+	}
+	err = n.storage.SaveSnapshot(&snapshot)
+	if err != nil {
+		log.Print("Saving raft snapshot:", err)
+		return err
+	}
+	n.snapshot = &snapshot
+	if snapshot.Index > n.commitIndex {
+		n.commitIndex = snapshot.Index
+	}
+	n.lastApplied = snapshot.Index
+	n.resetElectionTimer()
+	return nil
+}
+
+// applier applies committed entries in order and completes the proposals
+// waiting for them.
+func (n *Node) applier() {
+	defer n.done.Done()
+	for {
+		n.lock.Lock()
+		for !n.stopped && n.lastApplied >= n.commitIndex {
+			n.applyCond.Wait()
+		}
+		stopped := n.stopped
+		n.lock.Unlock()
+		if stopped {
+			return
+		}
+
+		n.applyLock.Lock()
+		n.lock.Lock()
+		// A snapshot may have been installed while waiting
+		first := n.lastApplied - n.snapshotIndex()
+		entries := make([]LogEntry, n.commitIndex-n.lastApplied)
+		copy(entries, n.log[first:first+uint64(len(entries))])
+		n.lock.Unlock()
+
+		for _, entry := range entries {
+			var value interface{}
+			if entry.Command != nil {
+				value = n.fsm.Apply(entry.Index, entry.Command)
+			}
+			n.lock.Lock()
+			n.lastApplied = entry.Index
+			if w, ok := n.waiters[entry.Index]; ok {
+				if w.term == entry.Term {
+					w.value = value
+					w.result <- nil
+				} else {
+					w.result <- ErrLeadershipLost
+				}
+				delete(n.waiters, entry.Index)
+			}
+			n.lock.Unlock()
+		}
+		n.compact()
+		n.applyLock.Unlock()
+	}
+}
+
+// compact replaces the applied entries with a snapshot once there are more
+// than the configured threshold of them. Called with applyLock held.
+func (n *Node) compact() {
+	n.lock.Lock()
+	if n.config.SnapshotThreshold == 0 || n.lastApplied-n.snapshotIndex() < n.config.SnapshotThreshold {
+		n.lock.Unlock()
+		return
+	}
+	index := n.lastApplied
+	term := n.termAt(index)
+	n.lock.Unlock()
+
+	data, err := n.fsm.Snapshot()
+	if err != nil {
+		log.Print("Taking raft snapshot:", err)
+		return
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	snapshot := &Snapshot{Index: index, Term: term, Data: data}
+	err = n.storage.SaveSnapshot(snapshot)
+	if err != nil {
+		log.Print("Saving raft snapshot:", err)
+		return
+	}
+	// Applied entries are committed and never truncated
+	n.log = append([]LogEntry(nil), n.log[index-n.snapshotIndex():]...)
+	n.snapshot = snapshot
+	logging.Debugf("Raft node %s compacted log up to entry %d", n.config.Id, index)
+}
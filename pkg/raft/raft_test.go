@@ -0,0 +1,369 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testNode struct {
+	node     *Node
+	listener net.Listener
+	network  *testNetwork
+	lock     *sync.Mutex
+	applied  []string
+	// Leader the last snapshot restored was sent by
+	restoredFrom string
+}
+
+// testNetwork fails requests to and from isolated nodes
+type testNetwork struct {
+	lock     *sync.Mutex
+	isolated map[string]bool
+}
+
+func (n *testNetwork) isolate(id string, isolated bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.isolated[id] = isolated
+}
+
+func (n *testNetwork) check(from string, to string) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.isolated[from] || n.isolated[to] {
+		return fmt.Errorf("%s cannot reach %s", from, to)
+	}
+	return nil
+}
+
+type testTransport struct {
+	*RPCTransport
+	id      string
+	network *testNetwork
+}
+
+func (t *testTransport) RequestVote(peer string, args *RequestVoteArgs, reply *RequestVoteReply) error {
+	err := t.network.check(t.id, peer)
+	if err != nil {
+		return err
+	}
+	return t.RPCTransport.RequestVote(peer, args, reply)
+}
+
+func (t *testTransport) AppendEntries(peer string, args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	err := t.network.check(t.id, peer)
+	if err != nil {
+		return err
+	}
+	return t.RPCTransport.AppendEntries(peer, args, reply)
+}
+
+func (t *testTransport) InstallSnapshot(peer string, args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	err := t.network.check(t.id, peer)
+	if err != nil {
+		return err
+	}
+	return t.RPCTransport.InstallSnapshot(peer, args, reply)
+}
+
+func (t *testNode) Apply(index uint64, command []byte) interface{} {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.applied = append(t.applied, string(command))
+	return len(t.applied)
+}
+
+func (t *testNode) Snapshot() ([]byte, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return json.Marshal(t.applied)
+}
+
+func (t *testNode) Restore(snapshot []byte, leader string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.restoredFrom = leader
+	return json.Unmarshal(snapshot, &t.applied)
+}
+
+func (t *testNode) commands() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	result := make([]string, len(t.applied))
+	copy(result, t.applied)
+	return result
+}
+
+func (t *testNode) stop() {
+	t.listener.Close()
+	t.node.Stop()
+}
+
+// startCluster starts nodes talking net/rpc over loopback
+func startCluster(t *testing.T, ids []string, storage func(id string) Storage, threshold uint64) map[string]*testNode {
+	listeners := make(map[string]net.Listener)
+	addresses := make(map[string]string)
+	for _, id := range ids {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+		listeners[id] = listener
+		addresses[id] = listener.Addr().String()
+	}
+
+	network := &testNetwork{lock: &sync.Mutex{}, isolated: make(map[string]bool)}
+	nodes := make(map[string]*testNode)
+	for _, id := range ids {
+		peers := make([]string, 0)
+		for _, peer := range ids {
+			if peer != id {
+				peers = append(peers, peer)
+			}
+		}
+		config := DefaultConfig(id, peers)
+		config.ElectionTimeout = 100 * time.Millisecond
+		config.HeartbeatInterval = 20 * time.Millisecond
+		config.ProposeTimeout = time.Second
+		config.SnapshotThreshold = threshold
+
+		tn := &testNode{listener: listeners[id], network: network, lock: &sync.Mutex{}}
+		transport := &testTransport{
+			RPCTransport: NewRPCTransport(addresses, 200*time.Millisecond),
+			id:           id,
+			network:      network,
+		}
+		node, err := NewNode(config, transport, storage(id), tn)
+		assert.Nil(t, err)
+		tn.node = node
+		go Serve(listeners[id], node)
+		node.Start()
+		nodes[id] = tn
+	}
+	return nodes
+}
+
+func waitForLeader(t *testing.T, nodes map[string]*testNode) *testNode {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, tn := range nodes {
+			if tn.node.IsLeader() {
+				return tn
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("No leader elected")
+	return nil
+}
+
+func waitForCommands(t *testing.T, tn *testNode, expected []string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if len(tn.commands()) >= len(expected) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, expected, tn.commands(), tn.node.Id())
+}
+
+func TestReplicateAndFailover(t *testing.T) {
+	nodes := startCluster(t, []string{"a", "b", "c"}, func(id string) Storage { return NewMemoryStorage() }, 0)
+
+	leader := waitForLeader(t, nodes)
+	for i := 0; i < 5; i++ {
+		value, err := leader.node.Propose([]byte(fmt.Sprintf("command%d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, i+1, value)
+	}
+
+	expected := []string{"command0", "command1", "command2", "command3", "command4"}
+	for _, tn := range nodes {
+		waitForCommands(t, tn, expected)
+	}
+
+	for _, tn := range nodes {
+		if tn != leader {
+			_, err := tn.node.Propose([]byte("rejected"))
+			assert.Equal(t, ErrNotLeader, err)
+			assert.Equal(t, leader.node.Id(), tn.node.Leader())
+		}
+	}
+
+	// The remaining majority elects a new leader that keeps the committed entries
+	leader.stop()
+	delete(nodes, leader.node.Id())
+	newLeader := waitForLeader(t, nodes)
+	assert.Nil(t, newLeader.node.Barrier())
+	_, err := newLeader.node.Propose([]byte("command5"))
+	assert.Nil(t, err)
+
+	expected = append(expected, "command5")
+	for _, tn := range nodes {
+		waitForCommands(t, tn, expected)
+	}
+	for _, tn := range nodes {
+		tn.stop()
+	}
+}
+
+func TestNoQuorum(t *testing.T) {
+	nodes := startCluster(t, []string{"a", "b", "c"}, func(id string) Storage { return NewMemoryStorage() }, 0)
+	leader := waitForLeader(t, nodes)
+	for _, tn := range nodes {
+		if tn != leader {
+			tn.stop()
+		}
+	}
+
+	_, err := leader.node.Propose([]byte("command"))
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, len(leader.commands()))
+	leader.stop()
+}
+
+func TestCompactionAndCatchUp(t *testing.T) {
+	nodes := startCluster(t, []string{"a", "b", "c"}, func(id string) Storage { return NewMemoryStorage() }, 4)
+	leader := waitForLeader(t, nodes)
+	var lagging *testNode
+	for _, tn := range nodes {
+		if tn != leader {
+			lagging = tn
+			break
+		}
+	}
+	leader.network.isolate(lagging.node.Id(), true)
+
+	expected := make([]string, 0)
+	for i := 0; i < 10; i++ {
+		command := fmt.Sprintf("command%d", i)
+		_, err := leader.node.Propose([]byte(command))
+		assert.Nil(t, err)
+		expected = append(expected, command)
+	}
+	snapshot, err := leader.node.storage.LoadSnapshot()
+	assert.Nil(t, err)
+	assert.NotNil(t, snapshot)
+
+	// The entries the isolated node missed have been compacted, so it is
+	// sent the snapshot of the leader once it can be reached
+	leader.network.isolate(lagging.node.Id(), false)
+	waitForCommands(t, lagging, expected)
+	lagging.lock.Lock()
+	assert.Equal(t, leader.node.Id(), lagging.restoredFrom)
+	lagging.lock.Unlock()
+
+	for _, tn := range nodes {
+		tn.stop()
+	}
+}
+
+func TestRestartFromSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	storage, err := NewFileStorage(dir)
+	assert.Nil(t, err)
+	nodes := startCluster(t, []string{"a"}, func(id string) Storage { return storage }, 4)
+	leader := waitForLeader(t, nodes)
+	expected := make([]string, 0)
+	for i := 0; i < 10; i++ {
+		command := fmt.Sprintf("command%d", i)
+		_, err := leader.node.Propose([]byte(command))
+		assert.Nil(t, err)
+		expected = append(expected, command)
+	}
+	leader.stop()
+	assert.Nil(t, storage.Close())
+
+	storage, err = NewFileStorage(dir)
+	assert.Nil(t, err)
+	snapshot, err := storage.LoadSnapshot()
+	assert.Nil(t, err)
+	assert.NotNil(t, snapshot)
+	nodes = startCluster(t, []string{"a"}, func(id string) Storage { return storage }, 4)
+	waitForCommands(t, nodes["a"], expected)
+	nodes["a"].stop()
+	assert.Nil(t, storage.Close())
+}
+
+func TestFileStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	storage, err := NewFileStorage(dir)
+	assert.Nil(t, err)
+	_, _, entries, err := storage.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(entries))
+
+	assert.Nil(t, storage.SaveState(3, "b"))
+	assert.Nil(t, storage.Append([]LogEntry{{Term: 1, Index: 1}, {Term: 1, Index: 2, Command: []byte("x")}}))
+	assert.Nil(t, storage.Append([]LogEntry{{Term: 2, Index: 3, Command: []byte("y")}}))
+	assert.Nil(t, storage.Truncate(3))
+	assert.Nil(t, storage.Append([]LogEntry{{Term: 3, Index: 3, Command: []byte("z")}}))
+	assert.Nil(t, storage.Close())
+
+	storage, err = NewFileStorage(dir)
+	assert.Nil(t, err)
+	defer storage.Close()
+	term, votedFor, entries, err := storage.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), term)
+	assert.Equal(t, "b", votedFor)
+	assert.Equal(t, []LogEntry{
+		{Term: 1, Index: 1},
+		{Term: 1, Index: 2, Command: []byte("x")},
+		{Term: 3, Index: 3, Command: []byte("z")},
+	}, entries)
+}
+
+func TestFileStorageSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	storage, err := NewFileStorage(dir)
+	assert.Nil(t, err)
+	_, _, _, err = storage.Load()
+	assert.Nil(t, err)
+	assert.Nil(t, storage.Append([]LogEntry{{Term: 1, Index: 1}, {Term: 1, Index: 2, Command: []byte("x")}, {Term: 2, Index: 3, Command: []byte("y")}}))
+	assert.Nil(t, storage.SaveSnapshot(&Snapshot{Index: 2, Term: 1, Data: []byte("state")}))
+	assert.Nil(t, storage.Append([]LogEntry{{Term: 2, Index: 4, Command: []byte("z")}}))
+	assert.Nil(t, storage.Close())
+
+	storage, err = NewFileStorage(dir)
+	assert.Nil(t, err)
+	defer storage.Close()
+	_, _, entries, err := storage.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, []LogEntry{
+		{Term: 2, Index: 3, Command: []byte("y")},
+		{Term: 2, Index: 4, Command: []byte("z")},
+	}, entries)
+	snapshot, err := storage.LoadSnapshot()
+	assert.Nil(t, err)
+	assert.Equal(t, &Snapshot{Index: 2, Term: 1, Data: []byte("state")}, snapshot)
+
+	// A snapshot past the end of the log removes all entries
+	assert.Nil(t, storage.Truncate(4))
+	assert.Nil(t, storage.SaveSnapshot(&Snapshot{Index: 5, Term: 3, Data: []byte("later")}))
+	assert.Nil(t, storage.Append([]LogEntry{{Term: 3, Index: 6, Command: []byte("w")}}))
+	_, _, entries, err = storage.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, []LogEntry{{Term: 3, Index: 6, Command: []byte("w")}}, entries)
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package raft
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// Transport sends requests to the other members of the group
+type Transport interface {
+	RequestVote(peer string, args *RequestVoteArgs, reply *RequestVoteReply) error
+	AppendEntries(peer string, args *AppendEntriesArgs, reply *AppendEntriesReply) error
+	InstallSnapshot(peer string, args *InstallSnapshotArgs, reply *InstallSnapshotReply) error
+}
+
+// RPCTransport sends requests using net/rpc over TCP
+type RPCTransport struct {
+	lock      *sync.Mutex
+	addresses map[string]string
+	clients   map[string]*rpc.Client
+	timeout   time.Duration
+}
+
+// NewRPCTransport creates a transport for the given peer addresses, keyed by peer id
+func NewRPCTransport(addresses map[string]string, timeout time.Duration) *RPCTransport {
+	return &RPCTransport{
+		lock:      &sync.Mutex{},
+		addresses: addresses,
+		clients:   make(map[string]*rpc.Client),
+		timeout:   timeout,
+	}
+}
+
+func (t *RPCTransport) RequestVote(peer string, args *RequestVoteArgs, reply *RequestVoteReply) error {
+	return t.Call(peer, "Raft.RequestVote", args, reply)
+}
+
+func (t *RPCTransport) AppendEntries(peer string, args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	return t.Call(peer, "Raft.AppendEntries", args, reply)
+}
+
+func (t *RPCTransport) InstallSnapshot(peer string, args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	return t.Call(peer, "Raft.InstallSnapshot", args, reply)
+}
+
+func (t *RPCTransport) client(peer string) (*rpc.Client, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if client, ok := t.clients[peer]; ok {
+		return client, nil
+	}
+	address, ok := t.addresses[peer]
+	if !ok {
+		return nil, fmt.Errorf("Unknown peer %s", peer)
+	}
+	conn, err := net.DialTimeout("tcp", address, t.timeout)
+	if err != nil {
+		return nil, err
+	}
+	client := rpc.NewClient(conn)
+	t.clients[peer] = client
+	return client, nil
+}
+
+// Call sends a request to a service registered with ServeServices on the peer
+func (t *RPCTransport) Call(peer string, method string, args interface{}, reply interface{}) error {
+	client, err := t.client(peer)
+	if err != nil {
+		return err
+	}
+
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-time.After(t.timeout):
+		err = fmt.Errorf("Request to %s timed out", peer)
+	}
+
+	// Reconnect on the next request unless the peer returned an error
+	if _, ok := err.(rpc.ServerError); err != nil && !ok {
+		t.lock.Lock()
+		if t.clients[peer] == client {
+			delete(t.clients, peer)
+		}
+		t.lock.Unlock()
+		client.Close()
+	}
+	return err
+}
+
+// Close closes all connections to peers
+func (t *RPCTransport) Close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for peer, client := range t.clients {
+		client.Close()
+		delete(t.clients, peer)
+	}
+}
+
+// Service receives requests for a node over net/rpc
+type Service struct {
+	node *Node
+}
+
+func NewService(node *Node) *Service {
+	return &Service{node: node}
+}
+
+func (s *Service) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	return s.node.handleRequestVote(args, reply)
+}
+
+func (s *Service) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	return s.node.handleAppendEntries(args, reply)
+}
+
+func (s *Service) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	return s.node.handleInstallSnapshot(args, reply)
+}
+
+// Serve accepts requests for the node on listener until it is closed
+func Serve(listener net.Listener, node *Node) error {
+	return ServeServices(listener, map[string]interface{}{"Raft": NewService(node)})
+}
+
+// ServeServices accepts requests for the services, keyed by name, on
+// listener until it is closed
+func ServeServices(listener net.Listener, services map[string]interface{}) error {
+	server := rpc.NewServer()
+	for name, service := range services {
+		err := server.RegisterName(name, service)
+		if err != nil {
+			return err
+		}
+	}
+	server.Accept(listener)
+	return nil
+}
@@ -0,0 +1,378 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Storage persists the term, vote and log of a node, along with the
+// snapshot replacing the entries at the start of the log.
+type Storage interface {
+	// Load returns the term, vote and entries after the snapshot
+	Load() (term uint64, votedFor string, entries []LogEntry, err error)
+	// LoadSnapshot returns the last snapshot saved, or nil if there is none
+	LoadSnapshot() (*Snapshot, error)
+	SaveState(term uint64, votedFor string) error
+	Append(entries []LogEntry) error
+	// Truncate removes the entry at index and all entries after it
+	Truncate(index uint64) error
+	// SaveSnapshot saves a snapshot and removes the entries it replaces
+	SaveSnapshot(snapshot *Snapshot) error
+	Close() error
+}
+
+type MemoryStorage struct {
+	lock     *sync.Mutex
+	term     uint64
+	votedFor string
+	snapshot *Snapshot
+	entries  []LogEntry
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		lock: &sync.Mutex{},
+	}
+}
+
+func (m *MemoryStorage) Load() (uint64, string, []LogEntry, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	entries := make([]LogEntry, len(m.entries))
+	copy(entries, m.entries)
+	return m.term, m.votedFor, entries, nil
+}
+
+func (m *MemoryStorage) LoadSnapshot() (*Snapshot, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.snapshot, nil
+}
+
+func (m *MemoryStorage) SaveState(term uint64, votedFor string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.term = term
+	m.votedFor = votedFor
+	return nil
+}
+
+func (m *MemoryStorage) Append(entries []LogEntry) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.entries = append(m.entries, entries...)
+	return nil
+}
+
+func (m *MemoryStorage) Truncate(index uint64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i, entry := range m.entries {
+		if entry.Index >= index {
+			m.entries = m.entries[:i]
+			break
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStorage) SaveSnapshot(snapshot *Snapshot) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.snapshot = snapshot
+	entries := make([]LogEntry, 0, len(m.entries))
+	for _, entry := range m.entries {
+		if entry.Index > snapshot.Index {
+			entries = append(entries, entry)
+		}
+	}
+	m.entries = entries
+	return nil
+}
+
+func (m *MemoryStorage) Close() error {
+	return nil
+}
+
+// FileStorage keeps the term and vote in state.json, the snapshot in
+// snapshot.bin and the entries after it in log.bin in a directory. Each log
+// record is:
+//
+//	term   uint64
+//	index  uint64
+//	length int64 (-1 for a nil command)
+//	command [length]byte
+//
+// The snapshot is the index and term of the last entry it replaces followed
+// by its data.
+type FileStorage struct {
+	dir     string
+	lock    *sync.Mutex
+	logFile *os.File
+	// Positions of the records from the entry at first in the log file
+	first     uint64
+	positions []int64
+	end       int64
+}
+
+type fileState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"votedFor"`
+}
+
+const recordHeaderSz = 24
+
+func NewFileStorage(dir string) (*FileStorage, error) {
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	logFile, err := os.OpenFile(filepath.Join(dir, "log.bin"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStorage{
+		dir:     dir,
+		lock:    &sync.Mutex{},
+		logFile: logFile,
+		first:   1,
+	}, nil
+}
+
+func (f *FileStorage) Load() (uint64, string, []LogEntry, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var state fileState
+	data, err := ioutil.ReadFile(filepath.Join(f.dir, "state.json"))
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+		if err != nil {
+			return 0, "", nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, "", nil, err
+	}
+
+	snapshot, err := f.readSnapshot()
+	if err != nil {
+		return 0, "", nil, err
+	}
+	f.first = 1
+	if snapshot != nil {
+		f.first = snapshot.Index + 1
+	}
+
+	_, err = f.logFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	reader := bufio.NewReader(f.logFile)
+	entries := make([]LogEntry, 0)
+	f.positions = make([]int64, 0)
+	position := int64(0)
+	for {
+		hdr := make([]byte, recordHeaderSz)
+		_, err := io.ReadFull(reader, hdr)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// A partially written record at the end is discarded
+			break
+		} else if err != nil {
+			return 0, "", nil, err
+		}
+		entry := LogEntry{
+			Term:  binary.LittleEndian.Uint64(hdr[0:8]),
+			Index: binary.LittleEndian.Uint64(hdr[8:16]),
+		}
+		length := int64(binary.LittleEndian.Uint64(hdr[16:24]))
+		if length >= 0 {
+			entry.Command = make([]byte, length)
+			_, err = io.ReadFull(reader, entry.Command)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			} else if err != nil {
+				return 0, "", nil, err
+			}
+		} else {
+			length = 0
+		}
+		// Entries replaced by the snapshot remain if the log was not
+		// rewritten after saving it
+		if entry.Index >= f.first {
+			if entry.Index != f.first+uint64(len(entries)) {
+				return 0, "", nil, fmt.Errorf("Raft log entry %d found at position %d", entry.Index, f.first+uint64(len(entries)))
+			}
+			entries = append(entries, entry)
+			f.positions = append(f.positions, position)
+		}
+		position += recordHeaderSz + length
+	}
+	f.end = position
+	err = f.logFile.Truncate(f.end)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	return state.Term, state.VotedFor, entries, nil
+}
+
+func (f *FileStorage) LoadSnapshot() (*Snapshot, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.readSnapshot()
+}
+
+func (f *FileStorage) readSnapshot() (*Snapshot, error) {
+	data, err := ioutil.ReadFile(filepath.Join(f.dir, "snapshot.bin"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(data) < 16 {
+		return nil, fmt.Errorf("Raft snapshot is truncated")
+	}
+	return &Snapshot{
+		Index: binary.LittleEndian.Uint64(data[0:8]),
+		Term:  binary.LittleEndian.Uint64(data[8:16]),
+		Data:  data[16:],
+	}, nil
+}
+
+// writeFile replaces a file in the storage directory with data
+func (f *FileStorage) writeFile(name string, data []byte) error {
+	tmp := filepath.Join(f.dir, name+".tmp")
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(data)
+	if err == nil {
+		err = out.Sync()
+	}
+	out.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(f.dir, name))
+}
+
+func (f *FileStorage) SaveState(term uint64, votedFor string) error {
+	data, err := json.Marshal(fileState{Term: term, VotedFor: votedFor})
+	if err != nil {
+		return err
+	}
+	return f.writeFile("state.json", data)
+}
+
+func (f *FileStorage) Append(entries []LogEntry) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	buf := new(bytes.Buffer)
+	positions := make([]int64, 0, len(entries))
+	for _, entry := range entries {
+		positions = append(positions, f.end+int64(buf.Len()))
+		length := int64(len(entry.Command))
+		if entry.Command == nil {
+			length = -1
+		}
+		binary.Write(buf, binary.LittleEndian, entry.Term)
+		binary.Write(buf, binary.LittleEndian, entry.Index)
+		binary.Write(buf, binary.LittleEndian, length)
+		buf.Write(entry.Command)
+	}
+	_, err := f.logFile.WriteAt(buf.Bytes(), f.end)
+	if err != nil {
+		return err
+	}
+	err = f.logFile.Sync()
+	if err != nil {
+		return err
+	}
+	if len(f.positions) == 0 && len(entries) > 0 {
+		f.first = entries[0].Index
+	}
+	f.end += int64(buf.Len())
+	f.positions = append(f.positions, positions...)
+	return nil
+}
+
+func (f *FileStorage) Truncate(index uint64) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if index < f.first || index >= f.first+uint64(len(f.positions)) {
+		return nil
+	}
+	end := f.positions[index-f.first]
+	err := f.logFile.Truncate(end)
+	if err != nil {
+		return err
+	}
+	f.end = end
+	f.positions = f.positions[:index-f.first]
+	return f.logFile.Sync()
+}
+
+// SaveSnapshot writes the snapshot and then rewrites the log without the
+// entries it replaces
+func (f *FileStorage) SaveSnapshot(snapshot *Snapshot) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, snapshot.Index)
+	binary.Write(buf, binary.LittleEndian, snapshot.Term)
+	buf.Write(snapshot.Data)
+	err := f.writeFile("snapshot.bin", buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	start := f.end
+	kept := 0
+	if snapshot.Index+1 >= f.first && snapshot.Index+1 < f.first+uint64(len(f.positions)) {
+		start = f.positions[snapshot.Index+1-f.first]
+		kept = len(f.positions) - int(snapshot.Index+1-f.first)
+	}
+	remaining := make([]byte, f.end-start)
+	_, err = f.logFile.ReadAt(remaining, start)
+	if err != nil {
+		return err
+	}
+	err = f.writeFile("log.bin", remaining)
+	if err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile(filepath.Join(f.dir, "log.bin"), os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	f.logFile.Close()
+	f.logFile = logFile
+
+	positions := make([]int64, 0, kept)
+	for _, position := range f.positions[len(f.positions)-kept:] {
+		positions = append(positions, position-start)
+	}
+	f.positions = positions
+	f.first = snapshot.Index + 1
+	f.end -= start
+	return nil
+}
+
+func (f *FileStorage) Close() error {
+	return f.logFile.Close()
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package raft
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var ErrNotLeader = errors.New("not the leader")
+var ErrLeadershipLost = errors.New("leadership lost before the entry was committed")
+var ErrTimeout = errors.New("timed out waiting for the entry to be committed")
+var ErrStopped = errors.New("node stopped")
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+func (r role) String() string {
+	switch r {
+	case leader:
+		return "leader"
+	case candidate:
+		return "candidate"
+	default:
+		return "follower"
+	}
+}
+
+// LogEntry is an entry in the replicated log. Entries with a nil command
+// are appended by a new leader to commit entries from earlier terms.
+type LogEntry struct {
+	Term    uint64
+	Index   uint64
+	Command []byte
+}
+
+// StateMachine is the state replicated by the log. Commands are applied in
+// log order on every node, and the log is compacted by replacing the
+// entries applied so far with a snapshot of the state.
+type StateMachine interface {
+	// Apply applies a committed command, returning the result to the proposer
+	Apply(index uint64, command []byte) interface{}
+	// Snapshot returns the state after the last command applied, which must
+	// be durable once it returns, as the entries applied are removed
+	Snapshot() ([]byte, error)
+	// Restore replaces the state with a snapshot. The snapshot is either
+	// taken by this node, or sent by the leader with the given id when the
+	// entries needed to catch up are no longer in its log.
+	Restore(snapshot []byte, leader string) error
+}
+
+// Snapshot replaces the entries up to and including Index
+type Snapshot struct {
+	Index uint64
+	Term  uint64
+	Data  []byte
+}
+
+type Config struct {
+	Id string
+	// Ids of the other members of the group
+	Peers []string
+	// Election timeouts are randomized between ElectionTimeout and twice that
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	// How long Propose waits for an entry to be committed
+	ProposeTimeout time.Duration
+	// Number of applied entries kept in the log before it is compacted, or 0
+	// to never compact it
+	SnapshotThreshold uint64
+}
+
+func DefaultConfig(id string, peers []string) Config {
+	return Config{
+		Id:                id,
+		Peers:             peers,
+		ElectionTimeout:   300 * time.Millisecond,
+		HeartbeatInterval: 50 * time.Millisecond,
+		ProposeTimeout:    5 * time.Second,
+		SnapshotThreshold: 8192,
+	}
+}
+
+type Node struct {
+	config    Config
+	transport Transport
+	storage   Storage
+	fsm       StateMachine
+	random    *rand.Rand
+
+	// Held while applying entries or restoring a snapshot, before lock
+	applyLock *sync.Mutex
+
+	lock      *sync.Mutex
+	applyCond *sync.Cond
+	role      role
+	term      uint64
+	votedFor  string
+	// Entries after the snapshot
+	log           []LogEntry
+	snapshot      *Snapshot
+	commitIndex   uint64
+	lastApplied   uint64
+	leaderId      string
+	termStart     uint64
+	electionReset time.Time
+	heartbeat     time.Time
+	timeout       time.Duration
+	nextIndex     map[string]uint64
+	matchIndex    map[string]uint64
+	inflight      map[string]bool
+	waiters       map[uint64]*waiter
+
+	stop     chan struct{}
+	stopped  bool
+	done     *sync.WaitGroup
+	notifyCh chan struct{}
+}
+
+type waiter struct {
+	term   uint64
+	value  interface{}
+	result chan error
+}
+
+type RequestVoteArgs struct {
+	Term         uint64
+	CandidateId  string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type RequestVoteReply struct {
+	Term        uint64
+	VoteGranted bool
+}
+
+type AppendEntriesArgs struct {
+	Term         uint64
+	LeaderId     string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []LogEntry
+	LeaderCommit uint64
+}
+
+type AppendEntriesReply struct {
+	Term    uint64
+	Success bool
+	// Index the leader should continue from when the entries did not match
+	ConflictIndex uint64
+}
+
+type InstallSnapshotArgs struct {
+	Term     uint64
+	LeaderId string
+	Snapshot Snapshot
+}
+
+type InstallSnapshotReply struct {
+	Term uint64
+}
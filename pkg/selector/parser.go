@@ -0,0 +1,338 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package selector
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenIdentifier
+	tokenKeyword
+	tokenString
+	tokenNumber
+	tokenOperator
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+var keywords = map[string]bool{
+	"AND":     true,
+	"OR":      true,
+	"NOT":     true,
+	"IS":      true,
+	"NULL":    true,
+	"IN":      true,
+	"LIKE":    true,
+	"BETWEEN": true,
+	"TRUE":    true,
+	"FALSE":   true,
+}
+
+func isIdentifierStart(r rune) bool {
+	return unicode.IsLetter(r) || r == '_' || r == '$'
+}
+
+func isIdentifierPart(r rune) bool {
+	return isIdentifierStart(r) || unicode.IsDigit(r) || r == '.'
+}
+
+// tokenize splits an expression into tokens. Keywords are upper cased,
+// string literals and quoted identifiers are unquoted.
+func tokenize(expression string) ([]token, error) {
+	runes := []rune(expression)
+	tokens := make([]token, 0)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case r == '\'' || r == '"':
+			// Quotes are escaped by doubling them
+			var text strings.Builder
+			i++
+			for {
+				if i >= len(runes) {
+					return nil, fmt.Errorf("unterminated quote at position %d", start)
+				}
+				if runes[i] == r {
+					if i+1 < len(runes) && runes[i+1] == r {
+						text.WriteRune(r)
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				text.WriteRune(runes[i])
+				i++
+			}
+			kind := tokenString
+			if r == '"' {
+				kind = tokenIdentifier
+			}
+			tokens = append(tokens, token{kind: kind, text: text.String(), pos: start})
+		case isIdentifierStart(r):
+			for i < len(runes) && isIdentifierPart(runes[i]) {
+				i++
+			}
+			text := string(runes[start:i])
+			if keywords[strings.ToUpper(text)] {
+				tokens = append(tokens, token{kind: tokenKeyword, text: strings.ToUpper(text), pos: start})
+			} else {
+				tokens = append(tokens, token{kind: tokenIdentifier, text: text, pos: start})
+			}
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.' || runes[i] == 'e' || runes[i] == 'E' ||
+				((runes[i] == '-' || runes[i] == '+') && (runes[i-1] == 'e' || runes[i-1] == 'E'))) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: string(runes[start:i]), pos: start})
+		case strings.ContainsRune("=<>!", r):
+			i++
+			if i < len(runes) && (runes[i] == '=' || (r == '<' && runes[i] == '>')) {
+				i++
+			}
+			op := string(runes[start:i])
+			if op == "!" {
+				return nil, fmt.Errorf("unexpected '!' at position %d", start)
+			}
+			if op == "!=" {
+				op = "<>"
+			}
+			tokens = append(tokens, token{kind: tokenOperator, text: op, pos: start})
+		case strings.ContainsRune("(),-+", r):
+			i++
+			tokens = append(tokens, token{kind: tokenOperator, text: string(r), pos: start})
+		default:
+			return nil, fmt.Errorf("unexpected '%c' at position %d", r, start)
+		}
+	}
+	return append(tokens, token{kind: tokenEnd, text: "end of expression", pos: len(runes)}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEnd {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) accept(kind tokenKind, text string) bool {
+	t := p.peek()
+	if t.kind == kind && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(kind tokenKind, text string) error {
+	if !p.accept(kind, text) {
+		return p.unexpected()
+	}
+	return nil
+}
+
+func (p *parser) unexpected() error {
+	t := p.peek()
+	return fmt.Errorf("unexpected '%s' at position %d", t.text, t.pos)
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokenKeyword, "OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &or{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokenKeyword, "AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &and{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.accept(tokenKeyword, "NOT") {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &not{operand: operand}, nil
+	}
+	return p.parsePredicate()
+}
+
+func (p *parser) parsePredicate() (node, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	if t.kind == tokenOperator && strings.ContainsAny(t.text, "=<>") {
+		p.next()
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return &comparison{op: t.text, left: left, right: right}, nil
+	}
+
+	if p.accept(tokenKeyword, "IS") {
+		negate := p.accept(tokenKeyword, "NOT")
+		if err := p.expect(tokenKeyword, "NULL"); err != nil {
+			return nil, err
+		}
+		return &isNull{operand: left, negate: negate}, nil
+	}
+
+	negate := p.accept(tokenKeyword, "NOT")
+	switch {
+	case p.accept(tokenKeyword, "IN"):
+		values, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		return &in{operand: left, values: values, negate: negate}, nil
+	case p.accept(tokenKeyword, "LIKE"):
+		pattern := p.next()
+		if pattern.kind != tokenString {
+			return nil, fmt.Errorf("expected a string after LIKE at position %d", pattern.pos)
+		}
+		return &like{operand: left, pattern: pattern.text, negate: negate}, nil
+	case p.accept(tokenKeyword, "BETWEEN"):
+		low, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokenKeyword, "AND"); err != nil {
+			return nil, err
+		}
+		high, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return &between{operand: left, low: low, high: high, negate: negate}, nil
+	case negate:
+		return nil, p.unexpected()
+	}
+	return left, nil
+}
+
+// parseList parses a parenthesized list of literals
+func (p *parser) parseList() ([]interface{}, error) {
+	if err := p.expect(tokenOperator, "("); err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, 0)
+	for {
+		operand, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		value, ok := operand.(*literal)
+		if !ok {
+			return nil, fmt.Errorf("IN only accepts literals")
+		}
+		values = append(values, value.value)
+		if !p.accept(tokenOperator, ",") {
+			break
+		}
+	}
+	if err := p.expect(tokenOperator, ")"); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func (p *parser) parseOperand() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenIdentifier:
+		return &identifier{name: t.text}, nil
+	case tokenString:
+		return &literal{value: t.text}, nil
+	case tokenNumber:
+		return parseNumber(t.text, t.pos)
+	case tokenKeyword:
+		switch t.text {
+		case "TRUE":
+			return &literal{value: true}, nil
+		case "FALSE":
+			return &literal{value: false}, nil
+		}
+	case tokenOperator:
+		switch t.text {
+		case "-", "+":
+			number := p.next()
+			if number.kind != tokenNumber {
+				return nil, fmt.Errorf("expected a number at position %d", number.pos)
+			}
+			return parseNumber(t.text+number.text, t.pos)
+		case "(":
+			inner, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(tokenOperator, ")"); err != nil {
+				return nil, err
+			}
+			return inner, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected '%s' at position %d", t.text, t.pos)
+}
+
+func parseNumber(text string, pos int) (node, error) {
+	if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return &literal{value: i}, nil
+	}
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid number '%s' at position %d", text, pos)
+	}
+	return &literal{value: f}, nil
+}
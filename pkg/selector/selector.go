@@ -0,0 +1,336 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+// Package selector implements message selectors, a subset of the SQL-92
+// conditional expressions used by JMS message selectors:
+//
+//	color = 'red' AND (size > 10 OR NOT urgent)
+//	region IN ('eu', 'us') AND name LIKE 'sensor-%' AND owner IS NOT NULL
+//	reading BETWEEN 10 AND 20.5
+//
+// Identifiers are resolved by the caller. Comparisons involving a missing
+// identifier are unknown, and a selector only matches when it evaluates to
+// true.
+package selector
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Lookup returns the value of an identifier, which must be a string, bool,
+// integer or floating point number, or false if it is not set.
+type Lookup func(name string) (interface{}, bool)
+
+type Selector struct {
+	expression string
+	root       node
+}
+
+// Parse parses a selector expression
+func Parse(expression string) (*Selector, error) {
+	tokens, err := tokenize(expression)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokenEnd {
+		return nil, fmt.Errorf("unexpected '%s' at position %d", p.peek().text, p.peek().pos)
+	}
+	return &Selector{
+		expression: expression,
+		root:       root,
+	}, nil
+}
+
+// Match returns true if the selector evaluates to true
+func (s *Selector) Match(lookup Lookup) bool {
+	result, ok := s.root.eval(lookup).(bool)
+	return ok && result
+}
+
+func (s *Selector) String() string {
+	return s.expression
+}
+
+// A node evaluates to a string, bool, int64, float64 or nil if unknown
+type node interface {
+	eval(lookup Lookup) interface{}
+}
+
+type literal struct {
+	value interface{}
+}
+
+func (n *literal) eval(lookup Lookup) interface{} {
+	return n.value
+}
+
+type identifier struct {
+	name string
+}
+
+func (n *identifier) eval(lookup Lookup) interface{} {
+	value, ok := lookup(n.name)
+	if !ok {
+		return nil
+	}
+	return normalize(value)
+}
+
+// normalize converts values to the types used during evaluation
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string, bool, int64, float64:
+		return v
+	case int:
+		return int64(v)
+	case int8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint8:
+		return int64(v)
+	case uint16:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case uint64:
+		return int64(v)
+	case float32:
+		return float64(v)
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return nil
+	}
+}
+
+type and struct {
+	left, right node
+}
+
+func (n *and) eval(lookup Lookup) interface{} {
+	left, leftOk := n.left.eval(lookup).(bool)
+	if leftOk && !left {
+		return false
+	}
+	right, rightOk := n.right.eval(lookup).(bool)
+	if rightOk && !right {
+		return false
+	}
+	if leftOk && rightOk {
+		return true
+	}
+	return nil
+}
+
+type or struct {
+	left, right node
+}
+
+func (n *or) eval(lookup Lookup) interface{} {
+	left, leftOk := n.left.eval(lookup).(bool)
+	if leftOk && left {
+		return true
+	}
+	right, rightOk := n.right.eval(lookup).(bool)
+	if rightOk && right {
+		return true
+	}
+	if leftOk && rightOk {
+		return false
+	}
+	return nil
+}
+
+type not struct {
+	operand node
+}
+
+func (n *not) eval(lookup Lookup) interface{} {
+	if value, ok := n.operand.eval(lookup).(bool); ok {
+		return !value
+	}
+	return nil
+}
+
+type comparison struct {
+	op          string
+	left, right node
+}
+
+func (n *comparison) eval(lookup Lookup) interface{} {
+	left := n.left.eval(lookup)
+	if _, isBool := left.(bool); isBool && n.op != "=" && n.op != "<>" {
+		return nil
+	}
+	c, ok := compare(left, n.right.eval(lookup))
+	if !ok {
+		return nil
+	}
+	switch n.op {
+	case "=":
+		return c == 0
+	case "<>":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default:
+		return c >= 0
+	}
+}
+
+// compare returns the ordering of two values, or false if they are unknown
+// or not comparable. Booleans are only ordered to test equality.
+func compare(left, right interface{}) (int, bool) {
+	switch l := left.(type) {
+	case string:
+		if r, ok := right.(string); ok {
+			return strings.Compare(l, r), true
+		}
+	case bool:
+		if r, ok := right.(bool); ok {
+			if l == r {
+				return 0, true
+			}
+			return 1, true
+		}
+	case int64:
+		switch r := right.(type) {
+		case int64:
+			return compareInts(l, r), true
+		case float64:
+			return compareFloats(float64(l), r), true
+		}
+	case float64:
+		switch r := right.(type) {
+		case int64:
+			return compareFloats(l, float64(r)), true
+		case float64:
+			return compareFloats(l, r), true
+		}
+	}
+	return 0, false
+}
+
+func compareInts(l, r int64) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func compareFloats(l, r float64) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	default:
+		return 0
+	}
+}
+
+type isNull struct {
+	operand node
+	negate  bool
+}
+
+func (n *isNull) eval(lookup Lookup) interface{} {
+	return (n.operand.eval(lookup) == nil) != n.negate
+}
+
+type in struct {
+	operand node
+	values  []interface{}
+	negate  bool
+}
+
+func (n *in) eval(lookup Lookup) interface{} {
+	value := n.operand.eval(lookup)
+	if value == nil {
+		return nil
+	}
+	for _, v := range n.values {
+		if c, ok := compare(value, v); ok && c == 0 {
+			return !n.negate
+		}
+	}
+	return n.negate
+}
+
+type between struct {
+	operand, low, high node
+	negate             bool
+}
+
+func (n *between) eval(lookup Lookup) interface{} {
+	value := n.operand.eval(lookup)
+	low, lowOk := compare(value, n.low.eval(lookup))
+	high, highOk := compare(value, n.high.eval(lookup))
+	if !lowOk || !highOk {
+		return nil
+	}
+	return (low >= 0 && high <= 0) != n.negate
+}
+
+type like struct {
+	operand node
+	pattern string
+	negate  bool
+}
+
+func (n *like) eval(lookup Lookup) interface{} {
+	value, ok := n.operand.eval(lookup).(string)
+	if !ok {
+		return nil
+	}
+	return matchLike(n.pattern, value) != n.negate
+}
+
+// matchLike matches value against a LIKE pattern, where '%' matches any
+// sequence of characters and '_' matches a single character.
+func matchLike(pattern string, value string) bool {
+	p := []rune(pattern)
+	v := []rune(value)
+	// Positions to backtrack to after the last '%'
+	star, match := -1, 0
+	i, j := 0, 0
+	for j < len(v) {
+		if i < len(p) && (p[i] == '_' || p[i] == v[j]) {
+			i++
+			j++
+		} else if i < len(p) && p[i] == '%' {
+			star = i
+			match = j
+			i++
+		} else if star >= 0 {
+			i = star + 1
+			match++
+			j = match
+		} else {
+			return false
+		}
+	}
+	for i < len(p) && p[i] == '%' {
+		i++
+	}
+	return i == len(p)
+}
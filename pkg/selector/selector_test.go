@@ -0,0 +1,84 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package selector
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	values := map[string]interface{}{
+		"color":              "red",
+		"size":               int32(12),
+		"reading":            15.5,
+		"urgent":             false,
+		"name":               "sensor-42",
+		"properties.subject": "it's",
+		"x-opt-region":       "eu",
+	}
+	lookup := func(name string) (interface{}, bool) {
+		value, ok := values[name]
+		return value, ok
+	}
+
+	for expression, expected := range map[string]bool{
+		"color = 'red'":                            true,
+		"color = 'blue'":                           false,
+		"color <> 'blue'":                          true,
+		"color != 'blue'":                          true,
+		"size > 10 AND size <= 12":                 true,
+		"size < 10 OR NOT urgent":                  true,
+		"urgent":                                   false,
+		"urgent = FALSE":                           true,
+		"reading BETWEEN 10 AND 20.5":              true,
+		"reading NOT BETWEEN 10 AND 20.5":          false,
+		"size = 12.0":                              true,
+		"size > -1":                                true,
+		"color IN ('blue', 'red')":                 true,
+		"color NOT IN ('blue', 'red')":             false,
+		"name LIKE 'sensor-%'":                     true,
+		"name LIKE 'sensor-_'":                     false,
+		"name NOT LIKE '%-4_'":                     false,
+		"properties.subject = 'it''s'":             true,
+		"\"x-opt-region\" = 'eu'":                  true,
+		"owner IS NULL":                            true,
+		"owner IS NOT NULL":                        false,
+		"color IS NOT NULL and (size = 1 or true)": true,
+		// Comparisons with missing identifiers are unknown
+		"owner = 'bob'":                   false,
+		"NOT owner = 'bob'":               false,
+		"owner = 'bob' OR color = 'red'":  true,
+		"owner = 'bob' AND color = 'red'": false,
+		"color > 3":                       false,
+	} {
+		s, err := Parse(expression)
+		assert.Nil(t, err, expression)
+		if err == nil {
+			assert.Equal(t, expected, s.Match(lookup), expression)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expression := range []string{
+		"",
+		"color =",
+		"color = 'red",
+		"(color = 'red'",
+		"color = 'red')",
+		"color LIKE 1",
+		"color IN (a)",
+		"size ! 3",
+		"size NOT 3",
+		"size BETWEEN 1 OR 2",
+		"color = 'red' color",
+	} {
+		_, err := Parse(expression)
+		assert.NotNil(t, err, expression)
+	}
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package server
+
+import (
+	"path"
+)
+
+// AclRule lists the address patterns a user is allowed to send to and
+// receive from, and the restricted management operations the user may
+// perform. Patterns use path.Match syntax.
+type AclRule struct {
+	Send    []string
+	Receive []string
+	Manage  []string
+}
+
+// The rule for this user applies to all users without a rule of their own.
+const AnyUser = "*"
+
+// SetAcl replaces the access control rules keyed by user name. An empty set
+// of rules allows all access.
+func (s *Server) SetAcl(rules map[string]AclRule) {
+	acl := make(map[string]AclRule, len(rules))
+	for user, rule := range rules {
+		acl[user] = rule
+	}
+	s.lock.Lock()
+	s.acl = acl
+	s.lock.Unlock()
+}
+
+// The user name of connections that did not authenticate
+const anonymousUser = "anonymous"
+
+func (s *Server) isAllowed(user string, address string, send bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.acl) == 0 {
+		return true
+	}
+	rule, ok := s.rule(user)
+	if !ok {
+		return false
+	}
+	patterns := rule.Receive
+	if send {
+		patterns = rule.Send
+	}
+	return matchAny(patterns, address)
+}
+
+// isManagementAllowed returns true if the user may perform a restricted
+// management operation. Restricted operations are never allowed for
+// anonymous users, and need a matching manage pattern if there are rules.
+func (s *Server) isManagementAllowed(user string, operation string) bool {
+	if user == "" || user == anonymousUser {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.acl) == 0 {
+		return true
+	}
+	rule, ok := s.rule(user)
+	return ok && matchAny(rule.Manage, operation)
+}
+
+func (s *Server) rule(user string) (AclRule, bool) {
+	rule, ok := s.acl[user]
+	if !ok {
+		rule, ok = s.acl[AnyUser]
+	}
+	return rule, ok
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,224 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package server
+
+import (
+	"net"
+	"sync"
+
+	"github.com/apache/qpid-proton/go/pkg/amqp"
+	"github.com/apache/qpid-proton/go/pkg/proton"
+)
+
+// Connections accepted by the server are driven by a proton engine with a
+// MessagingHandler, so links and deliveries expose the terminus types and
+// delivery states transactions and redirects need. Proton objects are only
+// used in the engine goroutine. Server goroutines block on channels filled
+// by the handler, and inject the operations that touch proton objects.
+
+// ConnectionOption configures the engine of a connection accepted by the server
+type ConnectionOption func(engine *proton.Engine)
+
+// SASLAllowInsecure allows or disallows clear text SASL mechanisms
+func SASLAllowInsecure(allow bool) ConnectionOption {
+	return func(engine *proton.Engine) {
+		engine.Transport().SASL().SetAllowInsecureMechs(allow)
+	}
+}
+
+// SASLAllowedMechs sets the space separated list of allowed SASL mechanisms
+func SASLAllowedMechs(mechs string) ConnectionOption {
+	return func(engine *proton.Engine) {
+		engine.Transport().SASL().AllowedMechs(mechs)
+	}
+}
+
+var saslConfigOnce sync.Once
+
+// SASLConfig sets the directory and name of the SASL configuration. The
+// configuration is global to the process, so it is only applied to the
+// first connection.
+func SASLConfig(dir string, name string) ConnectionOption {
+	return func(engine *proton.Engine) {
+		saslConfigOnce.Do(func() {
+			sasl := engine.Transport().SASL()
+			if name != "" {
+				sasl.ConfigName(name)
+			}
+			if dir != "" {
+				sasl.ConfigPath(dir)
+			}
+		})
+	}
+}
+
+type connection struct {
+	engine *proton.Engine
+	str    string
+	// Links opened by the peer are sent here until they are accepted or rejected
+	incoming  chan *incomingLink
+	done      chan struct{}
+	err       proton.ErrorHolder
+	closeOnce sync.Once
+	// Set when the connection is opened, before any link is sent to incoming
+	user string
+
+	// Only used in the engine goroutine
+	codec amqp.MessageCodec
+	links map[proton.Link]endpoint
+	sent  map[proton.Delivery]chan<- error
+}
+
+// endpoint is a link accepted on the connection
+type endpoint interface {
+	closed(err error)
+}
+
+func newConnection(conn net.Conn, id string, opts []ConnectionOption) (*connection, error) {
+	c := &connection{
+		incoming: make(chan *incomingLink),
+		done:     make(chan struct{}),
+		links:    make(map[proton.Link]endpoint),
+		sent:     make(map[proton.Delivery]chan<- error),
+	}
+	adapter := proton.NewMessagingAdapter(c)
+	// Endpoints are opened, and messages settled and flow controlled, by the server
+	adapter.Prefetch = 0
+	adapter.AutoAccept = false
+	adapter.AutoSettle = false
+	adapter.AutoOpen = false
+	engine, err := proton.NewEngine(conn, adapter)
+	if err != nil {
+		return nil, err
+	}
+	engine.Server()
+	for _, opt := range opts {
+		opt(engine)
+	}
+	engine.Connection().SetContainer(id)
+	c.engine = engine
+	c.str = engine.String()
+	go c.run()
+	return c, nil
+}
+
+func (c *connection) run() {
+	err := c.engine.Run()
+	c.err.Set(err)
+	c.err.Set(amqp.Errorf(amqp.IllegalState, "Connection %s closed", c.str))
+	// Handlers no longer run, so the links are closed from this goroutine
+	for delivery, result := range c.sent {
+		result <- c.err.Get()
+		delete(c.sent, delivery)
+	}
+	for link, ep := range c.links {
+		ep.closed(c.err.Get())
+		delete(c.links, link)
+	}
+	c.codec.Close()
+	close(c.done)
+	close(c.incoming)
+}
+
+func (c *connection) String() string { return c.str }
+
+func (c *connection) User() string { return c.user }
+
+func (c *connection) Done() <-chan struct{} { return c.done }
+
+func (c *connection) Incoming() <-chan *incomingLink { return c.incoming }
+
+// Close closes the connection, passing err to the peer if it is set, and
+// waits for the peer to close it
+func (c *connection) Close(err error) {
+	c.closeOnce.Do(func() {
+		c.engine.Close(err)
+	})
+}
+
+// HandleMessagingEvent is called in the engine goroutine
+func (c *connection) HandleMessagingEvent(t proton.MessagingEvent, e proton.Event) {
+	switch t {
+	case proton.MConnectionOpening:
+		c.user = e.Transport().User()
+		if e.Connection().State().LocalUninit() {
+			e.Connection().Open()
+		}
+
+	case proton.MSessionOpening:
+		if e.Session().State().LocalUninit() {
+			e.Session().Open()
+		}
+
+	case proton.MSessionClosed:
+		for link := range c.links {
+			if link.Session() == e.Session() {
+				c.linkClosed(link, proton.EndpointError(e.Session()))
+			}
+		}
+
+	case proton.MLinkOpening:
+		if e.Link().State().LocalUninit() {
+			c.incomingLink(e.Link())
+		}
+
+	case proton.MLinkClosing:
+		e.Link().Close()
+
+	case proton.MLinkClosed:
+		c.linkClosed(e.Link(), proton.EndpointError(e.Link()))
+
+	case proton.MMessage:
+		if r, ok := c.links[e.Link()].(*receiver); ok {
+			r.message(e.Delivery())
+		} else {
+			proton.CloseError(e.Link(), amqp.Errorf(amqp.InternalError, "No receiver for %s", e.Link()))
+		}
+
+	case proton.MSendable:
+		if s, ok := c.links[e.Link()].(*sender); ok {
+			s.trySend()
+		}
+
+	case proton.MSettled:
+		if result, ok := c.sent[e.Delivery()]; ok {
+			delete(c.sent, e.Delivery())
+			e.Delivery().Settle()
+			result <- nil
+		}
+
+	case proton.MConnectionClosing:
+		c.err.Set(e.Connection().RemoteCondition().Error())
+	}
+}
+
+// incomingLink passes a link opened by the peer to the server. Later events
+// may use the link, so the engine waits until it is accepted or rejected.
+func (c *connection) incomingLink(link proton.Link) {
+	in := newIncomingLink(c, link)
+	c.incoming <- in
+	err := (<-in.decision)()
+	if err != nil {
+		proton.CloseError(link, err)
+	}
+}
+
+func (c *connection) linkClosed(link proton.Link, err error) {
+	ep, ok := c.links[link]
+	if !ok {
+		return
+	}
+	// Messages the peer will not settle any more fail
+	for delivery, result := range c.sent {
+		if delivery.Link() == link {
+			result <- amqp.Errorf(amqp.IllegalState, "Link %s closed", link)
+			delete(c.sent, delivery)
+		}
+	}
+	ep.closed(err)
+	delete(c.links, link)
+	link.Free()
+}
@@ -0,0 +1,39 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/lulf/slim/pkg/commitlog"
+)
+
+// NewDebugHandler returns a handler serving the net/http/pprof profiles,
+// expvar variables and a JSON dump of the commit log state.
+//
+//	/debug/pprof/                     profile index
+//	/debug/pprof/goroutine?debug=2    goroutine dump
+//	/debug/vars                       expvar variables
+//	/debug/state                      topics, subscribers and queue depths
+func NewDebugHandler(cl *commitlog.CommitLog) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/state", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(cl.Stats())
+	})
+	return mux
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package server
+
+import (
+	"fmt"
+
+	"github.com/apache/qpid-proton/go/pkg/amqp"
+	"github.com/lulf/slim/pkg/commitlog"
+)
+
+// Idempotent producers annotate messages with their producer id and an
+// increasing sequence number, and optionally an epoch increased whenever
+// the producer restarts its sequence.
+var producerIdAnnotation = amqp.AnnotationKeySymbol("x-opt-producer-id")
+var producerEpochAnnotation = amqp.AnnotationKeySymbol("x-opt-producer-epoch")
+var sequenceAnnotation = amqp.AnnotationKeySymbol("x-opt-sequence")
+
+// SetDedup makes topics accept messages already stored by their producer
+// without storing them again, remembering the last window messages of each
+// producer. If messageIds is set, messages without a producer id are
+// deduplicated on their message-id. The state of producers is saved in
+// stateDir, if set. It must be set before the server is run.
+func (s *Server) SetDedup(window int, messageIds bool, stateDir string) {
+	s.dedupMessageIds = messageIds
+	s.cl.SetDedup(window, func(payload []byte) (commitlog.DedupKey, bool) {
+		m := amqp.NewMessage()
+		err := m.Decode(payload)
+		if err != nil {
+			return commitlog.DedupKey{}, false
+		}
+		return s.dedupKey(m)
+	}, stateDir)
+}
+
+// dedupKey returns the key identifying a message from an idempotent producer
+func (s *Server) dedupKey(m amqp.Message) (commitlog.DedupKey, bool) {
+	annotations := m.MessageAnnotations()
+	if mirror, ok := annotations[mirrorAnnotation].(string); ok {
+		sequence, err := asInt64(annotations[mirrorOffsetAnnotation])
+		if err == nil {
+			return commitlog.DedupKey{Producer: mirror, Sequence: sequence, Sparse: true}, true
+		}
+	}
+	if producer, ok := annotations[producerIdAnnotation].(string); ok {
+		key := commitlog.DedupKey{Producer: producer, Sequence: -1}
+		if value, ok := annotations[producerEpochAnnotation]; ok {
+			epoch, err := asInt64(value)
+			if err != nil || epoch < 0 {
+				return commitlog.DedupKey{}, false
+			}
+			key.Epoch = epoch
+		}
+		if value, ok := annotations[sequenceAnnotation]; ok {
+			sequence, err := asInt64(value)
+			if err == nil && sequence >= 0 {
+				key.Sequence = sequence
+				return key, true
+			}
+		}
+		if m.MessageId() != nil {
+			key.Id = fmt.Sprint(m.MessageId())
+			return key, true
+		}
+		return commitlog.DedupKey{}, false
+	}
+
+	if s.dedupMessageIds && m.MessageId() != nil {
+		return commitlog.DedupKey{Sequence: -1, Id: fmt.Sprint(m.MessageId())}, true
+	}
+	return commitlog.DedupKey{}, false
+}
@@ -0,0 +1,268 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/apache/qpid-proton/go/pkg/amqp"
+	"github.com/apache/qpid-proton/go/pkg/electron"
+	"github.com/lulf/slim/pkg/api"
+	"github.com/lulf/slim/pkg/commitlog"
+)
+
+// Messages sent to consumers are annotated with their offset and timestamp,
+// which followers use to store them under the same offset as the leader.
+var offsetAnnotation = amqp.AnnotationKeySymbol("x-opt-offset")
+var timestampAnnotation = amqp.AnnotationKeySymbol("x-opt-timestamp")
+
+// How often the leader is asked for new topics when following all topics
+const topicDiscoveryInterval = 10 * time.Second
+
+// How long to wait before reconnecting to the leader
+const reconnectInterval = 5 * time.Second
+
+// Follower tails topics on a leader and stores their entries under the same
+// offsets in the local commit log.
+type Follower struct {
+	id     string
+	cl     *commitlog.CommitLog
+	leader string
+	topics []string
+	opts   []electron.ConnectionOption
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewFollower creates a follower of the leader at address, tailing the given
+// topics, or all topics on the leader if none are given.
+func NewFollower(id string, cl *commitlog.CommitLog, leader string, topics []string, opts ...electron.ConnectionOption) *Follower {
+	return &Follower{
+		id:     id,
+		cl:     cl,
+		leader: leader,
+		topics: topics,
+		opts:   opts,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+func (f *Follower) Leader() string {
+	return f.leader
+}
+
+func (f *Follower) Run() {
+	defer close(f.done)
+	for {
+		err := f.follow()
+		select {
+		case <-f.stop:
+			return
+		default:
+		}
+		log.Printf("Following %s: %v, reconnecting in %v", f.leader, err, reconnectInterval)
+		select {
+		case <-f.stop:
+			return
+		case <-time.After(reconnectInterval):
+		}
+	}
+}
+
+// Stop disconnects from the leader and waits for entries being replicated
+// to be stored.
+func (f *Follower) Stop() {
+	close(f.stop)
+	<-f.done
+}
+
+func (f *Follower) follow() error {
+	opts := append([]electron.ConnectionOption{electron.ContainerId(f.id)}, f.opts...)
+	conn, err := electron.Dial("tcp", f.leader, opts...)
+	if err != nil {
+		return err
+	}
+	log.Printf("Following %s", f.leader)
+
+	tails := &sync.WaitGroup{}
+	defer tails.Wait()
+
+	tailing := make(map[string]bool)
+	for {
+		topics := f.topics
+		if len(topics) == 0 {
+			topics, err = listTopics(conn, f.id)
+			if err != nil {
+				conn.Close(nil)
+				return err
+			}
+		}
+		for _, name := range topics {
+			if !tailing[name] {
+				tailing[name] = true
+				tails.Add(1)
+				go f.tail(conn, name, tails)
+			}
+		}
+
+		select {
+		case <-f.stop:
+			conn.Close(nil)
+			return nil
+		case <-conn.Done():
+			return conn.Error()
+		case <-time.After(topicDiscoveryInterval):
+		}
+	}
+}
+
+func (f *Follower) tail(conn electron.Connection, name string, tails *sync.WaitGroup) {
+	defer tails.Done()
+	topic, err := f.cl.GetOrNewTopic(name)
+	if err != nil {
+		log.Print("Creating topic:", err)
+		conn.Close(nil)
+		return
+	}
+
+	offset := topic.LastCommitted() + 1
+	rcv, err := conn.Receiver(
+		electron.Source(name),
+		electron.Filter(map[amqp.Symbol]interface{}{"offset": offset}),
+		electron.Capacity(100),
+		electron.Prefetch(true))
+	if err != nil {
+		log.Print("Tailing topic ", name, ":", err)
+		conn.Close(nil)
+		return
+	}
+	log.Printf("Tailing topic %s from offset %d", name, offset)
+
+	result := make(chan bool, 1)
+	for {
+		rm, err := rcv.Receive()
+		if err != nil {
+			return
+		}
+
+		message, err := replicatedMessage(rm.Message)
+		if err != nil {
+			log.Print("Replicating topic ", name, ":", err)
+			rm.Reject()
+			conn.Close(amqp.Errorf(amqp.DecodeError, "%v", err))
+			return
+		}
+
+		topic.AddEntry(commitlog.NewReplicatedEntry(message, func(ok bool) {
+			result <- ok
+		}))
+		if !<-result {
+			rm.Release()
+			conn.Close(nil)
+			return
+		}
+		rm.Accept()
+	}
+}
+
+// replicatedMessage removes the offset and timestamp annotations added by the
+// leader and returns the message with them as it was originally stored.
+func replicatedMessage(m amqp.Message) (*api.Message, error) {
+	offset, timestamp, ok, err := takeOffsetAnnotations(m)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("Message without offset annotation")
+	}
+
+	data, err := m.Encode(nil)
+	if err != nil {
+		return nil, err
+	}
+	message := api.NewMessage(offset, data)
+	message.Timestamp = timestamp
+	return message, nil
+}
+
+// takeOffsetAnnotations removes the offset and timestamp annotations from
+// the message and returns their values. ok is false if the message has no
+// offset annotation.
+func takeOffsetAnnotations(m amqp.Message) (offset int64, timestamp int64, ok bool, err error) {
+	annotations := m.MessageAnnotations()
+	offsetValue, ok := annotations[offsetAnnotation]
+	if !ok {
+		return 0, 0, false, nil
+	}
+	offset, err = asInt64(offsetValue)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	timestamp, err = asInt64(annotations[timestampAnnotation])
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	delete(annotations, offsetAnnotation)
+	delete(annotations, timestampAnnotation)
+	if len(annotations) == 0 {
+		annotations = nil
+	}
+	m.SetMessageAnnotations(annotations)
+	return offset, timestamp, true, nil
+}
+
+// listTopics requests the names of all topics on the leader through its
+// management node.
+func listTopics(conn electron.Connection, id string) ([]string, error) {
+	replyTo := fmt.Sprintf("%s/%s-%d", managementAddress, id, os.Getpid())
+	rcv, err := conn.Receiver(electron.Source(replyTo))
+	if err != nil {
+		return nil, err
+	}
+	defer rcv.Close(nil)
+
+	snd, err := conn.Sender(electron.Target(managementAddress))
+	if err != nil {
+		return nil, err
+	}
+	defer snd.Close(nil)
+
+	request := amqp.NewMessage()
+	request.SetMessageId(uint64(time.Now().UnixNano()))
+	request.SetReplyTo(replyTo)
+	request.SetApplicationProperties(map[string]interface{}{"operation": "LIST-TOPICS"})
+	outcome := snd.SendSync(request)
+	if outcome.Status != electron.Accepted {
+		return nil, fmt.Errorf("Sending request: %v %v", outcome.Status, outcome.Error)
+	}
+
+	for {
+		rm, err := rcv.ReceiveTimeout(30 * time.Second)
+		if err != nil {
+			return nil, err
+		}
+		rm.Accept()
+		response := rm.Message
+		if response.CorrelationId() != request.MessageId() {
+			continue
+		}
+		statusCode, _ := response.ApplicationProperties()["statusCode"].(int32)
+		if statusCode != 200 {
+			return nil, fmt.Errorf("Listing topics failed (%d): %v", statusCode, response.ApplicationProperties()["statusDescription"])
+		}
+		body, _ := response.Body().(string)
+		var topics []string
+		err = json.Unmarshal([]byte(body), &topics)
+		return topics, err
+	}
+}
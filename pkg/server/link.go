@@ -0,0 +1,392 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package server
+
+import (
+	"io"
+
+	"github.com/apache/qpid-proton/go/pkg/amqp"
+	"github.com/apache/qpid-proton/go/pkg/proton"
+)
+
+// incomingLink is a link opened by the peer. The engine waits until the
+// server calls one of the accept or reject methods.
+type incomingLink struct {
+	conn        *connection
+	pLink       proton.Link
+	name        string
+	source      string
+	target      string
+	filter      map[amqp.Symbol]interface{}
+	coordinator bool
+	decision    chan func() error
+}
+
+// Called in the engine goroutine
+func newIncomingLink(c *connection, pLink proton.Link) *incomingLink {
+	in := &incomingLink{
+		conn:        c,
+		pLink:       pLink,
+		name:        pLink.Name(),
+		source:      pLink.RemoteSource().Address(),
+		target:      pLink.RemoteTarget().Address(),
+		coordinator: pLink.RemoteTarget().Type() == proton.Coordinator,
+		decision:    make(chan func() error),
+	}
+	filter := pLink.RemoteSource().Filter()
+	if !filter.Empty() {
+		// An invalid filter is treated as no filter
+		_ = filter.Unmarshal(&in.filter)
+	}
+	return in
+}
+
+// IsSender returns true if the server sends messages on the link
+func (in *incomingLink) IsSender() bool { return in.pLink.IsSender() }
+
+// IsCoordinator returns true if the link targets a transaction coordinator
+func (in *incomingLink) IsCoordinator() bool { return in.coordinator }
+
+func (in *incomingLink) Source() string { return in.source }
+
+func (in *incomingLink) Target() string { return in.target }
+
+func (in *incomingLink) Filter() map[amqp.Symbol]interface{} { return in.filter }
+
+// Reject closes the link with an error
+func (in *incomingLink) Reject(err error) {
+	in.decision <- func() error { return err }
+}
+
+// RejectWithInfo closes the link with an error condition carrying info. The
+// condition is left without info if the info can not be encoded.
+func (in *incomingLink) RejectWithInfo(err amqp.Error, info map[amqp.Symbol]interface{}) {
+	in.decision <- func() error {
+		condition := in.pLink.Condition()
+		condition.SetName(err.Name)
+		condition.SetDescription(err.Description)
+		if infoErr := condition.Info().Marshal(info); infoErr != nil {
+			condition.Clear()
+		}
+		return err
+	}
+}
+
+// AcceptSender opens the link for sending messages to the peer
+func (in *incomingLink) AcceptSender() *sender {
+	return in.accept(func() endpoint {
+		s := &sender{link: in.newLink()}
+		in.conn.links[in.pLink] = s
+		in.pLink.Open()
+		return s
+	}).(*sender)
+}
+
+// AcceptReceiver opens the link for receiving messages from the peer. The
+// peer is given credit for capacity messages that are not yet received.
+func (in *incomingLink) AcceptReceiver(capacity int) *receiver {
+	return in.accept(func() endpoint {
+		r := &receiver{
+			link:   in.newLink(),
+			buffer: make(chan *receivedMessage, capacity),
+		}
+		in.conn.links[in.pLink] = r
+		in.pLink.Open()
+		r.flow()
+		return r
+	}).(*receiver)
+}
+
+func (in *incomingLink) accept(open func() endpoint) endpoint {
+	opened := make(chan endpoint, 1)
+	in.decision <- func() error {
+		opened <- open()
+		return nil
+	}
+	return <-opened
+}
+
+func (in *incomingLink) newLink() link {
+	return link{
+		conn:   in.conn,
+		pLink:  in.pLink,
+		str:    in.pLink.String(),
+		name:   in.name,
+		source: in.source,
+		target: in.target,
+		filter: in.filter,
+		done:   make(chan struct{}),
+	}
+}
+
+type link struct {
+	conn   *connection
+	pLink  proton.Link
+	str    string
+	name   string
+	source string
+	target string
+	filter map[amqp.Symbol]interface{}
+	done   chan struct{}
+	err    proton.ErrorHolder
+}
+
+func (l *link) String() string { return l.str }
+
+func (l *link) LinkName() string { return l.name }
+
+func (l *link) Source() string { return l.source }
+
+func (l *link) Target() string { return l.target }
+
+func (l *link) Filter() map[amqp.Symbol]interface{} { return l.filter }
+
+func (l *link) Connection() *connection { return l.conn }
+
+// Done is closed when the link is closed
+func (l *link) Done() <-chan struct{} { return l.done }
+
+// Error returns why the link was closed, or nil if it is open
+func (l *link) Error() error { return l.err.Get() }
+
+// Close closes the link, passing err to the peer if it is set
+func (l *link) Close(err error) {
+	_ = l.conn.engine.Inject(func() {
+		if l.Error() == nil && l.pLink.State().LocalActive() {
+			proton.CloseError(l.pLink, err)
+		}
+	})
+}
+
+// Called in the engine goroutine
+func (l *link) closed(err error) {
+	l.err.Set(err)
+	l.err.Set(io.EOF)
+	close(l.done)
+}
+
+type sender struct {
+	link
+	// Only used in the engine goroutine
+	sending []*sendable
+}
+
+type sendable struct {
+	message amqp.Message
+	// Receives the outcome once the peer settles the message, nil if the
+	// outcome is not wanted
+	result chan<- error
+}
+
+// SendSync sends a message and waits until the peer settles it
+func (s *sender) SendSync(m amqp.Message) error {
+	result := make(chan error, 1)
+	err := s.conn.engine.Inject(func() {
+		s.startSend(&sendable{message: m, result: result})
+	})
+	if err != nil {
+		return err
+	}
+	return <-result
+}
+
+// SendForget sends a message settled, without waiting for the peer
+func (s *sender) SendForget(m amqp.Message) {
+	_ = s.conn.engine.Inject(func() {
+		s.startSend(&sendable{message: m})
+	})
+}
+
+// Called in the engine goroutine
+func (s *sender) startSend(sm *sendable) {
+	if err := s.Error(); err != nil {
+		sm.finish(err)
+		return
+	}
+	s.sending = append(s.sending, sm)
+	s.trySend()
+}
+
+// Called in the engine goroutine
+func (s *sender) trySend() {
+	for s.pLink.Credit() > 0 && len(s.sending) > 0 {
+		sm := s.sending[0]
+		s.sending = s.sending[1:]
+		s.send(sm)
+	}
+}
+
+// Called in the engine goroutine with credit
+func (s *sender) send(sm *sendable) {
+	data, err := s.conn.codec.Encode(sm.message, nil)
+	if err != nil {
+		sm.finish(err)
+		return
+	}
+	delivery, err := s.pLink.SendMessageBytes(data)
+	if err != nil {
+		sm.finish(err)
+		return
+	}
+	if sm.result == nil || s.pLink.RemoteSndSettleMode() == proton.SndSettled {
+		delivery.Settle()
+		sm.finish(nil)
+		return
+	}
+	s.conn.sent[delivery] = sm.result
+}
+
+// finish passes the outcome of sending the message, if it is wanted
+func (sm *sendable) finish(err error) {
+	if sm.result != nil {
+		sm.result <- err
+	}
+}
+
+// Called in the engine goroutine
+func (s *sender) closed(err error) {
+	s.link.closed(err)
+	for _, sm := range s.sending {
+		sm.finish(s.Error())
+	}
+	s.sending = nil
+}
+
+type receiver struct {
+	link
+	buffer chan *receivedMessage
+}
+
+// Receive waits for a message from the peer
+func (r *receiver) Receive() (*receivedMessage, error) {
+	rm, ok := <-r.buffer
+	if !ok {
+		return nil, r.Error()
+	}
+	_ = r.conn.engine.Inject(r.flow)
+	return rm, nil
+}
+
+// Called in the engine goroutine. Tops up the credit of the peer to the
+// free space in the buffer.
+func (r *receiver) flow() {
+	if r.Error() != nil {
+		return
+	}
+	credit := cap(r.buffer) - len(r.buffer) - r.pLink.Credit()
+	if credit > 0 {
+		r.pLink.Flow(credit)
+	}
+}
+
+// Called in the engine goroutine
+func (r *receiver) message(delivery proton.Delivery) {
+	if r.pLink.State().RemoteClosed() {
+		return
+	}
+	data, err := delivery.MessageBytes()
+	m := amqp.NewMessage()
+	if err == nil {
+		err = r.conn.codec.Decode(m, data)
+	}
+	if err != nil {
+		proton.CloseError(r.pLink, err)
+		return
+	}
+	r.pLink.Advance()
+	if r.pLink.Credit() < 0 {
+		proton.CloseError(r.pLink, amqp.Errorf(amqp.InternalError, "Received message in excess of credit"))
+		return
+	}
+	rm := &receivedMessage{
+		Message:   m,
+		receiver:  r,
+		pDelivery: delivery,
+		state:     delivery.Remote().Type(),
+	}
+	// Unknown states are handled like no state
+	var fields interface{}
+	if delivery.Remote().Data().Unmarshal(&fields) == nil {
+		rm.stateFields, _ = fields.(amqp.List)
+	}
+	// Credit never exceeds the free space in the buffer
+	r.buffer <- rm
+}
+
+// Called in the engine goroutine
+func (r *receiver) closed(err error) {
+	r.link.closed(err)
+	close(r.buffer)
+}
+
+// receivedMessage is a message received from the peer, and the delivery
+// state the peer sent it with
+type receivedMessage struct {
+	Message     amqp.Message
+	receiver    *receiver
+	pDelivery   proton.Delivery
+	state       uint64
+	stateFields amqp.List
+}
+
+// State returns the descriptor code and fields of the delivery state
+func (rm *receivedMessage) State() (uint64, amqp.List) {
+	return rm.state, rm.stateFields
+}
+
+func (rm *receivedMessage) acknowledge(f func(delivery proton.Delivery)) error {
+	return rm.receiver.conn.engine.Inject(func() {
+		// Deliveries are freed with their link
+		if rm.receiver.Error() == nil {
+			f(rm.pDelivery)
+		}
+	})
+}
+
+// Accept settles the message as accepted
+func (rm *receivedMessage) Accept() error {
+	return rm.acknowledge(proton.Delivery.Accept)
+}
+
+// Reject settles the message as rejected
+func (rm *receivedMessage) Reject() error {
+	return rm.acknowledge(proton.Delivery.Reject)
+}
+
+// Release settles the message as released, so the peer may send it elsewhere
+func (rm *receivedMessage) Release() error {
+	return rm.acknowledge(func(delivery proton.Delivery) {
+		delivery.Release(false)
+	})
+}
+
+// RejectWithError settles the message as rejected with an error condition
+func (rm *receivedMessage) RejectWithError(err amqp.Error) error {
+	return rm.acknowledge(func(delivery proton.Delivery) {
+		condition := delivery.Local().Condition()
+		condition.SetName(err.Name)
+		condition.SetDescription(err.Description)
+		delivery.Reject()
+	})
+}
+
+// SettleWithState settles the message with a delivery state given by its
+// descriptor code and fields
+func (rm *receivedMessage) SettleWithState(code uint64, fields []interface{}) error {
+	return rm.receiver.conn.engine.InjectWait(func() error {
+		if err := rm.receiver.Error(); err != nil {
+			return err
+		}
+		delivery := rm.pDelivery
+		err := delivery.Local().Data().Marshal(fields)
+		if err != nil {
+			return err
+		}
+		delivery.Update(code)
+		delivery.Settle()
+		return nil
+	})
+}
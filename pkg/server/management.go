@@ -0,0 +1,433 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/apache/qpid-proton/go/pkg/amqp"
+	"github.com/lulf/slim/pkg/commitlog"
+	"github.com/lulf/slim/pkg/datastore"
+)
+
+// Requests are sent to the management address with the operation and its
+// arguments as application properties. Responses are sent to the reply-to
+// address of the request, which must be the source of a link attached by
+// the client on the same connection and start with the reply prefix.
+const managementAddress = "$management"
+const managementReplyPrefix = managementAddress + "/"
+
+func isManagementAddress(address string) bool {
+	return address == managementAddress
+}
+
+// Addresses under the reply prefix are reserved for replies and are never topics
+func isManagementReplyAddress(address string) bool {
+	return strings.HasPrefix(address, managementReplyPrefix)
+}
+
+type replyLinks struct {
+	lock  *sync.Mutex
+	links map[string]*sender
+}
+
+func newReplyLinks() *replyLinks {
+	return &replyLinks{
+		lock:  &sync.Mutex{},
+		links: make(map[string]*sender),
+	}
+}
+
+func (r *replyLinks) add(address string, snd *sender) {
+	r.lock.Lock()
+	r.links[address] = snd
+	r.lock.Unlock()
+	go func() {
+		<-snd.Done()
+		r.lock.Lock()
+		if r.links[address] == snd {
+			delete(r.links, address)
+		}
+		r.lock.Unlock()
+	}()
+}
+
+func (r *replyLinks) get(address string) (*sender, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	snd, ok := r.links[address]
+	return snd, ok
+}
+
+type managementError struct {
+	statusCode int32
+	err        error
+}
+
+func (e *managementError) Error() string {
+	return e.err.Error()
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &managementError{400, fmt.Errorf(format, args...)}
+}
+
+func notFound(format string, args ...interface{}) error {
+	return &managementError{404, fmt.Errorf(format, args...)}
+}
+
+func notAllowed(format string, args ...interface{}) error {
+	return &managementError{403, fmt.Errorf(format, args...)}
+}
+
+func (s *Server) management(rcv *receiver, replies *replyLinks) {
+	for {
+		rm, err := rcv.Receive()
+		if err != nil {
+			log.Print("Closing management link: ", rcv.String())
+			rcv.Close(nil)
+			return
+		}
+		request := rm.Message
+		rm.Accept()
+
+		response := s.handleManagement(rcv.Connection(), request)
+		correlationId := request.MessageId()
+		if correlationId == nil {
+			correlationId = request.CorrelationId()
+		}
+		response.SetCorrelationId(correlationId)
+
+		snd, ok := replies.get(request.ReplyTo())
+		if !ok {
+			log.Print("No reply link for management request:", request.ReplyTo())
+			continue
+		}
+		err = snd.SendSync(response)
+		if err != nil {
+			log.Print("Error sending management response:", err)
+		}
+	}
+}
+
+// Operations that modify or remove data, or write to the server file system
+var restrictedOperations = map[string]bool{
+	"DELETE-TOPIC":  true,
+	"RESET-OFFSETS": true,
+	"GC":            true,
+	"SNAPSHOT":      true,
+	"PROMOTE":       true,
+}
+
+// SetSnapshotDir sets the directory that snapshots are written to. Snapshots
+// are refused unless it is set.
+func (s *Server) SetSnapshotDir(dir string) {
+	s.snapshotDir = dir
+}
+
+func (s *Server) handleManagement(conn *connection, request amqp.Message) amqp.Message {
+	props := request.ApplicationProperties()
+	operation, _ := props["operation"].(string)
+
+	var result interface{}
+	var err error
+	if restrictedOperations[operation] && !s.isManagementAllowed(conn.User(), operation) {
+		err = notAllowed("User '%s' is not allowed to perform '%s'", conn.User(), operation)
+	} else {
+		result, err = s.dispatchManagement(operation, props)
+	}
+
+	response := amqp.NewMessage()
+	if err != nil {
+		statusCode := int32(500)
+		if mErr, ok := err.(*managementError); ok {
+			statusCode = mErr.statusCode
+		}
+		log.Printf("Management operation %s failed: %v", operation, err)
+		response.SetApplicationProperties(map[string]interface{}{
+			"statusCode":        statusCode,
+			"statusDescription": err.Error(),
+		})
+		return response
+	}
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		response.SetApplicationProperties(map[string]interface{}{
+			"statusCode":        int32(500),
+			"statusDescription": err.Error(),
+		})
+		return response
+	}
+	response.SetContentType("application/json")
+	response.SetApplicationProperties(map[string]interface{}{
+		"statusCode":        int32(200),
+		"statusDescription": "OK",
+	})
+	response.Marshal(string(body))
+	return response
+}
+
+func (s *Server) dispatchManagement(operation string, props map[string]interface{}) (interface{}, error) {
+	var result interface{}
+	var err error
+	switch operation {
+	case "GET-STATS":
+		result, err = s.getStats(props)
+	case "LIST-TOPICS":
+		result = s.cl.Topics()
+	case "CREATE-TOPIC":
+		result, err = s.createTopic(props)
+	case "DELETE-TOPIC":
+		result, err = s.deleteTopic(props)
+	case "DESCRIBE-TOPIC":
+		result, err = s.describeTopic(props)
+	case "RESET-OFFSETS":
+		result, err = s.resetOffsets(props)
+	case "GC":
+		result, err = s.garbageCollect(props)
+	case "FLUSH":
+		result, err = map[string]interface{}{}, s.cl.Flush()
+	case "SNAPSHOT":
+		result, err = s.snapshot(props)
+	case "PROMOTE":
+		result, err = s.promote()
+	case "LIST-MIRRORS":
+		result, err = s.listMirrors()
+	default:
+		err = badRequest("Unknown operation '%s'", operation)
+	}
+	return result, err
+}
+
+func (s *Server) getStats(props map[string]interface{}) (interface{}, error) {
+	stats := s.cl.Stats()
+	name, ok := props["name"].(string)
+	if !ok || name == "" {
+		return stats, nil
+	}
+	for _, topic := range stats {
+		if topic.Name == name {
+			return []commitlog.TopicStats{topic}, nil
+		}
+	}
+	return nil, notFound("Topic '%s' not found", name)
+}
+
+func stringProperty(props map[string]interface{}, key string) (string, error) {
+	value, ok := props[key].(string)
+	if !ok || value == "" {
+		return "", badRequest("Missing property '%s'", key)
+	}
+	return value, nil
+}
+
+func topicError(name string, err error) error {
+	if err == commitlog.ErrTopicNotFound {
+		return notFound("Topic '%s' not found", name)
+	}
+	return err
+}
+
+func (s *Server) createTopic(props map[string]interface{}) (interface{}, error) {
+	name, err := stringProperty(props, "name")
+	if err != nil {
+		return nil, err
+	}
+	if isManagementAddress(name) {
+		return nil, badRequest("Invalid topic name '%s'", name)
+	}
+	if s.isFollower() {
+		return nil, notAllowed("Server is a read-only follower")
+	}
+	topic, err := s.cl.GetOrNewTopic(name)
+	if err != nil {
+		return nil, err
+	}
+	return topic.Stats(), nil
+}
+
+func (s *Server) deleteTopic(props map[string]interface{}) (interface{}, error) {
+	name, err := stringProperty(props, "name")
+	if err != nil {
+		return nil, err
+	}
+	if s.isFollower() {
+		return nil, notAllowed("Server is a read-only follower")
+	}
+	if s.cluster != nil {
+		return nil, notAllowed("Deleting topics is not replicated in a cluster")
+	}
+	err = s.cl.DeleteTopic(name)
+	if err != nil {
+		return nil, topicError(name, err)
+	}
+	return map[string]interface{}{"name": name}, nil
+}
+
+type topicDescription struct {
+	commitlog.TopicStats
+	NumMessages int64               `json:"numMessages"`
+	Retention   datastore.Retention `json:"retention"`
+}
+
+func (s *Server) describeTopic(props map[string]interface{}) (interface{}, error) {
+	name, err := stringProperty(props, "name")
+	if err != nil {
+		return nil, err
+	}
+	topic, err := s.cl.GetTopic(name)
+	if err != nil {
+		return nil, topicError(name, err)
+	}
+	numMessages, err := s.cl.NumMessages(name)
+	if err != nil {
+		return nil, topicError(name, err)
+	}
+	return topicDescription{
+		TopicStats:  topic.Stats(),
+		NumMessages: numMessages,
+		Retention:   s.cl.Retention(name),
+	}, nil
+}
+
+// resetOffsets moves the committed offset of a consumer group to the
+// earliest or latest entry, or to the first entry stored at or after a
+// timestamp given in seconds since the epoch.
+func (s *Server) resetOffsets(props map[string]interface{}) (interface{}, error) {
+	name, err := stringProperty(props, "name")
+	if err != nil {
+		return nil, err
+	}
+	group, err := stringProperty(props, "group")
+	if err != nil {
+		return nil, err
+	}
+	position, err := stringProperty(props, "position")
+	if err != nil {
+		return nil, err
+	}
+
+	topic, err := s.cl.GetTopic(name)
+	if err != nil {
+		return nil, topicError(name, err)
+	}
+
+	var offset int64
+	switch position {
+	case "earliest":
+		offset = -1
+	case "latest":
+		offset = topic.LastCommitted()
+	case "timestamp":
+		value, ok := props["timestamp"]
+		if !ok {
+			return nil, badRequest("Missing property 'timestamp'")
+		}
+		timestamp, err := asInt64(value)
+		if err != nil {
+			return nil, badRequest("Invalid property 'timestamp': %v", err)
+		}
+		offset, err = s.cl.OffsetAt(name, timestamp)
+		if err != nil {
+			return nil, topicError(name, err)
+		}
+	default:
+		return nil, badRequest("Invalid position '%s'", position)
+	}
+
+	topic.ResetGroup(group, offset)
+	return commitlog.GroupStats{
+		Name:   group,
+		Offset: offset,
+		Lag:    topic.LastCommitted() - offset,
+	}, nil
+}
+
+func (s *Server) garbageCollect(props map[string]interface{}) (interface{}, error) {
+	topics := s.cl.Topics()
+	if name, ok := props["name"].(string); ok && name != "" {
+		topics = []string{name}
+	}
+	for _, name := range topics {
+		err := s.cl.GarbageCollect(name)
+		if err != nil {
+			return nil, topicError(name, err)
+		}
+	}
+	return topics, nil
+}
+
+type snapshotResult struct {
+	Path    string           `json:"path"`
+	Offsets map[string]int64 `json:"offsets"`
+}
+
+// snapshot writes a copy of the datastore to a directory under the snapshot
+// directory, which must not already exist.
+func (s *Server) snapshot(props map[string]interface{}) (interface{}, error) {
+	name, err := stringProperty(props, "path")
+	if err != nil {
+		return nil, err
+	}
+	if s.snapshotDir == "" {
+		return nil, notAllowed("Snapshots are disabled")
+	}
+	clean := filepath.Clean(name)
+	if filepath.IsAbs(name) || clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return nil, badRequest("Invalid snapshot path '%s', which must be relative to the snapshot directory", name)
+	}
+	path := filepath.Join(s.snapshotDir, clean)
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	offsets, err := s.cl.Snapshot(path)
+	if err != nil {
+		return nil, err
+	}
+	return snapshotResult{
+		Path:    path,
+		Offsets: offsets,
+	}, nil
+}
+
+func (s *Server) promote() (interface{}, error) {
+	err := s.Promote()
+	if err != nil {
+		return nil, badRequest("%v", err)
+	}
+	return map[string]interface{}{"role": "leader"}, nil
+}
+
+type mirrorStatus struct {
+	Name    string           `json:"name"`
+	Source  string           `json:"source"`
+	Offsets map[string]int64 `json:"offsets"`
+}
+
+// listMirrors returns the last source offset mirrored from each topic
+func (s *Server) listMirrors() (interface{}, error) {
+	s.lock.Lock()
+	mirrors := s.mirrors
+	s.lock.Unlock()
+
+	result := make([]mirrorStatus, 0, len(mirrors))
+	for _, mirror := range mirrors {
+		result = append(result, mirrorStatus{
+			Name:    mirror.Name(),
+			Source:  mirror.Source(),
+			Offsets: mirror.Offsets(),
+		})
+	}
+	return result, nil
+}
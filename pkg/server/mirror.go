@@ -0,0 +1,391 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/apache/qpid-proton/go/pkg/amqp"
+	"github.com/apache/qpid-proton/go/pkg/electron"
+	"github.com/lulf/slim/pkg/api"
+	"github.com/lulf/slim/pkg/commitlog"
+	"github.com/lulf/slim/pkg/datastore"
+)
+
+// How often the offsets mirrored up to are written to the state file
+const checkpointInterval = time.Second
+
+// Mirrored messages are annotated with the mirror and source topic they were
+// mirrored from and their source offset, so that messages stored after the
+// last checkpoint are found in the log when the mirror resumes.
+var mirrorAnnotation = amqp.AnnotationKeySymbol("x-opt-mirror")
+var mirrorOffsetAnnotation = amqp.AnnotationKeySymbol("x-opt-mirror-offset")
+
+// MirrorConfig selects the topics a mirror copies and where they are stored
+type MirrorConfig struct {
+	// Address of the source
+	Source string
+	// Topics to mirror. Empty mirrors all topics, which requires a Slim source.
+	Topics []string
+	// Prefix added to the name of mirrored topics
+	Prefix string
+	// Local names of mirrored topics, replacing the prefixed name
+	Rename map[string]string
+	// The source is a plain AMQP broker rather than a Slim server. Messages
+	// are consumed without the offset filter and resuming relies on the
+	// source redelivering unacknowledged messages.
+	Plain bool
+}
+
+// Mirror copies topics from a remote source into local topics. Unlike a
+// follower, mirrored entries get new offsets in the local topics. The
+// offsets mirrored up to are kept in a state file, and the mirror resumes
+// after the last message found in the log from there after a restart.
+type Mirror struct {
+	name      string
+	cl        *commitlog.CommitLog
+	config    MirrorConfig
+	stateFile string
+	opts      []electron.ConnectionOption
+	stop      chan struct{}
+	done      chan struct{}
+
+	lock    *sync.Mutex
+	offsets map[string]mirrorOffsets
+	dirty   bool
+}
+
+// mirrorOffsets is the last message mirrored from a source topic
+type mirrorOffsets struct {
+	Source int64 `json:"source"`
+	// Offset the message was stored at in the local topic
+	Local int64 `json:"local"`
+}
+
+// NewMirror creates a mirror keeping its state in stateFile
+func NewMirror(name string, cl *commitlog.CommitLog, config MirrorConfig, stateFile string, opts ...electron.ConnectionOption) (*Mirror, error) {
+	offsets, err := loadCheckpoint(stateFile)
+	if err != nil {
+		return nil, err
+	}
+	return &Mirror{
+		name:      name,
+		cl:        cl,
+		config:    config,
+		stateFile: stateFile,
+		opts:      opts,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		lock:      &sync.Mutex{},
+		offsets:   offsets,
+	}, nil
+}
+
+func (m *Mirror) Name() string {
+	return m.name
+}
+
+func (m *Mirror) Source() string {
+	return m.config.Source
+}
+
+func (m *Mirror) Run() {
+	defer close(m.done)
+	defer m.checkpoint()
+	for {
+		err := m.mirror()
+		select {
+		case <-m.stop:
+			return
+		default:
+		}
+		log.Printf("Mirroring %s from %s: %v, reconnecting in %v", m.name, m.config.Source, err, reconnectInterval)
+		select {
+		case <-m.stop:
+			return
+		case <-time.After(reconnectInterval):
+		}
+	}
+}
+
+// Stop disconnects from the source, waits for entries being mirrored to be
+// stored and writes the state file.
+func (m *Mirror) Stop() {
+	close(m.stop)
+	<-m.done
+}
+
+// target returns the local name of a source topic
+func (m *Mirror) target(name string) string {
+	if renamed, ok := m.config.Rename[name]; ok {
+		return renamed
+	}
+	return m.config.Prefix + name
+}
+
+func (m *Mirror) mirror() error {
+	id := "slim-mirror-" + m.name
+	opts := append([]electron.ConnectionOption{electron.ContainerId(id)}, m.opts...)
+	conn, err := electron.Dial("tcp", m.config.Source, opts...)
+	if err != nil {
+		return err
+	}
+	log.Printf("Mirroring %s from %s", m.name, m.config.Source)
+
+	tails := &sync.WaitGroup{}
+	defer tails.Wait()
+
+	ticker := time.NewTicker(checkpointInterval)
+	defer ticker.Stop()
+	discover := time.Now()
+
+	tailing := make(map[string]bool)
+	for {
+		if !discover.After(time.Now()) {
+			topics := m.config.Topics
+			if len(topics) == 0 {
+				topics, err = listTopics(conn, id)
+				if err != nil {
+					conn.Close(nil)
+					return err
+				}
+			}
+			for _, name := range topics {
+				if !tailing[name] {
+					tailing[name] = true
+					tails.Add(1)
+					go m.tail(conn, name, tails)
+				}
+			}
+			discover = time.Now().Add(topicDiscoveryInterval)
+		}
+
+		select {
+		case <-m.stop:
+			conn.Close(nil)
+			return nil
+		case <-conn.Done():
+			return conn.Error()
+		case <-ticker.C:
+			m.checkpoint()
+		}
+	}
+}
+
+func (m *Mirror) tail(conn electron.Connection, name string, tails *sync.WaitGroup) {
+	defer tails.Done()
+	targetName := m.target(name)
+	topic, err := m.cl.GetOrNewTopic(targetName)
+	if err != nil {
+		log.Print("Creating topic:", err)
+		conn.Close(nil)
+		return
+	}
+
+	opts := []electron.LinkOption{
+		electron.Source(name),
+		electron.Capacity(100),
+		electron.Prefetch(true),
+	}
+	err = m.recover(name, targetName)
+	if err != nil {
+		log.Print("Recovering mirrored offset:", err)
+		conn.Close(nil)
+		return
+	}
+	offset := m.mirrored(name) + 1
+	if !m.config.Plain {
+		opts = append(opts, electron.Filter(map[amqp.Symbol]interface{}{"offset": offset}))
+	}
+	rcv, err := conn.Receiver(opts...)
+	if err != nil {
+		log.Print("Mirroring topic ", name, ":", err)
+		conn.Close(nil)
+		return
+	}
+	log.Printf("Mirroring topic %s to %s from offset %d", name, targetName, offset)
+
+	result := make(chan bool, 1)
+	for {
+		rm, err := rcv.Receive()
+		if err != nil {
+			return
+		}
+
+		// Messages from a Slim source carry their offset, other messages are
+		// numbered in the order they are received.
+		sourceOffset, _, ok, err := takeOffsetAnnotations(rm.Message)
+		if err != nil {
+			log.Print("Mirroring topic ", name, ":", err)
+			rm.Reject()
+			conn.Close(amqp.Errorf(amqp.DecodeError, "%v", err))
+			return
+		}
+		if !ok {
+			sourceOffset = m.mirrored(name) + 1
+		} else if sourceOffset <= m.mirrored(name) {
+			rm.Accept()
+			continue
+		}
+
+		annotations := rm.Message.MessageAnnotations()
+		if annotations == nil {
+			annotations = make(map[amqp.AnnotationKey]interface{})
+		}
+		annotations[mirrorAnnotation] = m.producer(name)
+		annotations[mirrorOffsetAnnotation] = sourceOffset
+		rm.Message.SetMessageAnnotations(annotations)
+		data, err := rm.Message.Encode(nil)
+		if err != nil {
+			log.Print("Encoding message:", err)
+			rm.Reject()
+			continue
+		}
+
+		message := api.NewMessage(0, data)
+		key := commitlog.DedupKey{Producer: m.producer(name), Sequence: sourceOffset, Sparse: true}
+		topic.AddEntry(commitlog.NewIdempotentEntry(message, key, func(ok bool) {
+			result <- ok
+		}))
+		if !<-result {
+			rm.Release()
+			conn.Close(nil)
+			return
+		}
+		m.setMirrored(name, sourceOffset, message.Offset)
+		rm.Accept()
+	}
+}
+
+// producer identifies the messages mirrored from a source topic
+func (m *Mirror) producer(name string) string {
+	return m.name + "/" + name
+}
+
+// recover finds the messages mirrored from a source topic that were stored
+// after the last checkpoint and advances the mirrored offset past them.
+func (m *Mirror) recover(name string, targetName string) error {
+	m.lock.Lock()
+	from := int64(0)
+	if offsets, ok := m.offsets[name]; ok {
+		from = offsets.Local + 1
+	}
+	m.lock.Unlock()
+
+	producer := m.producer(name)
+	for {
+		messages, err := m.cl.ReadMessages(targetName, from, datastore.ReadBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, message := range messages {
+			from = message.Offset + 1
+			decoded := amqp.NewMessage()
+			if decoded.Decode(message.Payload) != nil {
+				continue
+			}
+			annotations := decoded.MessageAnnotations()
+			if annotations[mirrorAnnotation] != producer {
+				continue
+			}
+			sourceOffset, err := asInt64(annotations[mirrorOffsetAnnotation])
+			if err == nil && sourceOffset > m.mirrored(name) {
+				m.setMirrored(name, sourceOffset, message.Offset)
+			}
+		}
+		if len(messages) < datastore.ReadBatchSize {
+			return nil
+		}
+	}
+}
+
+// mirrored returns the last offset mirrored from a source topic, or -1 if
+// nothing has been mirrored from it.
+func (m *Mirror) mirrored(name string) int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if offsets, ok := m.offsets[name]; ok {
+		return offsets.Source
+	}
+	return -1
+}
+
+// setMirrored records the last message mirrored from a source topic. Local
+// is -1 if the message was already stored.
+func (m *Mirror) setMirrored(name string, source int64, local int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	offsets, ok := m.offsets[name]
+	if !ok {
+		offsets.Local = -1
+	}
+	offsets.Source = source
+	if local > offsets.Local {
+		offsets.Local = local
+	}
+	m.offsets[name] = offsets
+	m.dirty = true
+}
+
+// Offsets returns the last offset mirrored from each source topic
+func (m *Mirror) Offsets() map[string]int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	offsets := make(map[string]int64, len(m.offsets))
+	for name, mirrored := range m.offsets {
+		offsets[name] = mirrored.Source
+	}
+	return offsets
+}
+
+// checkpoint writes the mirrored offsets to the state file if they changed
+func (m *Mirror) checkpoint() {
+	m.lock.Lock()
+	if !m.dirty {
+		m.lock.Unlock()
+		return
+	}
+	data, err := json.Marshal(m.offsets)
+	m.dirty = false
+	m.lock.Unlock()
+	if err == nil {
+		err = writeCheckpoint(m.stateFile, data)
+	}
+	if err != nil {
+		log.Print("Writing mirror state:", err)
+	}
+}
+
+func loadCheckpoint(path string) (map[string]mirrorOffsets, error) {
+	offsets := make(map[string]mirrorOffsets)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return offsets, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &offsets)
+	if err != nil {
+		return nil, err
+	}
+	return offsets, nil
+}
+
+// writeCheckpoint replaces the state file atomically so that a crash while
+// writing leaves the previous state intact.
+func writeCheckpoint(path string, data []byte) error {
+	tmp := path + ".tmp"
+	err := ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
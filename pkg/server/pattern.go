@@ -0,0 +1,115 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package server
+
+import (
+	"log"
+	"path"
+	"time"
+
+	"github.com/apache/qpid-proton/go/pkg/amqp"
+	"github.com/lulf/slim/pkg/commitlog"
+)
+
+// Messages sent on links attached to a pattern are annotated with their topic
+var topicAnnotation = amqp.AnnotationKeySymbol("x-opt-topic")
+
+// How often topics matching a pattern are looked for
+const patternDiscoveryInterval = time.Second
+
+// isPattern returns true if the source filter marks the address as a
+// pattern in path.Match syntax rather than a topic name.
+func isPattern(filter map[amqp.Symbol]interface{}) bool {
+	pattern, _ := filterAsBool(filter, "pattern", false)
+	return pattern
+}
+
+// patternSender merges the entries of all topics matching the source
+// pattern of the link, including topics created while it is attached. Each
+// topic has its own subscriber and position. Topics found when the link is
+// attached start from the offset filter, later topics from their first entry.
+func (s *Server) patternSender(conn *connection, snd *sender, sf *subscriptionFilter) {
+	defer s.links.Done()
+	pattern := snd.Source()
+	if _, err := path.Match(pattern, ""); err != nil {
+		log.Print("Closing link: ", snd.String(), ": ", err)
+		snd.Close(amqp.Errorf("amqp:invalid-field", "Invalid pattern '%s': %v", pattern, err))
+		return
+	}
+
+	subs := make(map[string]*commitlog.Subscriber)
+	// Positions of topics whose subscriber ended, to resume from if the topic is found again
+	positions := make(map[string]int64)
+	ended := make(chan string)
+	first := true
+
+	discover := func() {
+		for _, name := range s.cl.Topics() {
+			if _, ok := subs[name]; ok {
+				continue
+			}
+			if matched, _ := path.Match(pattern, name); !matched || !s.isAllowed(conn.User(), name, false) {
+				continue
+			}
+			topic, err := s.cl.GetTopic(name)
+			if err != nil {
+				continue
+			}
+
+			offset, since := sf.offset, sf.since
+			if position, ok := positions[name]; ok {
+				offset = position
+			} else if !first {
+				offset, since = 0, 0
+			} else {
+				offset = s.startOffset(name, sf)
+			}
+			sub := topic.NewSubscriber(s.id+"-"+snd.LinkName()+"-"+name, sf.group, offset, since)
+			subs[name] = sub
+			go s.tailPattern(snd, sub, sf, name, ended)
+		}
+		first = false
+	}
+
+	discover()
+	ticker := time.NewTicker(patternDiscoveryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-snd.Done():
+			log.Print("Closing link: ", snd.String())
+			snd.Close(nil)
+			for _, sub := range subs {
+				sub.Close()
+			}
+			for len(subs) > 0 {
+				delete(subs, <-ended)
+			}
+			return
+		case name := <-ended:
+			positions[name] = subs[name].Offset()
+			delete(subs, name)
+		case <-ticker.C:
+			discover()
+		}
+	}
+}
+
+// tailPattern streams the entries of one topic matching a pattern until its
+// subscriber is closed or sending fails.
+func (s *Server) tailPattern(snd *sender, sub *commitlog.Subscriber, sf *subscriptionFilter, name string, ended chan<- string) {
+	for {
+		err := s.stream(snd, sub, sf.selector, name)
+		if err != nil {
+			if err != commitlog.ErrSubscriberClosed {
+				log.Print("Error streaming events of ", name, ":", err)
+			}
+			sub.Close()
+			ended <- name
+			return
+		}
+	}
+}
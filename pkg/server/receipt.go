@@ -0,0 +1,59 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package server
+
+import (
+	"strings"
+
+	"github.com/apache/qpid-proton/go/pkg/amqp"
+	"github.com/lulf/slim/pkg/api"
+)
+
+// Producers learn the offsets of their messages by annotating them with the
+// address of a receipt link, which must be the source of a link attached by
+// the producer on the same connection and start with the receipt address.
+const receiptAddress = "$receipts"
+
+var receiptToAnnotation = amqp.AnnotationKeySymbol("x-opt-receipt-to")
+
+func isReceiptAddress(address string) bool {
+	return strings.HasPrefix(address, receiptAddress)
+}
+
+// takeReceiptTo removes the receipt address annotation from the message and
+// returns it, or an empty string if the message has none.
+func takeReceiptTo(m amqp.Message) string {
+	annotations := m.MessageAnnotations()
+	receiptTo, ok := annotations[receiptToAnnotation].(string)
+	if !ok {
+		return ""
+	}
+	delete(annotations, receiptToAnnotation)
+	if len(annotations) == 0 {
+		annotations = nil
+	}
+	m.SetMessageAnnotations(annotations)
+	return receiptTo
+}
+
+// sendReceipt tells the producer the offset a message was stored at, or -1
+// if it was a duplicate of a message already stored. The receipt carries
+// the message-id of the message as its correlation-id.
+func sendReceipt(replies *replyLinks, receiptTo string, topicName string, messageId interface{}, message *api.Message) {
+	snd, ok := replies.get(receiptTo)
+	if !ok {
+		return
+	}
+	receipt := amqp.NewMessage()
+	receipt.SetCorrelationId(messageId)
+	receipt.SetApplicationProperties(map[string]interface{}{
+		"topic":     topicName,
+		"offset":    message.Offset,
+		"timestamp": message.Timestamp,
+	})
+	// Receipts are sent from the topic writer, which must not wait for the producer
+	snd.SendForget(receipt)
+}
@@ -0,0 +1,32 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package server
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/apache/qpid-proton/go/pkg/amqp"
+)
+
+// rejectWithRedirect rejects a link with an amqp:link:redirect error whose
+// info holds the host and port of the leader, as clients following the
+// redirect expect. The error is sent without info if the leader address can
+// not be parsed.
+func rejectWithRedirect(in *incomingLink, leader string, err error) {
+	host, port, splitErr := net.SplitHostPort(leader)
+	portNumber, parseErr := strconv.ParseUint(port, 10, 16)
+	amqpErr, ok := err.(amqp.Error)
+	if splitErr != nil || parseErr != nil || !ok {
+		in.Reject(err)
+		return
+	}
+	in.RejectWithInfo(amqpErr, map[amqp.Symbol]interface{}{
+		"hostname":     host,
+		"network-host": host,
+		"port":         uint16(portNumber),
+	})
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/apache/qpid-proton/go/pkg/amqp"
+	"github.com/lulf/slim/pkg/selector"
+)
+
+// Descriptor of selector filters sent by JMS clients under the
+// "jms-selector" key
+const selectorDescriptor = amqp.Symbol("apache.org:selector-filter:string")
+
+// filterSelector returns the selector given in the "selector" filter, or
+// the "jms-selector" filter used by JMS clients, or nil if none is given.
+func filterSelector(filter map[amqp.Symbol]interface{}) (*selector.Selector, error) {
+	expression, err := filterAsString(filter, "selector", "")
+	if err != nil {
+		return nil, err
+	}
+	if value, ok := filter["jms-selector"]; ok && expression == "" {
+		if described, ok := value.(amqp.Described); ok {
+			value = described.Value
+		}
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("Invalid selector %v", value)
+		}
+		expression = s
+	}
+	if expression == "" {
+		return nil, nil
+	}
+	return selector.Parse(expression)
+}
+
+// messageLookup resolves selector identifiers to application properties of
+// the message, or to its header and properties sections when prefixed with
+// "header." or "properties.".
+func messageLookup(m amqp.Message) selector.Lookup {
+	return func(name string) (interface{}, bool) {
+		if strings.HasPrefix(name, "header.") {
+			switch strings.TrimPrefix(name, "header.") {
+			case "durable":
+				return m.Durable(), true
+			case "priority":
+				return m.Priority(), true
+			case "ttl":
+				return m.TTL().Nanoseconds() / 1000000, true
+			case "delivery_count":
+				return m.DeliveryCount(), true
+			}
+			return nil, false
+		}
+		if strings.HasPrefix(name, "properties.") {
+			return propertyValue(m, strings.TrimPrefix(name, "properties."))
+		}
+		value, ok := m.ApplicationProperties()[name]
+		return value, ok
+	}
+}
+
+func propertyValue(m amqp.Message, name string) (interface{}, bool) {
+	var value interface{}
+	switch name {
+	case "message_id":
+		value = m.MessageId()
+	case "user_id":
+		value = m.UserId()
+	case "to":
+		value = m.Address()
+	case "subject":
+		value = m.Subject()
+	case "reply_to":
+		value = m.ReplyTo()
+	case "correlation_id":
+		value = m.CorrelationId()
+	case "content_type":
+		value = m.ContentType()
+	case "content_encoding":
+		value = m.ContentEncoding()
+	case "creation_time":
+		if m.CreationTime().IsZero() {
+			return nil, false
+		}
+		value = m.CreationTime().UnixNano() / 1000000
+	case "group_id":
+		value = m.GroupId()
+	case "group_sequence":
+		value = m.GroupSequence()
+	case "reply_to_group_id":
+		value = m.ReplyToGroupId()
+	}
+	if value == nil || value == "" {
+		return nil, false
+	}
+	return value, true
+}
@@ -9,62 +9,287 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 
 	"github.com/apache/qpid-proton/go/pkg/amqp"
-	"github.com/apache/qpid-proton/go/pkg/electron"
 	"github.com/lulf/slim/pkg/api"
+	"github.com/lulf/slim/pkg/cluster"
 	"github.com/lulf/slim/pkg/commitlog"
+	"github.com/lulf/slim/pkg/logging"
+	"github.com/lulf/slim/pkg/selector"
 )
 
-func NewServer(id string, cl *commitlog.CommitLog) *Server {
-	container := electron.NewContainer(id)
+func NewServer(id string, cl *commitlog.CommitLog, opts ...ConnectionOption) *Server {
 	return &Server{
-		container: container,
-		cl:        cl,
+		id:       id,
+		connOpts: opts,
+		cl:       cl,
 		codec: &amqp.MessageCodec{
 			Buffer: make([]byte, 1024),
 		},
+		lock:  &sync.Mutex{},
+		conns: make(map[*connection]bool),
+		links: &sync.WaitGroup{},
+		txns:  make(map[string]*transaction),
 	}
 }
 
 func (s *Server) Run(listener net.Listener) {
+	s.lock.Lock()
+	s.listeners = append(s.listeners, listener)
+	s.lock.Unlock()
 	for {
-		conn, err := s.container.Accept(listener)
+		netConn, err := listener.Accept()
 		if err != nil {
+			if s.isDraining() {
+				return
+			}
 			log.Print("Accept error:", err)
 			continue
 		}
+		conn, err := newConnection(netConn, s.id, s.connOpts)
+		if err != nil {
+			log.Print("Creating connection:", err)
+			netConn.Close()
+			continue
+		}
+		s.lock.Lock()
+		if s.isDraining() {
+			s.lock.Unlock()
+			conn.Close(amqp.Errorf("amqp:connection:forced", "Server is shutting down"))
+			return
+		}
+		s.conns[conn] = true
+		s.lock.Unlock()
 		go s.connection(conn)
 	}
 }
 
+// Follow makes the server a read-only follower replicating from a leader
+func (s *Server) Follow(follower *Follower) {
+	s.lock.Lock()
+	s.follower = follower
+	s.lock.Unlock()
+	go follower.Run()
+}
+
+// AddMirror starts mirroring topics into the commit log until the server is
+// shut down.
+func (s *Server) AddMirror(mirror *Mirror) {
+	s.lock.Lock()
+	s.mirrors = append(s.mirrors, mirror)
+	s.lock.Unlock()
+	go mirror.Run()
+}
+
+// Promote stops following the leader and starts accepting producers
+func (s *Server) Promote() error {
+	s.lock.Lock()
+	follower := s.follower
+	s.follower = nil
+	s.lock.Unlock()
+	if follower == nil {
+		return fmt.Errorf("Server is not a follower")
+	}
+	follower.Stop()
+	log.Printf("Promoted from follower of %s to leader", follower.Leader())
+	return nil
+}
+
+// SetCluster makes the server only accept producers while it is the leader
+// of the cluster. It must be set before the server is run.
+func (s *Server) SetCluster(c *cluster.Cluster) {
+	s.cluster = c
+}
+
+// redirect returns the AMQP address of the cluster leader and an error
+// redirecting producers to it, or a nil error if producers are accepted.
+func (s *Server) redirect() (string, error) {
+	if s.cluster == nil || s.cluster.IsLeader() {
+		return "", nil
+	}
+	leader := s.cluster.LeaderAddress()
+	if leader == "" {
+		return "", amqp.Errorf("amqp:link:redirect", "Not the leader and no leader is elected")
+	}
+	return leader, amqp.Errorf("amqp:link:redirect", "Not the leader, the leader is at %s", leader)
+}
+
+func (s *Server) isFollower() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.follower != nil
+}
+
+func (s *Server) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) != 0
+}
+
+// startLink registers a link that Shutdown waits for, unless the server is
+// already draining. Draining is set under the same lock, so no link is
+// registered once Shutdown waits for the links.
+func (s *Server) startLink() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.isDraining() {
+		return false
+	}
+	s.links.Add(1)
+	return true
+}
+
+// Shutdown stops accepting connections and messages, waits for the entries
+// already queued in the commit log to be stored and settled, and closes
+// all connections.
+func (s *Server) Shutdown() {
+	s.lock.Lock()
+	atomic.StoreInt32(&s.draining, 1)
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	follower := s.follower
+	mirrors := s.mirrors
+	s.lock.Unlock()
+
+	if follower != nil {
+		follower.Stop()
+	}
+	for _, mirror := range mirrors {
+		mirror.Stop()
+	}
+
+	log.Print("Draining commit log")
+	s.cl.Close()
+
+	s.lock.Lock()
+	conns := make([]*connection, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.lock.Unlock()
+
+	for _, conn := range conns {
+		log.Print("Closing connection: ", conn.String())
+		conn.Close(amqp.Errorf("amqp:connection:forced", "Server is shutting down"))
+	}
+	s.links.Wait()
+}
+
+func asInt64(value interface{}) (int64, error) {
+	switch value := value.(type) {
+	case int64:
+		return value, nil
+	case int32:
+		return int64(value), nil
+	case uint32:
+		return int64(value), nil
+	case uint64:
+		return int64(value), nil
+	case int:
+		return int64(value), nil
+	default:
+		return 0, fmt.Errorf("Invalid value type %s", value)
+	}
+}
+
 func filterAsInt64(filter map[amqp.Symbol]interface{}, propertyName amqp.Symbol, defaultValue int64) (int64, error) {
 	propertyValue, ok := filter[propertyName]
-	var value int64
-	if ok {
-		switch propertyValue.(type) {
-		case int64:
-			value = propertyValue.(int64)
-		case int32:
-			value = int64(propertyValue.(int32))
-		case uint32:
-			value = int64(propertyValue.(uint32))
-		case uint64:
-			value = int64(propertyValue.(uint64))
-		case int:
-			value = int64(propertyValue.(int))
-		default:
-			return 0, fmt.Errorf("Invalid value type %s", propertyValue)
-		}
-	} else {
-		value = defaultValue
+	if !ok {
+		return defaultValue, nil
+	}
+	return asInt64(propertyValue)
+}
+
+func filterAsBool(filter map[amqp.Symbol]interface{}, propertyName amqp.Symbol, defaultValue bool) (bool, error) {
+	propertyValue, ok := filter[propertyName]
+	if !ok {
+		return defaultValue, nil
+	}
+	value, ok := propertyValue.(bool)
+	if !ok {
+		return false, fmt.Errorf("Invalid value type %s", propertyValue)
 	}
 	return value, nil
 }
 
-func (s *Server) connection(conn electron.Connection) {
+func filterAsString(filter map[amqp.Symbol]interface{}, propertyName amqp.Symbol, defaultValue string) (string, error) {
+	propertyValue, ok := filter[propertyName]
+	if !ok {
+		return defaultValue, nil
+	}
+	switch value := propertyValue.(type) {
+	case string:
+		return value, nil
+	case amqp.Symbol:
+		return string(value), nil
+	default:
+		return "", fmt.Errorf("Invalid value type %s", propertyValue)
+	}
+}
+
+// subscriptionFilter holds the source filters of a consumer
+type subscriptionFilter struct {
+	offset   int64
+	since    int64
+	group    string
+	selector *selector.Selector
+	pattern  bool
+}
+
+// startOffset returns the offset a subscriber starts from, which is the
+// first entry stored at or after the "since" filter if no offset is given.
+func (s *Server) startOffset(topicName string, sf *subscriptionFilter) int64 {
+	if sf.offset >= 0 || sf.since <= 0 {
+		return sf.offset
+	}
+	offset, err := s.cl.OffsetAt(topicName, sf.since)
+	if err != nil {
+		log.Print("Finding offset at ", sf.since, ":", err)
+		return sf.offset
+	}
+	return offset + 1
+}
+
+func parseSubscriptionFilter(filter map[amqp.Symbol]interface{}) (*subscriptionFilter, error) {
+	var err error
+	sf := &subscriptionFilter{}
+	// Retrieve offset
+	sf.offset, err = filterAsInt64(filter, "offset", -1)
+	if err != nil {
+		return nil, err
+	}
+
+	// Retrieve since filter
+	sf.since, err = filterAsInt64(filter, "since", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Retrieve consumer group
+	sf.group, err = filterAsString(filter, "group", "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Retrieve pattern flag
+	sf.pattern, err = filterAsBool(filter, "pattern", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Retrieve selector
+	sf.selector, err = filterSelector(filter)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid selector: %v", err)
+	}
+	return sf, nil
+}
+
+func (s *Server) connection(conn *connection) {
 	done := conn.Done()
 	subs := make([]*commitlog.Subscriber, 0)
+	replies := newReplyLinks()
 	for {
 		select {
 		case <-done:
@@ -72,99 +297,196 @@ func (s *Server) connection(conn electron.Connection) {
 			for _, sub := range subs {
 				sub.Close()
 			}
+			s.rollbackTransactions(conn)
 			conn.Close(nil)
+			s.lock.Lock()
+			delete(s.conns, conn)
+			s.lock.Unlock()
 			return
 		case in := <-conn.Incoming():
-			switch in := in.(type) {
-			case *electron.IncomingSender:
-				snd := in.Accept().(electron.Sender)
-				// TODO: Read offset from properties
-				log.Println("Got new sender", snd)
+			if in == nil {
+				continue
+			}
+			if s.isDraining() {
+				in.Reject(amqp.Errorf("amqp:connection:forced", "Server is shutting down"))
+				continue
+			}
+			if in.IsSender() {
+				if isManagementAddress(in.Source()) {
+					in.Reject(amqp.Errorf(amqp.NotAllowed, "Responses are sent to the reply-to address of requests"))
+					continue
+				}
+				// Access to the topics matching a pattern is checked for each topic
+				if !isManagementReplyAddress(in.Source()) && !isReceiptAddress(in.Source()) && !isPattern(in.Filter()) && !s.isAllowed(conn.User(), in.Source(), false) {
+					log.Printf("User '%s' not allowed to receive from '%s'", conn.User(), in.Source())
+					in.Reject(amqp.Errorf(amqp.UnauthorizedAccess, "Not allowed to receive from '%s'", in.Source()))
+					continue
+				}
+				snd := in.AcceptSender()
+				logging.Debug("Got new sender ", snd)
 				topicName := snd.Source()
-				topic, err := s.cl.GetOrNewTopic(topicName)
+				if isManagementReplyAddress(topicName) || isReceiptAddress(topicName) {
+					replies.add(topicName, snd)
+					continue
+				}
+				sf, err := parseSubscriptionFilter(snd.Filter())
 				if err != nil {
-					log.Print("Closing link: ", snd.String())
-					snd.Close(nil)
+					log.Print("Closing link: ", snd.String(), ": ", err)
+					snd.Close(amqp.Errorf("amqp:invalid-field", "%v", err))
 					continue
 				}
 
-				filter := snd.Filter()
-				// Retrieve offset
-				offset, err := filterAsInt64(filter, "offset", -1)
-				if err != nil {
-					log.Println(err)
+				if sf.pattern {
+					if !s.startLink() {
+						snd.Close(amqp.Errorf("amqp:connection:forced", "Server is shutting down"))
+						continue
+					}
+					go s.patternSender(conn, snd, sf)
 					continue
 				}
 
-				// Retrieve since filter
-				since, err := filterAsInt64(filter, "since", 0)
+				var topic *commitlog.Topic
+				if s.isFollower() {
+					// Topics are only created by replicating them from the leader
+					topic, err = s.cl.GetTopic(topicName)
+				} else {
+					topic, err = s.cl.GetOrNewTopic(topicName)
+				}
 				if err != nil {
-					log.Println(err)
+					log.Print("Closing link: ", snd.String())
+					snd.Close(amqp.Errorf(amqp.NotFound, "Topic '%s' not found", topicName))
 					continue
 				}
 
-				sub := topic.NewSubscriber(conn.Container().Id()+"-"+snd.LinkName(), offset, since)
+				if !s.startLink() {
+					snd.Close(amqp.Errorf("amqp:connection:forced", "Server is shutting down"))
+					continue
+				}
+				sub := topic.NewSubscriber(s.id+"-"+snd.LinkName(), sf.group, s.startOffset(topicName, sf), sf.since)
 				subs = append(subs, sub)
-				go s.sender(snd, sub)
-
-			case *electron.IncomingReceiver:
-				in.SetPrefetch(true)
-				in.SetCapacity(10) // TODO: Adjust based on backlog
-				rcv := in.Accept().(electron.Receiver)
+				go s.sender(snd, sub, sf.selector)
+			} else {
+				if in.IsCoordinator() {
+					if s.cluster != nil {
+						in.Reject(amqp.Errorf(amqp.NotImplemented, "Transactions are not supported in cluster mode"))
+						continue
+					}
+					if !s.startLink() {
+						in.Reject(amqp.Errorf("amqp:connection:forced", "Server is shutting down"))
+						continue
+					}
+					go s.coordinator(in.AcceptReceiver(10))
+					continue
+				}
+				if !s.isAllowed(conn.User(), in.Target(), true) {
+					log.Printf("User '%s' not allowed to send to '%s'", conn.User(), in.Target())
+					in.Reject(amqp.Errorf(amqp.UnauthorizedAccess, "Not allowed to send to '%s'", in.Target()))
+					continue
+				}
+				if isManagementReplyAddress(in.Target()) {
+					in.Reject(amqp.Errorf(amqp.NotAllowed, "Address '%s' is reserved for management replies", in.Target()))
+					continue
+				}
+				if in.Target() != managementAddress && s.isFollower() {
+					in.Reject(amqp.Errorf(amqp.NotAllowed, "Server is a read-only follower"))
+					continue
+				}
+				if in.Target() != managementAddress {
+					if leader, err := s.redirect(); err != nil {
+						rejectWithRedirect(in, leader, err)
+						continue
+					}
+				}
+				rcv := in.AcceptReceiver(10) // TODO: Adjust based on backlog
 
 				topicName := rcv.Target()
+				if topicName == managementAddress {
+					go s.management(rcv, replies)
+					continue
+				}
 				topic, err := s.cl.GetOrNewTopic(topicName)
 				if err != nil {
 					log.Print("Closing link: ", rcv.String())
 					rcv.Close(nil)
 					continue
 				}
-				go s.receiver(topic, rcv)
-			default:
-				if in != nil {
-					in.Accept()
+				if !s.startLink() {
+					rcv.Close(amqp.Errorf("amqp:connection:forced", "Server is shutting down"))
+					continue
 				}
+				go s.receiver(topic, rcv, replies)
 			}
 		}
 	}
 }
 
-func (s *Server) sender(snd electron.Sender, sub *commitlog.Subscriber) {
+func (s *Server) sender(snd *sender, sub *commitlog.Subscriber, sel *selector.Selector) {
+	defer s.links.Done()
+	defer sub.Close()
 	done := snd.Done()
+	// Stop reading from the datastore as soon as the link is closed
+	go func() {
+		<-done
+		sub.Close()
+	}()
 	for {
 		select {
 		case <-done:
 			log.Print("Closing link: ", snd.String())
 			snd.Close(nil)
-			sub.Close()
 			return
 		default:
-			err := sub.Stream(func(msg *api.Message) error {
-				m, err := amqp.DecodeMessage(msg.Payload)
-				if err != nil {
-					log.Print("Decoding message:", m)
-					return err
-				}
-				outcome := snd.SendSync(m)
-				if outcome.Status == electron.Unsent || outcome.Status == electron.Unacknowledged {
-					log.Print("Error sending message:", outcome.Error)
-					return outcome.Error
-				}
-				sub.Commit(msg.Offset)
-				return nil
-			})
-
+			err := s.stream(snd, sub, sel, "")
 			if err != nil {
-				log.Print("Error streaming events for sub:", err)
+				if err == commitlog.ErrSubscriberClosed {
+					log.Print("Closing link: ", snd.String())
+				} else {
+					log.Print("Error streaming events for sub:", err)
+				}
 				snd.Close(nil)
-				sub.Close()
 				return
 			}
 		}
 	}
 }
 
-func (s *Server) receiver(topic *commitlog.Topic, rcv electron.Receiver) {
+// stream sends the entries available to the subscriber that match the
+// selector. Entries are annotated with their offset and timestamp, and with
+// their topic if topicName is set.
+func (s *Server) stream(snd *sender, sub *commitlog.Subscriber, sel *selector.Selector, topicName string) error {
+	return sub.Stream(func(msg *api.Message) error {
+		m, err := amqp.DecodeMessage(msg.Payload)
+		if err != nil {
+			log.Print("Decoding message:", m)
+			return err
+		}
+		if sel != nil && !sel.Match(messageLookup(m)) {
+			// Skipped messages still advance the subscriber
+			sub.Commit(msg.Offset)
+			return nil
+		}
+		annotations := m.MessageAnnotations()
+		if annotations == nil {
+			annotations = make(map[amqp.AnnotationKey]interface{})
+		}
+		annotations[offsetAnnotation] = msg.Offset
+		annotations[timestampAnnotation] = msg.Timestamp
+		if topicName != "" {
+			annotations[topicAnnotation] = topicName
+		}
+		m.SetMessageAnnotations(annotations)
+		err = snd.SendSync(m)
+		if err != nil {
+			log.Print("Error sending message:", err)
+			return err
+		}
+		sub.Commit(msg.Offset)
+		return nil
+	})
+}
+
+func (s *Server) receiver(topic *commitlog.Topic, rcv *receiver, replies *replyLinks) {
+	defer s.links.Done()
 	done := rcv.Done()
 	for {
 		select {
@@ -174,22 +496,34 @@ func (s *Server) receiver(topic *commitlog.Topic, rcv electron.Receiver) {
 			return
 		default:
 			rm, err := rcv.Receive()
-			if err == nil {
+			if err == nil && s.isDraining() {
+				// Let the producer deliver the message elsewhere
+				rm.Release()
+			} else if err == nil && s.stage(rcv.Connection(), topic.Name(), rm) {
+				// Staged in a transaction, stored when it is committed
+			} else if err == nil {
 				m := rm.Message
+				receiptTo := takeReceiptTo(m)
 				data, err := s.codec.Encode(m, make([]byte, 0))
 				if err != nil {
 					rm.Reject()
 				} else {
 					message := api.NewMessage(0, data)
-					topic.AddEntry(commitlog.NewEntry(message,
-						func(ok bool) {
-							if ok {
-								rm.Accept()
-							} else {
-								rm.Reject()
+					listener := func(ok bool) {
+						if ok {
+							if receiptTo != "" {
+								sendReceipt(replies, receiptTo, topic.Name(), m.MessageId(), message)
 							}
-						},
-					))
+							rm.Accept()
+						} else {
+							rm.Reject()
+						}
+					}
+					if key, ok := s.dedupKey(m); ok {
+						topic.AddEntry(commitlog.NewIdempotentEntry(message, key, listener))
+					} else {
+						topic.AddEntry(commitlog.NewEntry(message, listener))
+					}
 				}
 			}
 		}
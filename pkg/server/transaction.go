@@ -0,0 +1,191 @@
+/*
+ * Copyright 2020, Ulf Lilleengen
+ * License: Apache License 2.0 (see the file LICENSE or http://apache.org/licenses/LICENSE-2.0.html).
+ */
+
+package server
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"github.com/apache/qpid-proton/go/pkg/amqp"
+	"github.com/lulf/slim/pkg/api"
+	"github.com/lulf/slim/pkg/commitlog"
+)
+
+// Descriptors of the AMQP 1.0 transaction types
+const (
+	declareCode            = uint64(0x31)
+	dischargeCode          = uint64(0x32)
+	declaredCode           = uint64(0x33)
+	transactionalStateCode = uint64(0x34)
+	acceptedCode           = uint64(0x24)
+)
+
+const (
+	transactionUnknownId = "amqp:transaction:unknown-id"
+	transactionRollback  = "amqp:transaction:rollback"
+)
+
+// transaction is declared on the coordinator link of a connection. It is
+// rolled back if the connection closes before it is discharged.
+type transaction struct {
+	txn  *commitlog.Transaction
+	conn *connection
+}
+
+var txnCounter uint64
+
+// coordinator handles the declare and discharge messages sent on a
+// coordinator link
+func (s *Server) coordinator(rcv *receiver) {
+	defer s.links.Done()
+	done := rcv.Done()
+	for {
+		select {
+		case <-done:
+			log.Print("Closing link: ", rcv.String())
+			rcv.Close(nil)
+			return
+		default:
+			rm, err := rcv.Receive()
+			if err == nil {
+				err = s.control(rcv.Connection(), rm)
+				if err != nil {
+					log.Print("Handling transaction control:", err)
+				}
+			}
+		}
+	}
+}
+
+func (s *Server) control(conn *connection, rm *receivedMessage) error {
+	body, ok := rm.Message.Body().(amqp.Described)
+	if !ok {
+		return rm.RejectWithError(amqp.Errorf(amqp.DecodeError, "Expected a declare or discharge"))
+	}
+	fields, _ := body.Value.(amqp.List)
+	switch {
+	case isDescriptor(body.Descriptor, declareCode, "amqp:declare:list"):
+		id := fmt.Sprintf("txn-%d", atomic.AddUint64(&txnCounter, 1))
+		s.lock.Lock()
+		s.txns[id] = &transaction{
+			txn:  s.cl.NewTransaction(),
+			conn: conn,
+		}
+		s.lock.Unlock()
+		return rm.SettleWithState(declaredCode, []interface{}{amqp.Binary(id)})
+	case isDescriptor(body.Descriptor, dischargeCode, "amqp:discharge:list"):
+		id := ""
+		if len(fields) > 0 {
+			id, _ = transactionId(fields[0])
+		}
+		fail := len(fields) > 1 && fields[1] == true
+
+		s.lock.Lock()
+		t, ok := s.txns[id]
+		if ok && t.conn == conn {
+			delete(s.txns, id)
+		}
+		s.lock.Unlock()
+		if !ok || t.conn != conn {
+			return rm.RejectWithError(amqp.Errorf(transactionUnknownId, "Transaction '%s' not found", id))
+		}
+
+		if fail {
+			t.txn.Rollback()
+			return rm.Accept()
+		}
+		err := t.txn.Commit()
+		if err != nil {
+			log.Print("Committing transaction:", err)
+			return rm.RejectWithError(amqp.Errorf(transactionRollback, "Transaction '%s' rolled back: %v", id, err))
+		}
+		return rm.Accept()
+	default:
+		return rm.RejectWithError(amqp.Errorf(amqp.NotImplemented, "Unsupported descriptor %v", body.Descriptor))
+	}
+}
+
+// isDescriptor returns true if the descriptor matches the code or symbolic
+// name of a type
+func isDescriptor(descriptor interface{}, code uint64, name string) bool {
+	switch d := descriptor.(type) {
+	case uint64:
+		return d == code
+	case amqp.Symbol:
+		return string(d) == name
+	}
+	return false
+}
+
+func transactionId(value interface{}) (string, bool) {
+	switch id := value.(type) {
+	case amqp.Binary:
+		return string(id), true
+	case string:
+		return id, true
+	}
+	return "", false
+}
+
+// stage adds a message sent with a transactional delivery state to its
+// transaction. It returns false if the message is not part of a transaction.
+func (s *Server) stage(conn *connection, topicName string, rm *receivedMessage) bool {
+	code, fields := rm.State()
+	if code != transactionalStateCode {
+		return false
+	}
+
+	id := ""
+	if len(fields) > 0 {
+		id, _ = transactionId(fields[0])
+	}
+	s.lock.Lock()
+	t, ok := s.txns[id]
+	s.lock.Unlock()
+	if !ok || t.conn != conn {
+		err := rm.RejectWithError(amqp.Errorf(transactionUnknownId, "Transaction '%s' not found", id))
+		if err != nil {
+			log.Print("Rejecting message:", err)
+		}
+		return true
+	}
+
+	data, err := s.codec.Encode(rm.Message, make([]byte, 0))
+	if err != nil {
+		rm.Reject()
+		return true
+	}
+	message := api.NewMessage(0, data)
+	if key, ok := s.dedupKey(rm.Message); ok {
+		err = t.txn.AddIdempotent(topicName, message, key)
+	} else {
+		err = t.txn.Add(topicName, message)
+	}
+	if err != nil {
+		log.Print("Staging message:", err)
+		rm.Reject()
+		return true
+	}
+	accepted := amqp.Described{Descriptor: acceptedCode, Value: amqp.List{}}
+	err = rm.SettleWithState(transactionalStateCode, []interface{}{amqp.Binary(id), accepted})
+	if err != nil {
+		log.Print("Settling message:", err)
+	}
+	return true
+}
+
+// rollbackTransactions rolls back transactions declared on a closed connection
+func (s *Server) rollbackTransactions(conn *connection) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for id, t := range s.txns {
+		if t.conn == conn {
+			t.txn.Rollback()
+			delete(s.txns, id)
+		}
+	}
+}
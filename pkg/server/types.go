@@ -6,13 +6,31 @@
 package server
 
 import (
+	"net"
+	"sync"
+
 	"github.com/apache/qpid-proton/go/pkg/amqp"
-	"github.com/apache/qpid-proton/go/pkg/electron"
+	"github.com/lulf/slim/pkg/cluster"
 	"github.com/lulf/slim/pkg/commitlog"
 )
 
 type Server struct {
-	container electron.Container
+	id        string
 	cl        *commitlog.CommitLog
 	codec     *amqp.MessageCodec
+	connOpts  []ConnectionOption
+	listeners []net.Listener
+	acl       map[string]AclRule
+	lock      *sync.Mutex
+	conns     map[*connection]bool
+	links     *sync.WaitGroup
+	draining  int32
+	follower  *Follower
+	mirrors   []*Mirror
+	txns      map[string]*transaction
+	cluster   *cluster.Cluster
+	// Directory snapshots are written to, or empty if snapshots are disabled
+	snapshotDir string
+	// Deduplicate messages without a producer id on their message-id
+	dedupMessageIds bool
 }